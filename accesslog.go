@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Access log formats.
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+// clfTimeFormat is the timestamp format of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog logs every request along with its response status, size, and how
+// long it took. Requests are logged as JSON through the service's logger by
+// default, or in the Common or Combined Log Format used by Apache to a file
+// or stream of their own, for log analysis tools that only read those.
+//
+// Successful responses and redirects can be sampled, so that scanners
+// hitting the wildcard domain don't flood the logging pipeline. Errors,
+// including 404s, are always logged.
+type AccessLog struct {
+	format     string
+	sampleRate uint64
+	count      atomic.Uint64
+	mu         sync.Mutex
+	out        io.Writer
+}
+
+// NewAccessLog returns an AccessLog configured from the
+// vice.default_backend.access_log section of the config.
+func NewAccessLog(cfg *viper.Viper) (*AccessLog, error) {
+	cfg.SetDefault("vice.default_backend.access_log.format", AccessLogJSON)
+	cfg.SetDefault("vice.default_backend.access_log.output", "stdout")
+	cfg.SetDefault("vice.default_backend.access_log.sample_rate", 1)
+
+	l := &AccessLog{format: cfg.GetString("vice.default_backend.access_log.format")}
+	sampleRate := cfg.GetInt("vice.default_backend.access_log.sample_rate")
+	if sampleRate < 1 {
+		return nil, errors.New("vice.default_backend.access_log.sample_rate must be at least 1")
+	}
+	l.sampleRate = uint64(sampleRate)
+
+	switch l.format {
+	case AccessLogJSON:
+		return l, nil
+	case AccessLogCommon, AccessLogCombined:
+	default:
+		return nil, errors.Errorf("unsupported access log format %q", l.format)
+	}
+
+	switch output := cfg.GetString("vice.default_backend.access_log.output"); output {
+	case "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "error opening the access log")
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+// statusRecorder remembers the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// Flush passes flushes through, so that streamed responses still stream.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// clfField returns a value for a Common Log Format field, which uses a dash
+// for missing values.
+func clfField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// sampled returns true if a response with the status passed in should be
+// logged. Every error is logged, along with one in every sample rate of the
+// other responses.
+func (l *AccessLog) sampled(status int) bool {
+	if status >= http.StatusBadRequest || l.sampleRate == 1 {
+		return true
+	}
+	return l.count.Add(1)%l.sampleRate == 1
+}
+
+// line formats a request as a Common or Combined Log Format line.
+func (l *AccessLog) line(r *http.Request, rec *statusRecorder, start time.Time) string {
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	size := "-"
+	if rec.size > 0 {
+		size = strconv.FormatInt(rec.size, 10)
+	}
+	host := "-"
+	if ip := clientIP(r); ip != nil {
+		host = ip.String()
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s", host, user, start.Format(clfTimeFormat),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto, rec.status, size)
+	if l.format == AccessLogCombined {
+		line += fmt.Sprintf(" %q %q", clfField(r.Referer()), clfField(r.UserAgent()))
+	}
+	return line + "\n"
+}
+
+// Middleware logs each request once it has been handled.
+func (l *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if !l.sampled(rec.status) {
+			return
+		}
+
+		if l.format == AccessLogJSON {
+			log.WithFields(logrus.Fields{
+				"method":   r.Method,
+				"host":     r.Host,
+				"path":     r.URL.Path,
+				"status":   rec.status,
+				"size":     rec.size,
+				"duration": time.Since(start).Seconds(),
+			}).Info("request")
+			return
+		}
+
+		line := l.line(r, rec, start)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, err := io.WriteString(l.out, line); err != nil {
+			log.Errorf("error writing the access log: %s", err)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// analysisIDPattern matches analysis IDs, which are UUIDs.
+var analysisIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ExtendResponse is the body returned after extending an analysis' time
+// limit.
+type ExtendResponse struct {
+	AnalysisID     string    `json:"analysis_id"`
+	PlannedEndDate time.Time `json:"planned_end_date"`
+}
+
+// SaveAndExitResponse is the body returned after asking app-exposer to save
+// and exit an analysis.
+type SaveAndExitResponse struct {
+	AnalysisID string `json:"analysis_id"`
+	Subdomain  string `json:"subdomain"`
+}
+
+// errUntrustedOrigin is the message returned for analysis actions that rely on
+// the session cookie but come from another origin.
+const errUntrustedOrigin = "requests from other origins must send the access token in the Authorization header"
+
+// ownedAnalysis returns the analysis named in the path, either by its ID or
+// by its subdomain, if the authenticated user owns it and it hasn't ended.
+// Otherwise it writes an error response and returns nil. Requests that rely
+// on the session cookie must come from a trusted origin.
+func (a *App) ownedAnalysis(w http.ResponseWriter, r *http.Request) *Analysis {
+	if a.appExposer == nil {
+		writeError(w, "analysis actions are disabled", http.StatusNotFound)
+		return nil
+	}
+	if a.auth != nil && !a.auth.TrustedOrigin(r) {
+		writeError(w, errUntrustedOrigin, http.StatusForbidden)
+		return nil
+	}
+	username := a.sessionUser(w, r)
+	if username == "" {
+		return nil
+	}
+
+	var (
+		analysis *Analysis
+		err      error
+	)
+	vars := mux.Vars(r)
+	if subdomain, ok := vars["subdomain"]; ok {
+		analysis, err = a.LookupAnalysis(r.Context(), subdomain)
+	} else {
+		id := vars["id"]
+		if !analysisIDPattern.MatchString(id) {
+			writeError(w, "invalid analysis ID "+id, http.StatusBadRequest)
+			return nil
+		}
+		analysis, err = a.AnalysisByID(r.Context(), id)
+	}
+	if err == errDatabaseDisabled {
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("error looking up the analysis for %s: %s", r.URL.Path, err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	// Analyses belonging to other users are reported as missing, so that
+	// their IDs can't be probed.
+	if analysis == nil || analysis.Username != username {
+		writeError(w, "analysis not found", http.StatusNotFound)
+		return nil
+	}
+	if analysis.Ended() {
+		writeError(w, "the analysis has ended", http.StatusConflict)
+		return nil
+	}
+	return analysis
+}
+
+// ExtendTimeLimitHandler asks app-exposer to extend the time limit of an
+// analysis owned by the authenticated user. The new planned end date is
+// cached along with the analysis, so the status API reports it straight away.
+func (a *App) ExtendTimeLimitHandler(w http.ResponseWriter, r *http.Request) {
+	analysis := a.ownedAnalysis(w, r)
+	if analysis == nil {
+		return
+	}
+
+	plannedEndDate, err := a.appExposer.ExtendTimeLimit(r.Context(), analysis.ID)
+	if err != nil {
+		log.Errorf("error extending the time limit of analysis %s: %s", analysis.ID, err)
+		writeError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Infof("extended the time limit of analysis %s for %s to %s", analysis.ID, analysis.Username, plannedEndDate)
+
+	analysis.PlannedEndDate = &plannedEndDate
+	if a.cache != nil && analysis.Subdomain != "" {
+		a.cache.Update(analysis, a.cache.TTL())
+	}
+	writeJSON(w, http.StatusOK, &ExtendResponse{AnalysisID: analysis.ID, PlannedEndDate: plannedEndDate})
+}
+
+// SaveAndExitHandler asks app-exposer to save the outputs of the analysis
+// behind a subdomain and shut it down, on behalf of the authenticated owner.
+// It lets owners end a session whose app has stopped responding without going
+// back to the DE.
+func (a *App) SaveAndExitHandler(w http.ResponseWriter, r *http.Request) {
+	analysis := a.ownedAnalysis(w, r)
+	if analysis == nil {
+		return
+	}
+
+	if err := a.appExposer.SaveAndExit(r.Context(), analysis.ID); err != nil {
+		log.Errorf("error saving and exiting analysis %s: %s", analysis.ID, err)
+		writeError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Infof("save and exit requested for analysis %s by %s", analysis.ID, analysis.Username)
+	writeJSON(w, http.StatusAccepted, &SaveAndExitResponse{AnalysisID: analysis.ID, Subdomain: analysis.Subdomain})
+}
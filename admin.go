@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAuth only lets requests through if they carry the configured admin
+// token, either as a bearer token or as the password for basic auth so that
+// browsers can reach the dashboard. The admin API is disabled entirely when
+// no token is configured.
+func (a *App) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.adminToken == "" {
+			writeError(w, "the admin API is disabled", http.StatusNotFound)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="vice-default-backend"`)
+			writeError(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registerV1AdminRoutes adds the v1 admin API endpoints to the router passed
+// in, which must require the admin token.
+func (a *App) registerV1AdminRoutes(admin *mux.Router, doc routeDocumenter) {
+	doc(admin.HandleFunc("/overview", a.OverviewHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the live state shown on the dashboard.",
+		Response: Overview{},
+	})
+	doc(admin.HandleFunc("/stats", a.StatsHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get routing statistics rolled up over a window.",
+		Query:    []APIParam{{Name: "window", Description: "A duration between 1m and 24h, or up to the rollup retention when the hourly rollup is enabled. Defaults to 1h."}},
+		Response: StatsSummary{},
+	})
+	doc(admin.HandleFunc("/stats/hourly", a.StatsRollupHandler).Methods(http.MethodGet), APIOperation{
+		Summary: "Get the hourly routing counts by domain and outcome.",
+		Query: []APIParam{
+			{Name: "from", Description: "RFC 3339 start time, rounded down to the hour. Defaults to a week ago."},
+			{Name: "to", Description: "RFC 3339 end time. Defaults to now."},
+			{Name: "domain", Description: "Only return counts for this domain."},
+		},
+		Response: RollupResponse{},
+	})
+	doc(admin.HandleFunc("/metrics", MetricsHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the metrics in the Prometheus text format.",
+		Produces: []string{"text/plain"},
+	})
+	doc(admin.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the runtime variables, including the effective runtime limits.",
+		Produces: []string{"application/json"},
+	})
+	doc(admin.HandleFunc("/selftest", a.SelfTestHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Run the decision path for the configured known-good and missing subdomains.",
+		Response: SelfTestResult{},
+	})
+	doc(admin.HandleFunc("/audit/export", a.AuditExportHandler).Methods(http.MethodGet), APIOperation{
+		Summary: "Export audit records.",
+		Query: []APIParam{
+			{Name: "format", Description: "csv or ndjson. Defaults to ndjson."},
+			{Name: "from", Description: "RFC 3339 start time."},
+			{Name: "to", Description: "RFC 3339 end time."},
+			{Name: "subdomain", Description: "Only export records for this subdomain."},
+			{Name: "user", Description: "Only export records for analyses owned by this user."},
+			{Name: "visitor", Description: "Only export records for requests made by this user."},
+			{Name: "outcome", Description: "Only export records with this routing outcome."},
+			{Name: "decision", Description: "Only export records with this final decision."},
+			{Name: "reason", Description: "Only export records with this reason code."},
+			{Name: "analysis_id", Description: "Only export records for this analysis."},
+			{Name: "limit", Description: "Return a page of at most this many records, up to 1000, with a Link header pointing at the next page. The whole log is streamed when unset."},
+			{Name: "cursor", Description: "The cursor of the page to return, from the Link header."},
+		},
+		Produces: []string{"text/csv", "application/x-ndjson"},
+	})
+
+	doc(admin.HandleFunc("/maintenance", a.GetMaintenanceHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get whether maintenance mode is on.",
+		Response: MaintenanceStatus{},
+	})
+	doc(admin.HandleFunc("/maintenance", a.SetMaintenanceHandler).Methods(http.MethodPut), APIOperation{
+		Summary:  "Turn maintenance mode on or off.",
+		Request:  MaintenanceStatus{},
+		Response: MaintenanceStatus{},
+	})
+
+	doc(admin.HandleFunc("/banner", a.GetBannerHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the current banner.",
+		Response: Banner{},
+	})
+	doc(admin.HandleFunc("/banner", a.SetBannerHandler).Methods(http.MethodPut), APIOperation{
+		Summary:  "Replace the current banner.",
+		Request:  Banner{},
+		Response: Banner{},
+	})
+	doc(admin.HandleFunc("/banner", a.DeleteBannerHandler).Methods(http.MethodDelete), APIOperation{
+		Summary: "Clear the current banner.",
+		Status:  http.StatusNoContent,
+	})
+
+	doc(admin.HandleFunc("/flags", a.GetFlagsHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the state of every feature flag.",
+		Response: map[string]bool{},
+	})
+
+	doc(admin.HandleFunc("/preferences/{username}", a.GetPreferenceHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get a user's routing preferences.",
+		Response: UserPreference{},
+	})
+	doc(admin.HandleFunc("/preferences/{username}", a.SetPreferenceHandler).Methods(http.MethodPut), APIOperation{
+		Summary:  "Replace a user's routing preferences.",
+		Request:  UserPreference{},
+		Response: UserPreference{},
+	})
+	doc(admin.HandleFunc("/preferences/{username}", a.DeletePreferenceHandler).Methods(http.MethodDelete), APIOperation{
+		Summary: "Reset a user's routing preferences to the defaults.",
+		Status:  http.StatusNoContent,
+	})
+
+	doc(admin.HandleFunc("/subdomains", a.SubdomainsHandler).Methods(http.MethodGet), APIOperation{
+		Summary: "List the subdomains of the active analyses, with their owners, apps, states, and launch times.",
+		Query: []APIParam{
+			{Name: "owner", Description: "Only list analyses owned by this user."},
+			{Name: "state", Description: "Only list analyses in this state."},
+			{Name: "app", Description: "Only list analyses of the app with this ID or name."},
+			{Name: "from", Description: "Only list analyses launched at or after this RFC 3339 time."},
+			{Name: "to", Description: "Only list analyses launched before this RFC 3339 time."},
+			{Name: "limit", Description: "The page size, up to 1000. Defaults to 100."},
+			{Name: "cursor", Description: "The next_cursor from the previous page."},
+		},
+		Response: SubdomainsResponse{},
+	})
+	doc(admin.HandleFunc("/subdomains/unknown", a.UnknownSubdomainsHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "List the most-requested subdomains without an analysis over the rolling window.",
+		Query:    []APIParam{{Name: "limit", Description: "How many to list, up to 1000. Defaults to vice.default_backend.unknown_subdomains.top_n."}},
+		Response: UnknownSubdomainsResponse{},
+	})
+	doc(admin.HandleFunc("/lookup", a.LookupHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Resolve a host through the routing logic and report the analysis behind it and the decision the router would make.",
+		Query:    []APIParam{{Name: "host", Description: "A subdomain, host name, or app URL.", Required: true}},
+		Response: LookupResponse{},
+	})
+
+	doc(admin.HandleFunc("/cache", a.GetCacheHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the lookup cache's statistics and settings.",
+		Response: CacheResponse{},
+	})
+	doc(admin.HandleFunc("/cache", a.SetCacheHandler).Methods(http.MethodPut), APIOperation{
+		Summary:  "Change the lookup cache's settings until the service restarts. Settings that are left out keep their values.",
+		Request:  CacheSettings{},
+		Response: CacheResponse{},
+	})
+
+	doc(admin.HandleFunc("/pages/reload", a.ReloadPagesHandler).Methods(http.MethodPost), APIOperation{
+		Summary:  "Parse the HTML page templates again without restarting.",
+		Response: PagesResponse{},
+	})
+
+	doc(admin.HandleFunc("/loading-pages", a.GetLoadingPagesHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the loading page targets and their weights.",
+		Response: LoadingPagesResponse{},
+	})
+	doc(admin.HandleFunc("/loading-pages/weights", a.SetLoadingPageWeightsHandler).Methods(http.MethodPut), APIOperation{
+		Summary:  "Set the loading page weights. They must add up to 100.",
+		Request:  map[string]int{},
+		Response: LoadingPagesResponse{},
+	})
+}
+
+// RegisterAdminRoutes adds the admin dashboard to the router passed in, along
+// with deprecated aliases under /admin for the admin API endpoints that are
+// now served under /api/v1/admin.
+func (a *App) RegisterAdminRoutes(r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(a.adminAuth)
+	admin.HandleFunc("/ui", a.DashboardHandler).Methods(http.MethodGet)
+
+	legacy := admin.NewRoute().Subrouter()
+	legacy.Use(deprecatedAPI("/admin", "/api/v1/admin"))
+	a.registerV1AdminRoutes(legacy, undocumented)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Names of the alerts that can be sent to the webhook.
+const (
+	AlertNotFoundSpike   = "not_found_spike"
+	AlertLookupFallbacks = "lookup_fallbacks"
+)
+
+// alertEvaluationPeriod is how often the threshold alerts are checked.
+const alertEvaluationPeriod = time.Minute
+
+// defaultAlertCooldown is the default minimum time between two firings of the
+// same alert.
+const defaultAlertCooldown = 15 * time.Minute
+
+var alertsSent = NewCounterVec(
+	"alerts_total",
+	"Alerts sent to the webhook, by alert name and result.",
+	"alert", "result",
+)
+
+// Alerter posts Slack-compatible messages to a webhook when routing anomalies
+// are detected. An alert that has fired won't fire again until its cooldown
+// period has passed.
+type Alerter struct {
+	webhookURL          string
+	client              *http.Client
+	cooldown            time.Duration
+	notFoundThreshold   int
+	fallbackThreshold   int
+	environment         string
+	mu                  sync.Mutex
+	lastFired           map[string]time.Time
+	notFoundCount       int
+	lookupFallbackCount int
+}
+
+// NewAlerter returns an Alerter configured from the
+// vice.default_backend.alerts section of the config, or nil if no webhook is
+// configured.
+func NewAlerter(cfg *viper.Viper) *Alerter {
+	cfg.SetDefault("vice.default_backend.alerts.cooldown", defaultAlertCooldown)
+
+	webhookURL := cfg.GetString("vice.default_backend.alerts.webhook_url")
+	if webhookURL == "" {
+		return nil
+	}
+
+	a := &Alerter{
+		webhookURL:        webhookURL,
+		client:            &http.Client{Timeout: 10 * time.Second},
+		cooldown:          cfg.GetDuration("vice.default_backend.alerts.cooldown"),
+		notFoundThreshold: cfg.GetInt("vice.default_backend.alerts.not_found_per_minute"),
+		fallbackThreshold: cfg.GetInt("vice.default_backend.alerts.fallbacks_per_minute"),
+		environment:       cfg.GetString("vice.default_backend.alerts.environment"),
+		lastFired:         make(map[string]time.Time),
+	}
+	go a.evaluate()
+	return a
+}
+
+// Observe counts the routing decisions that the threshold alerts look at.
+func (a *Alerter) Observe(d Decision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case d.Outcome == OutcomeNotFound:
+		a.notFoundCount++
+	case d.LookupFailed():
+		a.lookupFallbackCount++
+	}
+}
+
+// evaluate checks the counts against the thresholds once per evaluation
+// period.
+func (a *Alerter) evaluate() {
+	for range time.Tick(alertEvaluationPeriod) {
+		a.mu.Lock()
+		notFound, fallbacks := a.notFoundCount, a.lookupFallbackCount
+		a.notFoundCount, a.lookupFallbackCount = 0, 0
+		a.mu.Unlock()
+
+		if a.notFoundThreshold > 0 && notFound >= a.notFoundThreshold {
+			a.Fire(AlertNotFoundSpike, fmt.Sprintf(
+				"%d requests for unknown VICE subdomains in the last minute (threshold %d).",
+				notFound, a.notFoundThreshold,
+			))
+		}
+		if a.fallbackThreshold > 0 && fallbacks >= a.fallbackThreshold {
+			a.Fire(AlertLookupFallbacks, fmt.Sprintf(
+				"%d requests were redirected without validation because subdomain lookups failed in the last minute (threshold %d).",
+				fallbacks, a.fallbackThreshold,
+			))
+		}
+	}
+}
+
+// Fire sends the named alert unless it's still cooling down from the last
+// time it fired. The webhook request is made in the background.
+func (a *Alerter) Fire(name, text string) {
+	now := time.Now()
+	a.mu.Lock()
+	if last, ok := a.lastFired[name]; ok && now.Sub(last) < a.cooldown {
+		a.mu.Unlock()
+		alertsSent.Inc(name, "suppressed")
+		return
+	}
+	a.lastFired[name] = now
+	a.mu.Unlock()
+
+	go a.post(name, text)
+}
+
+// post sends a message to the webhook in the format Slack's incoming webhooks
+// expect.
+func (a *Alerter) post(name, text string) {
+	prefix := "vice-default-backend"
+	if a.environment != "" {
+		prefix = fmt.Sprintf("%s (%s)", prefix, a.environment)
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("*%s* `%s`: %s", prefix, name, text),
+	})
+	if err != nil {
+		log.Errorf("error encoding alert %s: %s", name, err)
+		return
+	}
+
+	resp, err := a.client.Post(a.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("error sending alert %s: %s", name, err)
+		alertsSent.Inc(name, "error")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Errorf("alert webhook returned %s for alert %s", resp.Status, name)
+		alertsSent.Inc(name, "error")
+		return
+	}
+
+	log.Warnf("sent alert %s: %s", name, text)
+	alertsSent.Inc(name, "sent")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlerterObserve(t *testing.T) {
+	tests := []struct {
+		name          string
+		decision      Decision
+		wantNotFound  int
+		wantFallbacks int
+	}{
+		{"redirect", Decision{Outcome: OutcomeRedirect, Reason: ReasonAnalysisFound}, 0, 0},
+		{"not found", Decision{Outcome: OutcomeNotFound, Reason: ReasonUnknownSubdomain}, 1, 0},
+		{"lookup failed", Decision{Outcome: OutcomeRedirect, Reason: ReasonLookupFailed}, 0, 1},
+		{"lookup timeout", Decision{Outcome: OutcomeRedirect, Reason: ReasonLookupTimeout}, 0, 1},
+		{"error", Decision{Outcome: OutcomeError, Reason: ReasonBadAppURL}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Alerter{lastFired: make(map[string]time.Time)}
+			a.Observe(tt.decision)
+			if a.notFoundCount != tt.wantNotFound {
+				t.Errorf("counted %d requests for unknown subdomains, want %d", a.notFoundCount, tt.wantNotFound)
+			}
+			if a.lookupFallbackCount != tt.wantFallbacks {
+				t.Errorf("counted %d lookup fallbacks, want %d", a.lookupFallbackCount, tt.wantFallbacks)
+			}
+		})
+	}
+}
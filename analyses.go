@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Analysis states reported by the status API. These are coarser than the job
+// statuses stored in the DE database.
+const (
+	StateNotFound    = "not_found"
+	StateLaunching   = "launching"
+	StateRunning     = "running"
+	StateTerminating = "terminating"
+	StatePaused      = "paused"
+	StateSuspended   = "suspended"
+	StateCompleted   = "completed"
+	StateFailed      = "failed"
+	StateCanceled    = "canceled"
+	StateDeleted     = "deleted"
+)
+
+// Analysis contains the information about a VICE analysis that the default
+// backend needs in order to route requests for its subdomain.
+type Analysis struct {
+	ID             string
+	Name           string
+	Subdomain      string
+	Status         string
+	UserID         string
+	Username       string
+	StartDate      *time.Time
+	PlannedEndDate *time.Time
+
+	// LastMessage is the message of the most recent job status update.
+	LastMessage string
+
+	// AppID and SystemID identify the app the analysis was launched from,
+	// for building relaunch links.
+	AppID    string
+	AppName  string
+	SystemID string
+
+	// Deleted is set once the owner has deleted the analysis from the DE.
+	// It won't come back.
+	Deleted bool
+}
+
+// defaultTerminatingPattern matches the job status update messages sent while
+// an analysis saves its outputs and shuts down.
+const defaultTerminatingPattern = `(?i)upload|sav(e|ing) and exit|shutting down`
+
+// terminatingMessages matches the status update messages of running analyses
+// that are shutting down. It's replaced by ConfigureTerminating at startup.
+var terminatingMessages = regexp.MustCompile(defaultTerminatingPattern)
+
+// ConfigureTerminating sets the pattern used to recognize analyses that are
+// shutting down from vice.default_backend.terminating.pattern.
+func ConfigureTerminating(cfg *viper.Viper) error {
+	cfg.SetDefault("vice.default_backend.terminating.pattern", defaultTerminatingPattern)
+	pattern, err := regexp.Compile(cfg.GetString("vice.default_backend.terminating.pattern"))
+	if err != nil {
+		return errors.Wrap(err, "cannot parse vice.default_backend.terminating.pattern")
+	}
+	terminatingMessages = pattern
+	return nil
+}
+
+// State returns the status API state corresponding to the analysis' job status.
+func (a *Analysis) State() string {
+	if a == nil {
+		return StateNotFound
+	}
+	if a.Deleted {
+		return StateDeleted
+	}
+	switch a.Status {
+	case "Submitted", "Queued":
+		return StateLaunching
+	case "Running":
+		if a.LastMessage != "" && terminatingMessages.MatchString(a.LastMessage) {
+			return StateTerminating
+		}
+		return StateRunning
+	case "Completed":
+		return StateCompleted
+	case "Failed":
+		return StateFailed
+	case "Canceled":
+		return StateCanceled
+	default:
+		return StateLaunching
+	}
+}
+
+// Ended returns true if the analysis has completed, failed, been canceled, or
+// been deleted.
+func (a *Analysis) Ended() bool {
+	switch a.State() {
+	case StateCompleted, StateFailed, StateCanceled, StateDeleted:
+		return true
+	default:
+		return false
+	}
+}
+
+// errDatabaseDisabled is returned by lookups when the service was started
+// with --disable-db.
+var errDatabaseDisabled = errors.New("database lookups are disabled")
+
+// analysisColumns are the columns that scanAnalysis reads, in order, and
+// analysisTables are the tables they're selected from. Every query for
+// analyses shares them, so that they can't get out of step.
+const (
+	analysisColumns = `
+	       j.id,
+	       j.job_name,
+	       COALESCE(j.subdomain, ''),
+	       j.status,
+	       j.user_id,
+	       u.username,
+	       j.start_date,
+	       j.planned_end_date,
+	       COALESCE((SELECT su.message
+	                   FROM job_steps js
+	                   JOIN job_status_updates su ON su.external_id = js.external_id
+	                  WHERE js.job_id = j.id
+	               ORDER BY su.sent_on DESC
+	                  LIMIT 1), ''),
+	       COALESCE(j.app_id, ''),
+	       COALESCE(j.app_name, ''),
+	       COALESCE(t.system_id, ''),
+	       j.deleted`
+	analysisTables = `
+	  FROM jobs j
+	  JOIN users u ON j.user_id = u.id
+	  LEFT JOIN job_types t ON j.job_type_id = t.id`
+)
+
+const analysisBySubdomainQuery = `
+	SELECT` + analysisColumns + analysisTables + `
+	 WHERE j.subdomain = $1
+  ORDER BY j.start_date DESC
+     LIMIT 1
+`
+
+const analysisByIDQuery = `
+	SELECT` + analysisColumns + analysisTables + `
+	 WHERE j.id = $1
+`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAnalysis reads an analysis from a row containing analysisColumns.
+func scanAnalysis(row rowScanner) (*Analysis, error) {
+	var (
+		analysis                  Analysis
+		startDate, plannedEndDate sql.NullTime
+	)
+
+	err := row.Scan(
+		&analysis.ID,
+		&analysis.Name,
+		&analysis.Subdomain,
+		&analysis.Status,
+		&analysis.UserID,
+		&analysis.Username,
+		&startDate,
+		&plannedEndDate,
+		&analysis.LastMessage,
+		&analysis.AppID,
+		&analysis.AppName,
+		&analysis.SystemID,
+		&analysis.Deleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if startDate.Valid {
+		analysis.StartDate = &startDate.Time
+	}
+	if plannedEndDate.Valid {
+		analysis.PlannedEndDate = &plannedEndDate.Time
+	}
+
+	return &analysis, nil
+}
+
+// AnalysisBySubdomain returns the most recent analysis that uses the given
+// subdomain. Returns nil without an error if there isn't one. In development
+// mode the analysis comes from the fixtures instead of the database.
+func (a *App) AnalysisBySubdomain(ctx context.Context, subdomain string) (*Analysis, error) {
+	if a.fixtures != nil {
+		return a.fixtures.Lookup(subdomain), nil
+	}
+	if a.db == nil {
+		return nil, errDatabaseDisabled
+	}
+	start, endSpan := time.Now(), traceQuery(ctx, QueryAnalysisBySubdomain)
+	analysis, err := scanAnalysis(a.lookups.QueryRowContext(ctx, analysisBySubdomainQuery, subdomain))
+	observeQuery(QueryAnalysisBySubdomain, start, &err)
+	endSpan(&err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return analysis, err
+}
+
+// AnalysisByID returns the analysis with the given ID. Returns nil without an
+// error if there isn't one.
+func (a *App) AnalysisByID(ctx context.Context, id string) (*Analysis, error) {
+	if a.fixtures != nil {
+		return a.fixtures.LookupID(id), nil
+	}
+	if a.db == nil {
+		return nil, errDatabaseDisabled
+	}
+	start, endSpan := time.Now(), traceQuery(ctx, QueryAnalysisByID)
+	analysis, err := scanAnalysis(a.lookups.QueryRowContext(ctx, analysisByIDQuery, id))
+	observeQuery(QueryAnalysisByID, start, &err)
+	endSpan(&err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return analysis, err
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// writeJSON writes the value passed in to the response as a JSON document.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("unable to write JSON response: %s", err)
+	}
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, message string, status int) {
+	common.DetailedError(w, common.ErrorResponse{Message: message}, status)
+}
+
+// Defaults for long-polling status requests.
+const (
+	defaultStatusMaxWait      = time.Minute
+	defaultStatusPollInterval = time.Second
+)
+
+// StatusResponse is the body returned by the status API.
+type StatusResponse struct {
+	Subdomain   string  `json:"subdomain"`
+	State       string  `json:"state"`
+	Banner      *Banner `json:"banner,omitempty"`
+	Username    string  `json:"username,omitempty"`
+	ResumeURL   string  `json:"resume_url,omitempty"`
+	RelaunchURL string  `json:"relaunch_url,omitempty"`
+
+	// PlannedEndDate is when the analysis' time limit runs out.
+	PlannedEndDate *time.Time `json:"planned_end_date,omitempty"`
+}
+
+// ETag returns an entity tag that changes whenever any of the fields of the
+// response do, without having to encode it.
+func (s *StatusResponse) ETag() string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s", s.Subdomain, s.State, s.Username, s.ResumeURL, s.RelaunchURL)
+	if s.Banner != nil {
+		fmt.Fprintf(h, "\x00%s\x00%s", s.Banner.Message, s.Banner.Severity)
+		if s.Banner.Expires != nil {
+			fmt.Fprintf(h, "\x00%d", s.Banner.Expires.UnixNano())
+		}
+	}
+	if s.PlannedEndDate != nil {
+		fmt.Fprintf(h, "\x00%d", s.PlannedEndDate.UnixNano())
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// etagMatches returns true if an If-None-Match header value lists the entity
+// tag passed in. Weak tags match their strong equivalents, as RFC 9110
+// requires for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// statusResponse builds the status API response for a subdomain.
+func (a *App) statusResponse(r *http.Request, subdomain string) (*StatusResponse, error) {
+	analysis, err := a.LookupAnalysis(r.Context(), subdomain)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &StatusResponse{
+		Subdomain: subdomain,
+		State:     analysis.State(),
+		Banner:    a.banner.Get(),
+	}
+
+	if a.relaunch != nil && analysis != nil && analysis.Ended() {
+		resp.RelaunchURL = a.relaunch.URL(analysis)
+	}
+	if analysis != nil && !analysis.Ended() {
+		resp.PlannedEndDate = analysis.PlannedEndDate
+	}
+
+	var suspension *Suspension
+	if a.suspensions != nil {
+		if suspension = a.suspensions.Get(analysis); suspension != nil {
+			resp.State = suspension.Kind
+		}
+	}
+
+	// The owner's user name and the resume link are only included when the
+	// owner is the caller.
+	if a.auth != nil && analysis != nil {
+		session, err := a.auth.Session(r)
+		if err != nil {
+			log.Errorf("error checking the session for the status of %s: %s", subdomain, err)
+		}
+		if session != nil && a.Visitor(r, session) == analysis.Username {
+			resp.Username = analysis.Username
+			if suspension != nil {
+				resp.ResumeURL = a.suspensions.ResumeURL(analysis)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// statusWait returns how long a status request asked to wait for a change
+// with the wait query parameter, capped at the configured maximum.
+func (a *App) statusWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait < 0 {
+		return 0, errors.Errorf("invalid wait %q", v)
+	}
+	if wait > a.statusMaxWait {
+		wait = a.statusMaxWait
+	}
+	return wait, nil
+}
+
+// waitForStatus holds a status request until its response no longer matches
+// the If-None-Match header or the wait elapses, and returns the last
+// response. It wakes up when the lookup cache entry for the subdomain is
+// updated, and otherwise looks the subdomain up again every poll interval.
+func (a *App) waitForStatus(r *http.Request, resp *StatusResponse, inm string, wait time.Duration) (*StatusResponse, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(a.statusPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var changed <-chan struct{}
+		release := func() {}
+		if a.cache != nil {
+			changed, release = a.cache.Changed(resp.Subdomain)
+		}
+		done := false
+		select {
+		case <-r.Context().Done():
+			done = true
+		case <-timer.C:
+			done = true
+		case <-ticker.C:
+		case <-changed:
+		}
+		release()
+		if done {
+			return resp, nil
+		}
+
+		next, err := a.statusResponse(r, resp.Subdomain)
+		if err != nil {
+			return nil, err
+		}
+		resp = next
+		if !etagMatches(inm, resp.ETag()) {
+			return resp, nil
+		}
+	}
+}
+
+// StatusHandler reports what the default backend knows about the analysis
+// behind a subdomain. Responses have an ETag, and requests with a matching
+// If-None-Match header get a 304 with no body, which keeps the loading
+// page's polling cheap. With the wait query parameter as well, the request
+// is held until the response changes or the wait elapses.
+func (a *App) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	subdomain := mux.Vars(r)["subdomain"]
+
+	wait, err := a.statusWait(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := a.statusResponse(r, subdomain)
+	inm := r.Header.Get("If-None-Match")
+	if err == nil && wait > 0 && inm != "" && etagMatches(inm, resp.ETag()) {
+		resp, err = a.waitForStatus(r, resp, inm, wait)
+	}
+	if err == errDatabaseDisabled {
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Errorf("error looking up subdomain %s: %s", subdomain, err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	etag := resp.ETag()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if a.auth != nil {
+		// The owner gets a different response than everyone else.
+		vary(w, "Authorization", "Cookie")
+	}
+	if inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// The current version of the JSON API. Each version is served under
+// /api/{version}. Changes within a version are backwards compatible: fields
+// and endpoints may be added, but never removed, renamed, or given a
+// different meaning. Breaking changes go into a new version, registered
+// alongside the old one in RegisterAPIRoutes, and the old version is kept
+// until its consumers have moved.
+const apiVersion = "v1"
+
+// routeDocumenter records a route in the OpenAPI document, or not.
+type routeDocumenter func(*mux.Route, APIOperation) *mux.Route
+
+// undocumented is a routeDocumenter for routes that shouldn't appear in the
+// OpenAPI document, such as deprecated aliases.
+func undocumented(route *mux.Route, _ APIOperation) *mux.Route {
+	return route
+}
+
+// deprecatedAPI marks responses from the unversioned endpoints as deprecated
+// and points clients at the versioned equivalent.
+func deprecatedAPI(oldPrefix, newPrefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			successor := newPrefix + strings.TrimPrefix(r.URL.Path, oldPrefix)
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// registerV1Routes adds the v1 status API endpoints to the router passed in.
+func (a *App) registerV1Routes(r *mux.Router, doc routeDocumenter) {
+	doc(r.HandleFunc("/status/{subdomain}", a.StatusHandler).Methods(http.MethodGet), APIOperation{
+		Summary: "Get the state of the analysis behind a subdomain.",
+		Query: []APIParam{
+			{Name: "wait", Description: "With If-None-Match, how long to wait for the response to change, such as 30s."},
+		},
+		Response: StatusResponse{},
+	})
+	doc(r.HandleFunc("/metadata/{subdomain}", a.MetadataHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Describe the analysis behind a subdomain and the app it was launched from.",
+		Response: MetadataResponse{},
+	})
+	doc(r.HandleFunc("/preferences", a.GetMyPreferenceHandler).Methods(http.MethodGet), APIOperation{
+		Summary:  "Get the authenticated user's routing preferences.",
+		Response: UserPreference{},
+	})
+	doc(r.HandleFunc("/preferences", a.SetMyPreferenceHandler).Methods(http.MethodPut), APIOperation{
+		Summary:  "Replace the authenticated user's routing preferences.",
+		Request:  UserPreference{},
+		Response: UserPreference{},
+	})
+	doc(r.HandleFunc("/analyses/{id}/extend", a.ExtendTimeLimitHandler).Methods(http.MethodPost), APIOperation{
+		Summary:  "Extend the time limit of an analysis owned by the authenticated user.",
+		Response: ExtendResponse{},
+	})
+	doc(r.HandleFunc("/subdomains/{subdomain}/save-and-exit", a.SaveAndExitHandler).Methods(http.MethodPost), APIOperation{
+		Summary:  "Save the outputs of the authenticated user's analysis behind a subdomain and shut it down.",
+		Response: SaveAndExitResponse{},
+		Status:   http.StatusAccepted,
+	})
+}
+
+// RegisterAPIRoutes adds the JSON API endpoints to the router passed in. The
+// current version is served under /api/v1 and documented in the OpenAPI
+// document. The unversioned paths that predate it still work, but are
+// marked as deprecated.
+func (a *App) RegisterAPIRoutes(r *mux.Router) {
+	r.HandleFunc("/api/openapi.json", OpenAPIHandler).Methods(http.MethodGet)
+
+	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.HandleFunc("/openapi.json", OpenAPIHandler).Methods(http.MethodGet)
+	a.registerV1Routes(v1, documented)
+
+	v1Admin := v1.PathPrefix("/admin").Subrouter()
+	v1Admin.Use(a.adminAuth)
+	a.registerV1AdminRoutes(v1Admin, documented)
+
+	legacy := r.PathPrefix("/api/status").Subrouter()
+	legacy.Use(deprecatedAPI("/api", "/api/v1"))
+	legacy.HandleFunc("/{subdomain}", a.StatusHandler).Methods(http.MethodGet)
+}
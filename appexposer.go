@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+var appExposerActions = NewCounterVec(
+	"app_exposer_actions_total",
+	"Actions forwarded to app-exposer on behalf of analysis owners, by action and result.",
+	"action", "result",
+)
+
+// Actions forwarded to app-exposer.
+const (
+	ActionExtendTimeLimit = "extend_time_limit"
+	ActionSaveAndExit     = "save_and_exit"
+)
+
+// AppExposer calls app-exposer's admin API to act on VICE analyses on behalf
+// of their owners. Ownership is checked by the handlers before calling it.
+type AppExposer struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// NewAppExposer returns an AppExposer for the app-exposer at
+// app_exposer.base, or nil if it isn't set.
+func NewAppExposer(cfg *viper.Viper) (*AppExposer, error) {
+	raw := cfg.GetString("app_exposer.base")
+	if raw == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(raw)
+	if err != nil || !base.IsAbs() {
+		return nil, errors.New("app_exposer.base must be an absolute URL")
+	}
+	return &AppExposer{
+		base:   base,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// post sends a POST request to an app-exposer endpoint and decodes the JSON
+// response into v, if v isn't nil.
+func (e *AppExposer) post(ctx context.Context, action string, endpoint *url.URL, v interface{}) (err error) {
+	ctx, span := StartSpan(ctx, "app-exposer "+action, spanKindClient)
+	span.SetAttribute("http.request.method", http.MethodPost)
+	span.SetAttribute("url.full", endpoint.String())
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+			span.SetError(err.Error())
+		}
+		appExposerActions.Inc(action, result)
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	span.Inject(req.Header)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error calling app-exposer for %s", action)
+	}
+	defer resp.Body.Close()
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("app-exposer returned %s for %s: %s", resp.Status, action, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "error decoding the app-exposer response for %s", action)
+}
+
+// ExtendTimeLimit extends the time limit of an analysis by app-exposer's
+// configured extension and returns the new planned end date.
+func (e *AppExposer) ExtendTimeLimit(ctx context.Context, analysisID string) (time.Time, error) {
+	// app-exposer reports the new time limit as a string of seconds since
+	// the epoch.
+	var result struct {
+		TimeLimit string `json:"time_limit"`
+	}
+	endpoint := e.base.JoinPath("vice", "admin", "analyses", analysisID, "time-limit")
+	if err := e.post(ctx, ActionExtendTimeLimit, endpoint, &result); err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(result.TimeLimit, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "app-exposer returned an invalid time limit %q", result.TimeLimit)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// SaveAndExit asks app-exposer to upload the outputs of an analysis and shut
+// it down.
+func (e *AppExposer) SaveAndExit(ctx context.Context, analysisID string) error {
+	endpoint := e.base.JoinPath("vice", "admin", "analyses", analysisID, "save-and-exit")
+	return e.post(ctx, ActionSaveAndExit, endpoint, nil)
+}
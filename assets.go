@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// assetHashLength is the number of hex digits of the content hash put in
+// fingerprinted asset names.
+const assetHashLength = 12
+
+// immutableCacheControl is sent with fingerprinted assets, which never change
+// under the same name.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// minGzipSize is the smallest asset that gets compressed in memory. Smaller
+// ones aren't worth it.
+const minGzipSize = 1024
+
+// assetEncodings are the content codings of precompressed siblings, such as
+// app.js.br for app.js, in order of preference.
+var assetEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// compressedAsset is a precompressed version of an asset, read from a sibling
+// file or compressed in memory at load time.
+type compressedAsset struct {
+	encoding string
+	path     string
+	data     []byte
+	modTime  time.Time
+}
+
+// Assets fingerprints the files in the static file directory by adding a
+// hash of their contents to their names, such as css/app.3f2a1b9c0d4e.css
+// for css/app.css. Pages link to the fingerprinted names with the asset
+// template function, and those are served with long-lived cache headers, so
+// browsers can cache them hard and still pick up new versions as soon as
+// they're deployed.
+//
+// Assets with precompressed .br or .gz siblings are served from those to
+// clients that accept the encoding, and text assets without a .gz sibling
+// can be gzipped in memory at load time, so that nothing is compressed per
+// request.
+type Assets struct {
+	dir          string
+	gzipInMemory bool
+	mu           sync.RWMutex
+	hashed       map[string]string
+	files        map[string]string
+	compressed   map[string][]compressedAsset
+}
+
+// NewAssets returns an Assets for the static file directory configured from
+// the vice.default_backend.static section of the config. Load has to be
+// called before it's used.
+func NewAssets(cfg *viper.Viper, dir string) *Assets {
+	return &Assets{
+		dir:          dir,
+		gzipInMemory: cfg.GetBool("vice.default_backend.static.gzip_in_memory"),
+	}
+}
+
+// fingerprint adds a hash to a file name, before its extension.
+func fingerprint(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// hashFile returns the shortened hex SHA-256 hash of a file's contents.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:assetHashLength], nil
+}
+
+// walkStatic calls the function passed in for every file in the static file
+// directory. Hidden files and directories are skipped, which leaves out the
+// timestamped directories that Kubernetes puts in ConfigMap volumes.
+func walkStatic(dir string, fn func(path string) error) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return fn(p)
+	})
+}
+
+// compressible returns true if an asset's content type is worth compressing.
+func compressible(name string) bool {
+	ct, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(name)), ";")
+	switch {
+	case strings.HasPrefix(ct, "text/"):
+		return true
+	case ct == "application/javascript", ct == "application/json", ct == "application/xml", ct == "image/svg+xml":
+		return true
+	default:
+		return false
+	}
+}
+
+// gzipFile compresses a file in memory.
+func gzipFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compress finds or makes the precompressed versions of an asset.
+func (a *Assets) compress(p string) ([]compressedAsset, error) {
+	var result []compressedAsset
+	for _, enc := range assetEncodings {
+		if info, err := os.Stat(p + enc.ext); err == nil && !info.IsDir() {
+			result = append(result, compressedAsset{encoding: enc.name, path: p + enc.ext, modTime: info.ModTime()})
+			continue
+		}
+		if enc.name != "gzip" || !a.gzipInMemory || !compressible(p) {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < minGzipSize {
+			continue
+		}
+		data, err := gzipFile(p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, compressedAsset{encoding: enc.name, data: data, modTime: info.ModTime()})
+	}
+	return result, nil
+}
+
+// Load hashes every file in the static file directory, replacing the
+// fingerprinted names in use, and finds their precompressed versions.
+func (a *Assets) Load() error {
+	hashed := make(map[string]string)
+	files := make(map[string]string)
+	compressed := make(map[string][]compressedAsset)
+	err := walkStatic(a.dir, func(p string) error {
+		rel, err := filepath.Rel(a.dir, p)
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		hashed[name] = fingerprint(name, hash)
+		files[hashed[name]] = name
+		if c, err := a.compress(p); err != nil {
+			return err
+		} else if len(c) > 0 {
+			compressed[name] = c
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error fingerprinting the static assets")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hashed, a.files, a.compressed = hashed, files, compressed
+	return nil
+}
+
+// acceptsEncoding returns true if an Accept-Encoding header allows the
+// content coding passed in.
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveCompressed serves a precompressed version of an asset if the client
+// accepts one, returning false if it didn't.
+func (a *Assets) serveCompressed(w http.ResponseWriter, r *http.Request, name string) bool {
+	a.mu.RLock()
+	variants := a.compressed[name]
+	a.mu.RUnlock()
+	if len(variants) == 0 {
+		return false
+	}
+	vary(w, "Accept-Encoding")
+
+	accept := r.Header.Get("Accept-Encoding")
+	for _, v := range variants {
+		if !acceptsEncoding(accept, v.encoding) {
+			continue
+		}
+		var content io.ReadSeeker
+		if v.data != nil {
+			content = bytes.NewReader(v.data)
+		} else {
+			f, err := os.Open(v.path)
+			if err != nil {
+				return false
+			}
+			defer f.Close()
+			content = f
+		}
+		if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Header().Set("Content-Encoding", v.encoding)
+		http.ServeContent(w, r, name, v.modTime, content)
+		return true
+	}
+	return false
+}
+
+// URL returns the fingerprinted URL of a static asset, given its path in the
+// static file directory. Unknown assets get their plain URL.
+func (a *Assets) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if hashed, ok := a.hashed[name]; ok {
+		return "/static/" + hashed
+	}
+	return "/static/" + name
+}
+
+// Middleware serves requests for fingerprinted names from the files they
+// were made from, with headers that let them be cached indefinitely, and
+// serves precompressed versions to clients that accept them. Other requests
+// are passed through. It expects the /static/ prefix to have been stripped.
+func (a *Assets) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		a.mu.RLock()
+		original, ok := a.files[name]
+		a.mu.RUnlock()
+		if ok {
+			name = original
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = name, ""
+			w.Header().Set("Cache-Control", immutableCacheControl)
+		}
+		if a.serveCompressed(w, r, name) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// auditQueueSize is the number of decisions that can be waiting to be written
+// to the audit log before new ones get dropped.
+const auditQueueSize = 1000
+
+var auditRecords = NewCounterVec(
+	"audit_records_total",
+	"Routing decisions written to the audit log, by result.",
+	"result",
+)
+
+const insertAuditRecordQuery = `
+	INSERT INTO vice_default_backend_audit
+	    (time, host, subdomain, outcome, reason, variant, location, analysis_id, username, country, asn, client, visitor,
+	     decision)
+	VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, '')::uuid, NULLIF($9, ''),
+	        NULLIF($10, ''), NULLIF($11, 0), NULLIF($12, ''), NULLIF($13, ''), NULLIF($14, ''))
+`
+
+// AuditLog writes routing decisions to the audit table in the background so
+// that a slow database doesn't hold up routing.
+type AuditLog struct {
+	db    *sql.DB
+	queue chan Decision
+}
+
+// NewAuditLog returns an AuditLog that writes to the database passed in.
+func NewAuditLog(db *sql.DB) *AuditLog {
+	l := &AuditLog{
+		db:    db,
+		queue: make(chan Decision, auditQueueSize),
+	}
+	go l.run()
+	return l
+}
+
+// Record queues a decision to be written to the audit log.
+func (l *AuditLog) Record(d Decision) {
+	select {
+	case l.queue <- d:
+	default:
+		auditRecords.Inc("dropped")
+	}
+}
+
+func (l *AuditLog) run() {
+	for d := range l.queue {
+		start := time.Now()
+		_, err := l.db.ExecContext(
+			context.Background(),
+			insertAuditRecordQuery,
+			d.Time, d.Host, d.Subdomain, d.Outcome, d.Reason, d.Variant, d.Location, d.AnalysisID, d.Username,
+			d.Country, int64(d.ASN), d.Client, d.Visitor, d.Final,
+		)
+		observeQuery(QueryAuditInsert, start, &err)
+		if err != nil {
+			log.Errorf("error writing to the audit log: %s", err)
+			auditRecords.Inc("error")
+			continue
+		}
+		auditRecords.Inc("written")
+	}
+}
+
+// auditColumns are the columns included in audit log exports.
+var auditColumns = []string{
+	"time", "host", "subdomain", "outcome", "reason", "variant", "location", "analysis_id", "username",
+	"country", "asn", "client", "visitor", "decision",
+}
+
+// auditExportQuery builds the query used to export the audit log from the
+// filters and cursor in the request's query parameters. With a limit, one
+// more record than the limit is selected so that the handler can tell whether
+// there's another page.
+func auditExportQuery(r *http.Request, limit int) (string, []interface{}, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	q := r.URL.Query()
+	for _, param := range []string{"from", "to"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "%s must be an RFC 3339 timestamp", param)
+		}
+		args = append(args, t)
+		if param == "from" {
+			conditions = append(conditions, fmt.Sprintf("time >= $%d", len(args)))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("time < $%d", len(args)))
+		}
+	}
+	for _, filter := range []struct{ param, condition string }{
+		{"subdomain", "subdomain = $%d"},
+		{"user", "username = $%d"},
+		{"visitor", "visitor = $%d"},
+		{"outcome", "outcome = $%d"},
+		{"decision", "decision = $%d"},
+		{"reason", "reason = $%d"},
+		{"analysis_id", "analysis_id::text = $%d"},
+	} {
+		if v := q.Get(filter.param); v != "" {
+			args = append(args, v)
+			conditions = append(conditions, fmt.Sprintf(filter.condition, len(args)))
+		}
+	}
+
+	cursor, err := decodeCursor(q, 2)
+	if err != nil {
+		return "", nil, err
+	}
+	if cursor != nil {
+		t, err := time.Parse(time.RFC3339Nano, cursor[0])
+		if err != nil {
+			return "", nil, errors.New("invalid cursor")
+		}
+		id, err := strconv.ParseInt(cursor[1], 10, 64)
+		if err != nil {
+			return "", nil, errors.New("invalid cursor")
+		}
+		args = append(args, t, id)
+		conditions = append(conditions, fmt.Sprintf("(time, id) > ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	query := `
+	SELECT id, time, host, subdomain, outcome, reason,
+	       COALESCE(variant, ''), COALESCE(location, ''),
+	       COALESCE(analysis_id::text, ''), COALESCE(username, ''),
+	       COALESCE(country, ''), COALESCE(asn, 0), COALESCE(client, ''), COALESCE(visitor, ''),
+	       COALESCE(decision, '')
+	  FROM vice_default_backend_audit`
+	if len(conditions) > 0 {
+		query += "\n	 WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += "\n  ORDER BY time, id"
+	if limit > 0 {
+		query += fmt.Sprintf("\n  LIMIT %d", limit+1)
+	}
+
+	return query, args, nil
+}
+
+// auditRecord is a decision read back from the audit log along with its ID.
+type auditRecord struct {
+	id       int64
+	decision Decision
+}
+
+// AuditExportHandler streams the audit log as CSV or newline-delimited JSON,
+// depending on the format query parameter. The from, to, subdomain, user,
+// visitor, outcome, decision, reason, and analysis_id query parameters filter
+// the exported records. Without a limit the whole log is streamed. With one, a page of
+// records is returned, with a Link header pointing at the next page if there
+// is one.
+func (a *App) AuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if a.db == nil {
+		writeError(w, errDatabaseDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "csv" && format != "ndjson" {
+		writeError(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := pageLimit(r.URL.Query(), 0)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, args, err := auditExportQuery(r, limit)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	rows, err := a.db.QueryContext(r.Context(), query, args...)
+	observeQuery(QueryAuditExport, start, &err)
+	if err != nil {
+		log.Errorf("error querying the audit log: %s", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scan := func() (*auditRecord, error) {
+		var rec auditRecord
+		d := &rec.decision
+		err := rows.Scan(
+			&rec.id, &d.Time, &d.Host, &d.Subdomain, &d.Outcome, &d.Reason, &d.Variant, &d.Location, &d.AnalysisID, &d.Username,
+			&d.Country, &d.ASN, &d.Client, &d.Visitor, &d.Final,
+		)
+		return &rec, err
+	}
+
+	// Pages are read in full before anything is written, so that the Link
+	// header can be set. They're bounded by the maximum page size.
+	var page []*auditRecord
+	if limit > 0 {
+		for rows.Next() {
+			rec, err := scan()
+			if err != nil {
+				log.Errorf("error reading the audit log: %s", err)
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			page = append(page, rec)
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("error reading the audit log: %s", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(page) > limit {
+			page = page[:limit]
+			last := page[limit-1]
+			cursor := encodeCursor(last.decision.Time.Format(time.RFC3339Nano), strconv.FormatInt(last.id, 10))
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r, cursor)))
+		}
+	}
+
+	var (
+		csvWriter *csv.Writer
+		encoder   *json.Encoder
+	)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		csvWriter = csv.NewWriter(w)
+		_ = csvWriter.Write(auditColumns)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder = json.NewEncoder(w)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	write := func(d *Decision) error {
+		var err error
+		if csvWriter != nil {
+			err = csvWriter.Write([]string{
+				d.Time.Format(time.RFC3339Nano), d.Host, d.Subdomain, d.Outcome, d.Reason, d.Variant, d.Location, d.AnalysisID, d.Username,
+				d.Country, strconv.FormatUint(d.ASN, 10), d.Client, d.Visitor, d.Final,
+			})
+		} else {
+			err = encoder.Encode(d)
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%500 == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	}
+
+	if limit > 0 {
+		for _, rec := range page {
+			if err = write(&rec.decision); err != nil {
+				log.Errorf("error writing the audit log export: %s", err)
+				return
+			}
+		}
+	} else {
+		for rows.Next() {
+			rec, err := scan()
+			if err != nil {
+				log.Errorf("error reading the audit log: %s", err)
+				return
+			}
+			if err = write(&rec.decision); err != nil {
+				log.Errorf("error writing the audit log export: %s", err)
+				return
+			}
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("error reading the audit log: %s", err)
+		}
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the auth gating settings.
+const (
+	defaultAuthCookie        = "vice_access_token"
+	defaultAuthRedirectParam = "redirect_uri"
+	defaultAuthCacheTTL      = time.Minute
+	defaultAuthNegativeTTL   = 10 * time.Second
+	defaultAuthCacheSize     = 10000
+)
+
+var authCacheLookups = NewCounterVec(
+	"auth_introspection_cache_total",
+	"Access token lookups in the introspection cache, by result.",
+	"result",
+)
+
+// sessionEntry is a cached introspection result. A nil session records that
+// the token isn't active.
+type sessionEntry struct {
+	session *Session
+	expires time.Time
+}
+
+// Session is what the identity provider reports about an access token.
+type Session struct {
+	Active    bool   `json:"active"`
+	Username  string `json:"preferred_username"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Auth gates VICE apps behind a login. Requests without a valid session are
+// redirected to the DE or Keycloak login page with the original app URL as
+// the return URL, so that users land back where they intended after logging
+// in. Access tokens are taken from the Authorization header or the session
+// cookie and checked with the identity provider's OAuth 2.0 token
+// introspection endpoint (RFC 7662).
+type Auth struct {
+	client           *http.Client
+	loginURL         *url.URL
+	redirectParam    string
+	introspectionURL string
+	clientID         string
+	clientSecret     string
+	cookie           string
+	allowedOrigins   map[string]bool
+
+	// Introspection results are cached by the hash of the token, so that
+	// every request for an app's assets doesn't need a round trip to the
+	// identity provider.
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	cacheSize   int
+	mu          sync.Mutex
+	sessions    map[[sha256.Size]byte]sessionEntry
+}
+
+// NewAuth returns an Auth configured from the vice.default_backend.auth
+// section of the config, or nil if vice.default_backend.auth.enabled isn't
+// set.
+func NewAuth(cfg *viper.Viper) (*Auth, error) {
+	cfg.SetDefault("vice.default_backend.auth.cookie", defaultAuthCookie)
+	cfg.SetDefault("vice.default_backend.auth.redirect_param", defaultAuthRedirectParam)
+	cfg.SetDefault("vice.default_backend.auth.cache_ttl", defaultAuthCacheTTL)
+	cfg.SetDefault("vice.default_backend.auth.negative_cache_ttl", defaultAuthNegativeTTL)
+	cfg.SetDefault("vice.default_backend.auth.cache_size", defaultAuthCacheSize)
+
+	if !cfg.GetBool("vice.default_backend.auth.enabled") {
+		return nil, nil
+	}
+
+	loginURL, err := url.Parse(cfg.GetString("vice.default_backend.auth.login_url"))
+	if err != nil || !loginURL.IsAbs() {
+		return nil, errors.New("vice.default_backend.auth.login_url must be an absolute URL")
+	}
+	introspectionURL := cfg.GetString("vice.default_backend.auth.introspection_url")
+	if introspectionURL == "" {
+		return nil, errors.New("vice.default_backend.auth.introspection_url is required")
+	}
+	allowedOrigins := make(map[string]bool)
+	for _, origin := range cfg.GetStringSlice("vice.default_backend.auth.allowed_origins") {
+		allowedOrigins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return &Auth{
+		client:           &http.Client{Timeout: 5 * time.Second},
+		loginURL:         loginURL,
+		redirectParam:    cfg.GetString("vice.default_backend.auth.redirect_param"),
+		introspectionURL: introspectionURL,
+		clientID:         cfg.GetString("vice.default_backend.auth.client_id"),
+		clientSecret:     cfg.GetString("vice.default_backend.auth.client_secret"),
+		cookie:           cfg.GetString("vice.default_backend.auth.cookie"),
+		allowedOrigins:   allowedOrigins,
+		cacheTTL:         cfg.GetDuration("vice.default_backend.auth.cache_ttl"),
+		negativeTTL:      cfg.GetDuration("vice.default_backend.auth.negative_cache_ttl"),
+		cacheSize:        cfg.GetInt("vice.default_backend.auth.cache_size"),
+		sessions:         make(map[[sha256.Size]byte]sessionEntry),
+	}, nil
+}
+
+// token returns the access token sent with the request, if any.
+func (a *Auth) token(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if c, err := r.Cookie(a.cookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// TrustedOrigin returns true if a request that changes something on the
+// user's behalf can be trusted to come from the user. Requests that carry
+// the access token in the Authorization header are trusted, since browsers
+// never add it on their own. Requests that rely on the cookie must come from
+// the same origin or one of the allowed origins, so that pages on other
+// origins can't make them. Other VICE apps count as other origins even
+// though they're on the same site.
+func (a *Auth) TrustedOrigin(r *http.Request) bool {
+	if scheme, _, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return true
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	return strings.EqualFold(origin.Host, r.Host) || a.allowedOrigins[strings.ToLower(origin.Scheme+"://"+origin.Host)]
+}
+
+// Session returns the session for the request's access token, or nil if the
+// request has no token or the token isn't active.
+func (a *Auth) Session(r *http.Request) (*Session, error) {
+	token := a.token(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	a.mu.Lock()
+	entry, ok := a.sessions[key]
+	a.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		authCacheLookups.Inc("hit")
+		return entry.session, nil
+	}
+	authCacheLookups.Inc("miss")
+
+	session, err := a.introspect(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	if !session.Active {
+		session = nil
+	}
+	a.cacheSession(key, session, now)
+	return session, nil
+}
+
+// cacheSession caches an introspection result. Active sessions are kept for
+// the cache TTL, but never past the token's expiration time.
+func (a *Auth) cacheSession(key [sha256.Size]byte, session *Session, now time.Time) {
+	expires := now.Add(a.negativeTTL)
+	if session != nil {
+		expires = now.Add(a.cacheTTL)
+		if session.ExpiresAt > 0 {
+			if exp := time.Unix(session.ExpiresAt, 0); exp.Before(expires) {
+				expires = exp
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.sessions) >= a.cacheSize {
+		for k, e := range a.sessions {
+			if now.After(e.expires) {
+				delete(a.sessions, k)
+			}
+		}
+		// If it's still full, make room by dropping arbitrary entries.
+		for k := range a.sessions {
+			if len(a.sessions) < a.cacheSize {
+				break
+			}
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[key] = sessionEntry{session: session, expires: expires}
+}
+
+// introspect asks the identity provider about an access token.
+func (a *Auth) introspect(ctx context.Context, token string) (*Session, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.introspectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(a.clientID, a.clientSecret)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error introspecting the access token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token introspection returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var session Session
+	if err = json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, errors.Wrap(err, "error decoding the token introspection response")
+	}
+	return &session, nil
+}
+
+// Visitor returns the user name of the authenticated user making a request,
+// qualified with the user domain so that it can be compared with the owners
+// of analyses, and resolved through the user profiles if they're configured.
+func (a *App) Visitor(r *http.Request, session *Session) string {
+	if a.users == nil {
+		return qualifyUsername(session.Username, a.userDomain)
+	}
+	profile, err := a.users.Lookup(r.Context(), session.Username, a.auth.token(r))
+	if err != nil {
+		log.Error(err)
+		return a.users.Qualify(session.Username)
+	}
+	return profile.Username
+}
+
+// LoginURL returns the login page URL that returns to the given URL.
+func (a *Auth) LoginURL(returnURL string) string {
+	u := *a.loginURL
+	query := u.Query()
+	query.Set(a.redirectParam, returnURL)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
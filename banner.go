@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Banner severities.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Banner is an announcement that gets rendered into the pages served by the
+// default backend and returned by the status API.
+type Banner struct {
+	Message  string     `json:"message"`
+	Severity string     `json:"severity"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// Validate makes sure the banner has a message and a known severity. An empty
+// severity is defaulted to info.
+func (b *Banner) Validate() error {
+	if b.Message == "" {
+		return errors.New("banner message must not be empty")
+	}
+	switch b.Severity {
+	case "":
+		b.Severity = SeverityInfo
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return errors.Errorf("unknown banner severity %q", b.Severity)
+	}
+	return nil
+}
+
+// Expired returns true if the banner has an expiry that has passed.
+func (b *Banner) Expired() bool {
+	return b.Expires != nil && time.Now().After(*b.Expires)
+}
+
+// BannerStore holds the current banner. It is safe for concurrent use.
+type BannerStore struct {
+	mu     sync.RWMutex
+	banner *Banner
+}
+
+// NewBannerStore returns a BannerStore initialized from the
+// vice.default_backend.banner section of the config, if it's present.
+func NewBannerStore(cfg *viper.Viper) (*BannerStore, error) {
+	store := &BannerStore{}
+
+	message := cfg.GetString("vice.default_backend.banner.message")
+	if message == "" {
+		return store, nil
+	}
+
+	banner := &Banner{
+		Message:  message,
+		Severity: cfg.GetString("vice.default_backend.banner.severity"),
+	}
+	if expires := cfg.GetString("vice.default_backend.banner.expires"); expires != "" {
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse vice.default_backend.banner.expires")
+		}
+		banner.Expires = &t
+	}
+
+	if err := store.Set(banner); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Get returns the current banner, or nil if there isn't one or it has expired.
+func (s *BannerStore) Get() *Banner {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.banner == nil || s.banner.Expired() {
+		return nil
+	}
+	b := *s.banner
+	return &b
+}
+
+// Set validates and stores a new banner, replacing any existing one.
+func (s *BannerStore) Set(b *Banner) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.banner = b
+	return nil
+}
+
+// Clear removes the current banner.
+func (s *BannerStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.banner = nil
+}
+
+// GetBannerHandler returns the current banner, or a 404 if there isn't one.
+func (a *App) GetBannerHandler(w http.ResponseWriter, r *http.Request) {
+	banner := a.banner.Get()
+	if banner == nil {
+		writeError(w, "no banner is set", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, banner)
+}
+
+// SetBannerHandler replaces the current banner with the one in the request body.
+func (a *App) SetBannerHandler(w http.ResponseWriter, r *http.Request) {
+	var banner Banner
+	if err := json.NewDecoder(r.Body).Decode(&banner); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.banner.Set(&banner); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("banner set to %q (%s)", banner.Message, banner.Severity)
+	writeJSON(w, http.StatusOK, &banner)
+}
+
+// DeleteBannerHandler removes the current banner.
+func (a *App) DeleteBannerHandler(w http.ResponseWriter, r *http.Request) {
+	a.banner.Clear()
+	log.Info("banner cleared")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// defaultBrandingCacheTTL is how long app details are cached by default. Apps
+// are rarely renamed, so they can be cached for a while.
+const defaultBrandingCacheTTL = 10 * time.Minute
+
+// deSystemID is the system ID of apps defined in the DE's own apps tables.
+const deSystemID = "de"
+
+const appBrandingQuery = `
+	SELECT a.name,
+	       COALESCE(a.description, ''),
+	       COALESCE(i.integrator_name, '')
+	  FROM apps a
+	  LEFT JOIN integration_data i ON a.integration_data_id = i.id
+	 WHERE a.id = $1
+`
+
+// AppBranding identifies the app an analysis was launched from on the pages
+// served for it.
+type AppBranding struct {
+	Name        string
+	Description string
+	Integrator  string
+	IconURL     string
+}
+
+type brandingEntry struct {
+	name        string
+	description string
+	integrator  string
+	expires     time.Time
+}
+
+// Branding looks up the name, description, and integrator of the app behind an analysis in
+// the DE's apps and integration_data tables, and builds the URL of its icon,
+// so that the pages served for the analysis show which tool they're about.
+// Apps from other systems, or looked up without a database, are named from
+// the analysis alone. Lookups are cached by app ID.
+type Branding struct {
+	db      queryer
+	iconURL string
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]brandingEntry
+}
+
+// NewBranding returns a Branding configured from the
+// vice.default_backend.branding section of the config, or nil if
+// vice.default_backend.branding.enabled isn't set. The database can be nil.
+func NewBranding(cfg *viper.Viper, db queryer) *Branding {
+	cfg.SetDefault("vice.default_backend.branding.cache_ttl", defaultBrandingCacheTTL)
+
+	if !cfg.GetBool("vice.default_backend.branding.enabled") {
+		return nil
+	}
+	return &Branding{
+		db:      db,
+		iconURL: cfg.GetString("vice.default_backend.branding.icon_url"),
+		ttl:     cfg.GetDuration("vice.default_backend.branding.cache_ttl"),
+		entries: make(map[string]brandingEntry),
+	}
+}
+
+// Get returns the branding of an analysis' app, or nil if the app isn't
+// known. A failed lookup falls back to the app name recorded with the
+// analysis.
+func (b *Branding) Get(ctx context.Context, analysis *Analysis) *AppBranding {
+	if analysis.AppID == "" && analysis.AppName == "" {
+		return nil
+	}
+	branding := &AppBranding{Name: analysis.AppName, IconURL: b.icon(analysis)}
+	if b.db == nil || analysis.SystemID != deSystemID || !analysisIDPattern.MatchString(analysis.AppID) {
+		return branding
+	}
+
+	entry, err := b.lookup(ctx, analysis.AppID)
+	if err != nil {
+		log.Errorf("error looking up app %s: %s", analysis.AppID, err)
+		return branding
+	}
+	if entry.name != "" {
+		branding.Name = entry.name
+	}
+	branding.Description = entry.description
+	branding.Integrator = entry.integrator
+	return branding
+}
+
+// lookup returns the details of a DE app from the cache or the database.
+func (b *Branding) lookup(ctx context.Context, appID string) (entry brandingEntry, err error) {
+	b.mu.Lock()
+	entry, ok := b.entries[appID]
+	b.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry, nil
+	}
+
+	defer observeQuery(QueryAppBranding, time.Now(), &err)
+	defer traceQuery(ctx, QueryAppBranding)(&err)
+	entry = brandingEntry{}
+	err = b.db.QueryRowContext(ctx, appBrandingQuery, appID).Scan(&entry.name, &entry.description, &entry.integrator)
+	if err != nil && err != sql.ErrNoRows {
+		return entry, err
+	}
+	err = nil
+	entry.expires = time.Now().Add(b.ttl)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[appID] = entry
+	return entry, nil
+}
+
+// icon returns the URL of the app's icon, filling in the {system_id} and
+// {app_id} placeholders of the configured URL, or an empty string if no icon
+// URL is configured or the app isn't known.
+func (b *Branding) icon(analysis *Analysis) string {
+	if b.iconURL == "" || analysis.AppID == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{system_id}", url.PathEscape(analysis.SystemID),
+		"{app_id}", url.PathEscape(analysis.AppID),
+	).Replace(b.iconURL)
+}
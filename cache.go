@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the lookup cache settings.
+const (
+	defaultCacheTTL             = 30 * time.Second
+	defaultCacheNegativeTTL     = 5 * time.Second
+	defaultCacheRefreshInterval = time.Minute
+	defaultCacheWarmWindow      = 6 * time.Hour
+)
+
+const activeAnalysesQuery = `
+	SELECT DISTINCT ON (j.subdomain)` + analysisColumns + analysisTables + `
+	 WHERE j.subdomain IS NOT NULL
+	   AND j.subdomain <> ''
+	   AND j.status IN ('Submitted', 'Queued', 'Running')
+  ORDER BY j.subdomain, j.start_date DESC
+`
+
+// recentLaunchesQuery returns the latest analysis for each subdomain that
+// was launched within the last $1 seconds, whatever its status.
+const recentLaunchesQuery = `
+	SELECT DISTINCT ON (j.subdomain)` + analysisColumns + analysisTables + `
+	 WHERE j.subdomain IS NOT NULL
+	   AND j.subdomain <> ''
+	   AND j.start_date > now() - make_interval(secs => $1)
+  ORDER BY j.subdomain, j.start_date DESC
+`
+
+// maxChangeWaits bounds the number of subdomains that long-polling status
+// requests can wait on at once. Requests past it fall back to polling.
+const maxChangeWaits = 10000
+
+// changeWait is the channel closed when a subdomain's entry changes, along
+// with the number of requests waiting on it.
+type changeWait struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// cacheEntry is a cached lookup result. A nil analysis records that the
+// subdomain wasn't found.
+type cacheEntry struct {
+	analysis *Analysis
+	expires  time.Time
+}
+
+var (
+	cacheLookups = NewCounterVec(
+		"lookup_cache_lookups_total",
+		"Subdomain lookups in the lookup cache, by result (hit, negative_hit, stale, or miss).",
+		"result",
+	)
+	cacheEvictions = NewCounterVec(
+		"lookup_cache_evictions_total",
+		"Entries dropped from the lookup cache because they expired.",
+	)
+	cacheEntries = NewGaugeVec(
+		"lookup_cache_entries",
+		"Entries in the lookup cache as of the last full load.",
+	)
+)
+
+// Results of lookups in the lookup cache. A negative hit finds an entry
+// recording that the subdomain doesn't belong to an analysis, and a stale
+// lookup finds an entry that has expired.
+const (
+	CacheHit         = "hit"
+	CacheNegativeHit = "negative_hit"
+	CacheStale       = "stale"
+	CacheMiss        = "miss"
+)
+
+// CacheStats describes the contents of the lookup cache and how well it's
+// doing since the service started.
+type CacheStats struct {
+	Entries      int        `json:"entries"`
+	Loaded       bool       `json:"loaded"`
+	LastLoad     *time.Time `json:"last_load,omitempty"`
+	Hits         int64      `json:"hits"`
+	NegativeHits int64      `json:"negative_hits"`
+	Stale        int64      `json:"stale"`
+	Misses       int64      `json:"misses"`
+	Evictions    int64      `json:"evictions"`
+}
+
+// CacheSettings are the lookup cache settings that can be changed at runtime.
+// They're written as Go durations, such as 30s.
+type CacheSettings struct {
+	TTL             string `json:"ttl,omitempty"`
+	NegativeTTL     string `json:"negative_ttl,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+	WarmWindow      string `json:"warm_window,omitempty"`
+}
+
+// CacheResponse is the body returned by the lookup cache admin endpoints.
+type CacheResponse struct {
+	Stats    *CacheStats    `json:"stats"`
+	Settings *CacheSettings `json:"settings"`
+}
+
+// LookupCache holds the results of subdomain lookups in memory. The
+// subdomains of all active analyses are loaded from the database in full
+// every refresh interval, and individual lookups are cached as they happen.
+type LookupCache struct {
+	db         queryer
+	mu         sync.RWMutex
+	entries    map[string]cacheEntry
+	lastLoad   time.Time
+	loaded     atomic.Bool
+	loadedOnce sync.Once
+	loadedCh   chan struct{}
+
+	// changed holds a channel for each subdomain that long-polling status
+	// requests are waiting on. It's closed and removed when the subdomain's
+	// entry is updated, and removed when the last request stops waiting.
+	changed map[string]*changeWait
+
+	// The settings can be changed through the admin API while the cache is
+	// in use.
+	settingsMu      sync.RWMutex
+	ttl             time.Duration
+	negativeTTL     time.Duration
+	refreshInterval time.Duration
+	warmWindow      time.Duration
+
+	hits, negativeHits, stale, misses, evictions atomic.Int64
+}
+
+// NewLookupCache returns a LookupCache configured from the
+// vice.default_backend.cache section of the config, or nil if the cache isn't
+// enabled.
+func NewLookupCache(cfg *viper.Viper, db queryer) *LookupCache {
+	cfg.SetDefault("vice.default_backend.cache.ttl", defaultCacheTTL)
+	cfg.SetDefault("vice.default_backend.cache.negative_ttl", defaultCacheNegativeTTL)
+	cfg.SetDefault("vice.default_backend.cache.refresh_interval", defaultCacheRefreshInterval)
+	cfg.SetDefault("vice.default_backend.cache.warm_window", defaultCacheWarmWindow)
+
+	if !cfg.GetBool("vice.default_backend.cache.enabled") {
+		return nil
+	}
+
+	return &LookupCache{
+		db:              db,
+		ttl:             cfg.GetDuration("vice.default_backend.cache.ttl"),
+		negativeTTL:     cfg.GetDuration("vice.default_backend.cache.negative_ttl"),
+		refreshInterval: cfg.GetDuration("vice.default_backend.cache.refresh_interval"),
+		warmWindow:      cfg.GetDuration("vice.default_backend.cache.warm_window"),
+		entries:         make(map[string]cacheEntry),
+		loadedCh:        make(chan struct{}),
+		changed:         make(map[string]*changeWait),
+	}
+}
+
+// Changed returns a channel that's closed the next time the entry for a
+// subdomain is updated from a job status update, an analysis action, or a
+// full load, along with a function that must be called when the caller stops
+// waiting on it. The channel is nil, and never closed, if too many
+// subdomains are already being waited on.
+func (c *LookupCache) Changed(subdomain string) (<-chan struct{}, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.changed[subdomain]
+	if !ok {
+		if len(c.changed) >= maxChangeWaits {
+			return nil, func() {}
+		}
+		w = &changeWait{ch: make(chan struct{})}
+		c.changed[subdomain] = w
+	}
+	w.waiters++
+	return w.ch, func() { c.stopWaiting(subdomain, w) }
+}
+
+// stopWaiting removes a subdomain's channel once nobody is waiting on it, so
+// that requests for subdomains that never change don't leave channels behind.
+func (c *LookupCache) stopWaiting(subdomain string, w *changeWait) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.waiters--
+	if w.waiters == 0 && c.changed[subdomain] == w {
+		delete(c.changed, subdomain)
+	}
+}
+
+// notify wakes up the requests waiting for a subdomain's entry to change. The
+// cache must be locked.
+func (c *LookupCache) notify(subdomain string) {
+	if w, ok := c.changed[subdomain]; ok {
+		close(w.ch)
+		delete(c.changed, subdomain)
+	}
+}
+
+// Get returns the cached analysis for a subdomain. The second return value is
+// false if there's no unexpired entry for it.
+func (c *LookupCache) Get(subdomain string) (*Analysis, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[subdomain]
+	c.mu.RUnlock()
+	switch {
+	case !ok:
+		c.misses.Add(1)
+		cacheLookups.Inc(CacheMiss)
+		return nil, false
+	case time.Now().After(entry.expires):
+		c.stale.Add(1)
+		cacheLookups.Inc(CacheStale)
+		return nil, false
+	case entry.analysis == nil:
+		c.negativeHits.Add(1)
+		cacheLookups.Inc(CacheNegativeHit)
+	default:
+		c.hits.Add(1)
+		cacheLookups.Inc(CacheHit)
+	}
+	return entry.analysis, true
+}
+
+// Peek is like Get, but doesn't count the lookup in the cache statistics or
+// metrics.
+func (c *LookupCache) Peek(subdomain string) (*Analysis, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[subdomain]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.analysis, true
+}
+
+// TTL returns how long looked up analyses are cached.
+func (c *LookupCache) TTL() time.Duration {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return c.ttl
+}
+
+// Put caches the result of looking up a subdomain.
+func (c *LookupCache) Put(subdomain string, analysis *Analysis) {
+	c.settingsMu.RLock()
+	ttl := c.ttl
+	if analysis == nil {
+		ttl = c.negativeTTL
+	}
+	c.settingsMu.RUnlock()
+	c.PutFor(subdomain, analysis, ttl)
+}
+
+// PutFor caches an analysis for a subdomain for the given time.
+func (c *LookupCache) PutFor(subdomain string, analysis *Analysis, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[subdomain] = cacheEntry{analysis: analysis, expires: time.Now().Add(ttl)}
+}
+
+// Update caches an analysis for its subdomain for the given time unless the
+// subdomain is cached for a different analysis that started later, so that
+// updates about an earlier analysis don't replace a relaunched one. It
+// returns false if the cache wasn't changed.
+func (c *LookupCache) Update(analysis *Analysis, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[analysis.Subdomain]; ok && entry.analysis != nil && entry.analysis.ID != analysis.ID &&
+		entry.analysis.StartDate != nil && analysis.StartDate != nil && entry.analysis.StartDate.After(*analysis.StartDate) {
+		return false
+	}
+	c.entries[analysis.Subdomain] = cacheEntry{analysis: analysis, expires: time.Now().Add(ttl)}
+	c.notify(analysis.Subdomain)
+	return true
+}
+
+// Load adds the subdomains of all active analyses to the cache and drops
+// expired entries. It also warms the cache with the analyses launched within
+// the warm window, whatever their status, so that the first hit on a freshly
+// launched or just finished app doesn't need a lookup. Those entries last
+// until the next load.
+func (c *LookupCache) Load(ctx context.Context) error {
+	analyses, err := c.activeAnalyses(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.settingsMu.RLock()
+	ttl, refreshInterval, warmWindow := c.ttl, c.refreshInterval, c.warmWindow
+	c.settingsMu.RUnlock()
+
+	var recent []*Analysis
+	if warmWindow > 0 {
+		if recent, err = c.recentLaunches(ctx, warmWindow); err != nil {
+			log.Errorf("error warming the lookup cache with recent launches: %s", err)
+		}
+	}
+
+	now := time.Now()
+	warmTTL := ttl
+	if refreshInterval > warmTTL {
+		warmTTL = refreshInterval
+	}
+	c.mu.Lock()
+	for subdomain, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, subdomain)
+			c.evictions.Add(1)
+			cacheEvictions.Inc()
+		}
+	}
+	for _, analysis := range recent {
+		c.load(analysis, now.Add(warmTTL))
+	}
+	for _, analysis := range analyses {
+		c.load(analysis, now.Add(ttl))
+	}
+	c.lastLoad = now
+	cacheEntries.Set(float64(len(c.entries)))
+	c.mu.Unlock()
+
+	c.loaded.Store(true)
+	c.loadedOnce.Do(func() { close(c.loadedCh) })
+	log.Debugf("loaded %d active analyses and %d recent launches into the lookup cache", len(analyses), len(recent))
+	return nil
+}
+
+// Owned returns the unexpired cached analyses of a user that haven't ended.
+func (c *LookupCache) Owned(username string) []*Analysis {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var owned []*Analysis
+	for _, entry := range c.entries {
+		if entry.analysis != nil && entry.analysis.Username == username && now.Before(entry.expires) && !entry.analysis.Ended() {
+			owned = append(owned, entry.analysis)
+		}
+	}
+	return owned
+}
+
+// load caches an analysis read by Load. An unexpired entry recording that the
+// same analysis ended is kept, since the database may not reflect a job
+// status update yet. The cache must be locked.
+func (c *LookupCache) load(analysis *Analysis, expires time.Time) {
+	if entry, ok := c.entries[analysis.Subdomain]; ok && entry.analysis != nil &&
+		entry.analysis.ID == analysis.ID && entry.analysis.Ended() && !analysis.Ended() {
+		return
+	}
+	c.entries[analysis.Subdomain] = cacheEntry{analysis: analysis, expires: expires}
+	c.notify(analysis.Subdomain)
+}
+
+// activeAnalyses queries the database for all active analyses.
+func (c *LookupCache) activeAnalyses(ctx context.Context) (analyses []*Analysis, err error) {
+	defer observeQuery(QueryActiveAnalyses, time.Now(), &err)
+	return queryAnalyses(ctx, c.db, activeAnalysesQuery)
+}
+
+// recentLaunches queries the database for the analyses launched within the
+// warm window.
+func (c *LookupCache) recentLaunches(ctx context.Context, warmWindow time.Duration) (analyses []*Analysis, err error) {
+	defer observeQuery(QueryRecentLaunches, time.Now(), &err)
+	return queryAnalyses(ctx, c.db, recentLaunchesQuery, warmWindow.Seconds())
+}
+
+// queryAnalyses runs a query that returns analyses.
+func queryAnalyses(ctx context.Context, db queryer, query string, args ...interface{}) ([]*Analysis, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var analyses []*Analysis
+	for rows.Next() {
+		analysis, err := scanAnalysis(rows)
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, analysis)
+	}
+	return analyses, rows.Err()
+}
+
+// Poll loads the cache once per refresh interval until the process exits.
+func (c *LookupCache) Poll() {
+	for {
+		c.settingsMu.RLock()
+		refreshInterval := c.refreshInterval
+		c.settingsMu.RUnlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), refreshInterval)
+		if err := c.Load(ctx); err != nil {
+			log.Errorf("error loading the lookup cache: %s", err)
+		}
+		cancel()
+		time.Sleep(refreshInterval)
+	}
+}
+
+// Loaded returns true once the cache has been loaded in full at least once.
+func (c *LookupCache) Loaded() bool {
+	return c.loaded.Load()
+}
+
+// WaitLoaded returns a channel that's closed once the cache has been loaded
+// in full for the first time.
+func (c *LookupCache) WaitLoaded() <-chan struct{} {
+	return c.loadedCh
+}
+
+// Stats returns a summary of the cache's contents.
+func (c *LookupCache) Stats() *CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := &CacheStats{
+		Entries:      len(c.entries),
+		Loaded:       c.Loaded(),
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Stale:        c.stale.Load(),
+		Misses:       c.misses.Load(),
+		Evictions:    c.evictions.Load(),
+	}
+	if !c.lastLoad.IsZero() {
+		lastLoad := c.lastLoad
+		stats.LastLoad = &lastLoad
+	}
+	return stats
+}
+
+// Check reports whether the cache is being loaded from the database. It fails
+// if the last load was more than three refresh intervals ago.
+func (c *LookupCache) Check() (string, error) {
+	stats := c.Stats()
+	if stats.LastLoad == nil {
+		return "", errors.New("the cache hasn't been loaded yet")
+	}
+	c.settingsMu.RLock()
+	refreshInterval := c.refreshInterval
+	c.settingsMu.RUnlock()
+	if age := time.Since(*stats.LastLoad); age > 3*refreshInterval {
+		return "", fmt.Errorf("the cache was last loaded %s ago", age.Round(time.Second))
+	}
+	return fmt.Sprintf("%d entries, loaded at %s", stats.Entries, stats.LastLoad.Format(time.RFC3339)), nil
+}
+
+// Settings returns the current settings of the cache.
+func (c *LookupCache) Settings() *CacheSettings {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return &CacheSettings{
+		TTL:             c.ttl.String(),
+		NegativeTTL:     c.negativeTTL.String(),
+		RefreshInterval: c.refreshInterval.String(),
+		WarmWindow:      c.warmWindow.String(),
+	}
+}
+
+// SetSettings changes the settings that are set in the CacheSettings passed
+// in, leaving the others alone. Nothing is changed if any of them is invalid.
+// The new TTLs apply to entries cached from then on, and the new refresh
+// interval takes effect after the next load.
+func (c *LookupCache) SetSettings(settings *CacheSettings) error {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	ttl, negativeTTL, refreshInterval, warmWindow := c.ttl, c.negativeTTL, c.refreshInterval, c.warmWindow
+	for _, s := range []struct {
+		name     string
+		value    string
+		dest     *time.Duration
+		allowOff bool
+	}{
+		{"ttl", settings.TTL, &ttl, false},
+		{"negative_ttl", settings.NegativeTTL, &negativeTTL, false},
+		{"refresh_interval", settings.RefreshInterval, &refreshInterval, false},
+		{"warm_window", settings.WarmWindow, &warmWindow, true},
+	} {
+		if s.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s.value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", s.name)
+		}
+		if d < 0 || d == 0 && !s.allowOff {
+			return fmt.Errorf("%s must be positive", s.name)
+		}
+		*s.dest = d
+	}
+
+	c.ttl, c.negativeTTL, c.refreshInterval, c.warmWindow = ttl, negativeTTL, refreshInterval, warmWindow
+	return nil
+}
+
+// cacheEnabled writes an error response and returns false if the lookup cache
+// isn't enabled.
+func (a *App) cacheEnabled(w http.ResponseWriter) bool {
+	if a.cache == nil {
+		writeError(w, "the lookup cache is disabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// GetCacheHandler reports the lookup cache's statistics and settings.
+func (a *App) GetCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if a.cacheEnabled(w) {
+		writeJSON(w, http.StatusOK, &CacheResponse{Stats: a.cache.Stats(), Settings: a.cache.Settings()})
+	}
+}
+
+// SetCacheHandler changes the lookup cache's settings at runtime. Settings
+// left out of the request body keep their current values. The changes last
+// until the service restarts.
+func (a *App) SetCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.cacheEnabled(w) {
+		return
+	}
+	var settings CacheSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.cache.SetSettings(&settings); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	current := a.cache.Settings()
+	log.Infof("lookup cache settings changed: ttl %s, negative_ttl %s, refresh_interval %s, warm_window %s",
+		current.TTL, current.NegativeTTL, current.RefreshInterval, current.WarmWindow)
+	writeJSON(w, http.StatusOK, &CacheResponse{Stats: a.cache.Stats(), Settings: current})
+}
+
+// LookupAnalysis returns the analysis behind a subdomain, consulting the
+// lookup cache first if there is one.
+func (a *App) LookupAnalysis(ctx context.Context, subdomain string) (*Analysis, error) {
+	if a.cache != nil {
+		if analysis, ok := a.cache.Get(subdomain); ok {
+			return analysis, nil
+		}
+	}
+
+	analysis, err := a.AnalysisBySubdomain(ctx, subdomain)
+	if err != nil {
+		return nil, err
+	}
+	if a.cache != nil {
+		a.cache.Put(subdomain, analysis)
+	}
+	return analysis, nil
+}
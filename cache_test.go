@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func newTestLookupCache() *LookupCache {
+	return &LookupCache{
+		entries:  make(map[string]cacheEntry),
+		loadedCh: make(chan struct{}),
+		changed:  make(map[string]*changeWait),
+	}
+}
+
+func TestLookupCacheChangedIsRemovedWhenWaitersLeave(t *testing.T) {
+	c := newTestLookupCache()
+
+	first, releaseFirst := c.Changed("a1b2c3d4")
+	second, releaseSecond := c.Changed("a1b2c3d4")
+	if first != second {
+		t.Fatal("waiters on the same subdomain got different channels")
+	}
+
+	releaseFirst()
+	if _, ok := c.changed["a1b2c3d4"]; !ok {
+		t.Fatal("the channel was removed while a request was still waiting on it")
+	}
+	releaseSecond()
+	if len(c.changed) != 0 {
+		t.Fatalf("%d channels are left after every request stopped waiting", len(c.changed))
+	}
+}
+
+func TestLookupCacheChangedIsClosedOnUpdate(t *testing.T) {
+	c := newTestLookupCache()
+
+	changed, release := c.Changed("a1b2c3d4")
+	c.Update(&Analysis{ID: "1", Subdomain: "a1b2c3d4"}, defaultCacheTTL)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("the channel wasn't closed when the entry was updated")
+	}
+
+	// A request that starts waiting after the update gets a new channel,
+	// which the earlier request releasing its own mustn't remove.
+	_, releaseNext := c.Changed("a1b2c3d4")
+	release()
+	if _, ok := c.changed["a1b2c3d4"]; !ok {
+		t.Fatal("releasing the closed channel removed the new one")
+	}
+	releaseNext()
+	if len(c.changed) != 0 {
+		t.Fatalf("%d channels are left after every request stopped waiting", len(c.changed))
+	}
+}
+
+func TestLookupCacheChangedIsCapped(t *testing.T) {
+	c := newTestLookupCache()
+
+	for i := 0; i < maxChangeWaits; i++ {
+		c.Changed(strconv.Itoa(i))
+	}
+	changed, release := c.Changed("a1b2c3d4")
+	if changed != nil {
+		t.Error("got a channel past the limit")
+	}
+	release()
+	if len(c.changed) != maxChangeWaits {
+		t.Errorf("waiting on %d subdomains, want %d", len(c.changed), maxChangeWaits)
+	}
+}
+
+func TestLookupCachePeekIsNotCounted(t *testing.T) {
+	c := newTestLookupCache()
+	c.PutFor("a1b2c3d4", &Analysis{ID: "1", Subdomain: "a1b2c3d4"}, defaultCacheTTL)
+	c.PutFor("e5f6a7b8", nil, defaultCacheNegativeTTL)
+
+	if analysis, ok := c.Peek("a1b2c3d4"); !ok || analysis == nil || analysis.ID != "1" {
+		t.Errorf("Peek returned %+v, %t for a cached analysis", analysis, ok)
+	}
+	if analysis, ok := c.Peek("e5f6a7b8"); !ok || analysis != nil {
+		t.Errorf("Peek returned %+v, %t for a negative entry", analysis, ok)
+	}
+	if analysis, ok := c.Peek("c9d0e1f2"); ok || analysis != nil {
+		t.Errorf("Peek returned %+v, %t for a missing entry", analysis, ok)
+	}
+	if hits, negative, misses := c.hits.Load(), c.negativeHits.Load(), c.misses.Load(); hits+negative+misses != 0 {
+		t.Errorf("Peek counted %d hits, %d negative hits, and %d misses", hits, negative, misses)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyverse-de/vice-default-backend/client"
+)
+
+// parseInterspersed parses flags that may appear before, between, or after
+// the positional arguments, and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// runStatusCommand implements the status subcommand, which asks a running
+// instance what it thinks about a subdomain. It returns the exit code.
+func runStatusCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		server  = fs.String("server", envOr("VICE_DEFAULT_BACKEND_URL", "http://localhost:60000"), "The base URL of the running instance.")
+		timeout = fs.Duration("timeout", 30*time.Second, "How long to wait for an answer, including retries.")
+		asJSON  = fs.Bool("json", false, "Print the raw JSON response.")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: vice-default-backend status <subdomain> [--server URL] [--timeout 30s] [--json]")
+		fs.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return 2
+	}
+	subdomain := positional[0]
+
+	c, err := client.New(*server)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	status, err := c.Status(ctx, subdomain)
+	if err != nil {
+		fmt.Fprintf(stderr, "error getting the status of %s from %s: %s\n", subdomain, *server, err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(status); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Subdomain:\t%s\n", status.Subdomain)
+	fmt.Fprintf(tw, "State:\t%s\n", status.State)
+	if status.Banner != nil {
+		fmt.Fprintf(tw, "Banner:\t[%s] %s\n", status.Banner.Severity, status.Banner.Message)
+		if status.Banner.Expires != nil {
+			fmt.Fprintf(tw, "Banner expires:\t%s\n", status.Banner.Expires.Format(time.RFC3339))
+		}
+	}
+	if err = tw.Flush(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// envOr returns the value of an environment variable, or the fallback if it
+// isn't set.
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,226 @@
+// Package client is a Go client for the VICE default backend's status API.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Analysis states reported by the status API.
+const (
+	StateNotFound    = "not_found"
+	StateLaunching   = "launching"
+	StateRunning     = "running"
+	StateTerminating = "terminating"
+	StatePaused      = "paused"
+	StateSuspended   = "suspended"
+	StateCompleted   = "completed"
+	StateFailed      = "failed"
+	StateCanceled    = "canceled"
+	StateDeleted     = "deleted"
+)
+
+// Defaults for the retry behavior.
+const (
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 250 * time.Millisecond
+	DefaultTimeout    = 10 * time.Second
+)
+
+// maxBackoff caps the delay between two attempts.
+const maxBackoff = 5 * time.Second
+
+// Banner is an announcement returned along with the status.
+type Banner struct {
+	Message  string     `json:"message"`
+	Severity string     `json:"severity"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// Status is what the default backend knows about the analysis behind a
+// subdomain.
+type Status struct {
+	Subdomain string  `json:"subdomain"`
+	State     string  `json:"state"`
+	Banner    *Banner `json:"banner,omitempty"`
+
+	// Username is the owner of the analysis. It's only included when the
+	// request was made on behalf of the owner.
+	Username string `json:"username,omitempty"`
+
+	// ResumeURL is where the owner can resume a paused or suspended
+	// analysis. Like Username, it's only included for the owner.
+	ResumeURL string `json:"resume_url,omitempty"`
+
+	// RelaunchURL is the DE launch page for the app of an analysis that has
+	// ended.
+	RelaunchURL string `json:"relaunch_url,omitempty"`
+
+	// PlannedEndDate is when the time limit of an analysis that hasn't ended
+	// runs out.
+	PlannedEndDate *time.Time `json:"planned_end_date,omitempty"`
+}
+
+// APIError is returned when the API responds with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("the default backend returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("the default backend returned %d: %s", e.StatusCode, e.Message)
+}
+
+// retryable returns true for the statuses that are worth trying again.
+func (e *APIError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Client calls the status API of a VICE default backend. Requests that fail
+// with a network error, a 429, or a 5xx are retried with exponential backoff.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option customizes a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used to make requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets the number of times a failed request is retried and the
+// delay before the first retry, which doubles with each attempt.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New returns a Client for the default backend at baseURL, e.g.
+// https://vice-default-backend.prod.svc.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s", baseURL)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("%s is not an absolute URL", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		maxRetries: DefaultMaxRetries,
+		backoff:    DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Status returns the state of the analysis behind a subdomain.
+func (c *Client) Status(ctx context.Context, subdomain string) (*Status, error) {
+	var status Status
+	if err := c.get(ctx, c.baseURL.JoinPath("api", "v1", "status", subdomain), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Ready returns true if the analysis behind a subdomain is running.
+func (c *Client) Ready(ctx context.Context, subdomain string) (bool, error) {
+	status, err := c.Status(ctx, subdomain)
+	if err != nil {
+		return false, err
+	}
+	return status.State == StateRunning, nil
+}
+
+// get decodes the JSON response from a GET request into v, retrying as
+// needed.
+func (c *Client) get(ctx context.Context, u *url.URL, v interface{}) error {
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.try(ctx, u, v)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && !apiErr.retryable() {
+			return err
+		}
+		if ctx.Err() != nil || attempt >= c.maxRetries {
+			return err
+		}
+
+		wait := delay
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// try makes a single request. It returns the delay requested by a
+// Retry-After header, if any, along with any error.
+func (c *Client) try(ctx context.Context, u *url.URL, v interface{}) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+
+		var body struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		_ = json.Unmarshal(data, &body)
+		return retryAfter, &APIError{StatusCode: resp.StatusCode, Message: body.Message}
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, errors.Wrap(err, "unable to decode the response")
+	}
+	return 0, nil
+}
@@ -0,0 +1,304 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// statusServer serves the status API, answering each request with the
+// handler for its attempt, starting at 0. Requests past the last handler get
+// the last one.
+type statusServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	attempts []time.Time
+}
+
+func newStatusServer(t *testing.T, handlers ...http.HandlerFunc) *statusServer {
+	t.Helper()
+	s := &statusServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/status/a1b2c3d4" {
+			t.Errorf("got %s %s, want GET /api/v1/status/a1b2c3d4", r.Method, r.URL.Path)
+		}
+		if accept := r.Header.Get("Accept"); accept != "application/json" {
+			t.Errorf("Accept is %q, want application/json", accept)
+		}
+		s.mu.Lock()
+		attempt := len(s.attempts)
+		s.attempts = append(s.attempts, time.Now())
+		s.mu.Unlock()
+		if attempt >= len(handlers) {
+			attempt = len(handlers) - 1
+		}
+		handlers[attempt](w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// count returns the number of requests made.
+func (s *statusServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.attempts)
+}
+
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func newTestClient(t *testing.T, baseURL string, opts ...Option) *Client {
+	t.Helper()
+	c, err := New(baseURL, append([]Option{WithRetries(3, time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestStatus(t *testing.T) {
+	s := newStatusServer(t, respond(http.StatusOK, `{
+		"subdomain": "a1b2c3d4",
+		"state": "paused",
+		"banner": {"message": "Maintenance tonight", "severity": "warning", "expires": "2026-10-17T06:00:00Z"},
+		"username": "ipcdev",
+		"resume_url": "https://de.cyverse.org/analyses/1/resume",
+		"planned_end_date": "2026-10-20T12:00:00Z",
+		"unknown_field": true
+	}`))
+
+	got, err := newTestClient(t, s.URL).Status(context.Background(), "a1b2c3d4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC)
+	planned := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	want := &Status{
+		Subdomain:      "a1b2c3d4",
+		State:          StatePaused,
+		Banner:         &Banner{Message: "Maintenance tonight", Severity: "warning", Expires: &expires},
+		Username:       "ipcdev",
+		ResumeURL:      "https://de.cyverse.org/analyses/1/resume",
+		PlannedEndDate: &planned,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Status returned %+v, want %+v", got, want)
+	}
+}
+
+func TestStatusBadJSON(t *testing.T) {
+	s := newStatusServer(t, respond(http.StatusOK, `{"state":`))
+
+	if _, err := newTestClient(t, s.URL).Status(context.Background(), "a1b2c3d4"); err == nil {
+		t.Error("Status didn't return an error for a truncated body")
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		state string
+		want  bool
+	}{
+		{StateRunning, true},
+		{StateLaunching, false},
+		{StateNotFound, false},
+		{StateCompleted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			s := newStatusServer(t, respond(http.StatusOK, `{"subdomain":"a1b2c3d4","state":"`+tt.state+`"}`))
+
+			got, err := newTestClient(t, s.URL).Ready(context.Background(), "a1b2c3d4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Ready returned %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	for _, status := range []int{
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+	} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			s := newStatusServer(t,
+				respond(status, `{"message":"try again"}`),
+				respond(status, `{"message":"try again"}`),
+				respond(http.StatusOK, `{"subdomain":"a1b2c3d4","state":"running"}`),
+			)
+
+			ready, err := newTestClient(t, s.URL).Ready(context.Background(), "a1b2c3d4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ready {
+				t.Error("Ready returned false, want true")
+			}
+			if n := s.count(); n != 3 {
+				t.Errorf("made %d requests, want 3", n)
+			}
+		})
+	}
+}
+
+func TestBacksOffBetweenRetries(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	s := newStatusServer(t, respond(http.StatusServiceUnavailable, ""))
+
+	_, err := newTestClient(t, s.URL, WithRetries(2, backoff)).Status(context.Background(), "a1b2c3d4")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Status returned %v, want the last 503", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.attempts) != 3 {
+		t.Fatalf("made %d requests, want 3", len(s.attempts))
+	}
+	delay := backoff
+	for i := 1; i < len(s.attempts); i++ {
+		if gap := s.attempts[i].Sub(s.attempts[i-1]); gap < delay {
+			t.Errorf("request %d came %s after the one before, want at least %s", i+1, gap, delay)
+		}
+		delay *= 2
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		message string
+	}{
+		{http.StatusBadRequest, `{"message":"invalid wait \"x\""}`, `invalid wait "x"`},
+		{http.StatusNotFound, `{"message":"no analysis"}`, "no analysis"},
+		{http.StatusForbidden, `not JSON`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			s := newStatusServer(t, respond(tt.status, tt.body))
+
+			_, err := newTestClient(t, s.URL).Status(context.Background(), "a1b2c3d4")
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Status returned %v, want an APIError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Message != tt.message {
+				t.Errorf("got %d %q, want %d %q", apiErr.StatusCode, apiErr.Message, tt.status, tt.message)
+			}
+			if n := s.count(); n != 1 {
+				t.Errorf("made %d requests, want 1", n)
+			}
+		})
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper that calls the function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestRetriesConnectionErrors(t *testing.T) {
+	s := newStatusServer(t, respond(http.StatusOK, `{"subdomain":"a1b2c3d4","state":"running"}`))
+
+	failures := 0
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if failures < 2 {
+			failures++
+			return nil, errors.New("connection refused")
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	c := newTestClient(t, s.URL, WithHTTPClient(&http.Client{Transport: transport}))
+	if _, err := c.Status(context.Background(), "a1b2c3d4"); err != nil {
+		t.Fatal(err)
+	}
+	if failures != 2 || s.count() != 1 {
+		t.Errorf("failed %d times and made %d requests, want 2 and 1", failures, s.count())
+	}
+}
+
+func TestGivesUpOnConnectionErrors(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+
+	_, err := newTestClient(t, s.URL, WithRetries(2, time.Millisecond)).Status(context.Background(), "a1b2c3d4")
+	var apiErr *APIError
+	if err == nil || errors.As(err, &apiErr) {
+		t.Errorf("Status returned %v, want a connection error", err)
+	}
+}
+
+func TestGivesUpWhenContextIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newStatusServer(t, func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		respond(http.StatusServiceUnavailable, "")(w, r)
+	})
+
+	// Without the cancellation, the retries would take at least 15 seconds.
+	start := time.Now()
+	_, err := newTestClient(t, s.URL, WithRetries(3, time.Hour)).Status(ctx, "a1b2c3d4")
+	if err == nil {
+		t.Fatal("Status didn't return an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Status took %s to give up", elapsed)
+	}
+	if n := s.count(); n != 1 {
+		t.Errorf("made %d requests, want 1", n)
+	}
+}
+
+func TestDoesNotRequestWithCancelledContext(t *testing.T) {
+	s := newStatusServer(t, respond(http.StatusOK, `{"subdomain":"a1b2c3d4","state":"running"}`))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := newTestClient(t, s.URL).Status(ctx, "a1b2c3d4"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Status returned %v, want context.Canceled", err)
+	}
+	if n := s.count(); n != 0 {
+		t.Errorf("made %d requests, want none", n)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		wantErr bool
+	}{
+		{"https://vice-default-backend.prod.svc", false},
+		{"http://localhost:60000/", false},
+		{"vice-default-backend.prod.svc", true},
+		{"/api", true},
+		{"://", true},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.baseURL); (err != nil) != tt.wantErr {
+			t.Errorf("New(%q) returned %v, want an error: %t", tt.baseURL, err, tt.wantErr)
+		}
+	}
+}
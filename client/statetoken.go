@@ -0,0 +1,204 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StateTokenIssuer is the issuer of the state tokens passed to the loading
+// page.
+const StateTokenIssuer = "vice-default-backend"
+
+// stateTokenHeader is the encoded JOSE header of signed state tokens.
+var stateTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Errors returned by VerifyStateToken and DecryptStateToken.
+var (
+	ErrMalformedStateToken = errors.New("malformed state token")
+	ErrBadStateSignature   = errors.New("bad state token signature")
+	ErrExpiredStateToken   = errors.New("expired state token")
+	ErrUnknownStateKey     = errors.New("unknown state token key")
+	ErrBadStateCiphertext  = errors.New("state token can't be decrypted")
+)
+
+// StateKeySize is the size of the keys used to encrypt state tokens.
+const StateKeySize = 32
+
+// StateKeyID returns the ID of an encryption key, which is the start of its
+// hex-encoded SHA-256 hash. Both sides derive it from the key, so the ID
+// changes whenever the key is rotated.
+func StateKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// jweHeader is the JOSE header of encrypted state tokens, which are JWEs
+// encrypted directly with a shared AES-256-GCM key.
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Kid string `json:"kid"`
+}
+
+// StateClaims are the claims in the state token that the default backend
+// passes to the loading page when it redirects a request there.
+type StateClaims struct {
+	AppURL     string `json:"app_url"`
+	Subdomain  string `json:"subdomain"`
+	AnalysisID string `json:"analysis_id,omitempty"`
+	Issuer     string `json:"iss"`
+	IssuedAt   int64  `json:"iat"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+func signState(signingInput string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignStateToken encodes the claims as a JWT signed with HMAC-SHA256.
+func SignStateToken(claims *StateClaims, key []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := stateTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + signState(signingInput, key), nil
+}
+
+// VerifyStateToken checks the signature and expiration time of a state token
+// and returns its claims.
+func VerifyStateToken(token string, key []byte, now time.Time) (*StateClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != stateTokenHeader {
+		return nil, ErrMalformedStateToken
+	}
+	signingInput := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signState(signingInput, key))) {
+		return nil, ErrBadStateSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformedStateToken
+	}
+	var claims StateClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformedStateToken
+	}
+	return checkExpiry(&claims, now)
+}
+
+func checkExpiry(claims *StateClaims, now time.Time) (*StateClaims, error) {
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredStateToken
+	}
+	return claims, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != StateKeySize {
+		return nil, errors.Errorf("state token keys must be %d bytes long, got %d", StateKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptStateToken encodes the claims as a JWE in compact serialization,
+// encrypted with AES-256-GCM using the key directly ("alg":"dir",
+// "enc":"A256GCM"). The key's ID goes in the header so that the loading page
+// can pick the right key while keys are being rotated.
+func EncryptStateToken(claims *StateClaims, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(&jweHeader{Alg: "dir", Enc: "A256GCM", Kid: StateKeyID(key)})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	sealed := gcm.Seal(nil, nonce, payload, []byte(encodedHeader))
+	ciphertext, tag := sealed[:len(payload)], sealed[len(payload):]
+
+	return strings.Join([]string{
+		encodedHeader,
+		"",
+		base64.RawURLEncoding.EncodeToString(nonce),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// DecryptStateToken decrypts an encrypted state token with whichever of the
+// keys is named in its header, checks its expiration time, and returns its
+// claims. Passing both the old and the new key while rotating keys lets
+// tokens encrypted with either be read.
+func DecryptStateToken(token string, keys [][]byte, now time.Time) (*StateClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return nil, ErrMalformedStateToken
+	}
+	var decoded [5][]byte
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, ErrMalformedStateToken
+		}
+	}
+
+	var header jweHeader
+	if err := json.Unmarshal(decoded[0], &header); err != nil || header.Alg != "dir" || header.Enc != "A256GCM" {
+		return nil, ErrMalformedStateToken
+	}
+	var key []byte
+	for _, k := range keys {
+		if StateKeyID(k) == header.Kid {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrUnknownStateKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded[2]) != gcm.NonceSize() {
+		return nil, ErrMalformedStateToken
+	}
+	payload, err := gcm.Open(nil, decoded[2], append(decoded[3], decoded[4]...), []byte(parts[0]))
+	if err != nil {
+		return nil, ErrBadStateCiphertext
+	}
+
+	var claims StateClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformedStateToken
+	}
+	return checkExpiry(&claims, now)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"net/http"
+	"time"
+)
+
+//go:embed ui/dashboard.html
+var dashboardHTML []byte
+
+// DependencyStatus reports the health of something the service depends on.
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// checkDatabase pings a database.
+func checkDatabase(ctx context.Context, name string, db *sql.DB) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	status := DependencyStatus{Name: name}
+	start := time.Now()
+	err := db.PingContext(ctx)
+	status.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Healthy = true
+	}
+	return status
+}
+
+// Overview is the body returned by the dashboard's overview endpoint.
+type Overview struct {
+	RequestRate     float64            `json:"request_rate"`
+	RecentDecisions []Decision         `json:"recent_decisions"`
+	Dependencies    []DependencyStatus `json:"dependencies"`
+	Maintenance     bool               `json:"maintenance"`
+	Cache           *CacheStats        `json:"cache,omitempty"`
+}
+
+// OverviewHandler returns the live state of the service for the admin
+// dashboard.
+func (a *App) OverviewHandler(w http.ResponseWriter, r *http.Request) {
+	overview := &Overview{
+		RequestRate:     a.requestRate.PerSecond(),
+		RecentDecisions: a.decisions.Recent(),
+		Dependencies:    []DependencyStatus{},
+		Maintenance:     a.maintenance.Enabled(),
+	}
+	if a.db != nil {
+		overview.Dependencies = append(overview.Dependencies, checkDatabase(r.Context(), "database", a.db))
+	}
+	if a.replica != nil {
+		overview.Dependencies = append(overview.Dependencies, checkDatabase(r.Context(), "database_replica", a.replica.Replica()))
+	}
+	if a.cache != nil {
+		overview.Cache = a.cache.Stats()
+	}
+	writeJSON(w, http.StatusOK, overview)
+}
+
+// DashboardHandler serves the admin dashboard's single page.
+func (a *App) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(dashboardHTML); err != nil {
+		log.Errorf("error writing the dashboard: %s", err)
+	}
+}
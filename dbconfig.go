@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// readSecretFile returns the trimmed contents of a file mounted from a
+// secret.
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// DatabaseURIs returns the URIs of the DE database: the primary followed by
+// the ones in vice.db.failover_uris. The primary is read from the file named
+// by vice.db.uri_file if that's set, or from vice.db.uri otherwise. The user
+// name and password in each URI are replaced with the contents of the files
+// named by vice.db.user_file and vice.db.password_file if those are set, so
+// that the credentials can come from a Kubernetes Secret rather than the
+// shared config file.
+func DatabaseURIs(cfg *viper.Viper) ([]string, error) {
+	uri := cfg.GetString("vice.db.uri")
+	if path := cfg.GetString("vice.db.uri_file"); path != "" {
+		var err error
+		if uri, err = readSecretFile(path); err != nil {
+			return nil, errors.Wrap(err, "error reading vice.db.uri_file")
+		}
+	}
+
+	var uris []string
+	for _, u := range append([]string{uri}, cfg.GetStringSlice("vice.db.failover_uris")...) {
+		withCredentials, err := applyCredentialFiles(cfg, u)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, withCredentials)
+	}
+	return uris, nil
+}
+
+// applyCredentialFiles replaces the user name and password in a database URI
+// with the ones in vice.db.user_file and vice.db.password_file.
+func applyCredentialFiles(cfg *viper.Viper, uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Wrap(err, "Can't parse db.uri in the config file")
+	}
+
+	userFile := cfg.GetString("vice.db.user_file")
+	passwordFile := cfg.GetString("vice.db.password_file")
+	if userFile == "" && passwordFile == "" {
+		return uri, nil
+	}
+
+	username := parsed.User.Username()
+	if userFile != "" {
+		if username, err = readSecretFile(userFile); err != nil {
+			return "", errors.Wrap(err, "error reading vice.db.user_file")
+		}
+	}
+	password, hasPassword := parsed.User.Password()
+	if passwordFile != "" {
+		if password, err = readSecretFile(passwordFile); err != nil {
+			return "", errors.Wrap(err, "error reading vice.db.password_file")
+		}
+		hasPassword = true
+	}
+
+	if hasPassword {
+		parsed.User = url.UserPassword(username, password)
+	} else {
+		parsed.User = url.User(username)
+	}
+	return parsed.String(), nil
+}
+
+// redactedURI returns the URI with its password masked, for logging.
+func redactedURI(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "(unparseable URI)"
+	}
+	return parsed.Redacted()
+}
+
+var dbCredentialRotations = NewCounterVec(
+	"db_credential_rotations_total",
+	"Changes to the database credentials picked up without a restart, by result.",
+	"result",
+)
+
+var (
+	dbFailovers = NewCounterVec(
+		"db_failovers_total",
+		"Times the service switched to another database URI because the active one was unreachable.",
+	)
+	dbEndpointUp = NewGaugeVec(
+		"db_endpoint_up",
+		"Whether the last probe of each database host succeeded.",
+		"host",
+	)
+	dbEndpointActive = NewGaugeVec(
+		"db_endpoint_active",
+		"Whether each database host is the one new connections go to.",
+		"host",
+	)
+)
+
+// DBConnector opens Postgres connections using the active database URI out
+// of a list of equivalent ones. When a connection to the active URI fails,
+// the next URI that works becomes the active one and stays active until it
+// fails in turn, so the service doesn't flap between hosts.
+//
+// When the active URI changes, connections opened with the old one are
+// reported as no longer valid, so the pool closes them as they're returned
+// instead of reusing them, and new connections use the new URI. Queries that
+// are already running aren't interrupted.
+type DBConnector struct {
+	driver     pq.Driver
+	mu         sync.RWMutex
+	dsns       []string
+	active     int
+	generation uint64
+}
+
+// NewDBConnector returns a DBConnector for the database URIs, the first of
+// which is active to begin with.
+func NewDBConnector(dsns ...string) *DBConnector {
+	c := &DBConnector{dsns: dsns}
+	c.updateActiveGauge()
+	return c
+}
+
+// uriHost returns the host of a database URI, for logs and metrics.
+func uriHost(dsn string) string {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// updateActiveGauge records which host is active. The caller must not hold
+// the lock for writing.
+func (c *DBConnector) updateActiveGauge() {
+	dsns, active := c.DSNs(), c.DSN()
+	for _, dsn := range dsns {
+		value := 0.0
+		if dsn == active {
+			value = 1
+		}
+		dbEndpointActive.Set(value, uriHost(dsn))
+	}
+}
+
+// DSN returns the active database URI.
+func (c *DBConnector) DSN() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dsns[c.active]
+}
+
+// DSNs returns all of the database URIs.
+func (c *DBConnector) DSNs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.dsns...)
+}
+
+// SetDSNs replaces the database URIs, such as when the credentials change,
+// keeping the same position in the list active. It returns false if the URIs
+// haven't changed.
+func (c *DBConnector) SetDSNs(dsns []string) bool {
+	c.mu.Lock()
+	if slices.Equal(dsns, c.dsns) {
+		c.mu.Unlock()
+		return false
+	}
+	c.dsns = append([]string(nil), dsns...)
+	if c.active >= len(c.dsns) {
+		c.active = 0
+	}
+	c.generation++
+	c.mu.Unlock()
+
+	c.updateActiveGauge()
+	return true
+}
+
+func (c *DBConnector) current() (int, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.active, c.generation
+}
+
+// switchTo makes the URI at index active, unless the URIs have changed since
+// the generation passed in. It returns the current generation.
+func (c *DBConnector) switchTo(index int, generation uint64) uint64 {
+	c.mu.Lock()
+	if c.generation != generation || c.active == index {
+		defer c.mu.Unlock()
+		return c.generation
+	}
+	from, to := uriHost(c.dsns[c.active]), uriHost(c.dsns[index])
+	c.active = index
+	c.generation++
+	generation = c.generation
+	c.mu.Unlock()
+
+	dbFailovers.Inc()
+	c.updateActiveGauge()
+	log.Warnf("database failover from %s to %s", from, to)
+	return generation
+}
+
+// openPostgres opens a connection to a database URI without wrapping it.
+func openPostgres(ctx context.Context, dsn string) (driver.Conn, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// Connect opens a connection using the active database URI, failing over to
+// the others in order if it can't be reached.
+func (c *DBConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsns := c.DSNs()
+	active, generation := c.current()
+
+	conn, err := openPostgres(ctx, dsns[active])
+	if err == nil {
+		return &generationConn{Conn: conn, connector: c, generation: generation}, nil
+	}
+	firstErr := err
+
+	for i := range dsns {
+		if i == active || ctx.Err() != nil {
+			continue
+		}
+		if conn, err = openPostgres(ctx, dsns[i]); err == nil {
+			generation = c.switchTo(i, generation)
+			return &generationConn{Conn: conn, connector: c, generation: generation}, nil
+		}
+	}
+	return nil, firstErr
+}
+
+// dbProbeTimeout limits how long probing each database URI may take.
+const dbProbeTimeout = 5 * time.Second
+
+// probe reports whether a database URI accepts connections.
+func probe(ctx context.Context, dsn string) bool {
+	ctx, cancel := context.WithTimeout(ctx, dbProbeTimeout)
+	defer cancel()
+
+	conn, err := openPostgres(ctx, dsn)
+	up := err == nil
+	if up {
+		if p, ok := conn.(driver.Pinger); ok {
+			up = p.Ping(ctx) == nil
+		}
+		conn.Close()
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	dbEndpointUp.Set(value, uriHost(dsn))
+	return up
+}
+
+// Probe checks every database URI and fails over from the active one if it's
+// down and another is up.
+func (c *DBConnector) Probe(ctx context.Context) {
+	dsns := c.DSNs()
+	active, generation := c.current()
+
+	up := make([]bool, len(dsns))
+	for i, dsn := range dsns {
+		up[i] = probe(ctx, dsn)
+	}
+	if up[active] {
+		return
+	}
+	for i := range dsns {
+		if up[i] {
+			c.switchTo(i, generation)
+			return
+		}
+	}
+}
+
+// Monitor probes the database URIs on an interval until the context is
+// canceled. It does nothing if there's only one URI.
+func (c *DBConnector) Monitor(ctx context.Context, interval time.Duration) {
+	if len(c.DSNs()) < 2 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.Probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Driver returns the Postgres driver.
+func (c *DBConnector) Driver() driver.Driver {
+	return &c.driver
+}
+
+// generationConn is a connection that's only valid as long as the database
+// URI it was opened with is current. It passes the optional interfaces that
+// database/sql uses through to the Postgres connection.
+type generationConn struct {
+	driver.Conn
+	connector  *DBConnector
+	generation uint64
+}
+
+// IsValid implements driver.Validator.
+func (c *generationConn) IsValid() bool {
+	_, generation := c.connector.current()
+	return generation == c.generation
+}
+
+func (c *generationConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *generationConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *generationConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *generationConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// CredentialWatcher picks up changes to the database credentials without a
+// restart. It re-reads the secret files every check interval and, on
+// SIGHUP, also resolves the secrets in vice.secrets.mappings again. New
+// credentials are tested with a connection before the pool switches to them.
+type CredentialWatcher struct {
+	cfg       *viper.Viper
+	secrets   *Secrets
+	connector *DBConnector
+	interval  time.Duration
+}
+
+// NewCredentialWatcher returns a CredentialWatcher for the connector.
+func NewCredentialWatcher(cfg *viper.Viper, secrets *Secrets, connector *DBConnector) *CredentialWatcher {
+	cfg.SetDefault("vice.db.credentials_check_interval", "30s")
+	return &CredentialWatcher{
+		cfg:       cfg,
+		secrets:   secrets,
+		connector: connector,
+		interval:  cfg.GetDuration("vice.db.credentials_check_interval"),
+	}
+}
+
+// Check works out the database URIs again and switches the pool to them if
+// they have changed and a test connection succeeds.
+func (w *CredentialWatcher) Check(ctx context.Context) error {
+	dsns, err := DatabaseURIs(w.cfg)
+	if err != nil {
+		return err
+	}
+	if slices.Equal(dsns, w.connector.DSNs()) {
+		return nil
+	}
+
+	// Any of the URIs accepting a connection shows that the credentials work.
+	for _, dsn := range dsns {
+		var conn driver.Conn
+		if conn, err = openPostgres(ctx, dsn); err == nil {
+			conn.Close()
+			break
+		}
+	}
+	if err != nil {
+		dbCredentialRotations.Inc("failure")
+		return errors.Wrap(err, "error connecting with the new database credentials")
+	}
+
+	if w.connector.SetDSNs(dsns) {
+		dbCredentialRotations.Inc("success")
+		log.Infof("switched to new database credentials for %s", redactedURI(w.connector.DSN()))
+	}
+	return nil
+}
+
+// Run checks the credentials every check interval, and whenever the process
+// receives SIGHUP, until the context is canceled.
+func (w *CredentialWatcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-hup:
+			log.Info("got SIGHUP, reloading the database credentials")
+			if err := w.secrets.Apply(ctx, w.cfg); err != nil {
+				log.Error(err)
+				continue
+			}
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := w.Check(checkCtx); err != nil {
+			log.Errorf("error checking the database credentials: %s", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var (
+	dbQueries = NewCounterVec(
+		"db_queries_total",
+		"Database queries run, by query name.",
+		"query",
+	)
+	dbQueryErrors = NewCounterVec(
+		"db_query_errors_total",
+		"Database queries that failed, by query name.",
+		"query",
+	)
+	dbQueryDuration = NewHistogramVec(
+		"db_query_duration_seconds",
+		"Time taken by database queries, by query name.",
+		DefaultBuckets,
+		"query",
+	)
+
+	dbPoolConnections = NewGaugeVec(
+		"db_pool_connections",
+		"Connections in the database pool as of the last sample, by pool and state (open, in_use, or idle).",
+		"pool", "state",
+	)
+	dbPoolMaxOpen = NewGaugeVec(
+		"db_pool_max_open_connections",
+		"Maximum number of open connections allowed in the database pool, or 0 for no limit.",
+		"pool",
+	)
+	dbPoolWaits = NewCounterVec(
+		"db_pool_waits_total",
+		"Times a query had to wait for a connection from the database pool.",
+		"pool",
+	)
+	dbPoolWaitDuration = NewCounterVec(
+		"db_pool_wait_seconds_total",
+		"Time spent waiting for connections from the database pool.",
+		"pool",
+	)
+	dbPoolClosed = NewCounterVec(
+		"db_pool_closed_connections_total",
+		"Connections closed by the database pool, by pool and reason (max_idle, max_idle_time, or max_lifetime).",
+		"pool", "reason",
+	)
+)
+
+// defaultPoolStatsInterval is how often database pool statistics are sampled
+// by default.
+const defaultPoolStatsInterval = 10 * time.Second
+
+// Names of the queries in the database metrics.
+const (
+	QueryAnalysisBySubdomain    = "analysis_by_subdomain"
+	QueryAnalysisByInvocationID = "analysis_by_invocation_id"
+	QueryAnalysisByID           = "analysis_by_id"
+	QueryActiveAnalyses         = "active_analyses"
+	QueryRecentLaunches         = "recent_launches"
+	QueryFlags                  = "flags"
+	QueryAuditInsert            = "audit_insert"
+	QueryAuditExport            = "audit_export"
+	QueryReplicaLag             = "replica_lag"
+	QuerySharedAnalyses         = "shared_analyses"
+	QueryUserByUsername         = "user_by_username"
+	QueryUserPreference         = "user_preference"
+	QuerySuspendedAnalyses      = "suspended_analyses"
+	QueryAppBranding            = "app_branding"
+	QueryStatsRollupUpsert      = "stats_rollup_upsert"
+	QueryStatsRollupPrune       = "stats_rollup_prune"
+	QueryStatsRollup            = "stats_rollup"
+	QueryAuditPrune             = "audit_prune"
+)
+
+// observeQuery records the outcome of a named query that started at start.
+// It's meant to be deferred with a pointer to the function's error result.
+// Not finding a row isn't counted as an error.
+func observeQuery(name string, start time.Time, err *error) {
+	dbQueries.Inc(name)
+	dbQueryDuration.Observe(time.Since(start).Seconds(), name)
+	if *err != nil && *err != sql.ErrNoRows {
+		dbQueryErrors.Inc(name)
+	}
+}
+
+// recordPoolStats exports the difference between two samples of a database
+// pool's statistics. database/sql keeps running totals, so the counters are
+// advanced by how much the totals grew since the previous sample.
+func recordPoolStats(pool string, prev, cur sql.DBStats) {
+	dbPoolConnections.Set(float64(cur.OpenConnections), pool, "open")
+	dbPoolConnections.Set(float64(cur.InUse), pool, "in_use")
+	dbPoolConnections.Set(float64(cur.Idle), pool, "idle")
+	dbPoolMaxOpen.Set(float64(cur.MaxOpenConnections), pool)
+	dbPoolWaits.Add(float64(cur.WaitCount-prev.WaitCount), pool)
+	dbPoolWaitDuration.Add((cur.WaitDuration - prev.WaitDuration).Seconds(), pool)
+	dbPoolClosed.Add(float64(cur.MaxIdleClosed-prev.MaxIdleClosed), pool, "max_idle")
+	dbPoolClosed.Add(float64(cur.MaxIdleTimeClosed-prev.MaxIdleTimeClosed), pool, "max_idle_time")
+	dbPoolClosed.Add(float64(cur.MaxLifetimeClosed-prev.MaxLifetimeClosed), pool, "max_lifetime")
+}
+
+// MonitorPool samples a database pool's statistics on the interval passed in
+// until the context is canceled, so that pool exhaustion shows up in the
+// metrics before it shows up as routing latency.
+func MonitorPool(ctx context.Context, pool string, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev sql.DBStats
+	for {
+		cur := db.Stats()
+		recordPoolStats(pool, prev, cur)
+		prev = cur
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queryCanceled is the Postgres error code for statements that were canceled,
+// which is how statement_timeout ends them.
+const queryCanceled = "57014"
+
+// isTimeout returns true if a query failed because it took too long, either
+// on the client or on the server.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == queryCanceled
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Routing outcomes.
+const (
+	OutcomeRedirect      = "redirect"
+	OutcomeNotFound      = "not_found"
+	OutcomeMaintenance   = "maintenance"
+	OutcomeEnded         = "ended"
+	OutcomeDeleted       = "deleted"
+	OutcomeTerminating   = "terminating"
+	OutcomeSuspended     = "suspended"
+	OutcomeWarning       = "warning"
+	OutcomeRetry         = "retry"
+	OutcomeWait          = "wait"
+	OutcomeUpstreamError = "upstream_error"
+	OutcomeLogin         = "login"
+	OutcomeForbidden     = "forbidden"
+	OutcomeError         = "error"
+)
+
+// Reasons for routing outcomes.
+const (
+	ReasonMaintenanceMode  = "maintenance_mode"
+	ReasonUnknownSubdomain = "unknown_subdomain"
+	ReasonLookupFailed     = "lookup_failed"
+	ReasonLookupTimeout    = "lookup_timeout"
+	ReasonAnalysisFound    = "analysis_found"
+	ReasonAnalysisEnded    = "analysis_ended"
+	ReasonAnalysisDeleted  = "analysis_deleted"
+	ReasonSavingOutputs    = "saving_outputs"
+	ReasonAnalysisPaused   = "analysis_paused"
+	ReasonQuotaSuspended   = "quota_suspended"
+	ReasonSharedAnalysis   = "shared_analysis"
+	ReasonNoSession        = "no_session"
+	ReasonNotValidated     = "not_validated"
+	ReasonBadAppURL        = "bad_app_url"
+	ReasonStateTokenFailed = "state_token_failed"
+	ReasonAppCrashed       = "app_crashed"
+	ReasonAppRestarting    = "app_restarting"
+	ReasonAppSlow          = "app_slow"
+	ReasonFromLoadingPage  = "from_loading_page"
+	ReasonHostNotAllowed   = "host_not_allowed"
+)
+
+// Final routing decisions, as reported by route_decisions_total. They're the
+// outcomes, with redirects named after where they send the client.
+const (
+	DecisionRedirectLoading = "redirect_loading"
+	DecisionRedirectLogin   = "redirect_login"
+	DecisionNotFound        = "not_found"
+	DecisionEnded           = "ended"
+	DecisionDeleted         = "deleted"
+	DecisionTerminating     = "terminating"
+	DecisionSuspended       = "suspended"
+	DecisionWarning         = "warning"
+	DecisionRetry           = "retry"
+	DecisionWaitPage        = "wait_page"
+	DecisionUpstreamError   = "upstream_error"
+	DecisionMaintenance     = "maintenance"
+	DecisionForbidden       = "forbidden"
+	DecisionError           = "error"
+)
+
+var routeDecisions = NewCounterVec(
+	"route_decisions_total",
+	"Routed requests by final decision and reason.",
+	"decision", "reason",
+)
+
+// recentDecisionsSize is the number of routing decisions kept in memory for
+// the admin dashboard.
+const recentDecisionsSize = 100
+
+// Decision records what the default backend did with a request.
+type Decision struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Subdomain  string    `json:"subdomain"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason"`
+	Variant    string    `json:"variant,omitempty"`
+	Location   string    `json:"location,omitempty"`
+	AnalysisID string    `json:"analysis_id,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	Visitor    string    `json:"visitor,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	ASN        uint64    `json:"asn,omitempty"`
+	Client     string    `json:"client"`
+	Final      string    `json:"decision,omitempty"`
+
+	// dryRun is set for decisions made to answer a lookup rather than to
+	// route a real request.
+	dryRun bool
+}
+
+// FinalDecision returns the final decision for the routing outcome.
+func (d *Decision) FinalDecision() string {
+	switch d.Outcome {
+	case OutcomeRedirect:
+		return DecisionRedirectLoading
+	case OutcomeLogin:
+		return DecisionRedirectLogin
+	case OutcomeNotFound:
+		return DecisionNotFound
+	case OutcomeEnded:
+		return DecisionEnded
+	case OutcomeDeleted:
+		return DecisionDeleted
+	case OutcomeTerminating:
+		return DecisionTerminating
+	case OutcomeSuspended:
+		return DecisionSuspended
+	case OutcomeWarning:
+		return DecisionWarning
+	case OutcomeRetry:
+		return DecisionRetry
+	case OutcomeWait:
+		return DecisionWaitPage
+	case OutcomeUpstreamError:
+		return DecisionUpstreamError
+	case OutcomeMaintenance:
+		return DecisionMaintenance
+	case OutcomeForbidden:
+		return DecisionForbidden
+	default:
+		return DecisionError
+	}
+}
+
+// Failed returns true if the request couldn't be routed as it should have
+// been because something went wrong, rather than because of the state of the
+// analysis.
+func (d *Decision) Failed() bool {
+	return d.Outcome == OutcomeError || d.LookupFailed()
+}
+
+// LookupFailed returns true if the subdomain lookup failed or timed out, so
+// the request was routed without validating the subdomain.
+func (d *Decision) LookupFailed() bool {
+	return d.Reason == ReasonLookupFailed || d.Reason == ReasonLookupTimeout
+}
+
+// DecisionLog keeps the most recent routing decisions.
+type DecisionLog struct {
+	mu        sync.Mutex
+	decisions []Decision
+	next      int
+}
+
+// NewDecisionLog returns a DecisionLog that holds up to size decisions.
+func NewDecisionLog(size int) *DecisionLog {
+	return &DecisionLog{decisions: make([]Decision, 0, size)}
+}
+
+// Add records a decision, replacing the oldest one if the log is full.
+func (l *DecisionLog) Add(d Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.decisions) < cap(l.decisions) {
+		l.decisions = append(l.decisions, d)
+		return
+	}
+	l.decisions[l.next] = d
+	l.next = (l.next + 1) % len(l.decisions)
+}
+
+// Recent returns the recorded decisions, newest first.
+func (l *DecisionLog) Recent() []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.decisions)
+	recent := make([]Decision, n)
+	for i := 0; i < n; i++ {
+		recent[i] = l.decisions[(l.next-1-i+2*n)%n]
+	}
+	return recent
+}
+
+// rateWindow is the number of seconds the request rate is averaged over.
+const rateWindow = 60
+
+// RateCounter tracks the number of events per second over a sliding window.
+type RateCounter struct {
+	mu      sync.Mutex
+	buckets [rateWindow]int
+	seconds [rateWindow]int64
+}
+
+// Inc records an event that happened now.
+func (c *RateCounter) Inc() {
+	now := time.Now().Unix()
+	i := now % rateWindow
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seconds[i] != now {
+		c.seconds[i] = now
+		c.buckets[i] = 0
+	}
+	c.buckets[i]++
+}
+
+// PerSecond returns the average number of events per second over the window.
+func (c *RateCounter) PerSecond() float64 {
+	now := time.Now().Unix()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := 0
+	for i := range c.buckets {
+		if now-c.seconds[i] < rateWindow {
+			total += c.buckets[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
+
+// recordDecision updates the metrics and in-memory state that track routing
+// decisions.
+func (a *App) recordDecision(d Decision) {
+	d.Time = time.Now()
+	d.Final = d.FinalDecision()
+	routeOutcomes.Inc(d.Variant, d.Outcome)
+	routeDecisions.Inc(d.Final, d.Reason)
+	log.WithFields(logrus.Fields{
+		"decision":    d.Final,
+		"reason_code": d.Reason,
+		"host":        d.Host,
+		"subdomain":   d.Subdomain,
+		"variant":     d.Variant,
+		"location":    d.Location,
+		"analysis_id": d.AnalysisID,
+		"user":        d.Visitor,
+		"client":      d.Client,
+		"country":     d.Country,
+		"asn":         d.ASN,
+	}).Info("routed request")
+	requestsByClientClass.Inc(d.Client)
+	if a.geoip != nil {
+		country := d.Country
+		if country == "" {
+			country = "unknown"
+		}
+		requestsByCountry.Inc(country)
+	}
+	a.decisions.Add(d)
+	a.stats.Record(d)
+	a.unknownSubdomains.Record(d)
+	if a.rollup != nil {
+		a.rollup.Record(d)
+	}
+	if a.audit != nil {
+		a.audit.Record(d)
+	}
+	if a.alerts != nil {
+		a.alerts.Observe(d)
+	}
+	if a.emitters != nil {
+		a.emitters.Observe(d)
+	}
+	a.requestRate.Inc()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Defaults for the deep link settings.
+const (
+	defaultDeepLinkCookie = "vice_deep_link"
+	defaultDeepLinkMaxAge = 10 * time.Minute
+)
+
+// DeepLinks remembers the path and query that were originally requested on an
+// app's subdomain in a short-lived cookie before the request is sent to the
+// loading page. When the user comes back to the root of the app, whether to
+// the default backend while the app is still starting or to the app itself,
+// the deep link can be restored from the cookie.
+type DeepLinks struct {
+	cookie string
+	maxAge time.Duration
+}
+
+// NewDeepLinks returns a DeepLinks configured from the
+// vice.default_backend.deep_link section of the config, or nil if
+// vice.default_backend.deep_link.enabled isn't set.
+func NewDeepLinks(cfg *viper.Viper) *DeepLinks {
+	cfg.SetDefault("vice.default_backend.deep_link.cookie", defaultDeepLinkCookie)
+	cfg.SetDefault("vice.default_backend.deep_link.max_age", defaultDeepLinkMaxAge)
+
+	if !cfg.GetBool("vice.default_backend.deep_link.enabled") {
+		return nil
+	}
+	return &DeepLinks{
+		cookie: cfg.GetString("vice.default_backend.deep_link.cookie"),
+		maxAge: cfg.GetDuration("vice.default_backend.deep_link.max_age"),
+	}
+}
+
+// isRoot returns true if the request is for the root of the app without a
+// query string.
+func isRoot(r *http.Request) bool {
+	return (r.URL.Path == "" || r.URL.Path == "/") && r.URL.RawQuery == ""
+}
+
+// Handle returns the request with the remembered deep link restored if it's
+// for the root of the app. Otherwise, it remembers the requested path and
+// query in the cookie and returns the request unchanged.
+func (d *DeepLinks) Handle(w http.ResponseWriter, r *http.Request) *http.Request {
+	if isRoot(r) {
+		c, err := r.Cookie(d.cookie)
+		if err != nil {
+			return r
+		}
+		link, err := url.QueryUnescape(c.Value)
+		// Only paths on the same host are restored, so that the cookie can't
+		// be used to send users elsewhere.
+		if err != nil || !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+			return r
+		}
+		restored, err := url.ParseRequestURI(link)
+		if err != nil {
+			return r
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath, r.URL.RawQuery = restored.Path, restored.RawPath, restored.RawQuery
+		return r
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     d.cookie,
+		Value:    url.QueryEscape(r.URL.RequestURI()),
+		Path:     "/",
+		MaxAge:   int(d.maxAge.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return r
+}
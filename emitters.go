@@ -0,0 +1,289 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/cyverse-de/vice-default-backend/events"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Emitter types, as set in vice.default_backend.emitters.
+const (
+	EmitterWebhook = "webhook"
+	EmitterAMQP    = "amqp"
+	EmitterNATS    = "nats"
+	EmitterLog     = "log"
+	EmitterNoop    = "noop"
+)
+
+// Defaults for the emitter settings.
+const (
+	defaultEmitterTimeout        = 5 * time.Second
+	defaultRoutingEventsPrefix   = "vice.routing"
+	legacyRoutingEventsEmitter   = "routing_events"
+	legacyWebhookRoutedEventType = "routed"
+)
+
+var emittedEvents = NewCounterVec(
+	"emitted_events_total",
+	"Routing events handed to the event emitters, by emitter, event type, and result.",
+	"emitter", "event", "result",
+)
+
+// routingEventTypes are the event types of routing events, which are the
+// routing outcomes.
+var routingEventTypes = map[string]bool{
+	OutcomeRedirect:      true,
+	OutcomeNotFound:      true,
+	OutcomeMaintenance:   true,
+	OutcomeEnded:         true,
+	OutcomeDeleted:       true,
+	OutcomeTerminating:   true,
+	OutcomeSuspended:     true,
+	OutcomeWarning:       true,
+	OutcomeRetry:         true,
+	OutcomeWait:          true,
+	OutcomeUpstreamError: true,
+	OutcomeLogin:         true,
+	OutcomeForbidden:     true,
+	OutcomeError:         true,
+}
+
+// legacyWebhookEventTypes are the event types sent to the targets in
+// vice.default_backend.webhooks.targets that don't list their events.
+var legacyWebhookEventTypes = []string{OutcomeRedirect, OutcomeNotFound, OutcomeMaintenance}
+
+// RoutingEvent is the body of the event emitted for a routing decision.
+type RoutingEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Subdomain  string    `json:"subdomain"`
+	AnalysisID string    `json:"analysis_id,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	Decision   string    `json:"decision"`
+	Reason     string    `json:"reason"`
+	Variant    string    `json:"variant,omitempty"`
+	Location   string    `json:"location,omitempty"`
+	Client     string    `json:"client"`
+}
+
+// emitterConfig is the format of an entry in vice.default_backend.emitters.
+// URL is the webhook URL, or the AMQP or NATS server's URL. Prefix starts the
+// AMQP routing keys or NATS subjects.
+type emitterConfig struct {
+	Type         string
+	Name         string
+	Events       []string
+	URL          string
+	Secret       string
+	Exchange     string
+	Prefix       string
+	QueueSize    int           `mapstructure:"queue_size"`
+	MaxAttempts  int           `mapstructure:"max_attempts"`
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	Timeout      time.Duration
+}
+
+// Emitters publishes an event for each routing decision to the configured
+// emitters, such as webhooks, the DE's AMQP exchange, or NATS. Each emitter
+// has its own queue and retries, so that a slow one doesn't hold up the
+// others, and events are dropped when an emitter's queue is full.
+type Emitters struct {
+	emitter events.Multi
+
+	// brokers are the emitters that publish to a message broker, which are
+	// checked as dependencies.
+	brokers []*events.Pipeline
+}
+
+// NewEmitters returns an Emitters configured from vice.default_backend.emitters,
+// along with the webhook targets in vice.default_backend.webhooks.targets and
+// the AMQP publisher turned on by vice.default_backend.routing_events.enabled.
+// It returns nil if none of them are configured.
+func NewEmitters(cfg *viper.Viper) (*Emitters, error) {
+	var configured []emitterConfig
+	if err := cfg.UnmarshalKey("vice.default_backend.emitters", &configured); err != nil {
+		return nil, errors.Wrap(err, "cannot parse vice.default_backend.emitters")
+	}
+	webhooks, err := legacyWebhookEmitters(cfg)
+	if err != nil {
+		return nil, err
+	}
+	configured = append(configured, webhooks...)
+	if amqp := legacyRoutingEventsEmitterConfig(cfg); amqp != nil {
+		configured = append(configured, *amqp)
+	}
+	if len(configured) == 0 {
+		return nil, nil
+	}
+
+	e := &Emitters{}
+	for _, c := range configured {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		pipeline, err := newEmitter(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "emitter %s", c.Name)
+		}
+		if pipeline == nil {
+			continue
+		}
+		e.emitter = append(e.emitter, pipeline)
+		if c.Type == EmitterAMQP || c.Type == EmitterNATS {
+			e.brokers = append(e.brokers, pipeline)
+		}
+	}
+	return e, nil
+}
+
+// newEmitter returns the pipeline for an emitter, or nil for a no-op
+// emitter.
+func newEmitter(c emitterConfig) (*events.Pipeline, error) {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultEmitterTimeout
+	}
+	if c.Prefix == "" {
+		c.Prefix = defaultRoutingEventsPrefix
+	}
+
+	var (
+		sink events.Sink
+		err  error
+	)
+	switch c.Type {
+	case EmitterWebhook:
+		sink, err = events.NewWebhookSink(c.URL, c.Secret, c.Timeout)
+	case EmitterAMQP:
+		if c.URL == "" {
+			return nil, errors.New("an AMQP emitter needs a url")
+		}
+		if c.Exchange == "" {
+			c.Exchange = defaultEventsExchange
+		}
+		sink = events.NewAMQPSink(c.URL, c.Exchange, c.Prefix)
+	case EmitterNATS:
+		sink, err = events.NewNATSSink(c.URL, c.Prefix, c.Timeout)
+	case EmitterLog:
+		sink = events.NewLogSink(log)
+	case EmitterNoop:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unknown emitter type %q", c.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]bool)
+	for _, eventType := range c.Events {
+		if eventType == legacyWebhookRoutedEventType {
+			eventType = OutcomeRedirect
+		}
+		if !routingEventTypes[eventType] {
+			return nil, errors.Errorf("unknown event %q", eventType)
+		}
+		types[eventType] = true
+	}
+
+	return events.NewPipeline(sink, events.Options{
+		Name:         c.Name,
+		Types:        types,
+		QueueSize:    c.QueueSize,
+		MaxAttempts:  c.MaxAttempts,
+		RetryBackoff: c.RetryBackoff,
+		Observe: func(name, eventType, result string) {
+			emittedEvents.Inc(name, eventType, result)
+		},
+		Log: log,
+	}), nil
+}
+
+// legacyWebhookEmitters returns the emitters for the targets in
+// vice.default_backend.webhooks.targets, which share the settings in
+// vice.default_backend.webhooks.
+func legacyWebhookEmitters(cfg *viper.Viper) ([]emitterConfig, error) {
+	cfg.SetDefault("vice.default_backend.webhooks.queue_size", events.DefaultQueueSize)
+	cfg.SetDefault("vice.default_backend.webhooks.max_attempts", events.DefaultMaxAttempts)
+	cfg.SetDefault("vice.default_backend.webhooks.retry_backoff", events.DefaultRetryBackoff)
+	cfg.SetDefault("vice.default_backend.webhooks.timeout", defaultEmitterTimeout)
+
+	var targets []emitterConfig
+	if err := cfg.UnmarshalKey("vice.default_backend.webhooks.targets", &targets); err != nil {
+		return nil, errors.Wrap(err, "cannot parse vice.default_backend.webhooks.targets")
+	}
+	if cfg.GetInt("vice.default_backend.webhooks.max_attempts") < 1 {
+		return nil, errors.New("vice.default_backend.webhooks.max_attempts must be at least 1")
+	}
+	for i := range targets {
+		t := &targets[i]
+		t.Type = EmitterWebhook
+		if t.Name == "" {
+			if u, err := url.Parse(t.URL); err == nil {
+				t.Name = u.Host
+			}
+		}
+		if len(t.Events) == 0 {
+			t.Events = legacyWebhookEventTypes
+		}
+		t.QueueSize = cfg.GetInt("vice.default_backend.webhooks.queue_size")
+		t.MaxAttempts = cfg.GetInt("vice.default_backend.webhooks.max_attempts")
+		t.RetryBackoff = cfg.GetDuration("vice.default_backend.webhooks.retry_backoff")
+		t.Timeout = cfg.GetDuration("vice.default_backend.webhooks.timeout")
+	}
+	return targets, nil
+}
+
+// legacyRoutingEventsEmitterConfig returns the AMQP emitter turned on by
+// vice.default_backend.routing_events.enabled, or nil if it isn't. The broker
+// defaults to the one the job status updates come from.
+func legacyRoutingEventsEmitterConfig(cfg *viper.Viper) *emitterConfig {
+	cfg.SetDefault("vice.default_backend.routing_events.amqp.exchange", defaultEventsExchange)
+	cfg.SetDefault("vice.default_backend.routing_events.amqp.routing_key_prefix", defaultRoutingEventsPrefix)
+	cfg.SetDefault("vice.default_backend.routing_events.queue_size", events.DefaultQueueSize)
+
+	if !cfg.GetBool("vice.default_backend.routing_events.enabled") {
+		return nil
+	}
+	uri := cfg.GetString("vice.default_backend.routing_events.amqp.uri")
+	if uri == "" {
+		uri = cfg.GetString("vice.default_backend.events.amqp.uri")
+	}
+	return &emitterConfig{
+		Type:      EmitterAMQP,
+		Name:      legacyRoutingEventsEmitter,
+		URL:       uri,
+		Exchange:  cfg.GetString("vice.default_backend.routing_events.amqp.exchange"),
+		Prefix:    cfg.GetString("vice.default_backend.routing_events.amqp.routing_key_prefix"),
+		QueueSize: cfg.GetInt("vice.default_backend.routing_events.queue_size"),
+	}
+}
+
+// Observe emits the event for a routing decision.
+func (e *Emitters) Observe(d Decision) {
+	event := events.New(d.Outcome, d.Time, nil)
+	event.Data = &RoutingEvent{
+		ID:         event.ID,
+		Type:       event.Type,
+		Time:       d.Time,
+		Host:       d.Host,
+		Subdomain:  d.Subdomain,
+		AnalysisID: d.AnalysisID,
+		Username:   d.Username,
+		Decision:   d.Final,
+		Reason:     d.Reason,
+		Variant:    d.Variant,
+		Location:   d.Location,
+		Client:     d.Client,
+	}
+	e.emitter.Emit(event)
+}
+
+// Brokers returns the emitters that publish to a message broker.
+func (e *Emitters) Brokers() []*events.Pipeline {
+	return e.brokers
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+var jobEvents = NewCounterVec(
+	"job_events_total",
+	"Job status updates consumed from AMQP, by result.",
+	"result",
+)
+
+// Defaults for the job status event settings.
+const (
+	defaultEventsExchange   = "de"
+	defaultEventsRoutingKey = "jobs.updates"
+	defaultEventsTTL        = time.Hour
+	eventsReconnectInterval = 10 * time.Second
+)
+
+// maxTrackedJobs bounds the number of jobs JobEvents remembers. Jobs are
+// forgotten once they end, so this is only reached if end updates are lost,
+// and then they're all forgotten at once.
+const maxTrackedJobs = 10000
+
+const analysisByInvocationIDQuery = `
+	SELECT` + analysisColumns + analysisTables + `
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE s.external_id = $1
+	 LIMIT 1
+`
+
+// jobUpdate is the subset of the job status update messages published by the
+// job status listener that's used here.
+type jobUpdate struct {
+	Job struct {
+		InvocationID string `json:"uuid"`
+	} `json:"Job"`
+	State   string `json:"State"`
+	Message string `json:"Message"`
+}
+
+// jobStatuses are the job update states that correspond to job statuses in
+// the database. Other states, such as ImpendingCancellation, leave the
+// status alone.
+var jobStatuses = map[string]bool{
+	"Submitted": true,
+	"Queued":    true,
+	"Running":   true,
+	"Completed": true,
+	"Failed":    true,
+	"Canceled":  true,
+}
+
+// trackedJob is what JobEvents remembers about a job from its first update.
+// The subdomain is empty for jobs that aren't VICE analyses.
+type trackedJob struct {
+	analysisID string
+	subdomain  string
+}
+
+// JobEvents keeps the lookup cache up to date from the job status updates on
+// the DE's AMQP exchange. Each update for a VICE analysis refreshes the cache
+// entry for its subdomain, so VICE subdomains that are launched, start
+// running, or end are known without waiting for a lookup or the next full
+// load.
+//
+// The first update for a job looks the job up in the database, and the job
+// is remembered until it ends. Later updates for it are applied to the cached
+// analysis without a query, and updates for jobs that aren't VICE analyses
+// are skipped, so the database is only queried when a job is new or its
+// subdomain's entry isn't cached.
+type JobEvents struct {
+	uri        string
+	exchange   string
+	routingKey string
+	queue      string
+	ttl        time.Duration
+	db         queryer
+	cache      *LookupCache
+	connected  atomic.Bool
+	lastUpdate atomic.Int64
+
+	// jobs is only used by the consuming goroutine.
+	jobs map[string]trackedJob
+}
+
+// NewJobEvents returns a JobEvents configured from the
+// vice.default_backend.events section of the config, or nil if
+// vice.default_backend.events.amqp.uri isn't set.
+func NewJobEvents(cfg *viper.Viper, db queryer, cache *LookupCache) (*JobEvents, error) {
+	cfg.SetDefault("vice.default_backend.events.amqp.exchange", defaultEventsExchange)
+	cfg.SetDefault("vice.default_backend.events.amqp.routing_key", defaultEventsRoutingKey)
+	cfg.SetDefault("vice.default_backend.events.ttl", defaultEventsTTL)
+
+	uri := cfg.GetString("vice.default_backend.events.amqp.uri")
+	if uri == "" {
+		return nil, nil
+	}
+	if cache == nil {
+		return nil, errors.New("vice.default_backend.events requires vice.default_backend.cache.enabled")
+	}
+
+	return &JobEvents{
+		uri:        uri,
+		exchange:   cfg.GetString("vice.default_backend.events.amqp.exchange"),
+		routingKey: cfg.GetString("vice.default_backend.events.amqp.routing_key"),
+		queue:      cfg.GetString("vice.default_backend.events.amqp.queue"),
+		ttl:        cfg.GetDuration("vice.default_backend.events.ttl"),
+		db:         db,
+		cache:      cache,
+		jobs:       make(map[string]trackedJob),
+	}, nil
+}
+
+// Run consumes job status updates until the context is canceled,
+// reconnecting after errors.
+func (e *JobEvents) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := e.consume(ctx); err != nil {
+			log.Errorf("error consuming job status updates: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(eventsReconnectInterval):
+		}
+	}
+}
+
+// consume connects to the broker and handles updates until the connection
+// closes or the context is canceled.
+func (e *JobEvents) consume(ctx context.Context) error {
+	conn, err := amqp.Dial(e.uri)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to AMQP")
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return errors.Wrap(err, "error opening an AMQP channel")
+	}
+
+	if err = ch.ExchangeDeclare(e.exchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "error declaring the %s exchange", e.exchange)
+	}
+
+	// Without a configured name, each replica gets its own exclusive queue
+	// that goes away when it disconnects, since every replica needs every
+	// update.
+	durable, exclusive := e.queue != "", e.queue == ""
+	q, err := ch.QueueDeclare(e.queue, durable, !durable, exclusive, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "error declaring the job updates queue")
+	}
+	if err = ch.QueueBind(q.Name, e.routingKey, e.exchange, false, nil); err != nil {
+		return errors.Wrap(err, "error binding the job updates queue")
+	}
+
+	deliveries, err := ch.Consume(q.Name, "", true, exclusive, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "error consuming job updates")
+	}
+	log.Infof("consuming job status updates from %s with routing key %s", e.exchange, e.routingKey)
+	e.connected.Store(true)
+	defer e.connected.Store(false)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("the AMQP channel was closed")
+			}
+			e.handle(ctx, d.Body)
+		}
+	}
+}
+
+// handle refreshes the cache entry for the analysis in an update.
+func (e *JobEvents) handle(ctx context.Context, body []byte) {
+	e.lastUpdate.Store(time.Now().UnixNano())
+	var update jobUpdate
+	if err := json.Unmarshal(body, &update); err != nil || update.Job.InvocationID == "" {
+		jobEvents.Inc("invalid")
+		return
+	}
+
+	id := update.Job.InvocationID
+	if update.State == "Completed" || update.State == "Failed" || update.State == "Canceled" {
+		defer delete(e.jobs, id)
+	}
+
+	job, tracked := e.jobs[id]
+	if tracked && job.subdomain == "" {
+		jobEvents.Inc("not_vice")
+		return
+	}
+	var analysis *Analysis
+	if tracked {
+		if cached, _ := e.cache.Peek(job.subdomain); cached != nil && cached.ID == job.analysisID {
+			copied := *cached
+			analysis = &copied
+		}
+	}
+	if analysis == nil {
+		var err error
+		if analysis, err = e.lookup(ctx, id); err != nil {
+			return
+		}
+		if len(e.jobs) >= maxTrackedJobs {
+			e.jobs = make(map[string]trackedJob)
+		}
+		e.jobs[id] = trackedJob{analysisID: analysis.ID, subdomain: analysis.Subdomain}
+		if analysis.Subdomain == "" {
+			jobEvents.Inc("not_vice")
+			return
+		}
+	}
+
+	// The update may arrive before the database reflects it. Taking the
+	// status from the update means an analysis that ended gets the ended page
+	// right away instead of being redirected to the loading page until its
+	// entry expires.
+	if jobStatuses[update.State] {
+		analysis.Status = update.State
+		analysis.LastMessage = update.Message
+	}
+	if !e.cache.Update(analysis, e.ttl) {
+		jobEvents.Inc("superseded")
+		return
+	}
+	jobEvents.Inc("applied")
+	log.Debugf("job %s for subdomain %s is %s", id, analysis.Subdomain, analysis.Status)
+}
+
+// lookup returns the analysis for a job from the database. Failures are
+// counted and logged.
+func (e *JobEvents) lookup(ctx context.Context, invocationID string) (*Analysis, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	analysis, err := scanAnalysis(e.db.QueryRowContext(ctx, analysisByInvocationIDQuery, invocationID))
+	observeQuery(QueryAnalysisByInvocationID, start, &err)
+	switch {
+	case err == sql.ErrNoRows:
+		jobEvents.Inc("unknown_job")
+	case err != nil:
+		log.Errorf("error looking up the analysis for job %s: %s", invocationID, err)
+		jobEvents.Inc("error")
+	}
+	return analysis, err
+}
+
+// Check reports whether updates are being consumed from the broker.
+func (e *JobEvents) Check() (string, error) {
+	if !e.connected.Load() {
+		return "", errors.New("not connected to the AMQP broker")
+	}
+	last := e.lastUpdate.Load()
+	if last == 0 {
+		return "connected, no updates yet", nil
+	}
+	return "connected, last update at " + time.Unix(0, last).Format(time.RFC3339), nil
+}
@@ -0,0 +1,80 @@
+package events
+
+import (
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// AMQPSink publishes events to a topic exchange. The routing key is the
+// prefix followed by a period and the event type, so that consumers can bind
+// to the types they want. It connects when the first event is sent, and
+// again after the connection fails.
+//
+// Unlike the other sinks, it uses a client library, github.com/streadway/amqp,
+// which the job status consumer and the other DE services use as well. AMQP
+// 0-9-1 is a binary, stateful protocol with channels, heartbeats, and flow
+// control, so a hand-written client wouldn't stay small the way the NATS one
+// does.
+type AMQPSink struct {
+	uri       string
+	exchange  string
+	keyPrefix string
+	conn      *amqp.Connection
+	ch        *amqp.Channel
+}
+
+// NewAMQPSink returns an AMQPSink that publishes to the exchange on the
+// broker at the URI.
+func NewAMQPSink(uri, exchange, keyPrefix string) *AMQPSink {
+	return &AMQPSink{uri: uri, exchange: exchange, keyPrefix: keyPrefix}
+}
+
+// connect connects to the broker and declares the exchange.
+func (s *AMQPSink) connect() error {
+	conn, err := amqp.Dial(s.uri)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to AMQP")
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "error opening an AMQP channel")
+	}
+	if err = ch.ExchangeDeclare(s.exchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "error declaring the %s exchange", s.exchange)
+	}
+	s.conn, s.ch = conn, ch
+	return nil
+}
+
+// close drops the connection, so that the next event reconnects.
+func (s *AMQPSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.ch = nil, nil
+}
+
+// Send publishes an event. Failures are retryable, and reconnect.
+func (s *AMQPSink) Send(e *Event, body []byte) error {
+	if s.conn == nil || s.conn.IsClosed() {
+		s.close()
+		if err := s.connect(); err != nil {
+			return Retryable(err)
+		}
+	}
+	err := s.ch.Publish(s.exchange, s.keyPrefix+"."+e.Type, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Transient,
+		MessageId:    e.ID,
+		Timestamp:    e.Time,
+		Type:         e.Type,
+		Body:         body,
+	})
+	if err != nil {
+		s.close()
+		return Retryable(errors.Wrap(err, "error publishing to AMQP"))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Package events publishes what happens in the VICE default backend to other
+// systems. An Emitter takes events; the Pipeline emitter queues them and
+// hands them to a Sink in the background, retrying failed deliveries and
+// dropping events rather than blocking when the queue is full. Sinks post
+// events to webhooks, publish them to AMQP or NATS, or log them.
+//
+// Events are encoded as JSON once and sent to every sink in the same form.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Event is something that happened.
+type Event struct {
+	// ID identifies the event. It stays the same across retries, so that
+	// receivers can ignore duplicates.
+	ID string
+
+	// Type is the kind of event. It's used to choose which sinks get the
+	// event, and sinks that route messages put it at the end of the subject
+	// or routing key.
+	Type string
+
+	Time time.Time
+
+	// Data is encoded as JSON to make the body of the message.
+	Data interface{}
+}
+
+// New returns an event with a random ID.
+func New(eventType string, t time.Time, data interface{}) *Event {
+	return &Event{ID: NewID(), Type: eventType, Time: t, Data: data}
+}
+
+// NewID returns a random event ID, as 32 hex digits.
+func NewID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// Emitter takes events to be published. Emit doesn't block on the
+// destination.
+type Emitter interface {
+	Emit(e *Event)
+}
+
+// Nop is an Emitter that discards events.
+type Nop struct{}
+
+// Emit discards the event.
+func (Nop) Emit(*Event) {}
+
+// Multi is an Emitter that hands events to each of its emitters.
+type Multi []Emitter
+
+// Emit hands the event to each emitter.
+func (m Multi) Emit(e *Event) {
+	for _, emitter := range m {
+		emitter.Emit(e)
+	}
+}
+
+// retryableError marks a failed delivery that's worth retrying.
+type retryableError struct {
+	error
+}
+
+// Retryable marks an error returned by a Sink as worth retrying, such as a
+// network error or an overloaded receiver.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+// IsRetryable returns whether a delivery that failed with the error is worth
+// retrying.
+func IsRetryable(err error) bool {
+	_, ok := errors.Cause(err).(retryableError)
+	return ok
+}
@@ -0,0 +1,177 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultNATSPort is used for NATS URLs without a port.
+const defaultNATSPort = "4222"
+
+// natsInfo is the part of the server's INFO message that's used here.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsConnect is the CONNECT message sent to the server.
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// NATSSink publishes events to a NATS server with the core protocol. The
+// subject is the prefix followed by a period and the event type. Each
+// publication is followed by a PING, and only counts as sent once the
+// server's PONG arrives, so that permission errors and dead connections are
+// noticed. It connects when the first event is sent, and again after the
+// connection fails.
+//
+// The URL's scheme is nats, or tls to require TLS. Credentials in the URL are
+// sent as a user and password, or as a token when there's no password.
+type NATSSink struct {
+	url           *url.URL
+	subjectPrefix string
+	timeout       time.Duration
+	conn          net.Conn
+	r             *bufio.Reader
+}
+
+// NewNATSSink returns a NATSSink that publishes to the server at the URL.
+func NewNATSSink(u, subjectPrefix string, timeout time.Duration) (*NATSSink, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "nats" && parsed.Scheme != "tls") || parsed.Host == "" {
+		return nil, errors.Errorf("%q isn't a nats:// or tls:// URL", u)
+	}
+	return &NATSSink{url: parsed, subjectPrefix: subjectPrefix, timeout: timeout}, nil
+}
+
+// connect connects to the server and waits for it to accept the CONNECT
+// message.
+func (s *NATSSink) connect() error {
+	host := s.url.Host
+	if s.url.Port() == "" {
+		host = net.JoinHostPort(s.url.Hostname(), defaultNATSPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, s.timeout)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to NATS")
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return errors.Errorf("unexpected greeting from NATS: %q", line)
+	}
+	var info natsInfo
+	if err = json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return errors.Wrap(err, "error parsing the NATS server info")
+	}
+
+	secure := s.url.Scheme == "tls" || info.TLSRequired
+	if secure {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: s.url.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			return errors.Wrap(err, "error starting TLS with NATS")
+		}
+		s.conn, s.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	msg := natsConnect{TLSRequired: secure, Name: "vice-default-backend", Lang: "go", Version: "1"}
+	if user := s.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			msg.User, msg.Pass = user.Username(), pass
+		} else {
+			msg.AuthToken = user.Username()
+		}
+	}
+	connect, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	if _, err = s.conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		return errors.Wrap(err, "error sending CONNECT to NATS")
+	}
+	return s.waitForPong()
+}
+
+// close drops the connection, so that the next event reconnects.
+func (s *NATSSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.r = nil, nil
+}
+
+// readLine reads a protocol line without the line ending.
+func (s *NATSSink) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(err, "error reading from NATS")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// waitForPong reads until the server's PONG, answering its PINGs. An error
+// from the server before then is returned.
+func (s *NATSSink) waitForPong() error {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return errors.Wrap(err, "error answering a NATS PING")
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.Errorf("NATS returned an error: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+	}
+}
+
+// Send publishes an event. Failures are retryable, and reconnect.
+func (s *NATSSink) Send(e *Event, body []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			s.close()
+			return Retryable(err)
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	var msg []byte
+	msg = append(msg, "PUB "+s.subjectPrefix+"."+e.Type+" "+strconv.Itoa(len(body))+"\r\n"...)
+	msg = append(msg, body...)
+	msg = append(msg, "\r\nPING\r\n"...)
+	if _, err := s.conn.Write(msg); err != nil {
+		s.close()
+		return Retryable(errors.Wrap(err, "error publishing to NATS"))
+	}
+	if err := s.waitForPong(); err != nil {
+		s.close()
+		return Retryable(err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Delivery results passed to Options.Observe.
+const (
+	ResultSent    = "sent"
+	ResultRetried = "retried"
+	ResultFailed  = "failed"
+	ResultDropped = "dropped"
+)
+
+// Defaults for the pipeline options.
+const (
+	DefaultQueueSize    = 1024
+	DefaultMaxAttempts  = 3
+	DefaultRetryBackoff = time.Second
+)
+
+// Sink delivers encoded events to a destination. Send is only called from the
+// pipeline's goroutine, one event at a time. Errors wrapped with Retryable
+// are retried.
+type Sink interface {
+	Send(e *Event, body []byte) error
+}
+
+// Options configure a Pipeline.
+type Options struct {
+	// Name identifies the pipeline in logs and to Observe.
+	Name string
+
+	// Types are the event types sent to the sink. Other events are ignored.
+	// If it's empty, every event is sent.
+	Types map[string]bool
+
+	// QueueSize is the number of events queued before new ones are
+	// dropped. Defaults to DefaultQueueSize.
+	QueueSize int
+
+	// MaxAttempts is how many times a delivery is attempted before the
+	// event is given up on. Defaults to DefaultMaxAttempts.
+	MaxAttempts int
+
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// retry after that. Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+
+	// Observe is called with the event type and the result of each
+	// delivery attempt, for metrics.
+	Observe func(name, eventType, result string)
+
+	// Log gets delivery errors. Defaults to the standard logger.
+	Log *logrus.Entry
+}
+
+// Pipeline is an Emitter that queues events for a sink and delivers them in
+// order in the background. Deliveries that fail with a retryable error are
+// retried with exponential backoff. If the queue fills up, because the
+// destination is down or slow, new events are dropped rather than holding up
+// the caller.
+type Pipeline struct {
+	sink  Sink
+	opts  Options
+	queue chan *Event
+
+	mu       sync.Mutex
+	lastSent time.Time
+	lastErr  error
+}
+
+// NewPipeline returns a Pipeline that delivers events to the sink, and starts
+// delivering them.
+func NewPipeline(sink Sink, opts Options) *Pipeline {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.Observe == nil {
+		opts.Observe = func(string, string, string) {}
+	}
+	if opts.Log == nil {
+		opts.Log = logrus.NewEntry(logrus.StandardLogger())
+	}
+	p := &Pipeline{sink: sink, opts: opts, queue: make(chan *Event, opts.QueueSize)}
+	go p.run()
+	return p
+}
+
+// Name returns the pipeline's name.
+func (p *Pipeline) Name() string {
+	return p.opts.Name
+}
+
+// Emit queues the event if the sink takes its type.
+func (p *Pipeline) Emit(e *Event) {
+	if len(p.opts.Types) > 0 && !p.opts.Types[e.Type] {
+		return
+	}
+	select {
+	case p.queue <- e:
+	default:
+		p.opts.Observe(p.opts.Name, e.Type, ResultDropped)
+	}
+}
+
+// run delivers the queued events, one at a time.
+func (p *Pipeline) run() {
+	for e := range p.queue {
+		body, err := json.Marshal(e.Data)
+		if err != nil {
+			p.opts.Log.Errorf("error encoding event %s for %s: %s", e.ID, p.opts.Name, err)
+			p.opts.Observe(p.opts.Name, e.Type, ResultFailed)
+			continue
+		}
+
+		delay := p.opts.RetryBackoff
+		for attempt := 1; ; attempt++ {
+			err = p.sink.Send(e, body)
+			p.record(err)
+			if err == nil {
+				p.opts.Observe(p.opts.Name, e.Type, ResultSent)
+				break
+			}
+			if !IsRetryable(err) || attempt >= p.opts.MaxAttempts {
+				p.opts.Log.Errorf("error sending event %s to %s after %d attempts: %s", e.ID, p.opts.Name, attempt, err)
+				p.opts.Observe(p.opts.Name, e.Type, ResultFailed)
+				break
+			}
+			p.opts.Observe(p.opts.Name, e.Type, ResultRetried)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// record keeps the result of the latest delivery attempt for Check.
+func (p *Pipeline) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err == nil {
+		p.lastSent = time.Now()
+	}
+}
+
+// Check reports whether the latest delivery attempt succeeded, for health
+// checks.
+func (p *Pipeline) Check() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastErr != nil {
+		return "", errors.Wrap(p.lastErr, "the last delivery failed")
+	}
+	if p.lastSent.IsZero() {
+		return "nothing sent yet", nil
+	}
+	return "last sent at " + p.lastSent.Format(time.RFC3339), nil
+}
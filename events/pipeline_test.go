@@ -0,0 +1,247 @@
+package events
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// sinkFunc is a Sink that calls the function.
+type sinkFunc func(e *Event, body []byte) error
+
+func (f sinkFunc) Send(e *Event, body []byte) error {
+	return f(e, body)
+}
+
+// observation is a call to Options.Observe.
+type observation struct {
+	eventType string
+	result    string
+}
+
+// newTestPipeline returns a pipeline for the sink, with its observations sent
+// to the channel returned along with it.
+func newTestPipeline(sink Sink, opts Options) (*Pipeline, <-chan observation) {
+	observed := make(chan observation, 100)
+	opts.Name = "test"
+	opts.Observe = func(name, eventType, result string) {
+		observed <- observation{eventType: eventType, result: result}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	opts.Log = logrus.NewEntry(logger)
+	return NewPipeline(sink, opts), observed
+}
+
+// expectObserved fails the test unless the next observations are the ones
+// passed in.
+func expectObserved(t *testing.T, observed <-chan observation, want ...observation) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-observed:
+			if got != w {
+				t.Fatalf("observed %+v, want %+v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %+v", w)
+		}
+	}
+}
+
+// expectNothingObserved fails the test if there's another observation.
+func expectNothingObserved(t *testing.T, observed <-chan observation) {
+	t.Helper()
+	select {
+	case got := <-observed:
+		t.Fatalf("observed %+v, want nothing", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPipelineDropsWhenFull(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	sink := sinkFunc(func(e *Event, body []byte) error {
+		started <- e.ID
+		<-release
+		return nil
+	})
+	p, observed := newTestPipeline(sink, Options{QueueSize: 1})
+
+	p.Emit(&Event{ID: "1", Type: "redirect"})
+	if id := <-started; id != "1" {
+		t.Fatalf("sent event %s first, want 1", id)
+	}
+
+	// The first event is being sent, so the second fills the queue and the
+	// third is dropped.
+	p.Emit(&Event{ID: "2", Type: "redirect"})
+	p.Emit(&Event{ID: "3", Type: "not_found"})
+	expectObserved(t, observed, observation{"not_found", ResultDropped})
+
+	close(release)
+	expectObserved(t, observed, observation{"redirect", ResultSent})
+	if id := <-started; id != "2" {
+		t.Fatalf("sent event %s second, want 2", id)
+	}
+	expectObserved(t, observed, observation{"redirect", ResultSent})
+	expectNothingObserved(t, observed)
+}
+
+func TestPipelineRetries(t *testing.T) {
+	errDown := errors.New("down")
+	tests := []struct {
+		name        string
+		maxAttempts int
+		errs        []error
+		want        []string
+	}{
+		{
+			name:        "sent first time",
+			maxAttempts: 3,
+			errs:        []error{nil},
+			want:        []string{ResultSent},
+		},
+		{
+			name:        "retryable then sent",
+			maxAttempts: 3,
+			errs:        []error{Retryable(errDown), Retryable(errDown), nil},
+			want:        []string{ResultRetried, ResultRetried, ResultSent},
+		},
+		{
+			name:        "wrapped retryable then sent",
+			maxAttempts: 3,
+			errs:        []error{pkgerrors.Wrap(Retryable(errDown), "sending"), nil},
+			want:        []string{ResultRetried, ResultSent},
+		},
+		{
+			name:        "retryable until out of attempts",
+			maxAttempts: 2,
+			errs:        []error{Retryable(errDown), Retryable(errDown)},
+			want:        []string{ResultRetried, ResultFailed},
+		},
+		{
+			name:        "not retryable",
+			maxAttempts: 3,
+			errs:        []error{errDown},
+			want:        []string{ResultFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const backoff = 20 * time.Millisecond
+			var (
+				mu       sync.Mutex
+				attempts []time.Time
+			)
+			sink := sinkFunc(func(e *Event, body []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, time.Now())
+				if len(attempts) > len(tt.errs) {
+					t.Errorf("attempt %d wasn't expected", len(attempts))
+					return nil
+				}
+				return tt.errs[len(attempts)-1]
+			})
+			p, observed := newTestPipeline(sink, Options{MaxAttempts: tt.maxAttempts, RetryBackoff: backoff})
+
+			p.Emit(&Event{ID: "1", Type: "redirect"})
+			for _, result := range tt.want {
+				expectObserved(t, observed, observation{"redirect", result})
+			}
+			expectNothingObserved(t, observed)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(attempts) != len(tt.errs) {
+				t.Fatalf("made %d attempts, want %d", len(attempts), len(tt.errs))
+			}
+			delay := backoff
+			for i := 1; i < len(attempts); i++ {
+				if gap := attempts[i].Sub(attempts[i-1]); gap < delay {
+					t.Errorf("attempt %d came %s after the one before, want at least %s", i+1, gap, delay)
+				}
+				delay *= 2
+			}
+
+			_, err := p.Check()
+			if last := tt.errs[len(tt.errs)-1]; (err == nil) != (last == nil) {
+				t.Errorf("Check returned %v after the last attempt returned %v", err, last)
+			}
+		})
+	}
+}
+
+func TestPipelineFiltersTypes(t *testing.T) {
+	sent := make(chan *Event, 10)
+	sink := sinkFunc(func(e *Event, body []byte) error {
+		sent <- e
+		return nil
+	})
+	p, observed := newTestPipeline(sink, Options{Types: map[string]bool{"redirect": true}})
+
+	// Events are delivered in order, so if the not_found event had been
+	// queued it would have been sent first.
+	p.Emit(&Event{ID: "1", Type: "not_found", Data: map[string]string{"subdomain": "a"}})
+	p.Emit(&Event{ID: "2", Type: "redirect", Data: map[string]string{"subdomain": "b"}})
+	expectObserved(t, observed, observation{"redirect", ResultSent})
+	expectNothingObserved(t, observed)
+
+	e := <-sent
+	if e.ID != "2" {
+		t.Fatalf("sent event %s, want 2", e.ID)
+	}
+	select {
+	case e := <-sent:
+		t.Fatalf("sent event %s, want only one", e.ID)
+	default:
+	}
+}
+
+func TestPipelineEncodesData(t *testing.T) {
+	bodies := make(chan string, 1)
+	sink := sinkFunc(func(e *Event, body []byte) error {
+		bodies <- string(body)
+		return nil
+	})
+	p, observed := newTestPipeline(sink, Options{})
+
+	p.Emit(&Event{ID: "1", Type: "redirect", Data: func() {}})
+	p.Emit(&Event{ID: "2", Type: "redirect", Data: map[string]string{"subdomain": "a"}})
+	expectObserved(t, observed,
+		observation{"redirect", ResultFailed},
+		observation{"redirect", ResultSent},
+	)
+	if body, want := <-bodies, `{"subdomain":"a"}`; body != want {
+		t.Errorf("sent %s, want %s", body, want)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	errDown := errors.New("down")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errDown, false},
+		{"retryable", Retryable(errDown), true},
+		{"wrapped retryable", pkgerrors.Wrap(Retryable(errDown), "sending"), true},
+		{"retryable nil", Retryable(nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Headers sent with webhook deliveries.
+const (
+	WebhookEventHeader     = "X-Vice-Event"
+	WebhookDeliveryHeader  = "X-Vice-Delivery"
+	WebhookTimestampHeader = "X-Vice-Timestamp"
+	WebhookSignatureHeader = "X-Vice-Signature"
+)
+
+// WebhookSink posts events to a URL as JSON.
+//
+// When it has a secret, deliveries are signed: the X-Vice-Signature header is
+// sha256= followed by the hex-encoded HMAC-SHA256 of the X-Vice-Timestamp
+// header, a period, and the body, computed with the secret.
+type WebhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookSink returns a WebhookSink that posts to the URL, which must be
+// absolute.
+func NewWebhookSink(u, secret string, timeout time.Duration) (*WebhookSink, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || !parsed.IsAbs() {
+		return nil, errors.Errorf("%q isn't an absolute URL", u)
+	}
+	return &WebhookSink{
+		url:    u,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Send posts an event. Network errors, 429s, and 5xx responses are
+// retryable.
+func (s *WebhookSink) Send(e *Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, e.Type)
+	req.Header.Set(WebhookDeliveryHeader, e.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Retryable(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err = errors.Errorf("%s returned %s", req.URL.Host, resp.Status)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+			return Retryable(err)
+		}
+		return err
+	}
+	return nil
+}
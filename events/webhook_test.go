@@ -0,0 +1,144 @@
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkSignsDeliveries(t *testing.T) {
+	const (
+		secret = "s3cret"
+		body   = `{"subdomain":"a1b2c3d4"}`
+	)
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(server.URL, secret, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Unix()
+	if err = sink.Send(&Event{ID: "0123abcd", Type: "redirect"}, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	r, got := <-requests, <-bodies
+
+	if r.Method != http.MethodPost {
+		t.Errorf("method is %s, want POST", r.Method)
+	}
+	if got != body {
+		t.Errorf("body is %s, want %s", got, body)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":        "application/json",
+		WebhookEventHeader:    "redirect",
+		WebhookDeliveryHeader: "0123abcd",
+	} {
+		if v := r.Header.Get(header); v != want {
+			t.Errorf("%s is %q, want %q", header, v, want)
+		}
+	}
+
+	timestamp := r.Header.Get(WebhookTimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || ts < before || ts > time.Now().Unix() {
+		t.Errorf("%s is %q, want the Unix time it was sent", WebhookTimestampHeader, timestamp)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := r.Header.Get(WebhookSignatureHeader); signature != want {
+		t.Errorf("%s is %q, want %q", WebhookSignatureHeader, signature, want)
+	}
+}
+
+func TestWebhookSinkWithoutSecret(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(server.URL, "", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Send(&Event{ID: "1", Type: "redirect"}, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-requests; r.Header.Get(WebhookSignatureHeader) != "" {
+		t.Errorf("unsigned delivery has a %s header", WebhookSignatureHeader)
+	}
+}
+
+func TestWebhookSinkResponses(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantErr   bool
+		retryable bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusMovedPermanently, true, false},
+		{http.StatusBadRequest, true, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusTooManyRequests, true, true},
+		{http.StatusInternalServerError, true, true},
+		{http.StatusServiceUnavailable, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			sink, err := NewWebhookSink(server.URL, "", 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Send(&Event{ID: "1", Type: "redirect"}, []byte("{}"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send returned %v, want an error: %t", err, tt.wantErr)
+			}
+			if IsRetryable(err) != tt.retryable {
+				t.Errorf("IsRetryable(%v) = %t, want %t", err, !tt.retryable, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkNetworkErrorIsRetryable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	sink, err := NewWebhookSink(server.URL, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Send(&Event{ID: "1", Type: "redirect"}, []byte("{}")); !IsRetryable(err) {
+		t.Errorf("Send returned %v, want a retryable error", err)
+	}
+}
+
+func TestNewWebhookSinkRequiresAbsoluteURL(t *testing.T) {
+	for _, u := range []string{"", "/hooks", "hooks.example.org/vice", "%"} {
+		if _, err := NewWebhookSink(u, "", time.Second); err == nil {
+			t.Errorf("NewWebhookSink(%q) didn't return an error", u)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// fixtureAnalysis is an analysis as it's written in a fixtures file.
+type fixtureAnalysis struct {
+	ID        string `mapstructure:"id"`
+	Subdomain string `mapstructure:"subdomain"`
+	Name      string `mapstructure:"name"`
+	Status    string `mapstructure:"status"`
+	Username  string `mapstructure:"username"`
+	Message   string `mapstructure:"message"`
+	AppID     string `mapstructure:"app_id"`
+	AppName   string `mapstructure:"app_name"`
+	SystemID  string `mapstructure:"system_id"`
+	Deleted   bool   `mapstructure:"deleted"`
+}
+
+// defaultFixtures are served in development mode when no fixtures file is
+// given, covering each of the states the router treats differently.
+var defaultFixtures = []fixtureAnalysis{
+	{Subdomain: "a1b2c3d4", Name: "JupyterLab", Status: "Running", Username: "dev"},
+	{Subdomain: "launching", Name: "RStudio", Status: "Submitted", Username: "dev"},
+	{Subdomain: "completed", Name: "Cloud Shell", Status: "Completed", Username: "dev", AppID: "00000000-0000-0000-0000-0000000000c5", SystemID: "de"},
+	{Subdomain: "failed", Name: "VS Code", Status: "Failed", Username: "dev"},
+	{Subdomain: "terminating", Name: "JupyterLab", Status: "Running", Username: "dev", Message: "uploading outputs"},
+	{Subdomain: "deleted", Name: "RStudio", Status: "Completed", Username: "dev", Deleted: true},
+}
+
+// Fixtures is an in-memory set of analyses used in place of the database in
+// development mode.
+type Fixtures struct {
+	analyses map[string]*Analysis
+}
+
+// LoadFixtures reads the analyses from a YAML file like
+//
+//	analyses:
+//	  - subdomain: a1b2c3d4
+//	    name: JupyterLab
+//	    status: Running
+//	    username: ipcdev
+//
+// or uses a built-in set of examples if the path is empty.
+func LoadFixtures(path string) (*Fixtures, error) {
+	entries := defaultFixtures
+	if path != "" {
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, errors.Wrapf(err, "error reading fixtures from %s", path)
+		}
+		entries = nil
+		if err := v.UnmarshalKey("analyses", &entries); err != nil {
+			return nil, errors.Wrapf(err, "error parsing fixtures from %s", path)
+		}
+	}
+
+	f := &Fixtures{analyses: make(map[string]*Analysis, len(entries))}
+	start := time.Now()
+	for i, entry := range entries {
+		if entry.Subdomain == "" {
+			return nil, errors.Errorf("fixture %d has no subdomain", i)
+		}
+		id := entry.ID
+		if id == "" {
+			id = fmt.Sprintf("00000000-0000-0000-0000-%012d", i+1)
+		}
+		f.analyses[entry.Subdomain] = &Analysis{
+			ID:          id,
+			Name:        entry.Name,
+			Subdomain:   entry.Subdomain,
+			Status:      entry.Status,
+			UserID:      entry.Username,
+			Username:    entry.Username,
+			StartDate:   &start,
+			LastMessage: entry.Message,
+			AppID:       entry.AppID,
+			AppName:     entry.AppName,
+			SystemID:    entry.SystemID,
+			Deleted:     entry.Deleted,
+		}
+	}
+	return f, nil
+}
+
+// Lookup returns the analysis with the subdomain, or nil if there isn't one.
+func (f *Fixtures) Lookup(subdomain string) *Analysis {
+	if analysis, ok := f.analyses[subdomain]; ok {
+		a := *analysis
+		return &a
+	}
+	return nil
+}
+
+// LookupID returns the analysis with the ID, or nil if there isn't one.
+func (f *Fixtures) LookupID(id string) *Analysis {
+	for _, analysis := range f.analyses {
+		if analysis.ID == id {
+			a := *analysis
+			return &a
+		}
+	}
+	return nil
+}
+
+// Active returns the fixtures that haven't ended, sorted by subdomain.
+func (f *Fixtures) Active() []*Analysis {
+	var analyses []*Analysis
+	for _, subdomain := range f.Subdomains() {
+		if analysis := f.Lookup(subdomain); !analysis.Ended() {
+			analyses = append(analyses, analysis)
+		}
+	}
+	sort.Slice(analyses, func(i, j int) bool { return analyses[i].Subdomain < analyses[j].Subdomain })
+	return analyses
+}
+
+// Subdomains returns the subdomains of all of the fixtures.
+func (f *Fixtures) Subdomains() []string {
+	subdomains := make([]string, 0, len(f.analyses))
+	for subdomain := range f.analyses {
+		subdomains = append(subdomains, subdomain)
+	}
+	return subdomains
+}
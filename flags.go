@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Names of the feature flags consulted by the service.
+const (
+	FlagDBValidation = "db_validation"
+)
+
+// Headers used to override feature flags for a single request. The value of
+// the flags header is a comma-separated list of name=bool pairs, and the
+// expires header is the Unix time after which the override is rejected. The
+// signature header contains the hex-encoded HMAC-SHA256 of the expires header
+// value, a period, and the flags header value, computed with the configured
+// signing key.
+const (
+	flagsHeader          = "X-Vice-Flags"
+	flagsExpiresHeader   = "X-Vice-Flags-Expires"
+	flagsSignatureHeader = "X-Vice-Flags-Signature"
+)
+
+// defaultMaxOverrideLifetime is the default limit on how far in the future a
+// flag override can expire.
+const defaultMaxOverrideLifetime = time.Hour
+
+const flagsQuery = `
+	SELECT name, enabled
+	  FROM vice_default_backend_flags
+`
+
+// Flags holds the feature flags used to stage the rollout of new behaviors.
+// Flags are read from the vice.default_backend.flags.values section of the
+// config and, optionally, from a database table that is polled for changes.
+type Flags struct {
+	mu                  sync.RWMutex
+	config              map[string]bool
+	db                  map[string]bool
+	signingKey          []byte
+	maxOverrideLifetime time.Duration
+}
+
+// NewFlags returns a Flags initialized from the config.
+func NewFlags(cfg *viper.Viper) *Flags {
+	cfg.SetDefault("vice.default_backend.flags.max_override_lifetime", defaultMaxOverrideLifetime)
+
+	f := &Flags{
+		db:                  make(map[string]bool),
+		signingKey:          []byte(cfg.GetString("vice.default_backend.flags.signing_key")),
+		maxOverrideLifetime: cfg.GetDuration("vice.default_backend.flags.max_override_lifetime"),
+	}
+	f.LoadConfig(cfg)
+	return f
+}
+
+// LoadConfig replaces the flag values from the config, such as after the
+// remote config changes.
+func (f *Flags) LoadConfig(cfg *viper.Viper) {
+	values := make(map[string]bool)
+	for name := range cfg.GetStringMap("vice.default_backend.flags.values") {
+		values[name] = cfg.GetBool("vice.default_backend.flags.values." + name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = values
+}
+
+// Refresh reloads the flags stored in the database.
+func (f *Flags) Refresh(ctx context.Context, db *sql.DB) (err error) {
+	defer observeQuery(QueryFlags, time.Now(), &err)
+
+	rows, err := db.QueryContext(ctx, flagsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make(map[string]bool)
+	for rows.Next() {
+		var (
+			name    string
+			enabled bool
+		)
+		if err = rows.Scan(&name, &enabled); err != nil {
+			return err
+		}
+		values[name] = enabled
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.db = values
+	return nil
+}
+
+// Poll refreshes the flags from the database on the interval passed in until
+// the context is canceled.
+func (f *Flags) Poll(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Refresh(ctx, db); err != nil {
+			log.Errorf("error refreshing feature flags: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// All returns the effective value of every known flag, ignoring per-request
+// overrides. Values from the database take precedence over the config.
+func (f *Flags) All() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	all := make(map[string]bool, len(f.config)+len(f.db))
+	for name, v := range f.config {
+		all[name] = v
+	}
+	for name, v := range f.db {
+		all[name] = v
+	}
+	return all
+}
+
+// overrides returns the flag values from a correctly signed flags header that
+// hasn't expired. Expiry times further away than the maximum override
+// lifetime are rejected too, so that a leaked header can't be replayed for
+// long.
+func (f *Flags) overrides(r *http.Request) map[string]bool {
+	value := r.Header.Get(flagsHeader)
+	if value == "" || len(f.signingKey) == 0 {
+		return nil
+	}
+
+	expiresValue := r.Header.Get(flagsExpiresHeader)
+	sig, err := hex.DecodeString(r.Header.Get(flagsSignatureHeader))
+	if err != nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, f.signingKey)
+	mac.Write([]byte(expiresValue + "." + value))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		log.Warnf("ignoring %s header with an invalid signature", flagsHeader)
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	now := time.Now()
+	if err != nil || now.Unix() > expires || time.Unix(expires, 0).After(now.Add(f.maxOverrideLifetime)) {
+		log.Warnf("ignoring %s header that has expired or expires too late", flagsHeader)
+		return nil
+	}
+
+	overrides := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		if enabled, err := strconv.ParseBool(v); err == nil {
+			overrides[name] = enabled
+		}
+	}
+	return overrides
+}
+
+// Enabled returns whether the named flag is turned on for the request. The
+// request may be nil when there's no request to consider.
+func (f *Flags) Enabled(r *http.Request, name string) bool {
+	if r != nil {
+		if v, ok := f.overrides(r)[name]; ok {
+			return v
+		}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if v, ok := f.db[name]; ok {
+		return v
+	}
+	return f.config[name]
+}
+
+// GetFlagsHandler returns the effective value of every known flag.
+func (a *App) GetFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.flags.All())
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a MaxMind DB
+// file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSectionSeparator is the number of zero bytes between the search tree
+// and the data section.
+const mmdbDataSectionSeparator = 16
+
+// mmdbMaxDepth bounds how deeply maps, arrays, and pointers can nest, so that
+// a corrupt file with a pointer cycle can't recurse until the stack runs out.
+// Real records nest a handful of levels.
+const mmdbMaxDepth = 32
+
+// mmdbReader looks up records in a MaxMind DB (.mmdb) file. It implements just
+// enough of the format to read the country and ASN databases.
+type mmdbReader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// openMMDB reads a MaxMind DB file into memory.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.Errorf("%s is not a MaxMind DB file", path)
+	}
+	metaDecoder := &mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}
+	raw, _, err := metaDecoder.decode(0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading the metadata in %s", path)
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("the metadata in %s is not a map", path)
+	}
+
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uint(asUint(meta["node_count"])),
+		recordSize: uint(asUint(meta["record_size"])),
+		ipVersion:  uint(asUint(meta["ip_version"])),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, errors.Errorf("unsupported record size %d in %s", r.recordSize, path)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSectionSeparator > uint(i) {
+		return nil, errors.Errorf("the search tree in %s is truncated", path)
+	}
+	r.data = buf[treeSize+mmdbDataSectionSeparator : i]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases.
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) readRecord(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := r.buf[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := r.buf[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[off : off+4]))
+	}
+}
+
+// Lookup returns the record for the IP address, or nil if there isn't one.
+func (r *mmdbReader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	bits := 128
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	d := &mmdbDecoder{buf: r.data}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// mmdbDecoder decodes values in the MaxMind DB data section format. A decoder
+// is used for one lookup at a time.
+type mmdbDecoder struct {
+	buf   []byte
+	depth int
+}
+
+func (d *mmdbDecoder) bytesAt(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, errors.New("unexpected end of MaxMind DB data")
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// decode returns the value at the offset and the offset of the value after it.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth >= mmdbMaxDepth {
+		return nil, 0, errors.New("MaxMind DB data is nested too deeply")
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	ctrl, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	typ := uint(ctrl[0] >> 5)
+	if typ == 1 {
+		return d.decodePointer(ctrl[0], offset)
+	}
+	if typ == 0 {
+		ext, err := d.bytesAt(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(ext[0])
+		offset++
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytesAt(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + uint(beUint(b))
+		default:
+			size = 65821 + uint(beUint(b))
+		}
+	}
+
+	switch typ {
+	case 2: // UTF-8 string
+		b, err := d.bytesAt(offset, size)
+		return string(b), offset + size, err
+	case 3: // double
+		b, err := d.bytesAt(offset, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + 8, nil
+	case 4: // bytes
+		b, err := d.bytesAt(offset, size)
+		return b, offset + size, err
+	case 5, 6, 9, 10: // unsigned integers
+		b, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size > 8 {
+			b = b[size-8:]
+		}
+		return beUint(b), offset + size, nil
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, _ := key.(string)
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 8: // int32
+		b, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return int64(int32(uint32(beUint(b)))), offset + size, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	case 15: // float
+		b, err := d.bytesAt(offset, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset + 4, nil
+	default:
+		return nil, 0, errors.Errorf("unsupported MaxMind DB data type %d", typ)
+	}
+}
+
+// decodePointer follows a pointer and returns the value it points to along
+// with the offset following the pointer itself.
+func (d *mmdbDecoder) decodePointer(ctrl byte, offset uint) (interface{}, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	b, err := d.bytesAt(offset, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	vvv := uint64(ctrl & 0x7)
+
+	var target uint64
+	switch n {
+	case 1:
+		target = vvv<<8 | beUint(b)
+	case 2:
+		target = (vvv<<16 | beUint(b)) + 2048
+	case 3:
+		target = (vvv<<24 | beUint(b)) + 526336
+	default:
+		target = beUint(b)
+	}
+
+	value, _, err := d.decode(uint(target))
+	return value, offset + n, err
+}
+
+// asUint converts a decoded MaxMind DB integer to a uint64.
+func asUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
+
+var requestsByCountry = NewCounterVec(
+	"requests_by_country_total",
+	"Routed requests by the client's country, as resolved by GeoIP.",
+	"country",
+)
+
+// GeoIP resolves client IP addresses to countries and autonomous systems.
+type GeoIP struct {
+	country *mmdbReader
+	asn     *mmdbReader
+}
+
+// GeoInfo is the location information for a client.
+type GeoInfo struct {
+	Country string
+	ASN     uint64
+	ASOrg   string
+}
+
+// NewGeoIP opens the MaxMind databases named in the
+// vice.default_backend.geoip section of the config. Returns nil if neither is
+// configured.
+func NewGeoIP(cfg *viper.Viper) (*GeoIP, error) {
+	countryPath := cfg.GetString("vice.default_backend.geoip.country_db")
+	asnPath := cfg.GetString("vice.default_backend.geoip.asn_db")
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+
+	g := &GeoIP{}
+	var err error
+	if countryPath != "" {
+		if g.country, err = openMMDB(countryPath); err != nil {
+			return nil, errors.Wrap(err, "error opening the GeoIP country database")
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = openMMDB(asnPath); err != nil {
+			return nil, errors.Wrap(err, "error opening the GeoIP ASN database")
+		}
+	}
+	return g, nil
+}
+
+// Lookup returns the location information for an IP address. Errors are
+// logged rather than returned since enrichment is best-effort.
+func (g *GeoIP) Lookup(ip net.IP) GeoInfo {
+	var info GeoInfo
+	if ip == nil {
+		return info
+	}
+
+	if g.country != nil {
+		record, err := g.country.Lookup(ip)
+		if err != nil {
+			log.Debugf("error looking up the country for %s: %s", ip, err)
+		}
+		if country, ok := record["country"].(map[string]interface{}); ok {
+			info.Country, _ = country["iso_code"].(string)
+		}
+	}
+
+	if g.asn != nil {
+		record, err := g.asn.Lookup(ip)
+		if err != nil {
+			log.Debugf("error looking up the ASN for %s: %s", ip, err)
+		}
+		info.ASN = asUint(record["autonomous_system_number"])
+		info.ASOrg, _ = record["autonomous_system_organization"].(string)
+	}
+
+	return info
+}
+
+// defaultTrustedProxies is the default number of proxies in front of the
+// service that append to X-Forwarded-For, which is just the ingress
+// controller.
+const defaultTrustedProxies = 1
+
+// trustedProxies is the number of proxies in front of the service that append
+// the address they received a request from to X-Forwarded-For.
+var trustedProxies = defaultTrustedProxies
+
+// ConfigureTrustedProxies sets the number of trusted proxies from
+// vice.default_backend.trusted_proxies.
+func ConfigureTrustedProxies(cfg *viper.Viper) error {
+	cfg.SetDefault("vice.default_backend.trusted_proxies", defaultTrustedProxies)
+	n := cfg.GetInt("vice.default_backend.trusted_proxies")
+	if n < 0 {
+		return errors.New("vice.default_backend.trusted_proxies can't be negative")
+	}
+	trustedProxies = n
+	return nil
+}
+
+// clientIP returns the address of the client that made the request. Clients
+// can send any X-Forwarded-For header they like, so only the addresses
+// appended by the trusted proxies are believed: the client is the address the
+// outermost trusted proxy appended, counting from the right. The connection's
+// address is used when there are no trusted proxies or no usable header.
+func clientIP(r *http.Request) net.IP {
+	var hops []string
+	for _, fwd := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(fwd, ",")...)
+	}
+	if trustedProxies > 0 && len(hops) > 0 {
+		i := len(hops) - trustedProxies
+		if i < 0 {
+			i = 0
+		}
+		if ip := net.ParseIP(strings.TrimSpace(hops[i])); ip != nil {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// The service name this service reports its health under, in addition to the
+// empty name that stands for the server as a whole.
+const grpcHealthServiceName = "vice-default-backend"
+
+// Paths of the grpc.health.v1.Health methods.
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcHealthWatchPath = "/grpc.health.v1.Health/Watch"
+)
+
+// Values of the grpc.health.v1.HealthCheckResponse.ServingStatus enum.
+const (
+	grpcServingStatusServing        = 1
+	grpcServingStatusNotServing     = 2
+	grpcServingStatusServiceUnknown = 3
+)
+
+// gRPC status codes used in the grpc-status trailer.
+const (
+	grpcCodeOK            = 0
+	grpcCodeInvalidArg    = 3
+	grpcCodeNotFound      = 5
+	grpcCodeUnimplemented = 12
+)
+
+// grpcHealthWatchInterval is how often Watch streams check for a change in
+// the serving status.
+const grpcHealthWatchInterval = time.Second
+
+// GRPCHealthServer implements the gRPC health checking protocol
+// (grpc.health.v1.Health) over cleartext HTTP/2. The messages are small
+// enough that they're encoded by hand rather than pulling in gRPC. Cleartext
+// HTTP/2 comes from golang.org/x/net/http2/h2c, since net/http only serves
+// HTTP/2 over TLS.
+type GRPCHealthServer struct {
+	app *App
+}
+
+// NewGRPCHealthServer returns the HTTP server for the gRPC health checking
+// protocol, or nil if vice.default_backend.grpc_health.listen isn't set.
+func NewGRPCHealthServer(cfg *viper.Viper, app *App) *http.Server {
+	addr := cfg.GetString("vice.default_backend.grpc_health.listen")
+	if addr == "" {
+		return nil
+	}
+	h := &GRPCHealthServer{app: app}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(h, &http2.Server{}),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+}
+
+// servingStatus returns the status of a service. The second return value is
+// false if the service isn't known.
+func (h *GRPCHealthServer) servingStatus(service string) (int, bool) {
+	if service != "" && service != grpcHealthServiceName {
+		return grpcServingStatusServiceUnknown, false
+	}
+	if ready, _ := h.app.Ready(); !ready {
+		return grpcServingStatusNotServing, true
+	}
+	return grpcServingStatusServing, true
+}
+
+// ServeHTTP dispatches gRPC calls to the health methods.
+func (h *GRPCHealthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requests must be HTTP/2 POSTs", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	switch r.URL.Path {
+	case grpcHealthCheckPath:
+		h.check(w, r)
+	case grpcHealthWatchPath:
+		h.watch(w, r)
+	default:
+		writeGRPCStatus(w, grpcCodeUnimplemented, "unknown method "+r.URL.Path)
+	}
+}
+
+func (h *GRPCHealthServer) check(w http.ResponseWriter, r *http.Request) {
+	service, err := readHealthCheckRequest(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcCodeInvalidArg, err.Error())
+		return
+	}
+
+	status, known := h.servingStatus(service)
+	if !known {
+		writeGRPCStatus(w, grpcCodeNotFound, "unknown service")
+		return
+	}
+	if err = writeHealthCheckResponse(w, status); err != nil {
+		log.Errorf("error writing a gRPC health check response: %s", err)
+		return
+	}
+	writeGRPCStatus(w, grpcCodeOK, "")
+}
+
+// watch streams the serving status whenever it changes until the client goes
+// away.
+func (h *GRPCHealthServer) watch(w http.ResponseWriter, r *http.Request) {
+	service, err := readHealthCheckRequest(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcCodeInvalidArg, err.Error())
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(grpcHealthWatchInterval)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		if status, _ := h.servingStatus(service); status != last {
+			if err = writeHealthCheckResponse(w, status); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			last = status
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readHealthCheckRequest reads a length-prefixed HealthCheckRequest message
+// and returns its service field.
+func readHealthCheckRequest(body io.Reader) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return "", errors.Wrap(err, "error reading the gRPC message prefix")
+	}
+	if prefix[0] != 0 {
+		return "", errors.New("compressed gRPC messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > 4096 {
+		return "", errors.New("the health check request is too large")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return "", errors.Wrap(err, "error reading the gRPC message")
+	}
+
+	// Walk the fields, keeping the service (field 1, length-delimited) and
+	// skipping anything else.
+	var service string
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errors.New("malformed health check request")
+		}
+		msg = msg[n:]
+
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return "", errors.New("malformed health check request")
+			}
+			msg = msg[n:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return "", errors.New("malformed health check request")
+			}
+			if tag>>3 == 1 {
+				service = string(msg[n : n+int(length)])
+			}
+			msg = msg[n+int(length):]
+		default:
+			return "", errors.New("unsupported field type in health check request")
+		}
+	}
+	return service, nil
+}
+
+// writeHealthCheckResponse writes a length-prefixed HealthCheckResponse
+// message with the status in field 1.
+func writeHealthCheckResponse(w io.Writer, status int) error {
+	msg := []byte{0, 0, 0, 0, 2, 0x08, byte(status)}
+	_, err := w.Write(msg)
+	return err
+}
+
+// writeGRPCStatus sets the gRPC status trailers.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// headerRuleConfig is the format of an entry in
+// vice.default_backend.response_headers.
+type headerRuleConfig struct {
+	Prefix  string
+	Headers map[string]string
+}
+
+// headerRule sets headers on the responses to requests whose paths start with
+// the prefix.
+type headerRule struct {
+	prefix  string
+	headers map[string]string
+}
+
+// ResponseHeaders adds operator-defined headers, such as cache directives or
+// a Content-Security-Policy, to responses by path prefix. Every matching rule
+// is applied in the order they're configured. The headers replace any that
+// the handler set, and an empty value removes the header.
+type ResponseHeaders struct {
+	rules []headerRule
+}
+
+// NewResponseHeaders returns the ResponseHeaders configured in
+// vice.default_backend.response_headers, or nil if there aren't any.
+func NewResponseHeaders(cfg *viper.Viper) (*ResponseHeaders, error) {
+	var configured []headerRuleConfig
+	if err := cfg.UnmarshalKey("vice.default_backend.response_headers", &configured); err != nil {
+		return nil, errors.Wrap(err, "cannot parse vice.default_backend.response_headers")
+	}
+	if len(configured) == 0 {
+		return nil, nil
+	}
+
+	rh := &ResponseHeaders{}
+	for _, c := range configured {
+		if !strings.HasPrefix(c.Prefix, "/") {
+			return nil, errors.Errorf("response header prefixes must start with /, got %q", c.Prefix)
+		}
+		// The config keys are lower-cased when they're read, so the names
+		// are put back into their canonical form.
+		headers := make(map[string]string, len(c.Headers))
+		for name, value := range c.Headers {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+		rh.rules = append(rh.rules, headerRule{prefix: c.Prefix, headers: headers})
+	}
+	return rh, nil
+}
+
+// matching returns the rules that apply to a request.
+func (rh *ResponseHeaders) matching(r *http.Request) []headerRule {
+	var matched []headerRule
+	for _, rule := range rh.rules {
+		if strings.HasPrefix(r.URL.Path, rule.prefix) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// Middleware adds the configured headers to responses.
+func (rh *ResponseHeaders) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rules := rh.matching(r); len(rules) > 0 {
+			w = &headerWriter{ResponseWriter: w, rules: rules}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerWriter applies header rules just before the response headers are
+// written, so that they take precedence over the ones the handler set.
+type headerWriter struct {
+	http.ResponseWriter
+	rules   []headerRule
+	applied bool
+}
+
+func (hw *headerWriter) apply() {
+	if hw.applied {
+		return
+	}
+	hw.applied = true
+	h := hw.ResponseWriter.Header()
+	for _, rule := range hw.rules {
+		for name, value := range rule.headers {
+			if value == "" {
+				h.Del(name)
+			} else {
+				h.Set(name, value)
+			}
+		}
+	}
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	hw.apply()
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	hw.apply()
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through, so that streamed responses still stream.
+func (hw *headerWriter) Flush() {
+	hw.apply()
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
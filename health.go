@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// One-time initialization steps tracked by the startup probe.
+const (
+	StartupConfig     = "config"
+	StartupDatabase   = "database"
+	StartupMigrations = "migrations"
+	StartupCache      = "cache"
+)
+
+// StartupStep is the state of one initialization step.
+type StartupStep struct {
+	Name      string     `json:"name"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// Startup tracks the one-time initialization steps the service has to finish
+// before it's started. Unlike readiness, it never goes back to incomplete.
+type Startup struct {
+	mu    sync.RWMutex
+	steps []StartupStep
+	done  chan struct{}
+}
+
+// NewStartup returns a Startup that waits for the named steps.
+func NewStartup(names ...string) *Startup {
+	s := &Startup{done: make(chan struct{})}
+	for _, name := range names {
+		s.steps = append(s.steps, StartupStep{Name: name})
+	}
+	return s
+}
+
+// Complete marks a step as completed.
+func (s *Startup) Complete(name string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := true
+	for i := range s.steps {
+		if s.steps[i].Name == name && s.steps[i].Completed == nil {
+			s.steps[i].Completed = &now
+			log.Infof("startup step %s completed", name)
+		}
+		if s.steps[i].Completed == nil {
+			done = false
+		}
+	}
+	if done {
+		select {
+		case <-s.done:
+		default:
+			close(s.done)
+		}
+	}
+}
+
+// Done returns a channel that's closed once every step has completed.
+func (s *Startup) Done() <-chan struct{} {
+	return s.done
+}
+
+// Steps returns the state of each step and whether all of them are complete.
+func (s *Startup) Steps() ([]StartupStep, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	done := true
+	steps := make([]StartupStep, len(s.steps))
+	for i, step := range s.steps {
+		steps[i] = step
+		if step.Completed == nil {
+			done = false
+		}
+	}
+	return steps, done
+}
+
+// StartupResponse is the body returned by the startup probe.
+type StartupResponse struct {
+	Started bool          `json:"started"`
+	Steps   []StartupStep `json:"steps"`
+}
+
+// StartupHandler reports whether one-time initialization has finished,
+// returning a 503 until it has.
+func (a *App) StartupHandler(w http.ResponseWriter, _ *http.Request) {
+	steps, done := a.startup.Steps()
+	status := http.StatusOK
+	if !done {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, &StartupResponse{Started: done, Steps: steps})
+}
+
+// Ready returns whether the service is ready to receive traffic, along with
+// the reason if it isn't. When the lookup cache is enabled, the service isn't
+// ready until the cache has been loaded at least once. It's never ready again
+// once it has started shutting down.
+func (a *App) Ready() (bool, string) {
+	if a.draining.Load() {
+		return false, "The service is shutting down."
+	}
+	if a.cache != nil && !a.cache.Loaded() {
+		return false, "The lookup cache hasn't been loaded yet."
+	}
+	return true, ""
+}
+
+// Drain marks the service as shutting down, so that the readiness probe
+// fails while the listeners are still open.
+func (a *App) Drain() {
+	a.draining.Store(true)
+}
+
+// ReadyHandler reports whether the service is ready to receive traffic.
+func (a *App) ReadyHandler(w http.ResponseWriter, _ *http.Request) {
+	if ready, reason := a.Ready(); !ready {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "I'm ready.")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Dependencies checked for the detailed health report.
+const (
+	DependencyDatabase    = "database"
+	DependencyReplica     = "replica"
+	DependencyCache       = "cache"
+	DependencyAppExposer  = "app_exposer"
+	DependencyLoadingPage = "loading_page"
+	DependencyEvents      = "events"
+)
+
+// Defaults for the dependency check settings.
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+var dependencyHealth = NewGaugeVec(
+	"dependency_up",
+	"Whether the last check of a dependency passed.",
+	"dependency",
+)
+
+// DependencyCheck is the latest result of checking a dependency. CheckedAt is
+// unset until the first check finishes.
+type DependencyCheck struct {
+	SelfTestStep
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// HealthDetails is the body returned by the detailed health endpoint.
+type HealthDetails struct {
+	Healthy      bool              `json:"healthy"`
+	Dependencies []DependencyCheck `json:"dependencies"`
+}
+
+type dependency struct {
+	name  string
+	check func(context.Context) (string, error)
+}
+
+// HealthChecker checks the service's dependencies in the background, so that
+// the detailed health report can be requested as often as monitors like
+// without adding load to the dependencies.
+type HealthChecker struct {
+	interval     time.Duration
+	timeout      time.Duration
+	dependencies []dependency
+	mu           sync.RWMutex
+	results      map[string]DependencyCheck
+}
+
+// NewHealthChecker returns a HealthChecker configured from the
+// vice.default_backend.health section of the config.
+func NewHealthChecker(cfg *viper.Viper) *HealthChecker {
+	cfg.SetDefault("vice.default_backend.health.check_interval", defaultHealthCheckInterval)
+	cfg.SetDefault("vice.default_backend.health.check_timeout", defaultHealthCheckTimeout)
+	return &HealthChecker{
+		interval: cfg.GetDuration("vice.default_backend.health.check_interval"),
+		timeout:  cfg.GetDuration("vice.default_backend.health.check_timeout"),
+		results:  make(map[string]DependencyCheck),
+	}
+}
+
+// Add adds a dependency to check. The check returns a detail to report when
+// it passes.
+func (h *HealthChecker) Add(name string, check func(context.Context) (string, error)) {
+	h.dependencies = append(h.dependencies, dependency{name: name, check: check})
+}
+
+// Check checks every dependency at once and records the results.
+func (h *HealthChecker) Check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, d := range h.dependencies {
+		wg.Add(1)
+		go func(d dependency) {
+			defer wg.Done()
+			result := DependencyCheck{
+				SelfTestStep: timedStep(d.name, func() (string, error) { return d.check(ctx) }),
+			}
+			now := time.Now()
+			result.CheckedAt = &now
+
+			up := 0.0
+			if result.OK {
+				up = 1
+			}
+			dependencyHealth.Set(up, d.name)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.results[d.name] = result
+		}(d)
+	}
+	wg.Wait()
+}
+
+// Run checks the dependencies on the check interval until the context is
+// canceled.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Details returns the latest result for each dependency, in the order they
+// were added. The service is healthy if every check passed.
+func (h *HealthChecker) Details() *HealthDetails {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	details := &HealthDetails{Healthy: true, Dependencies: []DependencyCheck{}}
+	for _, d := range h.dependencies {
+		result, ok := h.results[d.name]
+		if !ok {
+			result = DependencyCheck{SelfTestStep: SelfTestStep{Name: d.name, Error: "not checked yet"}}
+		}
+		if !result.OK {
+			details.Healthy = false
+		}
+		details.Dependencies = append(details.Dependencies, result)
+	}
+	return details
+}
+
+// checkURL sends a GET request to a URL. Any response other than a server
+// error means the service behind it is up.
+func checkURL(ctx context.Context, client *http.Client, u string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return resp.Status, nil
+}
+
+// checkLoadingPages checks each of the loading page targets.
+func checkLoadingPages(ctx context.Context, client *http.Client, lp *LoadingPages) (string, error) {
+	var details []string
+	for _, t := range lp.Targets() {
+		status, err := checkURL(ctx, client, t.URL.String())
+		if err != nil {
+			return "", fmt.Errorf("loading page target %s: %s", t.Name, err)
+		}
+		details = append(details, t.Name+": "+status)
+	}
+	return strings.Join(details, ", "), nil
+}
+
+// AddDependencies adds the checks for the dependencies the service is
+// configured with. Features that are turned off aren't checked.
+func (h *HealthChecker) AddDependencies(a *App, events *JobEvents) {
+	client := &http.Client{
+		Timeout: h.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if a.db != nil {
+		h.Add(DependencyDatabase, func(ctx context.Context) (string, error) {
+			return "", a.db.PingContext(ctx)
+		})
+	}
+	if a.replica != nil {
+		h.Add(DependencyReplica, func(ctx context.Context) (string, error) {
+			if err := a.replica.Replica().PingContext(ctx); err != nil {
+				return "", err
+			}
+			if !a.replica.usable.Load() {
+				return "lagging, lookups are going to the primary", nil
+			}
+			return "in use", nil
+		})
+	}
+	if a.cache != nil {
+		h.Add(DependencyCache, func(context.Context) (string, error) {
+			return a.cache.Check()
+		})
+	}
+	if a.appExposer != nil {
+		h.Add(DependencyAppExposer, func(ctx context.Context) (string, error) {
+			return checkURL(ctx, client, a.appExposer.base.String())
+		})
+	}
+	if a.loadingPages != nil {
+		h.Add(DependencyLoadingPage, func(ctx context.Context) (string, error) {
+			return checkLoadingPages(ctx, client, a.loadingPages)
+		})
+	}
+	if events != nil {
+		h.Add(DependencyEvents, func(context.Context) (string, error) {
+			return events.Check()
+		})
+	}
+	if a.emitters != nil {
+		for _, broker := range a.emitters.Brokers() {
+			h.Add(broker.Name(), func(context.Context) (string, error) {
+				return broker.Check()
+			})
+		}
+	}
+}
+
+// HealthDetailsHandler reports the latest check of each dependency. It
+// returns a 503 if any of them failed.
+func (a *App) HealthDetailsHandler(w http.ResponseWriter, _ *http.Request) {
+	details := a.health.Details()
+	status := http.StatusOK
+	if !details.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, details)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// defaultRejectedHostStatus is the status code returned by default for
+// requests for hosts outside of the allowed domains.
+const defaultRejectedHostStatus = http.StatusMisdirectedRequest
+
+var rejectedHosts = NewCounterVec(
+	"rejected_hosts_total",
+	"Requests turned away because their host isn't in one of the allowed domains, by the header that had it.",
+	"header",
+)
+
+// HostAllowlist turns away requests for hosts outside of the domains that the
+// service serves before they're routed. Otherwise, whatever a client puts in
+// the Host or X-Frontend-Url header ends up in app URLs, redirects, pages,
+// and logs, where it can poison caches or forge log entries.
+type HostAllowlist struct {
+	domains []string
+	status  int
+}
+
+// NewHostAllowlist returns a HostAllowlist configured from the
+// vice.default_backend.hosts section of the config, or nil if
+// vice.default_backend.hosts.allowed_domains isn't set.
+func NewHostAllowlist(cfg *viper.Viper) (*HostAllowlist, error) {
+	cfg.SetDefault("vice.default_backend.hosts.reject_status", defaultRejectedHostStatus)
+
+	var domains []string
+	for _, d := range cfg.GetStringSlice("vice.default_backend.hosts.allowed_domains") {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	status := cfg.GetInt("vice.default_backend.hosts.reject_status")
+	if status != http.StatusMisdirectedRequest && status != http.StatusNotFound {
+		return nil, errors.Errorf("vice.default_backend.hosts.reject_status must be %d or %d, got %d",
+			http.StatusMisdirectedRequest, http.StatusNotFound, status)
+	}
+	return &HostAllowlist{domains: domains, status: status}, nil
+}
+
+// Allowed returns true if the host, with or without a port, is one of the
+// allowed domains or a subdomain of one.
+func (h *HostAllowlist) Allowed(host string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range h.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reject answers a request for a host outside of the allowed domains. The
+// host isn't repeated in the response or logged.
+func (h *HostAllowlist) Reject(w http.ResponseWriter, header string) {
+	rejectedHosts.Inc(header)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, http.StatusText(h.status), h.status)
+}
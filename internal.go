@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// NewInternalServer returns the HTTP server for the endpoints meant for
+// operators rather than users, /metrics and /debug/vars, or nil if
+// vice.default_backend.internal.listen isn't set. They're kept off the public
+// listener, where they'd shadow the same paths on every analysis subdomain,
+// and are otherwise only served under /api/v1/admin with the admin token.
+func NewInternalServer(cfg *viper.Viper, handler http.Handler) *http.Server {
+	addr := cfg.GetString("vice.default_backend.internal.listen")
+	if addr == "" {
+		return nil
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+var (
+	openConnections = NewGaugeVec(
+		"open_connections",
+		"Connections currently accepted by the listener.",
+	)
+	connectionLimitWaits = NewCounterVec(
+		"connection_limit_waits_total",
+		"Times the listener had to wait for a connection to close before accepting another one.",
+	)
+	concurrencyLimitRejections = NewCounterVec(
+		"concurrency_limit_rejections_total",
+		"Requests rejected because the concurrent request limit was reached, by request class.",
+		"class",
+	)
+)
+
+// Classes of requests that can be given their own concurrency limits.
+// ClassAll is the global limit that applies to every request.
+const (
+	ClassAll     = "all"
+	ClassAPI     = "api"
+	ClassRouting = "routing"
+	ClassStatic  = "static"
+)
+
+// requestClasses are the classes with their own limits, in the order their
+// settings are read.
+var requestClasses = []string{ClassAPI, ClassRouting, ClassStatic}
+
+// limitListener accepts at most a fixed number of simultaneous connections,
+// shared with the other listeners using the same semaphore. Once the limit is
+// reached, Accept blocks until a connection is closed.
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// LimitListeners returns listeners that together accept at most n
+// simultaneous connections from the listeners passed in.
+func LimitListeners(listeners []net.Listener, n int) []net.Listener {
+	sem := make(chan struct{}, n)
+	limited := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		limited[i] = &limitListener{
+			Listener: l,
+			sem:      sem,
+			done:     make(chan struct{}),
+		}
+	}
+	return limited
+}
+
+func (l *limitListener) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	connectionLimitWaits.Inc()
+	select {
+	case <-l.done:
+		return false
+	case l.sem <- struct{}{}:
+		return true
+	}
+}
+
+func (l *limitListener) release() {
+	<-l.sem
+	openConnections.Add(-1)
+}
+
+// Accept waits for a free slot and then for the next connection.
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		return nil, net.ErrClosed
+	}
+	openConnections.Add(1)
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &limitListenerConn{Conn: c, release: l.release}, nil
+}
+
+// Close closes the underlying listener and unblocks any pending Accept.
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { close(l.done) })
+	return err
+}
+
+// limitListenerConn releases its slot in the listener when it's closed.
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// ConcurrencyLimiter caps the number of requests processed at once. Requests
+// that can't get a slot within the queue timeout are rejected with a 503.
+type ConcurrencyLimiter struct {
+	class        string
+	sem          chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter configured from the
+// vice.default_backend.limits section of the config, or nil if no limit is
+// set.
+func NewConcurrencyLimiter(cfg *viper.Viper) *ConcurrencyLimiter {
+	return newConcurrencyLimiter(cfg, ClassAll, "vice.default_backend.limits")
+}
+
+// newConcurrencyLimiter returns a ConcurrencyLimiter for a class of requests
+// configured from the section of the config passed in, or nil if no limit
+// is set.
+func newConcurrencyLimiter(cfg *viper.Viper, class, section string) *ConcurrencyLimiter {
+	cfg.SetDefault(section+".queue_timeout", time.Second)
+
+	n := cfg.GetInt(section + ".max_concurrent_requests")
+	if n <= 0 {
+		return nil
+	}
+	return &ConcurrencyLimiter{
+		class:        class,
+		sem:          make(chan struct{}, n),
+		queueTimeout: cfg.GetDuration(section + ".queue_timeout"),
+	}
+}
+
+// serve waits for a free slot and then handles the request, or rejects it
+// with a 503 if none frees up within the queue timeout.
+func (c *ConcurrencyLimiter) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.sem <- struct{}{}:
+	case <-timer.C:
+		concurrencyLimitRejections.Inc(c.class)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	defer func() { <-c.sem }()
+
+	next.ServeHTTP(w, r)
+}
+
+// Middleware enforces the concurrency limit.
+func (c *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, next)
+	})
+}
+
+// ClassLimiters give the JSON API, the catch-all routing path, and the
+// static assets their own concurrency limits, so that loading page polling
+// doesn't crowd out the routes that hit the database or the other way
+// around. Other requests, such as health checks and the admin pages, aren't
+// limited by class.
+type ClassLimiters struct {
+	limiters map[string]*ConcurrencyLimiter
+}
+
+// NewClassLimiters returns the ClassLimiters configured in the
+// vice.default_backend.limits.classes section of the config, or nil if none
+// of the classes has a limit.
+func NewClassLimiters(cfg *viper.Viper) *ClassLimiters {
+	limiters := make(map[string]*ConcurrencyLimiter)
+	for _, class := range requestClasses {
+		if l := newConcurrencyLimiter(cfg, class, "vice.default_backend.limits.classes."+class); l != nil {
+			limiters[class] = l
+		}
+	}
+	if len(limiters) == 0 {
+		return nil
+	}
+	return &ClassLimiters{limiters: limiters}
+}
+
+// requestClass returns the class of a request from the route it matched. The
+// app subdomains are handled by the catch-all route, even when their paths
+// start with /api/, so the route is a better guide than the path.
+func requestClass(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	switch {
+	case err != nil:
+		return ""
+	case template == "/":
+		return ClassRouting
+	case strings.HasPrefix(template, "/static/"):
+		return ClassStatic
+	case strings.HasPrefix(template, "/api/"+apiVersion+"/admin"):
+		return ""
+	case strings.HasPrefix(template, "/api/"):
+		return ClassAPI
+	default:
+		return ""
+	}
+}
+
+// Middleware enforces the limit of each request's class.
+func (cl *ClassLimiters) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := cl.limiters[requestClass(r)]; l != nil {
+			l.serve(w, r, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Loading page variants used when the targets are configured through the
+// vice.default_backend.canary section.
+const (
+	VariantPrimary = "primary"
+	VariantCanary  = "canary"
+)
+
+// Default names of the header and cookie used to opt in to a particular
+// loading page target.
+const (
+	defaultCanaryHeader = "X-Loading-Page-Variant"
+	defaultCanaryCookie = "loading_page_variant"
+)
+
+var routeOutcomes = NewCounterVec(
+	"route_outcomes_total",
+	"Routing outcomes for requests sent to the loading page, by loading page variant.",
+	"variant", "outcome",
+)
+
+// LoadingPageTarget is a named loading page implementation along with the
+// percentage of apps that get sent to it.
+type LoadingPageTarget struct {
+	Name   string   `json:"name"`
+	URL    *url.URL `json:"-"`
+	Weight int      `json:"weight"`
+}
+
+// MarshalJSON includes the target's URL as a string.
+func (t LoadingPageTarget) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"name":   t.Name,
+		"url":    t.URL.String(),
+		"weight": t.Weight,
+	})
+}
+
+// openAPISchema describes the JSON encoding of a target.
+func (LoadingPageTarget) openAPISchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"name", "url", "weight"},
+		"properties": map[string]interface{}{
+			"name":   map[string]interface{}{"type": "string"},
+			"url":    map[string]interface{}{"type": "string"},
+			"weight": map[string]interface{}{"type": "integer"},
+		},
+	}
+}
+
+// LoadingPagesResponse is the body returned by the loading page endpoints.
+type LoadingPagesResponse struct {
+	Targets []LoadingPageTarget `json:"targets"`
+}
+
+// LoadingPages decides which loading page implementation a request gets sent
+// to. Apps are spread across the targets according to their weights, and
+// individual clients can opt in to a target with a header or cookie. The
+// weights can be changed at runtime.
+type LoadingPages struct {
+	mu      sync.RWMutex
+	targets []*LoadingPageTarget
+	header  string
+	cookie  string
+}
+
+// loadingPageTargetConfig is the format of an entry in
+// vice.default_backend.loading_pages.targets.
+type loadingPageTargetConfig struct {
+	Name   string
+	URL    string
+	Weight int
+}
+
+// NewLoadingPages returns a LoadingPages configured from the config. Targets
+// listed in vice.default_backend.loading_pages.targets take precedence.
+// Otherwise the primary loading page gets the traffic that isn't sent to the
+// optional vice.default_backend.canary.loading_page_url.
+func NewLoadingPages(cfg *viper.Viper, primary *url.URL) (*LoadingPages, error) {
+	cfg.SetDefault("vice.default_backend.canary.header", defaultCanaryHeader)
+	cfg.SetDefault("vice.default_backend.canary.cookie", defaultCanaryCookie)
+
+	lp := &LoadingPages{
+		header: cfg.GetString("vice.default_backend.canary.header"),
+		cookie: cfg.GetString("vice.default_backend.canary.cookie"),
+	}
+
+	var configured []loadingPageTargetConfig
+	if err := cfg.UnmarshalKey("vice.default_backend.loading_pages.targets", &configured); err != nil {
+		return nil, errors.Wrap(err, "cannot parse vice.default_backend.loading_pages.targets")
+	}
+
+	if len(configured) > 0 {
+		seen := make(map[string]bool)
+		for _, c := range configured {
+			if c.Name == "" || seen[c.Name] {
+				return nil, errors.Errorf("loading page targets need unique, non-empty names, got %q", c.Name)
+			}
+			seen[c.Name] = true
+			parsed, err := url.Parse(c.URL)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot parse the URL for loading page target %s", c.Name)
+			}
+			lp.targets = append(lp.targets, &LoadingPageTarget{Name: c.Name, URL: parsed, Weight: c.Weight})
+		}
+	} else {
+		canaryPercent := cfg.GetInt("vice.default_backend.canary.percent")
+		lp.targets = []*LoadingPageTarget{{Name: VariantPrimary, URL: primary, Weight: 100 - canaryPercent}}
+
+		if canaryURL := cfg.GetString("vice.default_backend.canary.loading_page_url"); canaryURL != "" {
+			parsed, err := url.Parse(canaryURL)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot parse vice.default_backend.canary.loading_page_url")
+			}
+			lp.targets = append(lp.targets, &LoadingPageTarget{Name: VariantCanary, URL: parsed, Weight: canaryPercent})
+		} else {
+			lp.targets[0].Weight = 100
+		}
+	}
+
+	weights := make(map[string]int)
+	for _, t := range lp.targets {
+		weights[t.Name] = t.Weight
+	}
+	if err := lp.validateWeights(weights); err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// validateWeights makes sure that every target has a weight between 0 and
+// 100 and that the weights add up to 100.
+func (lp *LoadingPages) validateWeights(weights map[string]int) error {
+	if len(weights) != len(lp.targets) {
+		return errors.Errorf("expected weights for %d loading page targets, got %d", len(lp.targets), len(weights))
+	}
+
+	total := 0
+	for _, t := range lp.targets {
+		w, ok := weights[t.Name]
+		if !ok {
+			return errors.Errorf("missing weight for loading page target %s", t.Name)
+		}
+		if w < 0 || w > 100 {
+			return errors.Errorf("the weight for loading page target %s must be between 0 and 100, got %d", t.Name, w)
+		}
+		total += w
+	}
+	if total != 100 {
+		return errors.Errorf("loading page target weights must add up to 100, got %d", total)
+	}
+	return nil
+}
+
+// Targets returns a copy of the current loading page targets.
+func (lp *LoadingPages) Targets() []LoadingPageTarget {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+	targets := make([]LoadingPageTarget, len(lp.targets))
+	for i, t := range lp.targets {
+		targets[i] = *t
+	}
+	return targets
+}
+
+// SetWeights atomically replaces the weights of all of the targets.
+func (lp *LoadingPages) SetWeights(weights map[string]int) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if err := lp.validateWeights(weights); err != nil {
+		return err
+	}
+	for _, t := range lp.targets {
+		t.Weight = weights[t.Name]
+	}
+	return nil
+}
+
+// optIn returns the target the client explicitly asked for, if any.
+func (lp *LoadingPages) optIn(r *http.Request) string {
+	if v := r.Header.Get(lp.header); v != "" {
+		return v
+	}
+	if c, err := r.Cookie(lp.cookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Target returns the base URL of the named loading page target.
+func (lp *LoadingPages) Target(name string) (*url.URL, bool) {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+	for _, t := range lp.targets {
+		if t.Name == name {
+			return t.URL, true
+		}
+	}
+	return nil, false
+}
+
+// maxUnescapes is how many levels of URL encoding are removed from a request
+// when looking for a loading page URL in it.
+const maxUnescapes = 3
+
+// FromLoadingPage returns true if the request came from one of the loading
+// page targets, according to its Referer header, or already has a loading
+// page URL in its path or query, encoded or not. Redirecting it to the loading
+// page again would nest one loading page URL inside another.
+func (lp *LoadingPages) FromLoadingPage(r *http.Request) bool {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Host != "" {
+		for _, t := range lp.targets {
+			if strings.EqualFold(referer.Host, t.URL.Host) && strings.HasPrefix(referer.Path, t.URL.Path) {
+				return true
+			}
+		}
+	}
+
+	requested := strings.ToLower(r.URL.RequestURI())
+	for i := 0; i <= maxUnescapes; i++ {
+		for _, t := range lp.targets {
+			if strings.Contains(requested, strings.ToLower(t.URL.Host+t.URL.Path)) {
+				return true
+			}
+		}
+		unescaped, err := url.QueryUnescape(requested)
+		if err != nil || unescaped == requested {
+			break
+		}
+		requested = unescaped
+	}
+	return false
+}
+
+// bucket maps the request's host onto a number between 0 and 99 so that all
+// of the requests for an app consistently get the same target.
+func bucket(host string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	return int(h.Sum32() % 100)
+}
+
+// Select returns the name and base URL of the loading page target that the
+// request should be redirected to.
+func (lp *LoadingPages) Select(r *http.Request) (string, *url.URL) {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+
+	if requested := lp.optIn(r); requested != "" {
+		for _, t := range lp.targets {
+			if t.Name == requested {
+				return t.Name, t.URL
+			}
+		}
+	}
+
+	b := bucket(r.Host)
+	cumulative := 0
+	for _, t := range lp.targets {
+		cumulative += t.Weight
+		if b < cumulative {
+			return t.Name, t.URL
+		}
+	}
+	last := lp.targets[len(lp.targets)-1]
+	return last.Name, last.URL
+}
+
+// GetLoadingPagesHandler lists the loading page targets and their weights.
+func (a *App) GetLoadingPagesHandler(w http.ResponseWriter, r *http.Request) {
+	targets := a.loadingPages.Targets()
+	writeJSON(w, http.StatusOK, &LoadingPagesResponse{Targets: targets})
+}
+
+// SetLoadingPageWeightsHandler replaces the loading page target weights. The
+// body is a JSON object mapping each target name to its new weight.
+func (a *App) SetLoadingPageWeightsHandler(w http.ResponseWriter, r *http.Request) {
+	var weights map[string]int
+	if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.loadingPages.SetWeights(weights); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("loading page weights set to %v", weights)
+	a.GetLoadingPagesHandler(w, r)
+}
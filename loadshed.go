@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// schedulerProbeInterval is how often the scheduler latency probe runs.
+const schedulerProbeInterval = 100 * time.Millisecond
+
+var shedRequests = NewCounterVec(
+	"shed_requests_total",
+	"Requests rejected by load shedding, by the limit that was exceeded.",
+	"reason",
+)
+
+// LoadShedder rejects new requests with a fast 503 while the service is
+// overloaded, so that health checks and requests that were already admitted
+// can still be served. A limit of zero disables the corresponding check.
+type LoadShedder struct {
+	maxInFlight      int64
+	maxGoroutines    int
+	maxLatency       time.Duration
+	retryAfter       string
+	exemptPrefixes   []string
+	inFlight         atomic.Int64
+	schedulerLatency atomic.Int64
+}
+
+// NewLoadShedder returns a LoadShedder configured from the
+// vice.default_backend.load_shedding section of the config, or nil if no
+// limits are set.
+func NewLoadShedder(cfg *viper.Viper) *LoadShedder {
+	cfg.SetDefault("vice.default_backend.load_shedding.retry_after", 5)
+	cfg.SetDefault("vice.default_backend.load_shedding.exempt_paths", []string{"/healthz", "/readyz", "/startupz", "/api/v1/admin/metrics"})
+
+	ls := &LoadShedder{
+		maxInFlight:    cfg.GetInt64("vice.default_backend.load_shedding.max_in_flight"),
+		maxGoroutines:  cfg.GetInt("vice.default_backend.load_shedding.max_goroutines"),
+		maxLatency:     cfg.GetDuration("vice.default_backend.load_shedding.max_scheduler_latency"),
+		retryAfter:     strconv.Itoa(cfg.GetInt("vice.default_backend.load_shedding.retry_after")),
+		exemptPrefixes: cfg.GetStringSlice("vice.default_backend.load_shedding.exempt_paths"),
+	}
+	if ls.maxInFlight <= 0 && ls.maxGoroutines <= 0 && ls.maxLatency <= 0 {
+		return nil
+	}
+
+	if ls.maxLatency > 0 {
+		go ls.probeScheduler()
+	}
+	return ls
+}
+
+// probeScheduler measures how late the runtime wakes up a ticker, which
+// grows as goroutines compete for CPU.
+func (ls *LoadShedder) probeScheduler() {
+	ticker := time.NewTicker(schedulerProbeInterval)
+	defer ticker.Stop()
+	expected := time.Now().Add(schedulerProbeInterval)
+	for now := range ticker.C {
+		lag := now.Sub(expected)
+		if lag < 0 {
+			lag = 0
+		}
+		ls.schedulerLatency.Store(int64(lag))
+		expected = now.Add(schedulerProbeInterval)
+	}
+}
+
+// overloaded returns the reason the service is overloaded, or an empty string
+// if it isn't.
+func (ls *LoadShedder) overloaded() string {
+	switch {
+	case ls.maxInFlight > 0 && ls.inFlight.Load() >= ls.maxInFlight:
+		return "in_flight"
+	case ls.maxGoroutines > 0 && runtime.NumGoroutine() >= ls.maxGoroutines:
+		return "goroutines"
+	case ls.maxLatency > 0 && time.Duration(ls.schedulerLatency.Load()) >= ls.maxLatency:
+		return "scheduler_latency"
+	default:
+		return ""
+	}
+}
+
+func (ls *LoadShedder) exempt(r *http.Request) bool {
+	for _, prefix := range ls.exemptPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware sheds requests while the service is overloaded.
+func (ls *LoadShedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ls.exempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reason := ls.overloaded(); reason != "" {
+			shedRequests.Inc(reason)
+			w.Header().Set("Retry-After", ls.retryAfter)
+			http.Error(w, "the service is overloaded, please try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		ls.inFlight.Add(1)
+		defer ls.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
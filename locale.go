@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cyverse-de/vice-default-backend/urls"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/text/language"
+)
+
+// Defaults for the locale settings.
+const (
+	defaultLocaleParam   = "locale"
+	defaultLocaleDefault = "en"
+)
+
+// Locales picks the locale a request should be served in and passes it on to
+// the loading page, so that the loading page doesn't need to work it out
+// again and both services agree on it. The locale from the user's profile,
+// which the DE stores in a cookie shared with the VICE domain, takes
+// precedence over the Accept-Language header.
+type Locales struct {
+	matcher   language.Matcher
+	supported []language.Tag
+	param     string
+	cookie    string
+}
+
+// NewLocales returns a Locales configured from the vice.default_backend.locale
+// section of the config, or nil if vice.default_backend.locale.enabled isn't
+// set. The first of the supported locales is used when none of the user's
+// preferences match.
+func NewLocales(cfg *viper.Viper) (*Locales, error) {
+	cfg.SetDefault("vice.default_backend.locale.param", defaultLocaleParam)
+	cfg.SetDefault("vice.default_backend.locale.supported", []string{defaultLocaleDefault})
+
+	if !cfg.GetBool("vice.default_backend.locale.enabled") {
+		return nil, nil
+	}
+
+	var supported []language.Tag
+	for _, s := range cfg.GetStringSlice("vice.default_backend.locale.supported") {
+		tag, err := language.Parse(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse the locale %q in vice.default_backend.locale.supported", s)
+		}
+		supported = append(supported, tag)
+	}
+	if len(supported) == 0 {
+		return nil, errors.New("vice.default_backend.locale.supported needs at least one locale")
+	}
+
+	return &Locales{
+		matcher:   language.NewMatcher(supported),
+		supported: supported,
+		param:     cfg.GetString("vice.default_backend.locale.param"),
+		cookie:    cfg.GetString("vice.default_backend.locale.cookie"),
+	}, nil
+}
+
+// Detect returns the supported locale that best matches the request.
+func (l *Locales) Detect(r *http.Request) string {
+	var preferred []language.Tag
+	if l.cookie != "" {
+		if c, err := r.Cookie(l.cookie); err == nil {
+			if tag, err := language.Parse(c.Value); err == nil {
+				preferred = append(preferred, tag)
+			}
+		}
+	}
+	// A malformed header is ignored.
+	accepted, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	preferred = append(preferred, accepted...)
+
+	_, index, _ := l.matcher.Match(preferred...)
+	return l.supported[index].String()
+}
+
+// Negotiate returns the supported locale that best matches the request, and
+// adds the headers it depends on to the response's Vary header.
+func (l *Locales) Negotiate(w http.ResponseWriter, r *http.Request) string {
+	vary(w, "Accept-Language")
+	if l.cookie != "" {
+		vary(w, "Cookie")
+	}
+	return l.Detect(r)
+}
+
+// Apply adds the locale to a loading page URL.
+func (l *Locales) Apply(u *url.URL, locale string) {
+	urls.SetQuery(u, l.param, locale)
+}
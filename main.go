@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"expvar"
 	"flag"
 	"fmt"
-	"html/template"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/configurate"
+	"github.com/cyverse-de/vice-default-backend/urls"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
@@ -25,27 +30,138 @@ func init() {
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 }
 
+// defaultRedirectCacheControl is the default Cache-Control header of the
+// redirects to the loading page. A cached redirect would keep sending users to
+// the loading page after their app is ready.
+const defaultRedirectCacheControl = "no-store"
+
 // App contains the http handlers for the application.
 type App struct {
 	db                       *sql.DB
+	replica                  *ReplicaDB
+	lookups                  queryer
 	viceBaseURL              string
 	loadingPageBaseURL       *url.URL
-	notFoundPath             string
+	loadingPages             *LoadingPages
+	locales                  *Locales
+	stateTokens              *StateTokens
+	deepLinks                *DeepLinks
+	bouncePage               bool
+	lookupTimeout            time.Duration
+	retryAfter               int
+	redirectCacheControl     string
+	waitPage                 *WaitPage
+	statusMaxWait            time.Duration
+	statusPollInterval       time.Duration
+	sharedWarning            *SharedWarning
+	suspensions              *Suspensions
+	relaunch                 *RelaunchLinks
+	supportURL               string
+	appExposer               *AppExposer
+	auth                     *Auth
+	users                    *UserProfiles
+	userDomain               string
+	preferences              *Preferences
 	disableCustomHeaderMatch bool
+	adminToken               string
+	banner                   *BannerStore
+	flags                    *Flags
+	pages                    *Pages
+	maintenance              *Maintenance
+	decisions                *DecisionLog
+	requestRate              *RateCounter
+	stats                    *Stats
+	rollup                   *StatsRollup
+	unknownSubdomains        *UnknownSubdomains
+	audit                    *AuditLog
+	notifier                 *Notifier
+	alerts                   *Alerter
+	emitters                 *Emitters
+	geoip                    *GeoIP
+	cache                    *LookupCache
+	fixtures                 *Fixtures
+	dbDisabled               bool
+	startup                  *Startup
+	health                   *HealthChecker
+	branding                 *Branding
+	hosts                    *HostAllowlist
+	draining                 atomic.Bool
+	selfTest                 SelfTestConfig
 }
 
 // AppURL returns the fully-formed app URL based on the request passed in. Uses
 // the Host header and the configured VICE base URL to construct the app URL.
+// When the host is already under the base URL's domain, the labels in front
+// of the domain, including any nested subdomains, are kept as they are.
 func (a *App) AppURL(r *http.Request) (string, error) {
 	fmt.Printf("%+v\n", r)
 	parsed, err := url.Parse(a.viceBaseURL)
 	if err != nil {
 		return "", err
 	}
-	parsed.Host = fmt.Sprintf("%s.%s", r.Host, parsed.Host)
-	parsed.RawPath = r.URL.RawPath
-	parsed.RawQuery = r.URL.RawQuery
-	return parsed.String(), nil
+	labels, _, ok := splitHost(r.Host, parsed.Hostname())
+	if !ok {
+		labels = []string{r.Host}
+	}
+	return urls.App(parsed, labels, r.URL).String(), nil
+}
+
+// Subdomain returns the subdomain that the request was sent to. The host in
+// the X-Frontend-Url header is used if it's present, unless custom header
+// matching is disabled.
+func (a *App) Subdomain(r *http.Request) string {
+	host := r.Host
+	if frontendHost := a.frontendHost(r); frontendHost != "" {
+		host = frontendHost
+	}
+	labels, _, _ := splitHost(host, a.baseDomain())
+	return labels[len(labels)-1]
+}
+
+// frontendHost returns the host in the X-Frontend-Url header, or an empty
+// string if there isn't one or custom header matching is disabled.
+func (a *App) frontendHost(r *http.Request) string {
+	if a.disableCustomHeaderMatch {
+		return ""
+	}
+	if frontendURL := r.Header.Get("X-Frontend-Url"); frontendURL != "" {
+		if parsed, err := url.Parse(frontendURL); err == nil {
+			return parsed.Host
+		}
+	}
+	return ""
+}
+
+// baseDomain returns the domain of the VICE base URL.
+func (a *App) baseDomain() string {
+	parsed, err := url.Parse(a.viceBaseURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
+
+// splitHost splits a host into the labels of its subdomain and its domain,
+// without the port. When the host is under the base domain, every label in
+// front of the base domain belongs to the subdomain, and ok is true. The last
+// of them identifies the analysis; the others are nested subdomains, as in
+// port1.a1b2c3.cyverse.run for apps that expose more than one port. Other
+// hosts are split at the first label.
+func splitHost(host, baseDomain string) (labels []string, domain string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	baseDomain = strings.TrimSuffix(baseDomain, ".")
+
+	if baseDomain != "" && len(host) > len(baseDomain)+1 {
+		i := len(host) - len(baseDomain)
+		if host[i-1] == '.' && strings.EqualFold(host[i:], baseDomain) {
+			return strings.Split(host[:i-1], "."), host[i:], true
+		}
+	}
+	subdomain, domain, _ := strings.Cut(host, ".")
+	return []string{subdomain}, domain, false
 }
 
 // TemplateURL is used for interpolating the URL into the template passed
@@ -57,38 +173,303 @@ type TemplateURL struct {
 // RouteRequest determines whether to redirect a request to the 404 handler,
 // the landing page, or the loading page.
 func (a *App) RouteRequest(w http.ResponseWriter, r *http.Request) {
+	decision := a.newDecision(r)
+	defer func() {
+		SpanFromContext(r.Context()).SetDecision(decision)
+		a.recordDecision(*decision)
+	}()
+
+	if a.hosts != nil {
+		var header string
+		if !a.hosts.Allowed(r.Host) {
+			header = "host"
+		} else if frontendHost := a.frontendHost(r); frontendHost != "" && !a.hosts.Allowed(frontendHost) {
+			header = "x_frontend_url"
+		}
+		if header != "" {
+			// The host is left out of the decision so that spoofed hosts
+			// don't end up in the logs.
+			decision.Host, decision.Subdomain = "", ""
+			decision.Outcome = OutcomeForbidden
+			decision.Reason = ReasonHostNotAllowed
+			a.hosts.Reject(w, header)
+			return
+		}
+	}
+	a.route(w, r, decision)
+}
+
+// newDecision starts the routing decision for a request.
+func (a *App) newDecision(r *http.Request) *Decision {
+	decision := &Decision{
+		Host:      r.Host,
+		Subdomain: a.Subdomain(r),
+		Client:    ClassifyUserAgent(r.UserAgent()),
+	}
+	if a.geoip != nil {
+		geo := a.geoip.Lookup(clientIP(r))
+		decision.Country = geo.Country
+		decision.ASN = geo.ASN
+	}
+	return decision
+}
+
+// route handles a request, filling in the decision passed in as it goes. Dry
+// runs skip auth gating and owner notifications.
+func (a *App) route(w http.ResponseWriter, r *http.Request, decision *Decision) {
+	if a.maintenance.Enabled() {
+		decision.Outcome = OutcomeMaintenance
+		decision.Reason = ReasonMaintenanceMode
+		a.MaintenanceHandler(w, r)
+		return
+	}
+
+	// Requests passed on by the ingress controller for apps that failed don't
+	// need routing.
+	if code := upstreamError(r); code != 0 {
+		a.UpstreamErrorHandler(w, r, code, decision)
+		return
+	}
+
+	if a.auth != nil && !decision.dryRun {
+		session, err := a.auth.Session(r)
+		switch {
+		case err != nil:
+			// Fail open like the database lookups do. The apps themselves
+			// still require a login.
+			log.Errorf("error checking the session for subdomain %s, continuing anyway: %s", decision.Subdomain, err)
+		case session == nil:
+			returnURL, err := a.AppURL(r)
+			if err != nil {
+				decision.Outcome = OutcomeError
+				decision.Reason = ReasonBadAppURL
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			decision.Outcome = OutcomeLogin
+			decision.Reason = ReasonNoSession
+			decision.Location = a.auth.LoginURL(returnURL)
+			http.Redirect(w, r, decision.Location, http.StatusFound)
+			return
+		default:
+			decision.Visitor = a.Visitor(r, session)
+		}
+	}
+
+	variant, loadingPageBaseURL := a.loadingPages.Select(r)
+
+	// Known users' preferences override the weights, but not explicit opt-ins.
+	pref := &UserPreference{}
+	if a.preferences != nil && decision.Visitor != "" {
+		if p, err := a.preferences.Get(r.Context(), decision.Visitor); err != nil {
+			log.Errorf("error getting the preferences of %s: %s", decision.Visitor, err)
+		} else {
+			pref = p
+		}
+		if pref.LoadingPageVariant != "" && a.loadingPages.optIn(r) == "" {
+			if u, ok := a.loadingPages.Target(pref.LoadingPageVariant); ok {
+				variant, loadingPageBaseURL = pref.LoadingPageVariant, u
+			}
+		}
+	}
+	decision.Variant = variant
+
+	// The analysis and its state are only known when the subdomain is looked
+	// up. Otherwise, the app is assumed to be launching.
+	var analysis *Analysis
+	state := StateLaunching
+	decision.Reason = ReasonNotValidated
+	if !a.dbDisabled && a.flags.Enabled(r, FlagDBValidation) {
+		ctx := r.Context()
+		if a.lookupTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, a.lookupTimeout)
+			defer cancel()
+		}
+		var err error
+		analysis, err = a.LookupAnalysis(ctx, decision.Subdomain)
+		switch {
+		case err != nil:
+			// Fail open so that a database problem doesn't take every VICE app down.
+			log.Errorf("error looking up subdomain %s, redirecting anyway: %s", decision.Subdomain, err)
+			decision.Reason = ReasonLookupFailed
+			if isTimeout(err) {
+				decision.Reason = ReasonLookupTimeout
+			}
+		case analysis == nil:
+			decision.Outcome = OutcomeNotFound
+			decision.Reason = ReasonUnknownSubdomain
+			a.notFound(w, r, decision.Visitor)
+			return
+		default:
+			decision.Reason = ReasonAnalysisFound
+			decision.AnalysisID = analysis.ID
+			state = analysis.State()
+			decision.Username = analysis.Username
+			if a.notifier != nil && !decision.dryRun {
+				a.notifier.Observe(analysis)
+			}
+			if analysis.Deleted {
+				decision.Outcome = OutcomeDeleted
+				decision.Reason = ReasonAnalysisDeleted
+				a.DeletedHandler(w, r, analysis)
+				return
+			}
+			if analysis.Ended() {
+				decision.Outcome = OutcomeEnded
+				decision.Reason = ReasonAnalysisEnded
+				a.EndedHandler(w, r, analysis)
+				return
+			}
+			if a.suspensions != nil {
+				if suspension := a.suspensions.Get(analysis); suspension != nil {
+					decision.Outcome = OutcomeSuspended
+					decision.Reason = ReasonQuotaSuspended
+					if suspension.Kind == StatePaused {
+						decision.Reason = ReasonAnalysisPaused
+					}
+					a.SuspendedHandler(w, r, analysis, suspension, decision.Visitor)
+					return
+				}
+			}
+			if analysis.State() == StateTerminating {
+				decision.Outcome = OutcomeTerminating
+				decision.Reason = ReasonSavingOutputs
+				a.TerminatingHandler(w, r, analysis)
+				return
+			}
+			if a.sharedWarning != nil && !pref.SkipSharedWarning && a.sharedWarning.Required(r, analysis) {
+				decision.Outcome = OutcomeWarning
+				decision.Reason = ReasonSharedAnalysis
+				a.SharedWarningHandler(w, r, analysis)
+				return
+			}
+		}
+	}
+
+	if wantsRetry(w, r) {
+		decision.Outcome = OutcomeRetry
+		a.RetryHandler(w, r, decision, state)
+		return
+	}
+
+	// The loading page only sends the client back once it thinks the app is
+	// ready, so a request from the loading page means the ingress hasn't
+	// caught up yet. Sending it back would nest the loading page URLs.
+	if a.loadingPages.FromLoadingPage(r) {
+		decision.Reason = ReasonFromLoadingPage
+		if a.waitPage == nil {
+			decision.Outcome = OutcomeRetry
+			a.RetryHandler(w, r, decision, state)
+			return
+		}
+		decision.Outcome = OutcomeWait
+		decision.Variant = VariantWait
+		a.WaitPageHandler(w, r, analysis)
+		return
+	}
+
+	if a.waitPage != nil && a.waitPage.Wanted(r, a.loadingPages) {
+		decision.Outcome = OutcomeWait
+		decision.Variant = VariantWait
+		a.WaitPageHandler(w, r, analysis)
+		return
+	}
+
+	if a.deepLinks != nil {
+		r = a.deepLinks.Handle(w, r)
+	}
+
 	appURL, err := a.AppURL(r)
 	if err != nil {
+		decision.Outcome = OutcomeError
+		decision.Reason = ReasonBadAppURL
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"country": decision.Country,
+		"asn":     decision.ASN,
+		"client":  decision.Client,
+		"user":    decision.Visitor,
+	}).Debugf("app url: %s, loading page variant: %s", appURL, variant)
+	loadingURL, err := a.LoadingURL(w, r, loadingPageBaseURL, appURL, decision)
+	if err != nil {
+		decision.Outcome = OutcomeError
+		decision.Reason = ReasonStateTokenFailed
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	decision.Outcome = OutcomeRedirect
+	decision.Location = loadingURL.String()
 
-	log.Infof("app url: %s", appURL)
-	loadingURL := a.loadingPageBaseURL.JoinPath(template.URLQueryEscaper(appURL))
+	// Browsers get the bounce page so that the URL fragment, which isn't sent
+	// to the server, survives the redirect.
+	if a.bouncePage && decision.Client == ClientBrowser {
+		a.BounceHandler(w, r, loadingPageBaseURL, appURL, decision)
+		return
+	}
+	if a.redirectCacheControl != "" {
+		w.Header().Set("Cache-Control", a.redirectCacheControl)
+	}
 	http.Redirect(w, r, loadingURL.String(), http.StatusTemporaryRedirect)
 }
 
+// LoadingURL returns the URL of the loading page for an app, passing it the
+// app URL directly, as the last segment of the path, or in a state token,
+// along with the user's locale.
+func (a *App) LoadingURL(w http.ResponseWriter, r *http.Request, base *url.URL, appURL string, decision *Decision) (*url.URL, error) {
+	loadingURL := urls.WithPathSegment(base, appURL)
+	if a.stateTokens != nil {
+		var err error
+		if loadingURL, err = a.stateTokens.LoadingURL(base, appURL, decision.Subdomain, decision.AnalysisID); err != nil {
+			return nil, err
+		}
+	}
+	if a.locales != nil {
+		a.locales.Apply(loadingURL, a.locales.Negotiate(w, r))
+	}
+	SpanFromContext(r.Context()).AddToURL(loadingURL)
+	return loadingURL, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			os.Exit(runStatusCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "smoke-test":
+			os.Exit(runSmokeTestCommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	log.Logger.SetReportCaller(true)
 
 	var (
 		err                      error
 		cfg                      *viper.Viper
-		dbURI                    string
+		dbURIs                   []string
 		viceBaseURL              string
 		loadingPageURL           string
 		loadingPageBaseURL       *url.URL
 		configPath               = flag.String("config", "/etc/iplant/de/jobservices.yml", "Path to the config file")
-		listenAddr               = flag.String("listen", "0.0.0.0:60000", "The listen address.")
+		listenAddr               = flag.String("listen", "0.0.0.0:60000", "Comma-separated listen addresses, e.g. 0.0.0.0:60000,[::]:60000.")
 		sslCert                  = flag.String("ssl-cert", "", "The path to the SSL .crt file.")
 		sslKey                   = flag.String("ssl-key", "", "The path to the SSL .key file.")
 		staticFilePath           = flag.String("static-file-path", "./static", "Path to static file assets.")
 		disableCustomHeaderMatch = flag.Bool("disable-custom-header-match", false, "Disables usage of the X-Frontend-Url header for subdomain matching. Use Host header instead. Useful during development.")
 		logLevel                 = flag.String("log-level", "info", "One of trace, debug, info, warn, error, fatal, or panic.")
+		devMode                  = flag.Bool("dev", false, "Run without Postgres, serving analyses from in-memory fixtures. For local development only.")
+		disableDB                = flag.Bool("disable-db", false, "Run without a database, redirecting every request to the loading page without validating it.")
+		profiles                 = flag.String("profile", envOr("VICE_DEFAULT_BACKEND_PROFILE", ""), "Comma-separated config profiles whose overlay files, such as jobservices.qa.yml, are merged over the config file in order.")
+		devFixtures              = flag.String("dev-fixtures", "", "YAML file of analyses to serve with --dev. Built-in examples are used if it's not set.")
 	)
 
 	flag.Parse()
 
+	startup := NewStartup(StartupConfig, StartupDatabase, StartupMigrations, StartupCache)
+
 	var levelSetting logrus.Level
 
 	switch *logLevel {
@@ -113,20 +494,78 @@ func main() {
 	log.Logger.SetLevel(levelSetting)
 
 	log.Infof("Reading config from %s", *configPath)
-	if _, err = os.Open(*configPath); err != nil {
+	if _, err = os.Open(*configPath); err == nil {
+		cfg, err = configurate.Init(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Done reading config from %s", *configPath)
+	} else if *devMode {
+		log.Warnf("%s doesn't exist, using the development defaults", *configPath)
+		cfg = viper.New()
+	} else {
 		log.Fatal(*configPath)
 	}
 
-	cfg, err = configurate.Init(*configPath)
+	if err = ApplyProfiles(cfg, *configPath, parseProfiles(*profiles)); err != nil {
+		log.Fatal(err)
+	}
+
+	otlpLogs, err := NewOTLPLogExporter(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Infof("Done reading config from %s", *configPath)
+	if otlpLogs != nil {
+		log.Logger.AddHook(otlpLogs)
+		go otlpLogs.Run(context.Background())
+		log.Infof("exporting logs to %s", cfg.GetString("vice.default_backend.otel.logs.endpoint"))
+	}
 
-	// Make sure the db.uri URL is parseable
-	dbURI = cfg.GetString("vice.db.uri")
-	if _, err = url.Parse(dbURI); err != nil {
-		log.Fatal(errors.Wrap(err, "Can't parse db.uri in the config file"))
+	if *devMode {
+		cfg.SetDefault("vice.default_backend.base_url", "https://cyverse.run")
+		cfg.SetDefault("vice.default_backend.loading_page_url", "http://localhost:3000/")
+		cfg.SetDefault("vice.default_backend.flags.values", map[string]interface{}{FlagDBValidation: true})
+	}
+
+	cfg.SetDefault("vice.default_backend.retry_after", defaultRetryAfter)
+	cfg.SetDefault("vice.default_backend.redirect_cache_control", defaultRedirectCacheControl)
+	cfg.SetDefault("vice.default_backend.status.max_wait", defaultStatusMaxWait)
+	cfg.SetDefault("vice.default_backend.status.poll_interval", defaultStatusPollInterval)
+
+	if err = ConfigureTerminating(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	remoteConfig, err := NewRemoteConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if remoteConfig != nil {
+		if err = remoteConfig.Load(context.Background(), cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Replace the settings that are mapped to secrets with their values
+	secrets, err := NewSecrets(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = secrets.Apply(context.Background(), cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	limits := ApplyRuntimeLimits(cfg)
+	log.Infof(
+		"GOMAXPROCS is %d (%s), memory limit is %d bytes (%s)",
+		limits.GOMAXPROCS, limits.GOMAXPROCSSource, limits.MemoryLimit, limits.MemoryLimitSource,
+	)
+
+	// Work out the database URI, reading the credentials from secret files if
+	// they are configured
+	dbURIs, err = DatabaseURIs(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Make sure the base URL is parseable
@@ -135,21 +574,70 @@ func main() {
 		log.Fatal(errors.Wrap(err, "Cannot parse vice.default_backend.base_url from the configuration file"))
 	}
 
+	if err = ConfigureTrustedProxies(cfg); err != nil {
+		log.Fatal(err)
+	}
+
 	// Make sure the loading page URL is parseable
 	loadingPageURL = cfg.GetString("vice.default_backend.loading_page_url")
 	if loadingPageBaseURL, err = url.Parse(loadingPageURL); err != nil {
 		log.Fatal(errors.Wrap(err, "Cannot parse vice.default_backend.loading_page_url"))
 	}
+	startup.Complete(StartupConfig)
 
-	// Test database connection
-	db, err := sql.Open("postgres", dbURI)
-	if err != nil {
-		log.Fatal(errors.Wrapf(err, "error connecting to database %s", dbURI))
+	if *devMode && *disableDB {
+		log.Fatal("--dev and --disable-db can't be used together")
 	}
 
-	if err = db.Ping(); err != nil {
-		log.Fatal(errors.Wrapf(err, "error pinging database %s", dbURI))
+	var (
+		db       *sql.DB
+		fixtures *Fixtures
+	)
+	switch {
+	case *disableDB:
+		log.Warn("the database is disabled, all requests will be redirected to the loading page without validation")
+	case *devMode:
+		log.Warn("running in development mode, without a database")
+		if fixtures, err = LoadFixtures(*devFixtures); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("serving fixtures for subdomains %s", strings.Join(fixtures.Subdomains(), ", "))
+	default:
+		connector := NewDBConnector(dbURIs...)
+		vault, err := NewVaultCredentials(cfg, connector)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Test database connection
+		if vault != nil {
+			if err = vault.Fetch(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		db = sql.OpenDB(connector)
+		if vault != nil {
+			go vault.Maintain(db)
+		} else {
+			go NewCredentialWatcher(cfg, secrets, connector).Run(context.Background())
+		}
+		cfg.SetDefault("vice.db.probe_interval", "10s")
+		go connector.Monitor(context.Background(), cfg.GetDuration("vice.db.probe_interval"))
+		cfg.SetDefault("vice.db.pool_stats_interval", defaultPoolStatsInterval)
+		go MonitorPool(context.Background(), "primary", db, cfg.GetDuration("vice.db.pool_stats_interval"))
+
+		if err = db.Ping(); err != nil {
+			log.Fatal(errors.Wrapf(err, "error pinging database %s", redactedURI(connector.DSN())))
+		}
+
+		if cfg.GetBool("vice.default_backend.db.migrate") {
+			if err = Migrate(context.Background(), db); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
+	startup.Complete(StartupDatabase)
+	startup.Complete(StartupMigrations)
 
 	useSSL := false
 	if *sslCert != "" || *sslKey != "" {
@@ -163,41 +651,366 @@ func main() {
 		useSSL = true
 	}
 
-	log.Infof("listen address is %s", *listenAddr)
+	banner, err := NewBannerStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loadingPages, err := NewLoadingPages(cfg, loadingPageBaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth, err := NewAuth(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	locales, err := NewLocales(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stateTokens, err := NewStateTokens(context.Background(), cfg, secrets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stateTokens != nil {
+		go stateTokens.Refresh()
+	}
+
+	mirror, err := NewMirror(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	flags := NewFlags(cfg)
+	if remoteConfig != nil && cfg.GetBool("vice.default_backend.remote_config.watch") {
+		remoteConfig.OnChange(flags.LoadConfig)
+		go remoteConfig.Watch(context.Background(), cfg.AllSettings())
+	}
+	if db != nil && cfg.GetBool("vice.default_backend.flags.use_db") {
+		cfg.SetDefault("vice.default_backend.flags.refresh_interval", "30s")
+		go flags.Poll(context.Background(), db, cfg.GetDuration("vice.default_backend.flags.refresh_interval"))
+	}
+
+	users, err := NewUserProfiles(cfg, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var sharedWarning *SharedWarning
+	if db != nil {
+		if sharedWarning = NewSharedWarning(cfg); sharedWarning != nil {
+			go sharedWarning.Poll(context.Background(), db, cfg.GetDuration("vice.default_backend.shared_warning.refresh_interval"))
+		}
+	}
+
+	suspensions, err := NewSuspensions(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if suspensions != nil && db != nil {
+		go suspensions.Poll(context.Background(), db, cfg.GetDuration("vice.default_backend.suspensions.refresh_interval"))
+	}
+
+	relaunch, err := NewRelaunchLinks(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	appExposer, err := NewAppExposer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	notifier, err := NewNotifier(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	geoip, err := NewGeoIP(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hosts, err := NewHostAllowlist(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	emitters, err := NewEmitters(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unknownSubdomains, err := NewUnknownSubdomains(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go unknownSubdomains.Run(context.Background())
+
+	var (
+		lookups queryer
+		replica *ReplicaDB
+		cache   *LookupCache
+		events  *JobEvents
+	)
+	if db != nil {
+		lookups = lookupQueryer(cfg, db)
+		if replica, err = NewReplicaDB(cfg, lookups); err != nil {
+			log.Fatal(err)
+		}
+		if replica != nil {
+			go replica.Monitor(context.Background())
+			go MonitorPool(context.Background(), "replica", replica.Replica(), cfg.GetDuration("vice.db.pool_stats_interval"))
+			lookups = replica
+		}
+		cache = NewLookupCache(cfg, lookups)
+
+		if events, err = NewJobEvents(cfg, lookups, cache); err != nil {
+			log.Fatal(err)
+		}
+		if events != nil {
+			go events.Run(context.Background())
+		}
+	}
+	if cache != nil {
+		go cache.Poll()
+		go func() {
+			<-cache.WaitLoaded()
+			startup.Complete(StartupCache)
+		}()
+	} else {
+		startup.Complete(StartupCache)
+	}
+
+	pages, err := LoadPages(*staticFilePath, NewAssets(cfg, *staticFilePath))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.SetDefault("vice.default_backend.pages.reload_interval", defaultPagesReloadInterval)
+	if interval := cfg.GetDuration("vice.default_backend.pages.reload_interval"); interval > 0 {
+		go pages.Watch(context.Background(), interval)
+	}
+
+	listenAddrs, err := parseListenAddrs(*listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("listen addresses are %s", strings.Join(listenAddrs, ", "))
 	log.Infof("VICE base is %s", viceBaseURL)
 	log.Infof("loading-page-url: %s", loadingPageURL)
+	for _, t := range loadingPages.Targets() {
+		log.Infof("loading page target %s: %s (%d%%)", t.Name, t.URL, t.Weight)
+	}
 	log.Infof("disable-custom-header-match is %+v", *disableCustomHeaderMatch)
 
 	app := App{
 		db:                       db,
+		replica:                  replica,
+		lookups:                  lookups,
 		disableCustomHeaderMatch: *disableCustomHeaderMatch,
 		loadingPageBaseURL:       loadingPageBaseURL,
+		loadingPages:             loadingPages,
+		locales:                  locales,
+		stateTokens:              stateTokens,
+		deepLinks:                NewDeepLinks(cfg),
+		bouncePage:               cfg.GetBool("vice.default_backend.bounce_page.enabled"),
+		lookupTimeout:            cfg.GetDuration("vice.default_backend.lookup_timeout"),
+		retryAfter:               cfg.GetInt("vice.default_backend.retry_after"),
+		redirectCacheControl:     cfg.GetString("vice.default_backend.redirect_cache_control"),
+		waitPage:                 NewWaitPage(cfg),
+		statusMaxWait:            cfg.GetDuration("vice.default_backend.status.max_wait"),
+		statusPollInterval:       cfg.GetDuration("vice.default_backend.status.poll_interval"),
+		sharedWarning:            sharedWarning,
+		suspensions:              suspensions,
+		relaunch:                 relaunch,
+		supportURL:               cfg.GetString("vice.default_backend.support_url"),
+		appExposer:               appExposer,
+		auth:                     auth,
+		users:                    users,
+		userDomain:               cfg.GetString("vice.default_backend.users.domain"),
+		preferences:              NewPreferences(cfg, db),
 		viceBaseURL:              viceBaseURL,
-		notFoundPath:             filepath.Join(*staticFilePath, "404.html"),
+		adminToken:               cfg.GetString("vice.default_backend.admin.token"),
+		banner:                   banner,
+		flags:                    flags,
+		maintenance:              &Maintenance{},
+		decisions:                NewDecisionLog(recentDecisionsSize),
+		requestRate:              &RateCounter{},
+		stats:                    &Stats{},
+		unknownSubdomains:        unknownSubdomains,
+		notifier:                 notifier,
+		alerts:                   NewAlerter(cfg),
+		emitters:                 emitters,
+		geoip:                    geoip,
+		cache:                    cache,
+		fixtures:                 fixtures,
+		dbDisabled:               *disableDB,
+		startup:                  startup,
+		health:                   NewHealthChecker(cfg),
+		hosts:                    hosts,
+		branding:                 NewBranding(cfg, lookups),
+		selfTest:                 NewSelfTestConfig(cfg),
+		pages:                    pages,
+	}
+
+	app.health.AddDependencies(&app, events)
+	go app.health.Run(context.Background())
+
+	if db != nil && cfg.GetBool("vice.default_backend.audit.enabled") {
+		log.Info("writing routing decisions to the audit log")
+		app.audit = NewAuditLog(db)
+	}
+
+	if app.rollup, err = NewStatsRollup(cfg, db); err != nil {
+		log.Fatal(err)
+	}
+	if app.rollup != nil {
+		log.Info("rolling up routing statistics by hour")
+		go app.rollup.Run(context.Background())
 	}
 
 	r := mux.NewRouter()
 
-	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, app.notFoundPath)
-	})
+	r.NotFoundHandler = http.HandlerFunc(app.NotFoundHandler)
+
+	middleware := NewMiddlewareRegistry()
+	middleware.Register(MiddlewareAdminAuth, app.adminAuth)
+
+	accessLog, err := NewAccessLog(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	middleware.Register(MiddlewareAccessLog, accessLog.Middleware)
+
+	tracer, err := NewTracer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tracer != nil {
+		log.Infof("exporting traces to %s", tracer.endpoint)
+		go tracer.Run(context.Background())
+		middleware.Register(MiddlewareTracing, tracer.Middleware)
+	}
 
+	headers, err := NewResponseHeaders(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if headers != nil {
+		middleware.Register(MiddlewareResponseHeaders, headers.Middleware)
+	}
+
+	if shedder := NewLoadShedder(cfg); shedder != nil {
+		middleware.Register(MiddlewareLoadShedding, shedder.Middleware)
+	}
+
+	if limiter := NewConcurrencyLimiter(cfg); limiter != nil {
+		middleware.Register(MiddlewareConcurrencyLimit, limiter.Middleware)
+	}
+
+	if limiters := NewClassLimiters(cfg); limiters != nil {
+		middleware.Register(MiddlewareClassLimits, limiters.Middleware)
+	}
+
+	if mirror != nil {
+		log.Infof("mirroring %g of requests to %s", mirror.fraction, mirror.target)
+		middleware.Register(MiddlewareMirror, mirror.Middleware)
+	}
+
+	if err = middleware.Configure(cfg); err != nil {
+		log.Fatal(err)
+	}
+	r.Use(middleware.Middleware)
+
+	r.HandleFunc("/healthz/details", app.HealthDetailsHandler)
 	r.PathPrefix("/healthz").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		fmt.Fprintf(w, "I'm healthy.")
 	})
+	r.HandleFunc("/readyz", app.ReadyHandler)
+	r.HandleFunc("/startupz", app.StartupHandler)
 
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(*staticFilePath))))
+	app.RegisterAPIRoutes(r)
+	app.RegisterAdminRoutes(r)
+
+	var staticFiles http.Handler = http.FileServer(http.Dir(*staticFilePath))
+	if cfg.GetBool("vice.default_backend.static.spa_fallback") {
+		staticFiles = NewSPAHandler(*staticFilePath)
+	}
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", pages.Assets().Middleware(staticFiles)))
+
+	spa, err := NewSPAMount(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if spa != nil {
+		log.Infof("serving the single-page app in %s at %s", spa.Dir, spa.Prefix)
+		r.PathPrefix(spa.Prefix).Handler(spa.Handler())
+	}
 
 	r.PathPrefix("/").HandlerFunc(app.RouteRequest)
 
-	server := &http.Server{
-		Handler: r,
-		Addr:    *listenAddr,
+	upgrader := NewUpgrader(cfg)
+	server := NewServer(cfg, strings.Join(listenAddrs, ","), r)
+	servers := []*http.Server{server}
+
+	if grpcHealth := NewGRPCHealthServer(cfg, &app); grpcHealth != nil {
+		log.Infof("serving gRPC health checks on %s", grpcHealth.Addr)
+		grpcListener, err := upgrader.Listen(net.ListenConfig{}, "tcp", grpcHealth.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := grpcHealth.Serve(grpcListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		servers = append(servers, grpcHealth)
 	}
-	if useSSL {
-		err = server.ListenAndServeTLS(*sslCert, *sslKey)
-	} else {
-		err = server.ListenAndServe()
+
+	internal := http.NewServeMux()
+	internal.HandleFunc("/metrics", MetricsHandler)
+	internal.Handle("/debug/vars", expvar.Handler())
+	if internalServer := NewInternalServer(cfg, internal); internalServer != nil {
+		log.Infof("serving metrics and debug variables on %s", internalServer.Addr)
+		internalListener, err := upgrader.Listen(net.ListenConfig{}, "tcp", internalServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := internalServer.Serve(internalListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		servers = append(servers, internalServer)
+	}
+
+	listeners, err := Listen(cfg, listenAddrs, useSSL, upgrader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdown := upgrader.HandleSignals(NewShutdownSettings(cfg, app.Drain), servers...)
+	go func() {
+		<-startup.Done()
+		upgrader.Ready()
+	}()
+
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if useSSL {
+				serveErrs <- server.ServeTLS(listener, *sslCert, *sslKey)
+			} else {
+				serveErrs <- server.Serve(listener)
+			}
+		}(listener)
+	}
+	if err = <-serveErrs; err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	log.Fatal(err)
+	<-shutdown
+	log.Info("shut down")
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Maintenance tracks whether the service is in maintenance mode. While it is,
+// requests for VICE apps get the maintenance page instead of being routed.
+type Maintenance struct {
+	enabled atomic.Bool
+}
+
+// Enabled returns whether maintenance mode is turned on.
+func (m *Maintenance) Enabled() bool {
+	return m.enabled.Load()
+}
+
+// Set turns maintenance mode on or off.
+func (m *Maintenance) Set(enabled bool) {
+	m.enabled.Store(enabled)
+}
+
+// MaintenanceStatus is the body of the maintenance mode admin endpoints.
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// MaintenanceHandler renders the maintenance page.
+func (a *App) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "300")
+	a.renderPage(w, http.StatusServiceUnavailable, "maintenance.html", a.pageData())
+}
+
+// GetMaintenanceHandler reports whether maintenance mode is turned on.
+func (a *App) GetMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &MaintenanceStatus{Enabled: a.maintenance.Enabled()})
+}
+
+// SetMaintenanceHandler turns maintenance mode on or off.
+func (a *App) SetMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var status MaintenanceStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.maintenance.Set(status.Enabled)
+	log.Infof("maintenance mode set to %t", status.Enabled)
+	writeJSON(w, http.StatusOK, &status)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MetadataResponse is the body returned by the app metadata endpoint. It has
+// what the loading page needs to show a card for the analysis without going
+// to the database itself.
+type MetadataResponse struct {
+	Subdomain      string     `json:"subdomain"`
+	Name           string     `json:"name"`
+	State          string     `json:"state"`
+	AppName        string     `json:"app_name,omitempty"`
+	AppDescription string     `json:"app_description,omitempty"`
+	IconURL        string     `json:"icon_url,omitempty"`
+	Owner          string     `json:"owner"`
+	LaunchedAt     *time.Time `json:"launched_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+}
+
+// ownerDisplayName returns the name of an analysis' owner to show to
+// visitors, which is the user name without the user domain.
+func ownerDisplayName(username string) string {
+	name, _, _ := strings.Cut(username, "@")
+	return name
+}
+
+// MetadataHandler describes the analysis behind a subdomain and the app it
+// was launched from. The app details come from the branding lookups, so
+// branding has to be enabled.
+func (a *App) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if a.branding == nil {
+		writeError(w, "app branding is disabled", http.StatusNotFound)
+		return
+	}
+
+	subdomain := mux.Vars(r)["subdomain"]
+	analysis, err := a.LookupAnalysis(r.Context(), subdomain)
+	if err == errDatabaseDisabled {
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Errorf("error looking up subdomain %s: %s", subdomain, err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if analysis == nil {
+		writeError(w, "no analysis uses the subdomain "+subdomain, http.StatusNotFound)
+		return
+	}
+
+	resp := &MetadataResponse{
+		Subdomain:  subdomain,
+		Name:       analysis.Name,
+		State:      analysis.State(),
+		Owner:      ownerDisplayName(analysis.Username),
+		LaunchedAt: analysis.StartDate,
+	}
+	if !analysis.Ended() {
+		resp.ExpiresAt = analysis.PlannedEndDate
+	}
+	if app := a.branding.Get(r.Context(), analysis); app != nil {
+		resp.AppName = app.Name
+		resp.AppDescription = app.Description
+		resp.IconURL = app.IconURL
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsNamespace prefixes the names of all of the metrics exported by the
+// service.
+const metricsNamespace = "vice_default_backend"
+
+// collector is implemented by anything that can write itself out in the
+// Prometheus text exposition format.
+type collector interface {
+	writeMetrics(w io.Writer)
+}
+
+// metricsRegistry holds the collectors exposed on /metrics.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+var registry = &metricsRegistry{}
+
+func (m *metricsRegistry) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// MetricsHandler writes all of the registered metrics in the Prometheus text
+// exposition format.
+func MetricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	registry.mu.Lock()
+	collectors := append([]collector(nil), registry.collectors...)
+	registry.mu.Unlock()
+
+	for _, c := range collectors {
+		c.writeMetrics(w)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats label names and values as a Prometheus label set.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricVec is the shared implementation of the labelled metric types.
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newMetricVec(metricType, name, help string, labels []string) *metricVec {
+	v := &metricVec{
+		name:       fmt.Sprintf("%s_%s", metricsNamespace, name),
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		values:     make(map[string]float64),
+		keys:       make(map[string][]string),
+	}
+	registry.register(v)
+	return v
+}
+
+func (v *metricVec) update(labelValues []string, f func(float64) float64) {
+	if len(labelValues) != len(v.labels) {
+		log.Errorf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues))
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.keys[key]; !ok {
+		v.keys[key] = append([]string(nil), labelValues...)
+	}
+	v.values[key] = f(v.values[key])
+}
+
+func (v *metricVec) writeMetrics(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.metricType)
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", v.name, labelString(v.labels, v.keys[k]), v.values[k])
+	}
+}
+
+// CounterVec is a monotonically increasing counter partitioned by labels.
+type CounterVec struct {
+	*metricVec
+}
+
+// NewCounterVec creates and registers a new CounterVec.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newMetricVec("counter", name, help, labels)}
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by n.
+func (c *CounterVec) Add(n float64, labelValues ...string) {
+	c.update(labelValues, func(v float64) float64 { return v + n })
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct {
+	*metricVec
+}
+
+// NewGaugeVec creates and registers a new GaugeVec.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newMetricVec("gauge", name, help, labels)}
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(n float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return n })
+}
+
+// Reset removes the gauge's values for all label values.
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values = make(map[string]float64)
+	g.keys = make(map[string][]string)
+}
+
+// Add adds n, which may be negative, to the gauge for the given label values.
+func (g *GaugeVec) Add(n float64, labelValues ...string) {
+	g.update(labelValues, func(v float64) float64 { return v + n })
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the histogram buckets
+// used for latencies.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogramSeries holds the observations for one set of label values.
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// HistogramVec counts observations in buckets, partitioned by labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// NewHistogramVec creates and registers a new HistogramVec with the given
+// bucket upper bounds, which must be sorted.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    fmt.Sprintf("%s_%s", metricsNamespace, name),
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registry.register(h)
+	return h
+}
+
+// Observe records a value for the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		log.Errorf("metric %s expects %d label values, got %d", h.name, len(h.labels), len(labelValues))
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) writeMetrics(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, k := range keys {
+		s := h.series[k]
+		for i, bound := range h.buckets {
+			values := append(append([]string(nil), s.labelValues...), strconv.FormatFloat(bound, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, values), s.counts[i])
+		}
+		values := append(append([]string(nil), s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labelString(h.labels, s.labelValues), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, s.labelValues), s.count)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Names of the middleware that can be put in a chain.
+const (
+	MiddlewareLoadShedding     = "load_shedding"
+	MiddlewareConcurrencyLimit = "concurrency_limit"
+	MiddlewareClassLimits      = "class_limits"
+	MiddlewareMirror           = "mirror"
+	MiddlewareAccessLog        = "access_log"
+	MiddlewareAdminAuth        = "admin_auth"
+	MiddlewareResponseHeaders  = "response_headers"
+	MiddlewareTracing          = "tracing"
+)
+
+// knownMiddleware lists every middleware name, whether or not the feature
+// behind it is enabled.
+var knownMiddleware = map[string]bool{
+	MiddlewareLoadShedding:     true,
+	MiddlewareConcurrencyLimit: true,
+	MiddlewareClassLimits:      true,
+	MiddlewareMirror:           true,
+	MiddlewareAccessLog:        true,
+	MiddlewareAdminAuth:        true,
+	MiddlewareResponseHeaders:  true,
+	MiddlewareTracing:          true,
+}
+
+// defaultMiddlewareChain is the chain used for requests that don't match a
+// configured prefix. Tracing comes first so that requests turned away by the
+// other middleware are traced too, and response headers next so that they're
+// added to the responses of the other middleware.
+var defaultMiddlewareChain = []string{
+	MiddlewareTracing,
+	MiddlewareResponseHeaders,
+	MiddlewareLoadShedding,
+	MiddlewareConcurrencyLimit,
+	MiddlewareClassLimits,
+	MiddlewareMirror,
+}
+
+// middlewareChainConfig is the format of an entry in
+// vice.default_backend.middleware.chains.
+type middlewareChainConfig struct {
+	Prefix     string
+	Middleware []string
+}
+
+// middlewareChain is the middleware applied to requests whose paths start
+// with the prefix.
+type middlewareChain struct {
+	prefix     string
+	middleware []mux.MiddlewareFunc
+}
+
+// MiddlewareRegistry holds the cross-cutting request handling features by
+// name, so that they can be wired up per route from the config instead of
+// being applied to every request. Features that are turned off aren't
+// registered, and chains that name them skip them.
+type MiddlewareRegistry struct {
+	middleware map[string]mux.MiddlewareFunc
+	def        []mux.MiddlewareFunc
+	chains     []middlewareChain
+}
+
+// NewMiddlewareRegistry returns an empty MiddlewareRegistry.
+func NewMiddlewareRegistry() *MiddlewareRegistry {
+	return &MiddlewareRegistry{middleware: make(map[string]mux.MiddlewareFunc)}
+}
+
+// Register adds an enabled middleware to the registry.
+func (m *MiddlewareRegistry) Register(name string, mw mux.MiddlewareFunc) {
+	m.middleware[name] = mw
+}
+
+// resolve looks up the middleware in a chain, leaving out the ones that
+// aren't enabled.
+func (m *MiddlewareRegistry) resolve(names []string) ([]mux.MiddlewareFunc, error) {
+	var chain []mux.MiddlewareFunc
+	for _, name := range names {
+		if !knownMiddleware[name] {
+			return nil, errors.Errorf("unknown middleware %q", name)
+		}
+		if mw, ok := m.middleware[name]; ok {
+			chain = append(chain, mw)
+		}
+	}
+	return chain, nil
+}
+
+// Configure builds the chains from the vice.default_backend.middleware
+// section of the config. Requests get the chain with the longest prefix that
+// matches their path, or the default chain if none does. It must be called
+// after all of the middleware has been registered.
+func (m *MiddlewareRegistry) Configure(cfg *viper.Viper) error {
+	cfg.SetDefault("vice.default_backend.middleware.default", defaultMiddlewareChain)
+
+	def, err := m.resolve(cfg.GetStringSlice("vice.default_backend.middleware.default"))
+	if err != nil {
+		return errors.Wrap(err, "cannot parse vice.default_backend.middleware.default")
+	}
+
+	var configured []middlewareChainConfig
+	if err = cfg.UnmarshalKey("vice.default_backend.middleware.chains", &configured); err != nil {
+		return errors.Wrap(err, "cannot parse vice.default_backend.middleware.chains")
+	}
+	var chains []middlewareChain
+	for _, c := range configured {
+		if !strings.HasPrefix(c.Prefix, "/") {
+			return errors.Errorf("middleware chain prefixes must start with /, got %q", c.Prefix)
+		}
+		resolved, err := m.resolve(c.Middleware)
+		if err != nil {
+			return errors.Wrapf(err, "cannot parse the middleware chain for %s", c.Prefix)
+		}
+		chains = append(chains, middlewareChain{prefix: c.Prefix, middleware: resolved})
+	}
+	sort.SliceStable(chains, func(i, j int) bool {
+		return len(chains[i].prefix) > len(chains[j].prefix)
+	})
+
+	m.def, m.chains = def, chains
+	return nil
+}
+
+// chain returns the middleware for a request.
+func (m *MiddlewareRegistry) chain(r *http.Request) []mux.MiddlewareFunc {
+	for _, c := range m.chains {
+		if strings.HasPrefix(r.URL.Path, c.prefix) {
+			return c.middleware
+		}
+	}
+	return m.def
+}
+
+// Middleware applies the chain for each request, with the first middleware in
+// the chain running first.
+func (m *MiddlewareRegistry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chain := m.chain(r)
+		h := next
+		for i := len(chain) - 1; i >= 0; i-- {
+			h = chain[i](h)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const createMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS vice_default_backend_migrations (
+	    version    integer PRIMARY KEY,
+	    applied_at timestamp with time zone NOT NULL DEFAULT now()
+	)
+`
+
+// migrationLockID is the Postgres advisory lock key held while a migration is
+// applied.
+const migrationLockID = 0x76696365
+
+// migration is a numbered SQL script that creates or changes the tables owned
+// by this service.
+type migration struct {
+	version int
+	name    string
+}
+
+// migrations returns the embedded migrations in the order they need to be
+// applied. File names start with the migration's version number.
+func migrations() ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []migration
+	for _, name := range names {
+		base := strings.TrimPrefix(name, "migrations/")
+		prefix, _, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "migration %s doesn't start with a version number", base)
+		}
+		ms = append(ms, migration{version: version, name: name})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	return ms, nil
+}
+
+// Migrate applies any migrations that haven't been applied to the database
+// yet. Each migration runs in its own transaction.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, createMigrationsTable); err != nil {
+		return errors.Wrap(err, "error creating the migrations table")
+	}
+
+	ms, err := migrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if err = applyMigration(ctx, db, m); err != nil {
+			return errors.Wrapf(err, "error applying migration %s", m.name)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	script, err := migrationFiles.ReadFile(m.name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Keep replicas that start at the same time from applying the same migration.
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM vice_default_backend_migrations WHERE version = $1)",
+		m.version,
+	).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO vice_default_backend_migrations (version) VALUES ($1)", m.version); err != nil {
+		return err
+	}
+
+	log.Infof("applied migration %s", m.name)
+	return tx.Commit()
+}
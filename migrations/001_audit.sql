@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS vice_default_backend_audit (
+    id          bigserial PRIMARY KEY,
+    time        timestamp with time zone NOT NULL,
+    host        text NOT NULL,
+    subdomain   text NOT NULL,
+    outcome     text NOT NULL,
+    reason      text NOT NULL,
+    variant     text,
+    location    text,
+    analysis_id uuid,
+    username    text
+);
+
+CREATE INDEX IF NOT EXISTS vice_default_backend_audit_time_idx
+    ON vice_default_backend_audit (time);
+
+CREATE INDEX IF NOT EXISTS vice_default_backend_audit_subdomain_idx
+    ON vice_default_backend_audit (subdomain, time);
+
+CREATE INDEX IF NOT EXISTS vice_default_backend_audit_username_idx
+    ON vice_default_backend_audit (username, time);
@@ -0,0 +1,3 @@
+ALTER TABLE vice_default_backend_audit
+    ADD COLUMN IF NOT EXISTS country text,
+    ADD COLUMN IF NOT EXISTS asn bigint;
@@ -0,0 +1,2 @@
+ALTER TABLE vice_default_backend_audit
+    ADD COLUMN IF NOT EXISTS client text;
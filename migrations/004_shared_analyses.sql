@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS vice_default_backend_shared_analyses (
+    analysis_id uuid PRIMARY KEY,
+    flagged_at  timestamp with time zone NOT NULL DEFAULT now()
+);
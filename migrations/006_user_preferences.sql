@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS vice_default_backend_user_preferences (
+    username             text PRIMARY KEY,
+    loading_page_variant text,
+    skip_shared_warning  boolean NOT NULL DEFAULT false,
+    updated_at           timestamp with time zone NOT NULL DEFAULT now()
+);
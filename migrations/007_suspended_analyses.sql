@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS vice_default_backend_suspended_analyses (
+    analysis_id  uuid PRIMARY KEY,
+    kind         text NOT NULL DEFAULT 'suspended' CHECK (kind IN ('paused', 'suspended')),
+    reason       text,
+    suspended_at timestamp with time zone NOT NULL DEFAULT now()
+);
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS vice_default_backend_audit_time_id_idx
+    ON vice_default_backend_audit (time, id);
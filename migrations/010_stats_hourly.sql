@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS vice_default_backend_stats_hourly (
+    hour    timestamp with time zone NOT NULL,
+    domain  text NOT NULL,
+    outcome text NOT NULL,
+    count   bigint NOT NULL,
+    PRIMARY KEY (hour, domain, outcome)
+);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS vice_default_backend_flags (
+    name    text PRIMARY KEY,
+    enabled boolean NOT NULL
+);
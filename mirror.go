@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// mirrorQueueSize is the number of mirrored requests that can be waiting to be
+// sent before new ones get dropped.
+const mirrorQueueSize = 100
+
+// mirrorCredentialHeaders are never sent to the mirror endpoint, so that
+// users' tokens and sessions don't end up in staging.
+var mirrorCredentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Vice-Flags-Signature",
+}
+
+var mirroredRequests = NewCounterVec(
+	"mirrored_requests_total",
+	"Requests replayed to the mirror endpoint, by result.",
+	"result",
+)
+
+// Mirror asynchronously replays a sampled fraction of incoming requests to a
+// staging instance or collector. Only the method, URL, and headers are sent;
+// request bodies are never mirrored, and neither are credential headers or
+// requests for the excluded paths, such as the admin API.
+type Mirror struct {
+	target          *url.URL
+	fraction        float64
+	stripHeaders    []string
+	excludePrefixes []string
+	client          *http.Client
+	queue           chan *http.Request
+}
+
+// NewMirror returns a Mirror configured from the vice.default_backend.mirror
+// section of the config, or nil if mirroring isn't enabled.
+func NewMirror(cfg *viper.Viper) (*Mirror, error) {
+	cfg.SetDefault("vice.default_backend.mirror.timeout", "5s")
+	cfg.SetDefault("vice.default_backend.mirror.exclude_paths", []string{"/admin", "/api"})
+
+	target := cfg.GetString("vice.default_backend.mirror.url")
+	if target == "" {
+		return nil, nil
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse vice.default_backend.mirror.url")
+	}
+
+	fraction := cfg.GetFloat64("vice.default_backend.mirror.fraction")
+	if fraction < 0 || fraction > 1 {
+		return nil, errors.Errorf("vice.default_backend.mirror.fraction must be between 0 and 1, got %g", fraction)
+	}
+
+	m := &Mirror{
+		target:          parsed,
+		fraction:        fraction,
+		stripHeaders:    append(mirrorCredentialHeaders, cfg.GetStringSlice("vice.default_backend.mirror.strip_headers")...),
+		excludePrefixes: cfg.GetStringSlice("vice.default_backend.mirror.exclude_paths"),
+		client: &http.Client{
+			Timeout: cfg.GetDuration("vice.default_backend.mirror.timeout"),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue: make(chan *http.Request, mirrorQueueSize),
+	}
+	go m.run()
+
+	return m, nil
+}
+
+// run sends the queued requests to the mirror endpoint.
+func (m *Mirror) run() {
+	for req := range m.queue {
+		resp, err := m.client.Do(req)
+		if err != nil {
+			log.Debugf("error mirroring request for %s: %s", req.Host, err)
+			mirroredRequests.Inc("error")
+			continue
+		}
+		resp.Body.Close()
+		mirroredRequests.Inc("sent")
+	}
+}
+
+// copyRequest builds the request that gets sent to the mirror endpoint.
+func (m *Mirror) copyRequest(r *http.Request) (*http.Request, error) {
+	u := *m.target
+	u.Path = r.URL.Path
+	u.RawPath = r.URL.RawPath
+	u.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range m.stripHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set("X-Vice-Mirrored", "true")
+	req.Host = r.Host
+	return req, nil
+}
+
+// excluded returns true if requests for a path are never mirrored.
+func (m *Mirror) excluded(path string) bool {
+	for _, prefix := range m.excludePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware queues a copy of a sample of the requests passing through it.
+func (m *Mirror) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.excluded(r.URL.Path) && rand.Float64() < m.fraction {
+			req, err := m.copyRequest(r)
+			if err != nil {
+				log.Errorf("error copying request for the mirror: %s", err)
+			} else {
+				select {
+				case m.queue <- req:
+				default:
+					mirroredRequests.Inc("dropped")
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
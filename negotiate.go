@@ -0,0 +1,51 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// vary adds request header names to the response's Vary header, so that
+// shared caches and browsers keep the responses negotiated from them apart.
+// Every function that picks a response from a request header calls it with
+// the headers it looked at. Names that are already listed aren't repeated.
+func vary(w http.ResponseWriter, names ...string) {
+	h := w.Header()
+	var all []string
+	listed := make(map[string]bool)
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && !listed[name] {
+				all = append(all, name)
+				listed[name] = true
+			}
+		}
+	}
+	for _, name := range names {
+		if name = http.CanonicalHeaderKey(name); !listed[name] {
+			all = append(all, name)
+			listed[name] = true
+		}
+	}
+	h.Set("Vary", strings.Join(all, ", "))
+}
+
+// prefersJSON returns true if the request's Accept header lists JSON but not
+// HTML, as API clients' requests do and browsers' navigations don't.
+func prefersJSON(r *http.Request) bool {
+	var json, html bool
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			json = true
+		case "text/html", "*/*":
+			html = true
+		}
+	}
+	return json && !html
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+var notificationsSent = NewCounterVec(
+	"notifications_total",
+	"Notifications sent to analysis owners through the notification agent, by kind and result.",
+	"kind", "result",
+)
+
+// Kinds of notifications sent to analysis owners.
+const (
+	NotificationFailedAccess  = "failed_access"
+	NotificationExpiredAccess = "expired_access"
+)
+
+// Notification is the request body accepted by the DE notification agent.
+type Notification struct {
+	Type    string                 `json:"type"`
+	User    string                 `json:"user"`
+	Subject string                 `json:"subject"`
+	Message string                 `json:"message"`
+	Email   bool                   `json:"email"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// Notifier tells analysis owners when their app URL is being used while the
+// analysis can't serve it: immediately if the analysis failed, and after a
+// few attempts if the analysis has ended. Each analysis gets at most one
+// notification of each kind per cooldown period.
+type Notifier struct {
+	endpoint         *url.URL
+	client           *http.Client
+	cooldown         time.Duration
+	expiredThreshold int
+
+	mu     sync.Mutex
+	access map[string]*accessAttempts
+}
+
+// accessAttempts tracks the attempts to access an analysis during a cooldown
+// period.
+type accessAttempts struct {
+	start    time.Time
+	count    int
+	notified bool
+}
+
+// NewNotifier returns a Notifier configured from the config, or nil if
+// notifications aren't enabled.
+func NewNotifier(cfg *viper.Viper) (*Notifier, error) {
+	cfg.SetDefault("vice.default_backend.notifications.cooldown", "24h")
+	cfg.SetDefault("vice.default_backend.notifications.expired_threshold", 3)
+
+	if !cfg.GetBool("vice.default_backend.notifications.enabled") {
+		return nil, nil
+	}
+
+	base, err := url.Parse(cfg.GetString("notification_agent.base"))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse notification_agent.base")
+	}
+
+	return &Notifier{
+		endpoint:         base.JoinPath("notification"),
+		client:           &http.Client{Timeout: 10 * time.Second},
+		cooldown:         cfg.GetDuration("vice.default_backend.notifications.cooldown"),
+		expiredThreshold: cfg.GetInt("vice.default_backend.notifications.expired_threshold"),
+		access:           make(map[string]*accessAttempts),
+	}, nil
+}
+
+// shouldNotify records an access attempt of the given kind and returns true
+// if it should result in a notification.
+func (n *Notifier) shouldNotify(kind, analysisID string, threshold int) bool {
+	key := kind + ":" + analysisID
+	now := time.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Forget about attempts from previous cooldown periods.
+	for k, a := range n.access {
+		if now.Sub(a.start) > n.cooldown {
+			delete(n.access, k)
+		}
+	}
+
+	a, ok := n.access[key]
+	if !ok {
+		a = &accessAttempts{start: now}
+		n.access[key] = a
+	}
+	if a.notified {
+		return false
+	}
+	a.count++
+	if a.count < threshold {
+		return false
+	}
+	a.notified = true
+	return true
+}
+
+// Observe is called when a request arrives for an analysis' subdomain.
+func (n *Notifier) Observe(analysis *Analysis) {
+	var kind, subject, message string
+	switch analysis.State() {
+	case StateFailed:
+		if !n.shouldNotify(NotificationFailedAccess, analysis.ID, 1) {
+			return
+		}
+		kind = NotificationFailedAccess
+		subject = fmt.Sprintf("%s is being accessed but has failed", analysis.Name)
+		message = fmt.Sprintf("Your analysis %s failed, but its URL is still being visited. You may want to relaunch it.", analysis.Name)
+	case StateCompleted, StateCanceled:
+		if !n.shouldNotify(NotificationExpiredAccess, analysis.ID, n.expiredThreshold) {
+			return
+		}
+		kind = NotificationExpiredAccess
+		subject = fmt.Sprintf("%s is being accessed but has ended", analysis.Name)
+		message = fmt.Sprintf("Your analysis %s has ended, but its URL is still being visited. You may want to relaunch it.", analysis.Name)
+	default:
+		return
+	}
+
+	go n.send(kind, &Notification{
+		Type:    "analysis",
+		User:    analysis.Username,
+		Subject: subject,
+		Message: message,
+		Payload: map[string]interface{}{
+			"analysis_id": analysis.ID,
+			"subdomain":   analysis.Subdomain,
+			"status":      analysis.Status,
+		},
+	})
+}
+
+// send posts a notification to the notification agent.
+func (n *Notifier) send(kind string, notification *Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		log.Errorf("error encoding notification: %s", err)
+		return
+	}
+
+	resp, err := n.client.Post(n.endpoint.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("error sending %s notification to %s: %s", kind, notification.User, err)
+		notificationsSent.Inc(kind, "error")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Errorf("notification agent returned %s for a %s notification to %s", resp.Status, kind, notification.User)
+		notificationsSent.Inc(kind, "error")
+		return
+	}
+
+	log.Infof("sent %s notification to %s", kind, notification.User)
+	notificationsSent.Inc(kind, "sent")
+}
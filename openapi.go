@@ -0,0 +1,279 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/gorilla/mux"
+)
+
+// APIParam documents a query parameter.
+type APIParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// APIOperation annotates a route with the information needed to describe it
+// in the OpenAPI document. Request and Response are values of the types that
+// are decoded from and encoded into the bodies; their schemas are derived
+// from the types' JSON encoding.
+type APIOperation struct {
+	Summary  string
+	Query    []APIParam
+	Request  interface{}
+	Response interface{}
+	Status   int
+	Produces []string
+}
+
+// openAPISchemaer is implemented by types whose JSON encoding doesn't follow
+// their struct fields.
+type openAPISchemaer interface {
+	openAPISchema() map[string]interface{}
+}
+
+type documentedRoute struct {
+	route *mux.Route
+	op    APIOperation
+}
+
+// apiRegistry holds the documented routes.
+type apiRegistry struct {
+	mu     sync.Mutex
+	routes []documentedRoute
+}
+
+var apiDocs = &apiRegistry{}
+
+// documented records the route and its annotation for the OpenAPI document
+// and returns the route.
+func documented(route *mux.Route, op APIOperation) *mux.Route {
+	apiDocs.mu.Lock()
+	defer apiDocs.mu.Unlock()
+	apiDocs.routes = append(apiDocs.routes, documentedRoute{route: route, op: op})
+	return route
+}
+
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// schemaBuilder derives JSON schemas from Go types, collecting named struct
+// types into the components section.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	openAPISchemaType = reflect.TypeOf((*openAPISchemaer)(nil)).Elem()
+)
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t.Kind() == reflect.Ptr:
+		return b.schema(t.Elem())
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(openAPISchemaType):
+		return reflect.Zero(t).Interface().(openAPISchemaer).openAPISchema()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		return b.structSchema(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the schema for a struct. Named structs are added to
+// the components and referred to.
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	if name != "" {
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := b.components[name]; ok {
+			return ref
+		}
+		// Reserve the name so that recursive types terminate.
+		b.components[name] = nil
+	}
+
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		fieldName, opts, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		properties[fieldName] = b.schema(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			required = append(required, fieldName)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if name == "" {
+		return schema
+	}
+	b.components[name] = schema
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// operation returns the OpenAPI operation object for a documented route.
+func (b *schemaBuilder) operation(path string, op APIOperation) map[string]interface{} {
+	var params []interface{}
+	for _, m := range pathVariable.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, q := range op.Query {
+		params = append(params, map[string]interface{}{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"required":    q.Required,
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		response["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Response))},
+		}
+	}
+	if len(op.Produces) > 0 {
+		content := map[string]interface{}{}
+		for _, contentType := range op.Produces {
+			content[contentType] = map[string]interface{}{}
+		}
+		response["content"] = content
+	}
+
+	operation := map[string]interface{}{
+		"summary": op.Summary,
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): response,
+			"default": map[string]interface{}{
+				"description": "An error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": b.schema(reflect.TypeOf(common.ErrorResponse{})),
+					},
+				},
+			},
+		},
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+	if op.Request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Request))},
+			},
+		}
+	}
+	if strings.Contains(path, "/admin/") {
+		operation["tags"] = []string{"admin"}
+		operation["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"basicAuth": []string{}},
+		}
+	} else {
+		operation["tags"] = []string{"api"}
+	}
+	return operation
+}
+
+// OpenAPISpec builds the OpenAPI 3 document from the documented routes.
+func OpenAPISpec() map[string]interface{} {
+	apiDocs.mu.Lock()
+	routes := append([]documentedRoute(nil), apiDocs.routes...)
+	apiDocs.mu.Unlock()
+
+	b := &schemaBuilder{components: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+	for _, dr := range routes {
+		path, err := dr.route.GetPathTemplate()
+		if err != nil {
+			continue
+		}
+		methods, err := dr.route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		openAPIPath := pathVariable.ReplaceAllString(path, "{$1}")
+		if paths[openAPIPath] == nil {
+			paths[openAPIPath] = map[string]interface{}{}
+		}
+		for _, method := range methods {
+			paths[openAPIPath][strings.ToLower(method)] = b.operation(path, dr.op)
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "vice-default-backend",
+			"description": "Status and admin APIs of the VICE default backend.",
+			"version":     apiVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler serves the OpenAPI document.
+func OpenAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, OpenAPISpec())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the OTLP log exporter settings.
+const (
+	defaultOTLPBatchSize     = 512
+	defaultOTLPQueueSize     = 4096
+	defaultOTLPFlushInterval = 5 * time.Second
+)
+
+var otlpLogRecords = NewCounterVec(
+	"otlp_log_records_total",
+	"Log records handed to the OTLP log exporter, by result.",
+	"result",
+)
+
+type otlpSeverity struct {
+	number int
+	text   string
+}
+
+// otlpSeverities maps logrus levels to OpenTelemetry severities.
+var otlpSeverities = map[logrus.Level]otlpSeverity{
+	logrus.TraceLevel: {1, "TRACE"},
+	logrus.DebugLevel: {5, "DEBUG"},
+	logrus.InfoLevel:  {9, "INFO"},
+	logrus.WarnLevel:  {13, "WARN"},
+	logrus.ErrorLevel: {17, "ERROR"},
+	logrus.FatalLevel: {21, "FATAL"},
+	logrus.PanicLevel: {24, "FATAL4"},
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string          `json:"timeUnixNano"`
+	ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+	SeverityNumber       int             `json:"severityNumber"`
+	SeverityText         string          `json:"severityText"`
+	Body                 otlpValue       `json:"body"`
+	Attributes           []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+// OTLPLogExporter is a logrus hook that sends log entries to an OpenTelemetry
+// collector, so that the logs go through the same pipeline as the other
+// telemetry.
+//
+// The resource attributes are taken from the OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES environment variables, as the OpenTelemetry SDKs
+// do, and then from the config. Entries are queued and sent in batches. If
+// the queue fills up because the collector can't keep up, entries are
+// dropped rather than holding up requests.
+type OTLPLogExporter struct {
+	endpoint      string
+	headers       map[string]string
+	client        *http.Client
+	resource      []otlpAttribute
+	omit          map[string]bool
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan otlpLogRecord
+	mu            sync.Mutex
+}
+
+// NewOTLPLogExporter returns an OTLPLogExporter configured from the
+// vice.default_backend.otel section of the config, or nil if
+// vice.default_backend.otel.logs.endpoint isn't set.
+func NewOTLPLogExporter(cfg *viper.Viper) (*OTLPLogExporter, error) {
+	cfg.SetDefault("vice.default_backend.otel.logs.batch_size", defaultOTLPBatchSize)
+	cfg.SetDefault("vice.default_backend.otel.logs.queue_size", defaultOTLPQueueSize)
+	cfg.SetDefault("vice.default_backend.otel.logs.flush_interval", defaultOTLPFlushInterval)
+
+	endpoint := cfg.GetString("vice.default_backend.otel.logs.endpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(endpoint); err != nil || !u.IsAbs() {
+		return nil, errors.New("vice.default_backend.otel.logs.endpoint must be an absolute URL")
+	}
+	batchSize := cfg.GetInt("vice.default_backend.otel.logs.batch_size")
+	queueSize := cfg.GetInt("vice.default_backend.otel.logs.queue_size")
+	if batchSize < 1 || queueSize < batchSize {
+		return nil, errors.New("vice.default_backend.otel.logs.queue_size must be at least the batch size, which must be positive")
+	}
+
+	resource, err := otlpResource(cfg.GetStringMapString("vice.default_backend.otel.resource_attributes"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The fields that the package logger adds to every entry identify the
+	// service, which the resource attributes already do.
+	omit := make(map[string]bool)
+	for k := range log.Data {
+		omit[k] = true
+	}
+
+	return &OTLPLogExporter{
+		endpoint:      endpoint,
+		headers:       cfg.GetStringMapString("vice.default_backend.otel.logs.headers"),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		resource:      resource,
+		omit:          omit,
+		batchSize:     batchSize,
+		flushInterval: cfg.GetDuration("vice.default_backend.otel.logs.flush_interval"),
+		queue:         make(chan otlpLogRecord, queueSize),
+	}, nil
+}
+
+// Levels returns the levels the exporter is called for, which is all of them.
+// The logger's own level still applies.
+func (e *OTLPLogExporter) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues a log entry. Fatal and panic entries are sent right away along
+// with everything queued before them, since the process is about to exit.
+func (e *OTLPLogExporter) Fire(entry *logrus.Entry) error {
+	severity := otlpSeverities[entry.Level]
+	record := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(entry.Time.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       severity.number,
+		SeverityText:         severity.text,
+		Body:                 otlpAnyValue(entry.Message),
+	}
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		if !e.omit[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		record.Attributes = append(record.Attributes, otlpAttribute{Key: k, Value: otlpAnyValue(entry.Data[k])})
+	}
+
+	select {
+	case e.queue <- record:
+	default:
+		otlpLogRecords.Inc("dropped")
+	}
+	if entry.Level <= logrus.FatalLevel {
+		for len(e.queue) > 0 {
+			e.flush()
+		}
+	}
+	return nil
+}
+
+// Run sends the queued entries whenever a batch fills up or the flush
+// interval passes, until the context is canceled.
+func (e *OTLPLogExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+		for len(e.queue) >= e.batchSize {
+			e.flush()
+		}
+	}
+}
+
+// flush sends up to a batch of the queued entries.
+func (e *OTLPLogExporter) flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var records []otlpLogRecord
+	for len(records) < e.batchSize && len(e.queue) > 0 {
+		records = append(records, <-e.queue)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	if err := e.send(records); err != nil {
+		// Logging the failure would only queue up another entry for the
+		// collector that can't be reached.
+		fmt.Fprintf(os.Stderr, "error exporting %d log records: %s\n", len(records), err)
+		otlpLogRecords.Add(float64(len(records)), "failed")
+		return
+	}
+	otlpLogRecords.Add(float64(len(records)), "exported")
+}
+
+// send posts a batch of log records to the collector.
+func (e *OTLPLogExporter) send(records []otlpLogRecord) error {
+	scope := otlpScopeLogs{LogRecords: records}
+	scope.Scope.Name = otlpScopeName
+	resourceLogs := otlpResourceLogs{ScopeLogs: []otlpScopeLogs{scope}}
+	resourceLogs.Resource.Attributes = e.resource
+	return postOTLP(e.client, e.endpoint, e.headers, &otlpLogsRequest{ResourceLogs: []otlpResourceLogs{resourceLogs}})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The helpers here are shared by the OpenTelemetry exporters, which send
+// telemetry to a collector with OTLP over HTTP, using the JSON encoding. The
+// protocol is simple enough that it's implemented here rather than pulling
+// in the OpenTelemetry SDK.
+
+// defaultOTLPServiceName is the service.name resource attribute unless the
+// environment or config sets another.
+const defaultOTLPServiceName = "vice-default-backend"
+
+// otlpScopeName is the instrumentation scope of the exported telemetry.
+const otlpScopeName = "github.com/cyverse-de/vice-default-backend"
+
+// otlpValue is an OTLP AnyValue in the protobuf JSON encoding, which encodes
+// 64-bit integers as strings.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpResource returns the resource attributes, starting with the service
+// name and then applying OTEL_RESOURCE_ATTRIBUTES, OTEL_SERVICE_NAME, and the
+// attributes from the config, in that order.
+func otlpResource(configured map[string]string) ([]otlpAttribute, error) {
+	attrs := map[string]string{"service.name": defaultOTLPServiceName}
+	if host, err := os.Hostname(); err == nil {
+		attrs["host.name"] = host
+	}
+	if env := os.Getenv("OTEL_RESOURCE_ATTRIBUTES"); env != "" {
+		for _, pair := range strings.Split(env, ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, errors.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES entry %q", pair)
+			}
+			v, err := url.PathUnescape(strings.TrimSpace(v))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid OTEL_RESOURCE_ATTRIBUTES entry %q", pair)
+			}
+			attrs[strings.TrimSpace(k)] = v
+		}
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		attrs["service.name"] = name
+	}
+	for k, v := range configured {
+		attrs[k] = v
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		result[i] = otlpAttribute{Key: k, Value: otlpAnyValue(attrs[k])}
+	}
+	return result, nil
+}
+
+// otlpAnyValue converts a log field value to an OTLP value.
+func otlpAnyValue(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s := fmt.Sprint(v)
+		return otlpValue{IntValue: &s}
+	case float32:
+		f := float64(v)
+		return otlpValue{DoubleValue: &f}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case error:
+		s := v.Error()
+		return otlpValue{StringValue: &s}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+// postOTLP sends an export request to an OTLP/HTTP endpoint.
+func postOTLP(client *http.Client, endpoint string, headers map[string]string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the collector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
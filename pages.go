@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PageData is passed to the templates for the pages served by the default
+// backend.
+type PageData struct {
+	Banner *Banner
+
+	// App is the branding of the analysis' app on pages served for an
+	// analysis, when branding is enabled.
+	App *AppBranding
+}
+
+// NotFoundPageData is passed to the template for the 404 page.
+type NotFoundPageData struct {
+	*PageData
+	Host        string
+	Subdomain   string
+	SupportURL  string
+	Suggestions []Suggestion
+}
+
+// Suggestion is a link to an app that the user might have meant.
+type Suggestion struct {
+	Name string
+	URL  string
+}
+
+// EndedPageData is passed to the template for the page served for analyses
+// that have ended.
+type EndedPageData struct {
+	*PageData
+	Name        string
+	State       string
+	RelaunchURL string
+}
+
+// defaultPagesReloadInterval is how often the page templates are checked for
+// changes by default.
+const defaultPagesReloadInterval = 30 * time.Second
+
+// pageFiles are the HTML page templates in the static file directory.
+var pageFiles = []string{
+	"404.html",
+	"maintenance.html",
+	"ended.html",
+	"deleted.html",
+	"terminating.html",
+	"suspended.html",
+	"bounce.html",
+	"shared.html",
+	"wait.html",
+	"crashed.html",
+	"restarting.html",
+	"slow.html",
+}
+
+// Pages holds the parsed HTML page templates. They can be reloaded while the
+// service is running, so that changes to the copy or branding, such as a
+// ConfigMap update, don't need a restart. The other static assets are read
+// from disk for every request, but are fingerprinted again along with the
+// reload so that pages link to their new versions.
+type Pages struct {
+	dir       string
+	assets    *Assets
+	mu        sync.RWMutex
+	templates *template.Template
+	modTime   time.Time
+	loadedAt  time.Time
+}
+
+// PagesResponse is the body returned by the page reload endpoint.
+type PagesResponse struct {
+	LoadedAt time.Time `json:"loaded_at"`
+	Files    []string  `json:"files"`
+}
+
+// LoadPages parses the HTML page templates in the static file directory and
+// fingerprints the static assets.
+func LoadPages(staticFilePath string, assets *Assets) (*Pages, error) {
+	p := &Pages{dir: staticFilePath, assets: assets}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// paths returns the paths of the page templates.
+func (p *Pages) paths() []string {
+	paths := make([]string, len(pageFiles))
+	for i, name := range pageFiles {
+		paths[i] = filepath.Join(p.dir, name)
+	}
+	return paths
+}
+
+// latestModTime returns the most recent modification time of the files in
+// the static file directory. Symbolic links, as used for ConfigMap volumes,
+// are followed.
+func (p *Pages) latestModTime() (time.Time, error) {
+	var latest time.Time
+	err := walkStatic(p.dir, func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// Reload fingerprints the static assets and parses the page templates again.
+// The templates in use are only replaced if all of them parse. The templates
+// can link to static assets by their fingerprinted URLs with the asset
+// function, as in {{asset "css/app.css"}}.
+func (p *Pages) Reload() error {
+	modTime, err := p.latestModTime()
+	if err != nil {
+		return errors.Wrap(err, "error reading the page templates")
+	}
+	if err = p.assets.Load(); err != nil {
+		return err
+	}
+	templates, err := template.New("").Funcs(template.FuncMap{"asset": p.assets.URL}).ParseFiles(p.paths()...)
+	if err != nil {
+		return errors.Wrap(err, "error parsing the page templates")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.templates, p.modTime, p.loadedAt = templates, modTime, time.Now()
+	return nil
+}
+
+// ExecuteTemplate renders the named page template.
+func (p *Pages) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	p.mu.RLock()
+	templates := p.templates
+	p.mu.RUnlock()
+	return templates.ExecuteTemplate(w, name, data)
+}
+
+// Assets returns the fingerprinted static assets.
+func (p *Pages) Assets() *Assets {
+	return p.assets
+}
+
+// LoadedAt returns when the page templates were last loaded.
+func (p *Pages) LoadedAt() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.loadedAt
+}
+
+// Watch reloads the page templates whenever a file in the static file
+// directory changes, checking on
+// the interval passed in until the context is canceled.
+func (p *Pages) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := p.latestModTime()
+		if err != nil {
+			log.Errorf("error checking the page templates for changes: %s", err)
+			continue
+		}
+		p.mu.RLock()
+		changed := !modTime.Equal(p.modTime)
+		p.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err = p.Reload(); err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Info("reloaded the page templates")
+	}
+}
+
+// ReloadPagesHandler reloads the page templates.
+func (a *App) ReloadPagesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.pages.Reload(); err != nil {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, &PagesResponse{LoadedAt: a.pages.LoadedAt(), Files: pageFiles})
+}
+
+// pageData returns the data common to all of the rendered pages.
+func (a *App) pageData() *PageData {
+	return &PageData{
+		Banner: a.banner.Get(),
+	}
+}
+
+// analysisPageData returns the data common to all of the rendered pages,
+// along with the branding of the analysis' app.
+func (a *App) analysisPageData(ctx context.Context, analysis *Analysis) *PageData {
+	data := a.pageData()
+	if a.branding != nil && analysis != nil {
+		data.App = a.branding.Get(ctx, analysis)
+	}
+	return data
+}
+
+// renderPage executes the named page template and writes it to the response
+// with the status code passed in.
+func (a *App) renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := a.pages.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Errorf("error rendering %s: %s", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Errorf("error writing %s: %s", name, err)
+	}
+}
+
+// NotFoundHandler renders the 404 page.
+func (a *App) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	a.notFound(w, r, "")
+}
+
+// notFound renders the 404 page with the host and subdomain that were
+// requested. Authenticated visitors also get links to their own running
+// analyses, if the lookup cache knows about any.
+func (a *App) notFound(w http.ResponseWriter, r *http.Request, visitor string) {
+	data := &NotFoundPageData{
+		PageData:   a.pageData(),
+		Host:       r.Host,
+		Subdomain:  a.Subdomain(r),
+		SupportURL: a.supportURL,
+	}
+	if visitor != "" && a.cache != nil {
+		_, domain, _ := splitHost(r.Host, a.baseDomain())
+		data.Suggestions = suggestions(r, domain, a.cache.Owned(visitor))
+	}
+	a.renderPage(w, http.StatusNotFound, "404.html", data)
+}
+
+// suggestions links to the analyses passed in on the domain passed in,
+// ordered by name.
+func suggestions(r *http.Request, domain string, analyses []*Analysis) []Suggestion {
+	if domain == "" {
+		return nil
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	var result []Suggestion
+	for _, analysis := range analyses {
+		if analysis.Subdomain == "" {
+			continue
+		}
+		u := url.URL{Scheme: scheme, Host: analysis.Subdomain + "." + domain, Path: "/"}
+		result = append(result, Suggestion{Name: analysis.Name, URL: u.String()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// EndedHandler renders the page for an analysis that has ended.
+func (a *App) EndedHandler(w http.ResponseWriter, r *http.Request, analysis *Analysis) {
+	data := &EndedPageData{
+		PageData: a.analysisPageData(r.Context(), analysis),
+		Name:     analysis.Name,
+		State:    analysis.State(),
+	}
+	if a.relaunch != nil {
+		data.RelaunchURL = a.relaunch.URL(analysis)
+	}
+	a.renderPage(w, http.StatusGone, "ended.html", data)
+}
+
+// DeletedResponse is the body returned to clients that asked for JSON for a
+// deleted analysis.
+type DeletedResponse struct {
+	Message   string `json:"message"`
+	Subdomain string `json:"subdomain"`
+	State     string `json:"state"`
+}
+
+// DeletedHandler answers a request for an analysis that has been deleted with
+// a 410, so that clients and crawlers stop asking for a URL that won't come
+// back. WebSocket clients and JavaScript get JSON instead of the page.
+func (a *App) DeletedHandler(w http.ResponseWriter, r *http.Request, analysis *Analysis) {
+	if wantsRetry(w, r) {
+		writeJSON(w, http.StatusGone, &DeletedResponse{
+			Message:   "the analysis has been deleted",
+			Subdomain: analysis.Subdomain,
+			State:     StateDeleted,
+		})
+		return
+	}
+	data := &EndedPageData{
+		PageData: a.analysisPageData(r.Context(), analysis),
+		Name:     analysis.Name,
+		State:    StateDeleted,
+	}
+	if a.relaunch != nil {
+		data.RelaunchURL = a.relaunch.URL(analysis)
+	}
+	a.renderPage(w, http.StatusGone, "deleted.html", data)
+}
+
+// TerminatingHandler renders the page for an analysis that's saving its
+// outputs and shutting down. It's served with a 503 and no Retry-After, since
+// the analysis won't come back once it's done.
+func (a *App) TerminatingHandler(w http.ResponseWriter, r *http.Request, analysis *Analysis) {
+	w.Header().Set("Cache-Control", "no-store")
+	a.renderPage(w, http.StatusServiceUnavailable, "terminating.html", &EndedPageData{
+		PageData: a.analysisPageData(r.Context(), analysis),
+		Name:     analysis.Name,
+		State:    analysis.State(),
+	})
+}
+
+// bounceFragmentPlaceholder stands in for the URL fragment in the loading
+// page URL given to the bounce page, which replaces it with the fragment.
+const bounceFragmentPlaceholder = "VICEFRAGMENTPLACEHOLDER"
+
+// BouncePageData is passed to the template for the bounce page.
+type BouncePageData struct {
+	// Location is where the page sends the browser when there's no fragment.
+	Location string
+
+	// FragmentLocation is the loading page URL for the app URL with the
+	// placeholder at the end. It's empty when the app URL can't be changed
+	// on the client, as with state tokens, in which case the fragment is
+	// added to Location instead.
+	FragmentLocation string
+
+	Placeholder string
+}
+
+// BounceHandler renders the page that sends browsers on to the loading page
+// after adding the URL fragment to the app URL on the client.
+func (a *App) BounceHandler(w http.ResponseWriter, r *http.Request, base *url.URL, appURL string, decision *Decision) {
+	data := &BouncePageData{Location: decision.Location, Placeholder: bounceFragmentPlaceholder}
+	if a.stateTokens == nil {
+		fragmentURL, err := a.LoadingURL(w, r, base, appURL+bounceFragmentPlaceholder, decision)
+		if err == nil {
+			data.FragmentLocation = fragmentURL.String()
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.renderPage(w, http.StatusOK, "bounce.html", data)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxPageSize is the largest page the admin list endpoints return.
+const maxPageSize = 1000
+
+// pageLimit returns the page size requested in the limit query parameter, or
+// def if it isn't set.
+func pageLimit(q url.Values, def int) (int, error) {
+	v := q.Get("limit")
+	if v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be a number between 1 and %d", maxPageSize)
+	}
+	return limit, nil
+}
+
+// encodeCursor returns an opaque cursor holding the sort key of the last item
+// on a page.
+func encodeCursor(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, "\n")))
+}
+
+// decodeCursor returns the parts of the cursor in the cursor query parameter,
+// or nil if there isn't one.
+func decodeCursor(q url.Values, n int) ([]string, error) {
+	v := q.Get("cursor")
+	if v == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	parts := strings.Split(string(raw), "\n")
+	if len(parts) != n {
+		return nil, errors.New("invalid cursor")
+	}
+	return parts, nil
+}
+
+// nextPageURL returns the request's URL with the cursor query parameter set
+// to the cursor passed in.
+func nextPageURL(r *http.Request, cursor string) string {
+	u := *r.URL
+	q := u.Query()
+	q.Set("cursor", cursor)
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
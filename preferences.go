@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// defaultPreferencesCacheTTL is how long preferences are cached by default.
+const defaultPreferencesCacheTTL = time.Minute
+
+const (
+	userPreferenceQuery = `
+	SELECT COALESCE(loading_page_variant, ''), skip_shared_warning
+	  FROM vice_default_backend_user_preferences
+	 WHERE username = $1
+`
+	setUserPreferenceQuery = `
+	INSERT INTO vice_default_backend_user_preferences
+	    (username, loading_page_variant, skip_shared_warning, updated_at)
+	VALUES ($1, NULLIF($2, ''), $3, now())
+	    ON CONFLICT (username) DO UPDATE
+	   SET loading_page_variant = EXCLUDED.loading_page_variant,
+	       skip_shared_warning = EXCLUDED.skip_shared_warning,
+	       updated_at = EXCLUDED.updated_at
+`
+	deleteUserPreferenceQuery = `
+	DELETE FROM vice_default_backend_user_preferences
+	 WHERE username = $1
+`
+)
+
+// UserPreference holds a user's routing preferences. An empty loading page
+// variant leaves the choice to the configured weights.
+type UserPreference struct {
+	Username           string `json:"username"`
+	LoadingPageVariant string `json:"loading_page_variant,omitempty"`
+	SkipSharedWarning  bool   `json:"skip_shared_warning"`
+}
+
+type preferenceEntry struct {
+	preference *UserPreference
+	expires    time.Time
+}
+
+// Preferences stores per-user routing preferences in the
+// vice_default_backend_user_preferences table. They're consulted while
+// routing requests from authenticated users and cached briefly.
+type Preferences struct {
+	db      *sql.DB
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]preferenceEntry
+}
+
+// NewPreferences returns a Preferences configured from the
+// vice.default_backend.preferences section of the config, or nil if
+// vice.default_backend.preferences.enabled isn't set.
+func NewPreferences(cfg *viper.Viper, db *sql.DB) *Preferences {
+	cfg.SetDefault("vice.default_backend.preferences.cache_ttl", defaultPreferencesCacheTTL)
+
+	if db == nil || !cfg.GetBool("vice.default_backend.preferences.enabled") {
+		return nil
+	}
+	return &Preferences{
+		db:      db,
+		ttl:     cfg.GetDuration("vice.default_backend.preferences.cache_ttl"),
+		entries: make(map[string]preferenceEntry),
+	}
+}
+
+// Get returns a user's preferences. Users without any get the defaults.
+func (p *Preferences) Get(ctx context.Context, username string) (pref *UserPreference, err error) {
+	p.mu.Lock()
+	entry, ok := p.entries[username]
+	p.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.preference, nil
+	}
+
+	defer observeQuery(QueryUserPreference, time.Now(), &err)
+	defer traceQuery(ctx, QueryUserPreference)(&err)
+	pref = &UserPreference{Username: username}
+	err = p.db.QueryRowContext(ctx, userPreferenceQuery, username).Scan(&pref.LoadingPageVariant, &pref.SkipSharedWarning)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries[username] = preferenceEntry{preference: pref, expires: time.Now().Add(p.ttl)}
+	return pref, nil
+}
+
+// Set stores a user's preferences.
+func (p *Preferences) Set(ctx context.Context, pref *UserPreference) error {
+	_, err := p.db.ExecContext(ctx, setUserPreferenceQuery, pref.Username, pref.LoadingPageVariant, pref.SkipSharedWarning)
+	p.forget(pref.Username)
+	return err
+}
+
+// Delete resets a user's preferences to the defaults.
+func (p *Preferences) Delete(ctx context.Context, username string) error {
+	_, err := p.db.ExecContext(ctx, deleteUserPreferenceQuery, username)
+	p.forget(username)
+	return err
+}
+
+func (p *Preferences) forget(username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.entries, username)
+}
+
+// preferencesEnabled writes an error response and returns false if
+// preferences aren't enabled.
+func (a *App) preferencesEnabled(w http.ResponseWriter) bool {
+	if a.preferences == nil {
+		writeError(w, "user preferences are disabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// writePreference writes a user's preferences to the response.
+func (a *App) writePreference(w http.ResponseWriter, r *http.Request, username string) {
+	pref, err := a.preferences.Get(r.Context(), username)
+	if err != nil {
+		log.Errorf("error getting the preferences of %s: %s", username, err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, pref)
+}
+
+// setPreference replaces a user's preferences with the ones in the request
+// body.
+func (a *App) setPreference(w http.ResponseWriter, r *http.Request, username string) {
+	var pref UserPreference
+	if err := json.NewDecoder(r.Body).Decode(&pref); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pref.LoadingPageVariant != "" {
+		if _, ok := a.loadingPages.Target(pref.LoadingPageVariant); !ok {
+			writeError(w, "unknown loading page variant "+pref.LoadingPageVariant, http.StatusBadRequest)
+			return
+		}
+	}
+	pref.Username = username
+	if err := a.preferences.Set(r.Context(), &pref); err != nil {
+		log.Errorf("error setting the preferences of %s: %s", username, err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, &pref)
+}
+
+// GetPreferenceHandler returns the preferences of the user named in the path.
+func (a *App) GetPreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	if a.preferencesEnabled(w) {
+		a.writePreference(w, r, mux.Vars(r)["username"])
+	}
+}
+
+// SetPreferenceHandler replaces the preferences of the user named in the
+// path.
+func (a *App) SetPreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	if a.preferencesEnabled(w) {
+		a.setPreference(w, r, mux.Vars(r)["username"])
+	}
+}
+
+// DeletePreferenceHandler resets the preferences of the user named in the
+// path.
+func (a *App) DeletePreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.preferencesEnabled(w) {
+		return
+	}
+	if err := a.preferences.Delete(r.Context(), mux.Vars(r)["username"]); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionUser returns the authenticated user making the request, writing an
+// error response and returning an empty string if there isn't one.
+func (a *App) sessionUser(w http.ResponseWriter, r *http.Request) string {
+	if a.auth == nil {
+		writeError(w, "authentication is disabled", http.StatusNotFound)
+		return ""
+	}
+	session, err := a.auth.Session(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadGateway)
+		return ""
+	}
+	if session == nil {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return ""
+	}
+	return a.Visitor(r, session)
+}
+
+// GetMyPreferenceHandler returns the preferences of the authenticated user.
+func (a *App) GetMyPreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.preferencesEnabled(w) {
+		return
+	}
+	if username := a.sessionUser(w, r); username != "" {
+		a.writePreference(w, r, username)
+	}
+}
+
+// SetMyPreferenceHandler replaces the preferences of the authenticated user.
+func (a *App) SetMyPreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.preferencesEnabled(w) {
+		return
+	}
+	if username := a.sessionUser(w, r); username != "" {
+		a.setPreference(w, r, username)
+	}
+}
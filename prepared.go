@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// PreparedDB runs queries through prepared statements, preparing each query
+// the first time it's used. database/sql prepares a statement on each
+// connection the first time the statement runs on it and reuses it after
+// that, so hot lookups skip parsing and planning on the server.
+type PreparedDB struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// NewPreparedDB returns a PreparedDB for the pool.
+func NewPreparedDB(db *sql.DB) *PreparedDB {
+	return &PreparedDB{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// lookupQueryer returns what routing lookups on the pool go through: a
+// PreparedDB unless vice.db.prepared_statements is turned off, which is
+// needed behind a pooler that doesn't support them, such as PgBouncer in
+// transaction mode.
+func lookupQueryer(cfg *viper.Viper, db *sql.DB) queryer {
+	cfg.SetDefault("vice.db.prepared_statements", true)
+	if !cfg.GetBool("vice.db.prepared_statements") {
+		return db
+	}
+	return NewPreparedDB(db)
+}
+
+// stmt returns the prepared statement for a query, preparing it if needed.
+// Failures aren't cached, so the next use tries again.
+func (p *PreparedDB) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stmt, ok := p.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := p.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	p.stmts[query] = stmt
+	return stmt, nil
+}
+
+// QueryContext runs a query through its prepared statement.
+func (p *PreparedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+// QueryRowContext runs a query that returns a single row through its prepared
+// statement. If the statement can't be prepared, the query runs unprepared
+// so that the error comes back through the row.
+func (p *PreparedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return p.db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
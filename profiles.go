@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// profileOverlayPath returns the path of the overlay file for a profile,
+// which sits next to the base config file with the profile name inserted
+// before the extension, as in jobservices.qa.yml.
+func profileOverlayPath(configPath, profile string) string {
+	ext := filepath.Ext(configPath)
+	return strings.TrimSuffix(configPath, ext) + "." + profile + ext
+}
+
+// parseProfiles splits a comma-separated list of profile names.
+func parseProfiles(list string) []string {
+	var profiles []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// ApplyProfiles merges the overlay file of each profile over the config, in
+// the order given, so later profiles win. Maps are merged key by key, while
+// lists and scalar values replace the ones beneath them. A missing overlay
+// is an error so that a mistyped profile doesn't go unnoticed.
+func ApplyProfiles(cfg *viper.Viper, configPath string, profiles []string) error {
+	cfg.SetConfigType("yaml")
+	for _, profile := range profiles {
+		path := profileOverlayPath(configPath, profile)
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "error opening the overlay for profile %s", profile)
+		}
+		err = cfg.MergeConfig(f)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error merging the overlay for profile %s from %s", profile, path)
+		}
+		log.Infof("merged the config overlay for profile %s from %s", profile, path)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// RelaunchLinks builds links to the DE's launch page for the app an analysis
+// was launched from, so that users whose analysis has ended can start it
+// again in one click. The links look like
+// {de_url}/apps/{system_id}/{app_id}/launch.
+type RelaunchLinks struct {
+	deURL *url.URL
+}
+
+// NewRelaunchLinks returns a RelaunchLinks configured from the
+// vice.default_backend.relaunch section of the config, or nil if
+// vice.default_backend.relaunch.de_url isn't set.
+func NewRelaunchLinks(cfg *viper.Viper) (*RelaunchLinks, error) {
+	raw := cfg.GetString("vice.default_backend.relaunch.de_url")
+	if raw == "" {
+		return nil, nil
+	}
+	deURL, err := url.Parse(raw)
+	if err != nil || !deURL.IsAbs() {
+		return nil, errors.New("vice.default_backend.relaunch.de_url must be an absolute URL")
+	}
+	return &RelaunchLinks{deURL: deURL}, nil
+}
+
+// URL returns the relaunch link for an analysis, or an empty string if the
+// analysis' app isn't known.
+func (l *RelaunchLinks) URL(analysis *Analysis) string {
+	if analysis.AppID == "" || analysis.SystemID == "" {
+		return ""
+	}
+	return l.deURL.JoinPath("apps", analysis.SystemID, analysis.AppID, "launch").String()
+}
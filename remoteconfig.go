@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Supported remote configuration providers.
+const (
+	RemoteConfigConsul = "consul"
+	RemoteConfigEtcd   = "etcd"
+)
+
+// remoteConfigRetryInterval is how long to wait before watching again after
+// an error.
+const remoteConfigRetryInterval = 10 * time.Second
+
+// consulWaitTime is how long a Consul blocking query waits for a change.
+const consulWaitTime = 5 * time.Minute
+
+// RemoteConfig reads settings from a key in Consul or etcd and merges them
+// over the ones in the config file at startup. The key holds a document in
+// the same format as the config file.
+//
+// Changes to the key can be watched for. The shared config is only written
+// at startup, since it's read without locking elsewhere, so each change is
+// merged into a private copy of the startup settings instead, which is handed
+// to the OnChange functions. Only the feature flags are applied that way;
+// other settings that change are ignored until the service restarts.
+type RemoteConfig struct {
+	provider string
+	endpoint *url.URL
+	key      string
+	format   string
+	token    string
+	client   *http.Client
+
+	mu       sync.Mutex
+	version  string
+	onChange []func(*viper.Viper)
+}
+
+// NewRemoteConfig returns a RemoteConfig configured from the
+// vice.default_backend.remote_config section of the config, or nil if no
+// provider is configured.
+func NewRemoteConfig(cfg *viper.Viper) (*RemoteConfig, error) {
+	cfg.SetDefault("vice.default_backend.remote_config.format", "yaml")
+
+	provider := cfg.GetString("vice.default_backend.remote_config.provider")
+	if provider == "" {
+		return nil, nil
+	}
+	if provider != RemoteConfigConsul && provider != RemoteConfigEtcd {
+		return nil, fmt.Errorf("unsupported remote config provider %q", provider)
+	}
+
+	endpoint, err := url.Parse(cfg.GetString("vice.default_backend.remote_config.endpoint"))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse vice.default_backend.remote_config.endpoint")
+	}
+	key := cfg.GetString("vice.default_backend.remote_config.key")
+	if key == "" {
+		return nil, errors.New("vice.default_backend.remote_config.key is required")
+	}
+
+	return &RemoteConfig{
+		provider: provider,
+		endpoint: endpoint,
+		key:      key,
+		format:   cfg.GetString("vice.default_backend.remote_config.format"),
+		token:    cfg.GetString("vice.default_backend.remote_config.token"),
+		// Consul blocking queries and etcd watches are long-lived, so the
+		// timeouts are set through contexts instead.
+		client: &http.Client{},
+	}, nil
+}
+
+// OnChange registers a function to call with the config after the remote
+// settings change.
+func (rc *RemoteConfig) OnChange(f func(*viper.Viper)) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.onChange = append(rc.onChange, f)
+}
+
+// Load reads the remote settings and merges them into the config. It must be
+// called before the config is shared.
+func (rc *RemoteConfig) Load(ctx context.Context, cfg *viper.Viper) error {
+	data, version, err := rc.fetch(ctx, "")
+	if err != nil {
+		return err
+	}
+	return rc.merge(cfg, data, version)
+}
+
+// merge parses the remote document and merges its settings into the config
+// passed in.
+func (rc *RemoteConfig) merge(cfg *viper.Viper, data []byte, version string) error {
+	remote := viper.New()
+	remote.SetConfigType(rc.format)
+	if err := remote.ReadConfig(bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "error parsing the remote config in %s", rc.key)
+	}
+	if err := cfg.MergeConfigMap(remote.AllSettings()); err != nil {
+		return errors.Wrapf(err, "error merging the remote config in %s", rc.key)
+	}
+
+	rc.mu.Lock()
+	rc.version = version
+	rc.mu.Unlock()
+	log.Infof("loaded the remote config from %s %s (version %s)", rc.provider, rc.key, version)
+	return nil
+}
+
+// Watch waits for changes to the remote settings until the context is
+// canceled. Each change is merged over a copy of the base settings, which
+// should be taken from the config with AllSettings before Watch is started,
+// and the copy is passed to the OnChange functions. The config itself isn't
+// changed.
+func (rc *RemoteConfig) Watch(ctx context.Context, base map[string]interface{}) {
+	for ctx.Err() == nil {
+		rc.mu.Lock()
+		current := rc.version
+		rc.mu.Unlock()
+
+		var err error
+		if rc.provider == RemoteConfigEtcd {
+			err = rc.waitEtcd(ctx, current)
+		}
+		var (
+			data    []byte
+			version string
+		)
+		if err == nil {
+			data, version, err = rc.fetch(ctx, current)
+		}
+		if err == nil && version != current {
+			snapshot := viper.New()
+			if err = snapshot.MergeConfigMap(base); err == nil {
+				err = rc.merge(snapshot, data, version)
+			}
+			if err == nil {
+				rc.mu.Lock()
+				callbacks := append([]func(*viper.Viper){}, rc.onChange...)
+				rc.mu.Unlock()
+				for _, f := range callbacks {
+					f(snapshot)
+				}
+			}
+		}
+
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("error watching the remote config: %s", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(remoteConfigRetryInterval):
+			}
+		}
+	}
+}
+
+// fetch reads the remote document and its version. For Consul, a non-empty
+// version turns the request into a blocking query that returns once the key
+// changes or the wait time runs out.
+func (rc *RemoteConfig) fetch(ctx context.Context, version string) ([]byte, string, error) {
+	if rc.provider == RemoteConfigEtcd {
+		return rc.fetchEtcd(ctx)
+	}
+	return rc.fetchConsul(ctx, version)
+}
+
+func (rc *RemoteConfig) do(req *http.Request) (*http.Response, error) {
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s returned %s for %s: %s", rc.provider, resp.Status, rc.key, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func (rc *RemoteConfig) fetchConsul(ctx context.Context, version string) ([]byte, string, error) {
+	timeout := 30 * time.Second
+	query := url.Values{"raw": {""}}
+	if version != "" {
+		query.Set("index", version)
+		query.Set("wait", consulWaitTime.String())
+		timeout += consulWaitTime
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	u := rc.endpoint.JoinPath("v1", "kv", rc.key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if rc.token != "" {
+		req.Header.Set("X-Consul-Token", rc.token)
+	}
+
+	resp, err := rc.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("X-Consul-Index"), nil
+}
+
+// etcdRangeResponse is the subset of an etcd v3 range response used here.
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Value       string `json:"value"`
+		ModRevision string `json:"mod_revision"`
+	} `json:"kvs"`
+}
+
+// etcdPost sends a request to the etcd v3 JSON gateway.
+func (rc *RemoteConfig) etcdPost(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rc.endpoint.JoinPath(path).String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rc.token != "" {
+		req.Header.Set("Authorization", rc.token)
+	}
+	return rc.do(req)
+}
+
+func (rc *RemoteConfig) fetchEtcd(ctx context.Context) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := rc.etcdPost(ctx, "v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(rc.key)),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var result etcdRangeResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	if len(result.Kvs) == 0 {
+		return nil, "", fmt.Errorf("the etcd key %s doesn't exist", rc.key)
+	}
+	data, err := base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, result.Kvs[0].ModRevision, nil
+}
+
+// waitEtcd opens an etcd watch on the key starting after the given revision
+// and returns once an event arrives.
+func (rc *RemoteConfig) waitEtcd(ctx context.Context, version string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	create := map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(rc.key))}
+	if rev, err := strconv.ParseInt(version, 10, 64); err == nil {
+		create["start_revision"] = strconv.FormatInt(rev+1, 10)
+	}
+	resp, err := rc.etcdPost(ctx, "v3/watch", map[string]interface{}{"create_request": create})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The watch streams JSON objects, the first of which confirms that the
+	// watch was created.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err = decoder.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(strings.TrimSpace(msg.Error.Message))
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+var (
+	dbReplicaLag = NewGaugeVec(
+		"db_replica_lag_seconds",
+		"Replication lag of the read replica as of the last check.",
+	)
+	dbReplicaInUse = NewGaugeVec(
+		"db_replica_in_use",
+		"Whether routing lookups are going to the read replica (1) or the primary (0).",
+	)
+	dbReplicaFallbacks = NewCounterVec(
+		"db_replica_fallbacks_total",
+		"Lookups sent to the primary because a query on the read replica failed.",
+	)
+)
+
+// replicaLagQuery returns the replica's lag in seconds, or zero if the server
+// isn't a standby.
+const replicaLagQuery = `
+	SELECT CASE WHEN pg_is_in_recovery()
+	            THEN COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	            ELSE 0
+	       END
+`
+
+// queryer is the part of *sql.DB used for routing lookups, so that they can
+// be sent to a read replica.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ReplicaDB sends routing lookups to a read-only replica, keeping that
+// internet-driven load off the primary. Lookups go to the primary instead
+// while the replica is down or lagging by more than the configured maximum,
+// and individual queries that fail on the replica are retried on the primary.
+type ReplicaDB struct {
+	primary       queryer
+	replica       *sql.DB
+	lookups       queryer
+	maxLag        time.Duration
+	checkInterval time.Duration
+	usable        atomic.Bool
+}
+
+// NewReplicaDB returns a ReplicaDB configured from the vice.db.replica
+// section of the config, or nil if vice.db.replica.uri isn't set. The
+// credential files apply to the replica URI as well. Lookups that can't use
+// the replica go to primary.
+func NewReplicaDB(cfg *viper.Viper, primary queryer) (*ReplicaDB, error) {
+	cfg.SetDefault("vice.db.replica.max_lag", "30s")
+	cfg.SetDefault("vice.db.replica.check_interval", "10s")
+
+	uri := cfg.GetString("vice.db.replica.uri")
+	if uri == "" {
+		return nil, nil
+	}
+	uri, err := applyCredentialFiles(cfg, uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building the replica URI")
+	}
+
+	replica := sql.OpenDB(NewDBConnector(uri))
+	return &ReplicaDB{
+		primary:       primary,
+		replica:       replica,
+		lookups:       lookupQueryer(cfg, replica),
+		maxLag:        cfg.GetDuration("vice.db.replica.max_lag"),
+		checkInterval: cfg.GetDuration("vice.db.replica.check_interval"),
+	}, nil
+}
+
+// Replica returns the pool for the replica.
+func (r *ReplicaDB) Replica() *sql.DB {
+	return r.replica
+}
+
+// setUsable records whether lookups can go to the replica.
+func (r *ReplicaDB) setUsable(usable bool) {
+	if r.usable.Swap(usable) != usable {
+		if usable {
+			log.Info("sending routing lookups to the read replica")
+		} else {
+			log.Warn("sending routing lookups to the primary database")
+		}
+	}
+	value := 0.0
+	if usable {
+		value = 1
+	}
+	dbReplicaInUse.Set(value)
+}
+
+// Check measures the replica's lag and decides whether lookups can use it.
+func (r *ReplicaDB) Check(ctx context.Context) error {
+	var lag float64
+	start := time.Now()
+	err := r.replica.QueryRowContext(ctx, replicaLagQuery).Scan(&lag)
+	observeQuery(QueryReplicaLag, start, &err)
+	if err != nil {
+		r.setUsable(false)
+		return errors.Wrap(err, "error checking the read replica")
+	}
+	dbReplicaLag.Set(lag)
+
+	lagging := time.Duration(lag*float64(time.Second)) > r.maxLag
+	r.setUsable(!lagging)
+	if lagging {
+		log.Warnf("the read replica is %gs behind", lag)
+	}
+	return nil
+}
+
+// Monitor checks the replica on an interval until the context is canceled.
+func (r *ReplicaDB) Monitor(ctx context.Context) {
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, r.checkInterval)
+		if err := r.Check(checkCtx); err != nil {
+			log.Error(err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fallback reports whether a query that failed on the replica with err
+// should be retried on the primary.
+func (r *ReplicaDB) fallback(ctx context.Context, err error) bool {
+	if err == nil || err == sql.ErrNoRows || ctx.Err() != nil {
+		return false
+	}
+	log.Errorf("falling back to the primary after a read replica error: %s", err)
+	dbReplicaFallbacks.Inc()
+	r.setUsable(false)
+	return true
+}
+
+// QueryContext runs a query on the replica if it's usable, or on the primary
+// otherwise.
+func (r *ReplicaDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if r.usable.Load() {
+		rows, err := r.lookups.QueryContext(ctx, query, args...)
+		if !r.fallback(ctx, err) {
+			return rows, err
+		}
+	}
+	return r.primary.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext runs a query that returns a single row on the replica if
+// it's usable, or on the primary otherwise.
+func (r *ReplicaDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if r.usable.Load() {
+		row := r.lookups.QueryRowContext(ctx, query, args...)
+		if !r.fallback(ctx, row.Err()) {
+			return row
+		}
+	}
+	return r.primary.QueryRowContext(ctx, query, args...)
+}
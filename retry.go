@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultRetryAfter is the default number of seconds clients that can't
+// follow a redirect to the loading page are told to wait before trying again.
+const defaultRetryAfter = 5
+
+// RetryResponse is the body returned to WebSocket upgrade requests and
+// requests made from JavaScript for apps that aren't ready yet.
+type RetryResponse struct {
+	Message    string `json:"message"`
+	Subdomain  string `json:"subdomain"`
+	State      string `json:"state"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+// isWebSocketUpgrade returns true if the request asks to upgrade the
+// connection to a WebSocket, as Jupyter kernels and VNC clients do when they
+// reconnect.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isScriptRequest returns true if the request was made from JavaScript with
+// XMLHttpRequest or fetch, as an app's own front end does while it's polling
+// the app's back end, or asks for JSON rather than HTML.
+func isScriptRequest(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") != "" || strings.EqualFold(r.Header.Get("Sec-Fetch-Mode"), "cors") ||
+		prefersJSON(r)
+}
+
+// wantsRetry returns true if the request came from a client that can't do
+// anything useful with a redirect to the loading page's HTML. The headers it
+// depends on are added to the response's Vary header.
+func wantsRetry(w http.ResponseWriter, r *http.Request) bool {
+	vary(w, "Upgrade", "X-Requested-With", "Sec-Fetch-Mode", "Accept")
+	return isWebSocketUpgrade(r) || isScriptRequest(r)
+}
+
+// RetryHandler answers a request for an app that isn't ready yet with a 503,
+// a Retry-After header, and the app's state. WebSocket clients and
+// JavaScript can't follow a redirect to the loading page, and treat one as a
+// failure that breaks their reconnect loops.
+func (a *App) RetryHandler(w http.ResponseWriter, r *http.Request, decision *Decision, state string) {
+	w.Header().Set("Retry-After", strconv.Itoa(a.retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusServiceUnavailable, &RetryResponse{
+		Message:    "the app isn't ready yet, please try again shortly",
+		Subdomain:  decision.Subdomain,
+		State:      state,
+		RetryAfter: a.retryAfter,
+	})
+}
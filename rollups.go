@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the hourly statistics rollup settings.
+const (
+	defaultRollupFlushInterval = time.Minute
+	defaultRollupRetention     = 365 * 24 * time.Hour
+	defaultRollupReportPeriod  = 7 * 24 * time.Hour
+	rollupPruneInterval        = time.Hour
+	auditPruneBatchSize        = 10000
+)
+
+// rollupOtherDomain is the domain that requests for hosts outside of the
+// served domains are counted under, so that arbitrary Host headers can't add
+// rows to the rollup table.
+const rollupOtherDomain = "other"
+
+const (
+	upsertStatsRollupQuery = `
+	INSERT INTO vice_default_backend_stats_hourly (hour, domain, outcome, count)
+	VALUES ($1, $2, $3, $4)
+	    ON CONFLICT (hour, domain, outcome) DO UPDATE
+	   SET count = vice_default_backend_stats_hourly.count + EXCLUDED.count
+`
+	statsRollupQuery = `
+	SELECT hour, domain, outcome, count
+	  FROM vice_default_backend_stats_hourly
+	 WHERE hour >= $1
+	   AND hour < $2
+	   AND ($3 = '' OR domain = $3)
+	 ORDER BY hour, domain, outcome
+`
+	pruneStatsRollupQuery = `
+	DELETE FROM vice_default_backend_stats_hourly
+	 WHERE hour < $1
+`
+	pruneAuditQuery = `
+	DELETE FROM vice_default_backend_audit
+	 WHERE id IN (SELECT id
+	                FROM vice_default_backend_audit
+	               WHERE time < $1
+	               LIMIT $2)
+`
+)
+
+var statsRollupRows = NewCounterVec(
+	"stats_rollup_rows_total",
+	"Rows written to or pruned from the hourly statistics rollup and the audit log, by table and operation.",
+	"table", "operation",
+)
+
+// rollupKey identifies a row of the hourly rollup.
+type rollupKey struct {
+	hour    int64
+	domain  string
+	outcome string
+}
+
+// RollupRow is the number of routing decisions with an outcome for a domain
+// in an hour.
+type RollupRow struct {
+	Hour    time.Time `json:"hour"`
+	Domain  string    `json:"domain"`
+	Outcome string    `json:"outcome"`
+	Count   int64     `json:"count"`
+}
+
+// RollupResponse is the body returned by the hourly statistics endpoint.
+type RollupResponse struct {
+	From time.Time   `json:"from"`
+	To   time.Time   `json:"to"`
+	Rows []RollupRow `json:"rows"`
+}
+
+// StatsRollup counts routing decisions per hour, domain, and outcome, and
+// adds the counts to the vice_default_backend_stats_hourly table every flush
+// interval. Each replica adds its own counts, so the table covers all of
+// them. Requests are counted under the served domain that their host is in,
+// which is the domain of the VICE base URL or one of the allowed domains, or
+// under rollupOtherDomain. Rows older than the retention period are pruned, along with audit
+// log records older than the audit retention period, if there is one, so that
+// the history is kept without keeping every raw audit record.
+//
+// Counts that can't be written are kept and added in the next flush. Counts
+// made since the last flush are lost when the process exits.
+type StatsRollup struct {
+	db             *sql.DB
+	flushInterval  time.Duration
+	retention      time.Duration
+	auditRetention time.Duration
+	domains        []string
+	mu             sync.Mutex
+	pending        map[rollupKey]int64
+}
+
+// NewStatsRollup returns a StatsRollup configured from the
+// vice.default_backend.stats.rollup section of the config, or nil if
+// vice.default_backend.stats.rollup.enabled isn't set.
+func NewStatsRollup(cfg *viper.Viper, db *sql.DB) (*StatsRollup, error) {
+	cfg.SetDefault("vice.default_backend.stats.rollup.flush_interval", defaultRollupFlushInterval)
+	cfg.SetDefault("vice.default_backend.stats.rollup.retention", defaultRollupRetention)
+
+	if !cfg.GetBool("vice.default_backend.stats.rollup.enabled") {
+		return nil, nil
+	}
+	if db == nil {
+		return nil, errors.New("vice.default_backend.stats.rollup requires the database")
+	}
+	r := &StatsRollup{
+		db:             db,
+		flushInterval:  cfg.GetDuration("vice.default_backend.stats.rollup.flush_interval"),
+		retention:      cfg.GetDuration("vice.default_backend.stats.rollup.retention"),
+		auditRetention: cfg.GetDuration("vice.default_backend.audit.retention"),
+		domains:        rollupDomains(cfg),
+		pending:        make(map[rollupKey]int64),
+	}
+	if r.flushInterval <= 0 || r.retention < statsRetention {
+		return nil, errors.New("vice.default_backend.stats.rollup needs a positive flush interval and a retention of at least 24h")
+	}
+	return r, nil
+}
+
+// rollupDomains returns the served domains: the domain of the VICE base URL
+// and the allowed domains, longest first, so that a host is counted under the
+// most specific one it's in.
+func rollupDomains(cfg *viper.Viper) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	add := func(d string) {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d != "" && !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	if u, err := url.Parse(cfg.GetString("vice.default_backend.base_url")); err == nil {
+		add(u.Hostname())
+	}
+	for _, d := range cfg.GetStringSlice("vice.default_backend.hosts.allowed_domains") {
+		add(d)
+	}
+	sort.SliceStable(domains, func(i, j int) bool { return len(domains[i]) > len(domains[j]) })
+	return domains
+}
+
+// Domain returns the served domain that the host, with or without a port, is
+// in, or rollupOtherDomain if it isn't in any of them.
+func (r *StatsRollup) Domain(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return d
+		}
+	}
+	return rollupOtherDomain
+}
+
+// Retention returns how long the hourly rollups are kept.
+func (r *StatsRollup) Retention() time.Duration {
+	return r.retention
+}
+
+// Record counts a routing decision for the served domain of the requested
+// host.
+func (r *StatsRollup) Record(d Decision) {
+	key := rollupKey{hour: d.Time.Truncate(time.Hour).Unix(), domain: r.Domain(d.Host), outcome: d.Outcome}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[key]++
+}
+
+// Run flushes the counts on the flush interval and prunes old rows every
+// hour until the context is canceled, when the counts are flushed one last
+// time.
+func (r *StatsRollup) Run(ctx context.Context) {
+	flush := time.NewTicker(r.flushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(rollupPruneInterval)
+	defer prune.Stop()
+
+	r.prune(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush(context.Background())
+			return
+		case <-flush.C:
+			r.flush(ctx)
+		case <-prune.C:
+			r.prune(ctx)
+		}
+	}
+}
+
+// flush adds the pending counts to the rollup table in one transaction. If it
+// fails, the counts are put back to be tried again.
+func (r *StatsRollup) flush(ctx context.Context) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[rollupKey]int64)
+	r.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := r.write(ctx, pending); err != nil {
+		log.Errorf("error writing the hourly statistics rollup: %s", err)
+		r.mu.Lock()
+		for k, n := range pending {
+			r.pending[k] += n
+		}
+		r.mu.Unlock()
+		return
+	}
+	statsRollupRows.Add(float64(len(pending)), "stats_hourly", "upserted")
+}
+
+// write upserts the counts passed in.
+func (r *StatsRollup) write(ctx context.Context, pending map[rollupKey]int64) (err error) {
+	defer observeQuery(QueryStatsRollupUpsert, time.Now(), &err)
+	defer traceQuery(ctx, QueryStatsRollupUpsert)(&err)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for k, n := range pending {
+		if _, err = tx.ExecContext(ctx, upsertStatsRollupQuery, time.Unix(k.hour, 0).UTC(), k.domain, k.outcome, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes rollup rows older than the retention period, and audit log
+// records older than the audit retention period. Audit records are deleted in
+// batches, so that a large backlog doesn't hold locks for long.
+func (r *StatsRollup) prune(ctx context.Context) {
+	if n, err := r.pruneRollups(ctx); err != nil {
+		log.Errorf("error pruning the hourly statistics rollup: %s", err)
+	} else {
+		statsRollupRows.Add(float64(n), "stats_hourly", "pruned")
+	}
+
+	if r.auditRetention <= 0 {
+		return
+	}
+	for ctx.Err() == nil {
+		n, err := r.pruneAudit(ctx)
+		if err != nil {
+			log.Errorf("error pruning the audit log: %s", err)
+			return
+		}
+		statsRollupRows.Add(float64(n), "audit", "pruned")
+		if n < auditPruneBatchSize {
+			return
+		}
+	}
+}
+
+func (r *StatsRollup) pruneRollups(ctx context.Context) (n int64, err error) {
+	defer observeQuery(QueryStatsRollupPrune, time.Now(), &err)
+	result, err := r.db.ExecContext(ctx, pruneStatsRollupQuery, time.Now().Add(-r.retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *StatsRollup) pruneAudit(ctx context.Context) (n int64, err error) {
+	defer observeQuery(QueryAuditPrune, time.Now(), &err)
+	result, err := r.db.ExecContext(ctx, pruneAuditQuery, time.Now().Add(-r.auditRetention), auditPruneBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Rows returns the rollup rows for the hours from the start of the hour that
+// from falls in up to to, optionally only for a domain.
+func (r *StatsRollup) Rows(ctx context.Context, from, to time.Time, domain string) (rows []RollupRow, err error) {
+	defer observeQuery(QueryStatsRollup, time.Now(), &err)
+	defer traceQuery(ctx, QueryStatsRollup)(&err)
+
+	result, err := r.db.QueryContext(ctx, statsRollupQuery, from.Truncate(time.Hour), to, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	rows = []RollupRow{}
+	for result.Next() {
+		var row RollupRow
+		if err = result.Scan(&row.Hour, &row.Domain, &row.Outcome, &row.Count); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, result.Err()
+}
+
+// Summary rolls up the hourly counts for the window ending now. Unique
+// subdomains and reasons aren't kept in the rollup, so they're left out.
+func (r *StatsRollup) Summary(ctx context.Context, window time.Duration) (*StatsSummary, error) {
+	rows, err := r.Rows(ctx, time.Now().Add(-window), time.Now(), "")
+	if err != nil {
+		return nil, err
+	}
+	summary := &StatsSummary{
+		Window:     window.String(),
+		Outcomes:   make(map[string]int),
+		Domains:    make(map[string]int),
+		TopReasons: []ReasonCount{},
+	}
+	for _, row := range rows {
+		summary.Outcomes[row.Outcome] += int(row.Count)
+		summary.Domains[row.Domain] += int(row.Count)
+		summary.Total += int(row.Count)
+	}
+	summary.Redirects = summary.Outcomes[OutcomeRedirect]
+	summary.NotFound = summary.Outcomes[OutcomeNotFound]
+	return summary, nil
+}
+
+// StatsRollupHandler returns the hourly rollup rows between the from and to
+// query parameters, which default to the last week, optionally only for the
+// domain in the domain query parameter.
+func (a *App) StatsRollupHandler(w http.ResponseWriter, r *http.Request) {
+	if a.rollup == nil {
+		writeError(w, "the hourly statistics rollup isn't enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-defaultRollupReportPeriod)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, p.name+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		*p.t = t
+	}
+	if !from.Before(to) {
+		writeError(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := a.rollup.Rows(r.Context(), from, to, strings.ToLower(q.Get("domain")))
+	if err != nil {
+		log.Errorf("error reading the hourly statistics rollup: %s", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, &RollupResponse{From: from.Truncate(time.Hour), To: to, Rows: rows})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Locations of the cgroup v2 and v1 limit files inside a container.
+const (
+	cgroupV2CPUMax       = "/sys/fs/cgroup/cpu.max"
+	cgroupV2MemoryMax    = "/sys/fs/cgroup/memory.max"
+	cgroupV1CPUQuota     = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriod    = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+	cgroupV1MemoryLimit  = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	cgroupV1NoLimitFloor = 1 << 62
+)
+
+// RuntimeLimits describes the limits the Go runtime is running under.
+type RuntimeLimits struct {
+	GOMAXPROCS        int    `json:"gomaxprocs"`
+	GOMAXPROCSSource  string `json:"gomaxprocs_source"`
+	CPUQuota          string `json:"cgroup_cpu_quota,omitempty"`
+	CgroupMemoryLimit int64  `json:"cgroup_memory_limit,omitempty"`
+	MemoryLimit       int64  `json:"memory_limit"`
+	MemoryLimitSource string `json:"memory_limit_source"`
+}
+
+func readTrimmed(path string) (string, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
+
+// cgroupCPUQuota returns the number of CPUs the cgroup is allowed to use, or
+// zero if it isn't limited.
+func cgroupCPUQuota() float64 {
+	if s, ok := readTrimmed(cgroupV2CPUMax); ok {
+		quota, period, _ := strings.Cut(s, " ")
+		q, qerr := strconv.ParseFloat(quota, 64)
+		p, perr := strconv.ParseFloat(period, 64)
+		if qerr != nil || perr != nil || p <= 0 {
+			return 0
+		}
+		return q / p
+	}
+
+	quota, qok := readTrimmed(cgroupV1CPUQuota)
+	period, pok := readTrimmed(cgroupV1CPUPeriod)
+	if !qok || !pok {
+		return 0
+	}
+	q, qerr := strconv.ParseFloat(quota, 64)
+	p, perr := strconv.ParseFloat(period, 64)
+	if qerr != nil || perr != nil || q <= 0 || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup in bytes, or zero
+// if it isn't limited.
+func cgroupMemoryLimit() int64 {
+	s, ok := readTrimmed(cgroupV2MemoryMax)
+	if !ok {
+		if s, ok = readTrimmed(cgroupV1MemoryLimit); !ok {
+			return 0
+		}
+	}
+	limit, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || limit <= 0 || limit >= cgroupV1NoLimitFloor {
+		return 0
+	}
+	return limit
+}
+
+// ApplyRuntimeLimits sizes GOMAXPROCS to the container's CPU quota and sets a
+// soft memory limit to a fraction of the container's memory limit, unless the
+// GOMAXPROCS or GOMEMLIMIT environment variables already set them. The
+// effective values are published in /debug/vars.
+func ApplyRuntimeLimits(cfg *viper.Viper) RuntimeLimits {
+	cfg.SetDefault("vice.default_backend.runtime.memory_limit_ratio", 0.9)
+
+	limits := RuntimeLimits{GOMAXPROCSSource: "default", MemoryLimitSource: "default"}
+
+	if quota := cgroupCPUQuota(); quota > 0 {
+		limits.CPUQuota = strconv.FormatFloat(quota, 'f', -1, 64)
+		if os.Getenv("GOMAXPROCS") == "" {
+			procs := int(math.Ceil(quota))
+			if procs < 1 {
+				procs = 1
+			}
+			runtime.GOMAXPROCS(procs)
+			limits.GOMAXPROCSSource = "cgroup"
+		}
+	}
+	if os.Getenv("GOMAXPROCS") != "" {
+		limits.GOMAXPROCSSource = "environment"
+	}
+	limits.GOMAXPROCS = runtime.GOMAXPROCS(0)
+
+	limits.CgroupMemoryLimit = cgroupMemoryLimit()
+	ratio := cfg.GetFloat64("vice.default_backend.runtime.memory_limit_ratio")
+	switch {
+	case os.Getenv("GOMEMLIMIT") != "":
+		limits.MemoryLimitSource = "environment"
+	case limits.CgroupMemoryLimit > 0 && ratio > 0 && ratio <= 1:
+		debug.SetMemoryLimit(int64(float64(limits.CgroupMemoryLimit) * ratio))
+		limits.MemoryLimitSource = "cgroup"
+	}
+	limits.MemoryLimit = debug.SetMemoryLimit(-1)
+
+	expvar.Publish("runtime_limits", expvar.Func(func() interface{} { return limits }))
+	return limits
+}
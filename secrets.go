@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// SecretProvider resolves references to secrets stored in some backend. The
+// reference is everything after the provider's scheme, such as the variable
+// name in env:VICE_ADMIN_TOKEN.
+type SecretProvider interface {
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+// secretMapping declares that a config key takes its value from a secret.
+type secretMapping struct {
+	Key    string `mapstructure:"key"`
+	Secret string `mapstructure:"secret"`
+}
+
+// Secrets resolves secret references of the form scheme:reference using the
+// provider registered for the scheme.
+type Secrets struct {
+	providers map[string]SecretProvider
+}
+
+// NewSecrets returns a Secrets with the env and file providers, plus the
+// vault and aws providers if they're configured in the vice.secrets section.
+func NewSecrets(cfg *viper.Viper) (*Secrets, error) {
+	s := &Secrets{
+		providers: map[string]SecretProvider{
+			"env":  envSecretProvider{},
+			"file": fileSecretProvider{},
+		},
+	}
+
+	vault, err := newVaultClient(cfg, "vice.secrets.vault")
+	if err != nil {
+		return nil, err
+	}
+	if vault != nil {
+		s.Register("vault", &vaultSecretProvider{vault: vault})
+	}
+
+	if aws := newAWSSecretsProvider(cfg); aws != nil {
+		s.Register("aws", aws)
+	}
+	return s, nil
+}
+
+// Register adds a provider for a scheme, replacing any existing one.
+func (s *Secrets) Register(scheme string, provider SecretProvider) {
+	s.providers[scheme] = provider
+}
+
+// Resolve returns the value of a secret reference.
+func (s *Secrets) Resolve(ctx context.Context, ref string) (string, error) {
+	scheme, rest, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", fmt.Errorf("secret reference %q has no scheme", ref)
+	}
+	provider, ok := s.providers[scheme]
+	if !ok {
+		return "", fmt.Errorf("no secret provider is configured for %q", scheme)
+	}
+	value, err := provider.Secret(ctx, rest)
+	return value, errors.Wrapf(err, "error resolving secret %s", ref)
+}
+
+// Apply resolves the secrets listed in vice.secrets.mappings, for example
+//
+//	vice:
+//	  secrets:
+//	    mappings:
+//	      - key: vice.db.uri
+//	        secret: vault:secret/data/vice#db_uri
+//	      - key: vice.default_backend.admin.token
+//	        secret: env:VICE_ADMIN_TOKEN
+//
+// and overrides the config keys with their values, so that the code reading
+// the settings doesn't need to know where they came from.
+func (s *Secrets) Apply(ctx context.Context, cfg *viper.Viper) error {
+	var mappings []secretMapping
+	if err := cfg.UnmarshalKey("vice.secrets.mappings", &mappings); err != nil {
+		return errors.Wrap(err, "error parsing vice.secrets.mappings")
+	}
+	for _, m := range mappings {
+		if m.Key == "" || m.Secret == "" {
+			return errors.New("each entry in vice.secrets.mappings needs a key and a secret")
+		}
+		value, err := s.Resolve(ctx, m.Secret)
+		if err != nil {
+			return err
+		}
+		cfg.Set(m.Key, value)
+	}
+	return nil
+}
+
+// splitField splits a reference of the form path#field.
+func splitField(ref, defaultField string) (string, string) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		field = defaultField
+	}
+	return path, field
+}
+
+// envSecretProvider reads secrets from environment variables.
+type envSecretProvider struct{}
+
+func (envSecretProvider) Secret(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s isn't set", name)
+	}
+	return value, nil
+}
+
+// fileSecretProvider reads secrets from files, such as mounted Kubernetes
+// Secrets.
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Secret(_ context.Context, path string) (string, error) {
+	return readSecretFile(path)
+}
+
+// vaultSecretProvider reads secrets from Vault. The reference is the path of
+// the secret followed by the field, which defaults to "value", as in
+// secret/data/vice#admin_token. Both version 1 and version 2 of the KV
+// secrets engine are supported.
+type vaultSecretProvider struct {
+	vault *vaultClient
+}
+
+func (p *vaultSecretProvider) Secret(ctx context.Context, ref string) (string, error) {
+	path, field := splitField(ref, "value")
+
+	var secret vaultSecret
+	if err := p.vault.call(ctx, http.MethodGet, path, nil, &secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string field %s", field)
+	}
+	return value, nil
+}
+
+// awsSecretsProvider reads secrets from AWS Secrets Manager, signing the
+// requests with the credentials in the standard AWS environment variables.
+// The reference is the secret ID, optionally followed by a field to extract
+// from a JSON secret, as in vice/backend#admin_token.
+type awsSecretsProvider struct {
+	client   *http.Client
+	region   string
+	endpoint string
+}
+
+// newAWSSecretsProvider returns an awsSecretsProvider configured from the
+// vice.secrets.aws section of the config, or nil if no region is configured.
+func newAWSSecretsProvider(cfg *viper.Viper) *awsSecretsProvider {
+	region := cfg.GetString("vice.secrets.aws.region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil
+	}
+	endpoint := cfg.GetString("vice.secrets.aws.endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", region)
+	}
+	return &awsSecretsProvider{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		region:   region,
+		endpoint: endpoint,
+	}
+}
+
+func (p *awsSecretsProvider) Secret(ctx context.Context, ref string) (string, error) {
+	id, field := splitField(ref, "")
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if err = signAWSRequest(req, body, p.region, "secretsmanager", time.Now()); err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("secrets manager returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var result struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if field == "" {
+		return result.SecretString, nil
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal([]byte(result.SecretString), &fields); err != nil {
+		return "", errors.Wrap(err, "the secret isn't a JSON object")
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string field %s", field)
+	}
+	return value, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header to a
+// request with an empty query string.
+func signAWSRequest(req *http.Request, body []byte, region, service string, now time.Time) error {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	names := []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	var signed []string
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		if value == "" {
+			continue
+		}
+		signed = append(signed, name)
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, "", canonicalHeaders.String(), signedHeaders, sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/vice-default-backend/urls"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// defaultSelfTestMissingSubdomain is looked up by the self-test when no
+// missing subdomain is configured. It can't be generated by the DE.
+const defaultSelfTestMissingSubdomain = "selftest-missing"
+
+// SelfTestConfig names the subdomains the self-test looks up.
+type SelfTestConfig struct {
+	KnownSubdomain   string
+	MissingSubdomain string
+}
+
+// NewSelfTestConfig reads the vice.default_backend.selftest section of the
+// config.
+func NewSelfTestConfig(cfg *viper.Viper) SelfTestConfig {
+	cfg.SetDefault("vice.default_backend.selftest.missing_subdomain", defaultSelfTestMissingSubdomain)
+	return SelfTestConfig{
+		KnownSubdomain:   cfg.GetString("vice.default_backend.selftest.known_subdomain"),
+		MissingSubdomain: cfg.GetString("vice.default_backend.selftest.missing_subdomain"),
+	}
+}
+
+// SelfTestStep is the result of one step of the decision path.
+type SelfTestStep struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// SelfTestCheck is the result of running the decision path for one subdomain.
+type SelfTestCheck struct {
+	Subdomain string         `json:"subdomain"`
+	Expected  string         `json:"expected"`
+	Passed    bool           `json:"passed"`
+	Steps     []SelfTestStep `json:"steps"`
+}
+
+// SelfTestResult is the body returned by the self-test endpoint.
+type SelfTestResult struct {
+	Passed bool            `json:"passed"`
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// timedStep runs f and records how long it took.
+func timedStep(name string, f func() (string, error)) SelfTestStep {
+	start := time.Now()
+	detail, err := f()
+	step := SelfTestStep{
+		Name:      name,
+		OK:        err == nil,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Detail:    detail,
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	return step
+}
+
+// selfTestSubdomain runs a subdomain through the cache, the database lookup,
+// and URL construction, checking whether the analysis is found as expected.
+func (a *App) selfTestSubdomain(ctx context.Context, subdomain string, expectFound bool) SelfTestCheck {
+	check := SelfTestCheck{Subdomain: subdomain, Expected: StateNotFound}
+	if expectFound {
+		check.Expected = "found"
+	}
+
+	if a.cache != nil {
+		check.Steps = append(check.Steps, timedStep("cache", func() (string, error) {
+			// Peek, so that self tests don't skew the cache hit ratio.
+			analysis, ok := a.cache.Peek(subdomain)
+			switch {
+			case !ok:
+				return "miss", nil
+			case (analysis != nil) != expectFound:
+				return "hit", errors.Errorf("the cache has the wrong answer: state %s", analysis.State())
+			default:
+				return "hit", nil
+			}
+		}))
+	}
+
+	var analysis *Analysis
+	check.Steps = append(check.Steps, timedStep("db_lookup", func() (string, error) {
+		var err error
+		analysis, err = a.AnalysisBySubdomain(ctx, subdomain)
+		if err != nil {
+			return "", err
+		}
+		if (analysis != nil) != expectFound {
+			return analysis.State(), errors.Errorf("expected %s, got state %s", check.Expected, analysis.State())
+		}
+		return analysis.State(), nil
+	}))
+
+	if expectFound {
+		check.Steps = append(check.Steps, timedStep("url_construction", func() (string, error) {
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+			if err != nil {
+				return "", err
+			}
+			r.Host = subdomain
+			appURL, err := a.AppURL(r)
+			if err != nil {
+				return "", err
+			}
+			_, loadingPageBaseURL := a.loadingPages.Select(r)
+			return urls.WithPathSegment(loadingPageBaseURL, appURL).String(), nil
+		}))
+	}
+
+	check.Passed = true
+	for _, step := range check.Steps {
+		check.Passed = check.Passed && step.OK
+	}
+	return check
+}
+
+// SelfTestHandler exercises the decision path for the configured known-good
+// and missing subdomains and reports the outcome and latency of each step.
+// The response is a 503 if any step failed so that synthetic monitoring can
+// alert on the status code alone.
+func (a *App) SelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var checks []SelfTestCheck
+	if a.selfTest.KnownSubdomain != "" {
+		checks = append(checks, a.selfTestSubdomain(ctx, a.selfTest.KnownSubdomain, true))
+	}
+	checks = append(checks, a.selfTestSubdomain(ctx, a.selfTest.MissingSubdomain, false))
+
+	result := &SelfTestResult{Passed: true, Checks: checks}
+	for _, check := range checks {
+		result.Passed = result.Passed && check.Passed
+	}
+
+	status := http.StatusOK
+	if !result.Passed {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, result)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the limits on request headers.
+const (
+	defaultMaxHeaderBytes    = 32 << 10
+	defaultReadHeaderTimeout = 10 * time.Second
+)
+
+// Listen opens the TCP listeners for the server, one for each address,
+// applying the keep-alive period and connection limit from the
+// vice.default_backend.server and vice.default_backend.limits sections of
+// the config. A negative keep-alive period disables TCP keep-alives; zero
+// uses Go's default. The connection limit applies to all of the listeners
+// together. Plain HTTP connections that send their headers too slowly get a
+// 408 response. The sockets are taken over from the process being replaced
+// during an upgrade.
+func Listen(cfg *viper.Viper, addrs []string, useSSL bool, upgrader *Upgrader) ([]net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAlive: cfg.GetDuration("vice.default_backend.server.tcp_keep_alive"),
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := upgrader.Listen(lc, listenNetwork(addr, len(addrs) > 1), addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if maxConns := cfg.GetInt("vice.default_backend.limits.max_connections"); maxConns > 0 {
+		log.Infof("accepting at most %d simultaneous connections", maxConns)
+		listeners = LimitListeners(listeners, maxConns)
+	}
+
+	// The 408 can't be written to TLS connections from down here, below the
+	// TLS layer, so those are still just closed.
+	if !useSSL {
+		for i, listener := range listeners {
+			listeners[i] = headerTimeoutListener{listener}
+		}
+	}
+	return listeners, nil
+}
+
+// listenNetwork returns the network to listen on for an address. A single
+// wildcard address such as 0.0.0.0:60000 or [::]:60000 listens on both IPv4
+// and IPv6. When there are several addresses, each one only listens on its
+// own address family, so that 0.0.0.0:60000 and [::]:60000 can be listed
+// together without the second one finding the port taken.
+func listenNetwork(addr string, multiple bool) string {
+	if !multiple {
+		return "tcp"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// parseListenAddrs splits a comma-separated list of listen addresses.
+func parseListenAddrs(list string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, errors.Wrapf(err, "invalid listen address %q", addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	return addrs, nil
+}
+
+// NewServer returns the HTTP server with the connection handling settings
+// from the vice.default_backend.server section of the config. Requests with
+// headers larger than the limit get a 431 from net/http.
+func NewServer(cfg *viper.Viper, addr string, handler http.Handler) *http.Server {
+	cfg.SetDefault("vice.default_backend.server.keep_alives", true)
+	cfg.SetDefault("vice.default_backend.server.max_header_bytes", defaultMaxHeaderBytes)
+	cfg.SetDefault("vice.default_backend.server.read_header_timeout", defaultReadHeaderTimeout)
+
+	server := &http.Server{
+		Handler:           handler,
+		Addr:              addr,
+		IdleTimeout:       cfg.GetDuration("vice.default_backend.server.idle_timeout"),
+		MaxHeaderBytes:    cfg.GetInt("vice.default_backend.server.max_header_bytes"),
+		ReadHeaderTimeout: cfg.GetDuration("vice.default_backend.server.read_header_timeout"),
+		ConnState:         trackHeaderReads,
+	}
+	server.SetKeepAlivesEnabled(cfg.GetBool("vice.default_backend.server.keep_alives"))
+	return server
+}
+
+// headerTimeoutResponse is written to clients that don't finish sending their
+// request headers within the read header timeout.
+const headerTimeoutResponse = "HTTP/1.1 408 Request Timeout\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Connection: close\r\n\r\n" +
+	"408 Request Timeout"
+
+var headerTimeouts = NewCounterVec(
+	"header_timeouts_total",
+	"Connections closed with a 408 because the client sent its request headers too slowly.",
+)
+
+// headerTimeoutListener wraps plain HTTP connections so that clients that
+// time out part way through sending a request get a 408 instead of having
+// the connection silently closed, which is all net/http does on its own.
+type headerTimeoutListener struct {
+	net.Listener
+}
+
+func (l headerTimeoutListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	htc := &headerTimeoutConn{Conn: c}
+	htc.readingHeaders.Store(true)
+	return htc, nil
+}
+
+// trackHeaderReads is the server's ConnState hook. net/http reports a
+// connection as active once it has parsed a request's headers, and as idle
+// once it's waiting for the next request, so read timeouts in between, such
+// as net/http canceling its own background read, aren't header timeouts.
+func trackHeaderReads(c net.Conn, state http.ConnState) {
+	htc, ok := c.(*headerTimeoutConn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateActive, http.StateHijacked:
+		htc.readingHeaders.Store(false)
+	case http.StateIdle:
+		htc.readingHeaders.Store(true)
+	}
+}
+
+// headerTimeoutConn tracks whether part of a request's headers has been read
+// since the last response was written. If a read deadline expires with
+// partial headers pending, the 408 replaces whatever net/http writes next and
+// is otherwise written when the connection is closed. Read deadlines that
+// expire on an idle keep-alive connection close it without a response.
+type headerTimeoutConn struct {
+	net.Conn
+	readingHeaders atomic.Bool
+	pending        atomic.Bool
+	timedOut       atomic.Bool
+	once           sync.Once
+}
+
+func (c *headerTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.pending.Store(true)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && c.pending.Load() && c.readingHeaders.Load() {
+		c.timedOut.Store(true)
+	}
+	return n, err
+}
+
+func (c *headerTimeoutConn) respondTimeout() {
+	c.once.Do(func() {
+		headerTimeouts.Inc()
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		io.WriteString(c.Conn, headerTimeoutResponse)
+	})
+}
+
+func (c *headerTimeoutConn) Write(b []byte) (int, error) {
+	if c.timedOut.Load() {
+		c.respondTimeout()
+		return len(b), nil
+	}
+	c.pending.Store(false)
+	return c.Conn.Write(b)
+}
+
+func (c *headerTimeoutConn) Close() error {
+	if c.timedOut.Load() {
+		c.respondTimeout()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Defaults for the shared analysis warning settings.
+const (
+	defaultSharedWarningCookie          = "vice_shared_warning"
+	defaultSharedWarningMaxAge          = 30 * 24 * time.Hour
+	defaultSharedWarningRefreshInterval = time.Minute
+)
+
+const sharedAnalysesQuery = `
+	SELECT analysis_id
+	  FROM vice_default_backend_shared_analyses
+`
+
+// SharedWarning shows a one-time warning page before users are sent on to an
+// analysis that has been flagged as publicly shared, reminding them whose app
+// they're using and not to enter their credentials into it. The flagged
+// analyses are read from the vice_default_backend_shared_analyses table. A
+// cookie set along with the page skips it on later visits.
+type SharedWarning struct {
+	cookie string
+	maxAge time.Duration
+	mu     sync.RWMutex
+	shared map[string]bool
+}
+
+// SharedWarningPageData is passed to the template for the shared analysis
+// warning page.
+type SharedWarningPageData struct {
+	*PageData
+	Name     string
+	Username string
+	Location string
+}
+
+// NewSharedWarning returns a SharedWarning configured from the
+// vice.default_backend.shared_warning section of the config, or nil if
+// vice.default_backend.shared_warning.enabled isn't set.
+func NewSharedWarning(cfg *viper.Viper) *SharedWarning {
+	cfg.SetDefault("vice.default_backend.shared_warning.cookie", defaultSharedWarningCookie)
+	cfg.SetDefault("vice.default_backend.shared_warning.max_age", defaultSharedWarningMaxAge)
+	cfg.SetDefault("vice.default_backend.shared_warning.refresh_interval", defaultSharedWarningRefreshInterval)
+
+	if !cfg.GetBool("vice.default_backend.shared_warning.enabled") {
+		return nil
+	}
+	return &SharedWarning{
+		cookie: cfg.GetString("vice.default_backend.shared_warning.cookie"),
+		maxAge: cfg.GetDuration("vice.default_backend.shared_warning.max_age"),
+		shared: make(map[string]bool),
+	}
+}
+
+// Refresh reloads the IDs of the shared analyses from the database.
+func (s *SharedWarning) Refresh(ctx context.Context, db *sql.DB) (err error) {
+	defer observeQuery(QuerySharedAnalyses, time.Now(), &err)
+
+	rows, err := db.QueryContext(ctx, sharedAnalysesQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	shared := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return err
+		}
+		shared[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shared = shared
+	return nil
+}
+
+// Poll refreshes the shared analyses from the database on the interval passed
+// in until the context is canceled.
+func (s *SharedWarning) Poll(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx, db); err != nil {
+			log.Errorf("error refreshing the shared analyses: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Required returns true if the request is for a shared analysis and the
+// warning hasn't been shown for it yet. The cookie holds the ID of the
+// analysis it was shown for, so a new analysis on the same subdomain gets
+// the warning again.
+func (s *SharedWarning) Required(r *http.Request, analysis *Analysis) bool {
+	s.mu.RLock()
+	shared := s.shared[analysis.ID]
+	s.mu.RUnlock()
+	if !shared {
+		return false
+	}
+	c, err := r.Cookie(s.cookie)
+	return err != nil || c.Value != analysis.ID
+}
+
+// SharedWarningHandler renders the warning page for a shared analysis and
+// sets the cookie that skips it next time. Continuing from the page requests
+// the app again, which then goes on to the loading page.
+func (a *App) SharedWarningHandler(w http.ResponseWriter, r *http.Request, analysis *Analysis) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.sharedWarning.cookie,
+		Value:    analysis.ID,
+		Path:     "/",
+		MaxAge:   int(a.sharedWarning.maxAge.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	a.renderPage(w, http.StatusOK, "shared.html", &SharedWarningPageData{
+		PageData: a.analysisPageData(r.Context(), analysis),
+		Name:     analysis.Name,
+		Username: analysis.Username,
+		Location: r.URL.RequestURI(),
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// smokeTest is one check run by the smoke-test subcommand.
+type smokeTest struct {
+	name string
+	run  func() error
+}
+
+// smokeTester makes requests against a running instance without following
+// redirects.
+type smokeTester struct {
+	baseURL *url.URL
+	domain  string
+	client  *http.Client
+}
+
+func (s *smokeTester) get(path, host string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, s.baseURL.JoinPath(path).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		req.Host = host
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (s *smokeTester) expectStatus(path, host string, status int) error {
+	resp, err := s.get(path, host)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != status {
+		return errors.Errorf("expected %d, got %s", status, resp.Status)
+	}
+	return nil
+}
+
+// expectRedirect checks that a request for the subdomain is sent to the
+// loading page with the app URL embedded in the location.
+func (s *smokeTester) expectRedirect(subdomain, loadingPagePrefix string) error {
+	resp, err := s.get("/", subdomain+"."+s.domain)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		return errors.Errorf("expected %d, got %s", http.StatusTemporaryRedirect, resp.Status)
+	}
+
+	location := resp.Header.Get("Location")
+	parsed, err := url.Parse(location)
+	if err != nil || !parsed.IsAbs() {
+		return errors.Errorf("the location %q isn't an absolute URL", location)
+	}
+	if loadingPagePrefix != "" && !strings.HasPrefix(location, loadingPagePrefix) {
+		return errors.Errorf("the location %q doesn't start with %s", location, loadingPagePrefix)
+	}
+	if !strings.Contains(location, subdomain) {
+		return errors.Errorf("the location %q doesn't mention the subdomain", location)
+	}
+	return nil
+}
+
+// runSmokeTestCommand implements the smoke-test subcommand, which runs a
+// battery of checks against a running instance for use as a deployment
+// gate. It returns the exit code.
+func runSmokeTestCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("smoke-test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		domain            = fs.String("domain", "", "The domain the VICE subdomains are under. Defaults to the host name of the base URL, without its port.")
+		subdomain         = fs.String("subdomain", "", "A seeded subdomain that should be redirected to the loading page. Skipped when unset.")
+		loadingPagePrefix = fs.String("loading-page-prefix", "", "A prefix the loading page redirect must start with.")
+		dbValidation      = fs.Bool("db-validation", false, "Expect unknown subdomains to get a 404, as they do with the db_validation flag on. Otherwise they're expected to be redirected to the loading page.")
+		timeout           = fs.Duration("timeout", 10*time.Second, "The timeout for each request.")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: vice-default-backend smoke-test <base URL> [--subdomain a1b2c3d4] [--domain cyverse.run] [--loading-page-prefix URL] [--db-validation] [--timeout 10s]")
+		fs.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	baseURL, err := url.Parse(positional[0])
+	if err != nil || !baseURL.IsAbs() {
+		fmt.Fprintf(stderr, "%s is not an absolute URL\n", positional[0])
+		return 2
+	}
+	if *domain == "" {
+		*domain = baseURL.Hostname()
+	}
+
+	s := &smokeTester{
+		baseURL: baseURL,
+		domain:  *domain,
+		client: &http.Client{
+			Timeout: *timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	junk := fmt.Sprintf("smoketest-%08x", rand.Uint32())
+	tests := []smokeTest{
+		{"healthz", func() error { return s.expectStatus("/healthz", "", http.StatusOK) }},
+		{"readyz", func() error { return s.expectStatus("/readyz", "", http.StatusOK) }},
+	}
+	if *dbValidation {
+		tests = append(tests, smokeTest{"unknown subdomain is a 404", func() error {
+			return s.expectStatus("/", junk+"."+s.domain, http.StatusNotFound)
+		}})
+	} else {
+		tests = append(tests, smokeTest{"unknown subdomain is redirected", func() error {
+			return s.expectRedirect(junk, *loadingPagePrefix)
+		}})
+	}
+	if *subdomain != "" {
+		tests = append(tests, smokeTest{"seeded subdomain is redirected", func() error {
+			return s.expectRedirect(*subdomain, *loadingPagePrefix)
+		}})
+	}
+
+	failed := 0
+	for _, test := range tests {
+		start := time.Now()
+		err := test.run()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Fprintf(stdout, "FAIL %s (%s): %s\n", test.name, elapsed, err)
+			continue
+		}
+		fmt.Fprintf(stdout, "PASS %s (%s)\n", test.name, elapsed)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(stdout, "%d of %d checks failed\n", failed, len(tests))
+		return 1
+	}
+	fmt.Fprintf(stdout, "all %d checks passed\n", len(tests))
+	return 0
+}
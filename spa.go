@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// spaIndex is the page served by a single-page app mount for paths that
+// don't match a file.
+const spaIndex = "index.html"
+
+// SPAHandler serves the files in a directory, falling back to its index.html
+// for paths that don't match a file and don't look like one, so that a
+// single-page app's client-side routes can be loaded directly. Missing files
+// with an extension, such as scripts and stylesheets, still get a 404.
+type SPAHandler struct {
+	dir   string
+	files http.Handler
+}
+
+// NewSPAHandler returns an SPAHandler for the directory passed in.
+func NewSPAHandler(dir string) *SPAHandler {
+	return &SPAHandler{dir: dir, files: http.FileServer(http.Dir(dir))}
+}
+
+// ServeHTTP serves the requested file or the index page. The request path
+// must already have the mount's prefix stripped.
+func (h *SPAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if _, err := os.Stat(filepath.Join(h.dir, filepath.FromSlash(name))); err == nil || path.Ext(name) != "" {
+		h.files.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, filepath.Join(h.dir, spaIndex))
+}
+
+// SPAMount is an additional path prefix that serves a single-page app.
+type SPAMount struct {
+	Prefix string
+	Dir    string
+}
+
+// NewSPAMount returns the single-page app mount configured in the
+// vice.default_backend.spa section of the config, or nil if
+// vice.default_backend.spa.prefix isn't set.
+func NewSPAMount(cfg *viper.Viper) (*SPAMount, error) {
+	prefix := cfg.GetString("vice.default_backend.spa.prefix")
+	if prefix == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+		return nil, errors.Errorf("vice.default_backend.spa.prefix must start and end with /, got %q", prefix)
+	}
+	dir := cfg.GetString("vice.default_backend.spa.dir")
+	if dir == "" {
+		return nil, errors.New("vice.default_backend.spa.dir is required")
+	}
+	if _, err := os.Stat(filepath.Join(dir, spaIndex)); err != nil {
+		return nil, errors.Wrap(err, "the single-page app directory needs an index.html")
+	}
+	return &SPAMount{Prefix: prefix, Dir: dir}, nil
+}
+
+// Handler returns the handler for the mount's prefix.
+func (m *SPAMount) Handler() http.Handler {
+	return http.StripPrefix(strings.TrimSuffix(m.Prefix, "/"), NewSPAHandler(m.Dir))
+}
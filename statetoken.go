@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/vice-default-backend/client"
+	"github.com/cyverse-de/vice-default-backend/urls"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the state token settings.
+const (
+	defaultStateTokenParam         = "state"
+	defaultStateTokenTTL           = 5 * time.Minute
+	defaultStateKeyRefreshInterval = 5 * time.Minute
+)
+
+// StateTokens issues the tokens passed to the loading page in place of the
+// bare app URL. The token carries the app URL, subdomain, and analysis ID
+// along with its issue time. By default it's a JWT signed with a key shared
+// with the loading page, which checks it as client.VerifyStateToken does.
+// Deployments that consider that metadata sensitive can have it encrypted
+// instead, and the loading page decrypts it as client.DecryptStateToken does.
+type StateTokens struct {
+	signingKey []byte
+	ttl        time.Duration
+	param      string
+
+	// The encryption key can come from a secret that's read again every
+	// refresh interval, so that it can be rotated without a restart.
+	secrets         *Secrets
+	keySecret       string
+	refreshInterval time.Duration
+	mu              sync.RWMutex
+	encryptionKey   []byte
+}
+
+// NewStateTokens returns a StateTokens configured from the
+// vice.default_backend.state_token section of the config, or nil if neither
+// a signing key nor an encryption key is configured. The encryption key is
+// taken from vice.default_backend.state_token.encryption_key_secret, a secret
+// reference, or vice.default_backend.state_token.encryption_key, and takes
+// precedence over the signing key.
+func NewStateTokens(ctx context.Context, cfg *viper.Viper, secrets *Secrets) (*StateTokens, error) {
+	cfg.SetDefault("vice.default_backend.state_token.param", defaultStateTokenParam)
+	cfg.SetDefault("vice.default_backend.state_token.ttl", defaultStateTokenTTL)
+	cfg.SetDefault("vice.default_backend.state_token.key_refresh_interval", defaultStateKeyRefreshInterval)
+
+	s := &StateTokens{
+		signingKey:      []byte(cfg.GetString("vice.default_backend.state_token.signing_key")),
+		ttl:             cfg.GetDuration("vice.default_backend.state_token.ttl"),
+		param:           cfg.GetString("vice.default_backend.state_token.param"),
+		secrets:         secrets,
+		keySecret:       cfg.GetString("vice.default_backend.state_token.encryption_key_secret"),
+		refreshInterval: cfg.GetDuration("vice.default_backend.state_token.key_refresh_interval"),
+	}
+
+	switch {
+	case s.keySecret != "":
+		if err := s.RefreshKey(ctx); err != nil {
+			return nil, err
+		}
+	case cfg.GetString("vice.default_backend.state_token.encryption_key") != "":
+		key, err := parseStateKey(cfg.GetString("vice.default_backend.state_token.encryption_key"))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse vice.default_backend.state_token.encryption_key")
+		}
+		s.encryptionKey = key
+	case len(s.signingKey) == 0:
+		return nil, nil
+	}
+	return s, nil
+}
+
+// parseStateKey decodes a base64-encoded encryption key.
+func parseStateKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != client.StateKeySize {
+		return nil, errors.Errorf("the key must be %d bytes long, got %d", client.StateKeySize, len(key))
+	}
+	return key, nil
+}
+
+// RefreshKey reads the encryption key from its secret again.
+func (s *StateTokens) RefreshKey(ctx context.Context) error {
+	encoded, err := s.secrets.Resolve(ctx, s.keySecret)
+	if err != nil {
+		return err
+	}
+	key, err := parseStateKey(encoded)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse the state token key in %s", s.keySecret)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.encryptionKey != nil && client.StateKeyID(key) != client.StateKeyID(s.encryptionKey) {
+		log.Infof("the state token encryption key was rotated to %s", client.StateKeyID(key))
+	}
+	s.encryptionKey = key
+	return nil
+}
+
+// Refresh reads the encryption key from its secret every refresh interval
+// until the process exits. It does nothing if the key doesn't come from a
+// secret.
+func (s *StateTokens) Refresh() {
+	if s.keySecret == "" {
+		return
+	}
+	for {
+		time.Sleep(s.refreshInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := s.RefreshKey(ctx); err != nil {
+			log.Errorf("error refreshing the state token encryption key: %s", err)
+		}
+		cancel()
+	}
+}
+
+// LoadingURL returns the loading page URL for a request, with a token for
+// the given app URL, subdomain, and analysis ID in the query string. The
+// analysis ID is empty if the subdomain wasn't looked up.
+func (s *StateTokens) LoadingURL(base *url.URL, appURL, subdomain, analysisID string) (*url.URL, error) {
+	now := time.Now()
+	claims := &client.StateClaims{
+		AppURL:     appURL,
+		Subdomain:  subdomain,
+		AnalysisID: analysisID,
+		Issuer:     client.StateTokenIssuer,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(s.ttl).Unix(),
+	}
+
+	s.mu.RLock()
+	encryptionKey := s.encryptionKey
+	s.mu.RUnlock()
+
+	var (
+		token string
+		err   error
+	)
+	if encryptionKey != nil {
+		token, err = client.EncryptStateToken(claims, encryptionKey)
+	} else {
+		token, err = client.SignStateToken(claims, s.signingKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return urls.WithQuery(base, s.param, token), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsRetention is how far back the in-memory statistics go.
+const statsRetention = 24 * time.Hour
+
+// statsBuckets is the number of one-minute buckets needed to cover the
+// retention period.
+const statsBuckets = int(statsRetention / time.Minute)
+
+// maxSubdomainsPerBucket bounds the memory used to count unique subdomains
+// when the service is being scanned.
+const maxSubdomainsPerBucket = 10000
+
+// statsBucket holds the counts for a single minute.
+type statsBucket struct {
+	minute     int64
+	outcomes   map[string]int
+	reasons    map[string]int
+	subdomains map[string]struct{}
+}
+
+// Stats keeps per-minute routing counts for the last day.
+type Stats struct {
+	mu      sync.Mutex
+	buckets [statsBuckets]*statsBucket
+}
+
+// Record counts a routing decision.
+func (s *Stats) Record(d Decision) {
+	minute := d.Time.Unix() / 60
+	i := minute % int64(statsBuckets)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.buckets[i]
+	if b == nil || b.minute != minute {
+		b = &statsBucket{
+			minute:     minute,
+			outcomes:   make(map[string]int),
+			reasons:    make(map[string]int),
+			subdomains: make(map[string]struct{}),
+		}
+		s.buckets[i] = b
+	}
+
+	b.outcomes[d.Outcome]++
+	if d.Reason != "" {
+		b.reasons[d.Reason]++
+	}
+	if len(b.subdomains) < maxSubdomainsPerBucket {
+		b.subdomains[d.Subdomain] = struct{}{}
+	}
+}
+
+// ReasonCount is the number of decisions made for a reason.
+type ReasonCount struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// StatsSummary contains the routing counts rolled up over a window.
+type StatsSummary struct {
+	Window           string         `json:"window"`
+	Total            int            `json:"total"`
+	Redirects        int            `json:"redirects"`
+	NotFound         int            `json:"not_found"`
+	Outcomes         map[string]int `json:"outcomes"`
+	UniqueSubdomains int            `json:"unique_subdomains"`
+	TopReasons       []ReasonCount  `json:"top_reasons"`
+
+	// Domains counts decisions by the domain of the requested host, for
+	// summaries taken from the hourly rollup.
+	Domains map[string]int `json:"domains,omitempty"`
+}
+
+// topReasonsCount is the number of reasons included in a summary.
+const topReasonsCount = 10
+
+// Summary rolls up the counts for the window ending now.
+func (s *Stats) Summary(window time.Duration) *StatsSummary {
+	now := time.Now().Unix() / 60
+	oldest := now - int64(window/time.Minute)
+
+	summary := &StatsSummary{
+		Window:   window.String(),
+		Outcomes: make(map[string]int),
+	}
+	reasons := make(map[string]int)
+	subdomains := make(map[string]struct{})
+
+	s.mu.Lock()
+	for _, b := range s.buckets {
+		if b == nil || b.minute <= oldest || b.minute > now {
+			continue
+		}
+		for outcome, n := range b.outcomes {
+			summary.Outcomes[outcome] += n
+			summary.Total += n
+		}
+		for reason, n := range b.reasons {
+			reasons[reason] += n
+		}
+		for subdomain := range b.subdomains {
+			subdomains[subdomain] = struct{}{}
+		}
+	}
+	s.mu.Unlock()
+
+	summary.Redirects = summary.Outcomes[OutcomeRedirect]
+	summary.NotFound = summary.Outcomes[OutcomeNotFound]
+	summary.UniqueSubdomains = len(subdomains)
+
+	summary.TopReasons = make([]ReasonCount, 0, len(reasons))
+	for reason, n := range reasons {
+		summary.TopReasons = append(summary.TopReasons, ReasonCount{Reason: reason, Count: n})
+	}
+	sort.Slice(summary.TopReasons, func(i, j int) bool {
+		if summary.TopReasons[i].Count != summary.TopReasons[j].Count {
+			return summary.TopReasons[i].Count > summary.TopReasons[j].Count
+		}
+		return summary.TopReasons[i].Reason < summary.TopReasons[j].Reason
+	})
+	if len(summary.TopReasons) > topReasonsCount {
+		summary.TopReasons = summary.TopReasons[:topReasonsCount]
+	}
+
+	return summary
+}
+
+// StatsHandler returns routing statistics rolled up over the window given in
+// the window query parameter, which defaults to one hour. Windows longer than
+// the in-memory statistics go back are answered from the hourly rollup, if
+// it's enabled.
+func (a *App) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	maxWindow := statsRetention
+	if a.rollup != nil {
+		maxWindow = a.rollup.Retention()
+	}
+	if window < time.Minute || window > maxWindow {
+		writeError(w, "window must be between 1m and "+strconv.Itoa(int(maxWindow.Hours()))+"h", http.StatusBadRequest)
+		return
+	}
+	if window <= statsRetention {
+		writeJSON(w, http.StatusOK, a.stats.Summary(window))
+		return
+	}
+
+	summary, err := a.rollup.Summary(r.Context(), window)
+	if err != nil {
+		log.Errorf("error reading the hourly statistics rollup: %s", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AnalysisSummary describes an analysis and the subdomain it uses.
+type AnalysisSummary struct {
+	Subdomain  string     `json:"subdomain"`
+	AnalysisID string     `json:"analysis_id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	AppID      string     `json:"app_id,omitempty"`
+	AppName    string     `json:"app_name,omitempty"`
+	State      string     `json:"state"`
+	StartDate  *time.Time `json:"start_date,omitempty"`
+}
+
+// summarize returns the summary of an analysis.
+func (a *App) summarize(analysis *Analysis) *AnalysisSummary {
+	return &AnalysisSummary{
+		Subdomain:  analysis.Subdomain,
+		AnalysisID: analysis.ID,
+		Name:       analysis.Name,
+		Owner:      analysis.Username,
+		AppID:      analysis.AppID,
+		AppName:    analysis.AppName,
+		State:      analysis.State(),
+		StartDate:  analysis.StartDate,
+	}
+}
+
+// SubdomainsResponse is the body returned by the active subdomains endpoint.
+// NextCursor is set when there are more subdomains after this page.
+type SubdomainsResponse struct {
+	Subdomains []*AnalysisSummary `json:"subdomains"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// defaultSubdomainsPageSize is the number of subdomains listed per page by
+// default.
+const defaultSubdomainsPageSize = 100
+
+// subdomainFilter selects the active analyses to list from the query
+// parameters of a request.
+type subdomainFilter struct {
+	owner    string
+	state    string
+	app      string
+	from, to time.Time
+	after    string
+}
+
+// parseSubdomainFilter reads the owner, state, app, from, to, and cursor
+// query parameters.
+func parseSubdomainFilter(q url.Values) (*subdomainFilter, error) {
+	f := &subdomainFilter{
+		owner: q.Get("owner"),
+		state: q.Get("state"),
+		app:   q.Get("app"),
+	}
+	for _, param := range []string{"from", "to"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s must be an RFC 3339 timestamp", param)
+		}
+		if param == "from" {
+			f.from = t
+		} else {
+			f.to = t
+		}
+	}
+	cursor, err := decodeCursor(q, 1)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		f.after = cursor[0]
+	}
+	return f, nil
+}
+
+// matches returns true if the analysis passes the filter. The app matches
+// either the app's ID or its name, ignoring case.
+func (f *subdomainFilter) matches(analysis *Analysis) bool {
+	switch {
+	case f.after != "" && analysis.Subdomain <= f.after:
+		return false
+	case f.owner != "" && analysis.Username != f.owner:
+		return false
+	case f.state != "" && analysis.State() != f.state:
+		return false
+	case f.app != "" && analysis.AppID != f.app && !strings.EqualFold(analysis.AppName, f.app):
+		return false
+	}
+	if !f.from.IsZero() || !f.to.IsZero() {
+		if analysis.StartDate == nil {
+			return false
+		}
+		if !f.from.IsZero() && analysis.StartDate.Before(f.from) {
+			return false
+		}
+		if !f.to.IsZero() && !analysis.StartDate.Before(f.to) {
+			return false
+		}
+	}
+	return true
+}
+
+// ActiveAnalyses returns the latest analysis on every subdomain that's still
+// submitted, queued, or running, ordered by subdomain. In development mode the
+// analyses come from the fixtures instead of the database.
+func (a *App) ActiveAnalyses(ctx context.Context) (analyses []*Analysis, err error) {
+	if a.fixtures != nil {
+		return a.fixtures.Active(), nil
+	}
+	if a.db == nil {
+		return nil, errDatabaseDisabled
+	}
+	defer observeQuery(QueryActiveAnalyses, time.Now(), &err)
+	return queryAnalyses(ctx, a.lookups, activeAnalysesQuery)
+}
+
+// SubdomainsHandler lists the subdomains of the active analyses straight from
+// the database, so that operators can see what the wildcard domain is
+// fronting. The list is ordered by subdomain and paged with the limit and
+// cursor query parameters, and the owner, state, app, from, and to query
+// parameters filter it.
+func (a *App) SubdomainsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := pageLimit(q, defaultSubdomainsPageSize)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseSubdomainFilter(q)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	analyses, err := a.ActiveAnalyses(r.Context())
+	if err == errDatabaseDisabled {
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Errorf("error listing the active analyses: %s", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The database's collation may not order subdomains the same way as the
+	// cursor comparison, so they're sorted here.
+	sort.Slice(analyses, func(i, j int) bool { return analyses[i].Subdomain < analyses[j].Subdomain })
+
+	resp := &SubdomainsResponse{Subdomains: make([]*AnalysisSummary, 0, limit)}
+	for _, analysis := range analyses {
+		if !filter.matches(analysis) {
+			continue
+		}
+		if len(resp.Subdomains) == limit {
+			resp.NextCursor = encodeCursor(resp.Subdomains[limit-1].Subdomain)
+			break
+		}
+		resp.Subdomains = append(resp.Subdomains, a.summarize(analysis))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// LookupResponse is the body returned by the lookup endpoint. Status is the
+// HTTP status the router would respond with, and Analysis is nil if the
+// subdomain doesn't belong to an analysis or wasn't looked up.
+type LookupResponse struct {
+	Subdomain string           `json:"subdomain"`
+	Analysis  *AnalysisSummary `json:"analysis,omitempty"`
+	Decision  *Decision        `json:"decision"`
+	Status    int              `json:"status"`
+}
+
+// LookupHandler resolves a host through the routing logic without serving
+// anything, reporting the analysis behind it and the decision the router
+// would make for a client with the caller's User-Agent. The host parameter can be a bare
+// subdomain, a host name, or a full app URL including the path. The dry run
+// skips auth gating and doesn't count towards the stats or the audit log.
+func (a *App) LookupHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		writeError(w, "the host parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	target, err := url.Parse(host)
+	if err != nil || target.Host == "" {
+		writeError(w, "invalid host "+r.URL.Query().Get("host"), http.StatusBadRequest)
+		return
+	}
+	target.Scheme = "http"
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("User-Agent", r.UserAgent())
+
+	rec := httptest.NewRecorder()
+	decision := a.newDecision(req)
+	decision.dryRun = true
+	a.route(rec, req, decision)
+	decision.Time = time.Now()
+
+	resp := &LookupResponse{
+		Subdomain: decision.Subdomain,
+		Decision:  decision,
+		Status:    rec.Code,
+	}
+	if decision.AnalysisID != "" {
+		analysis, err := a.LookupAnalysis(r.Context(), decision.Subdomain)
+		if err != nil {
+			log.Errorf("error looking up subdomain %s: %s", decision.Subdomain, err)
+		} else if analysis != nil {
+			resp.Analysis = a.summarize(analysis)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
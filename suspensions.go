@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// defaultSuspensionsRefreshInterval is how often the suspended analyses are
+// read from the database by default.
+const defaultSuspensionsRefreshInterval = time.Minute
+
+const suspendedAnalysesQuery = `
+	SELECT analysis_id, kind, COALESCE(reason, '')
+	  FROM vice_default_backend_suspended_analyses
+`
+
+// Suspension describes why an analysis isn't available. Kind is StatePaused
+// for analyses paused by an administrator and StateSuspended for analyses
+// suspended by quota enforcement.
+type Suspension struct {
+	Kind   string
+	Reason string
+}
+
+// Suspensions keeps track of the analyses listed in the
+// vice_default_backend_suspended_analyses table. Requests for them get a page
+// explaining why the app isn't available instead of the loading page, and the
+// status API reports them as paused or suspended.
+type Suspensions struct {
+	resumeURL *url.URL
+	mu        sync.RWMutex
+	suspended map[string]*Suspension
+}
+
+// SuspendedPageData is passed to the template for the page served for paused
+// and suspended analyses. ResumeURL is only set for the owner.
+type SuspendedPageData struct {
+	*PageData
+	Name      string
+	Kind      string
+	Reason    string
+	ResumeURL string
+}
+
+// NewSuspensions returns a Suspensions configured from the
+// vice.default_backend.suspensions section of the config, or nil if
+// vice.default_backend.suspensions.enabled isn't set.
+func NewSuspensions(cfg *viper.Viper) (*Suspensions, error) {
+	cfg.SetDefault("vice.default_backend.suspensions.refresh_interval", defaultSuspensionsRefreshInterval)
+
+	if !cfg.GetBool("vice.default_backend.suspensions.enabled") {
+		return nil, nil
+	}
+
+	s := &Suspensions{suspended: make(map[string]*Suspension)}
+	if raw := cfg.GetString("vice.default_backend.suspensions.resume_url"); raw != "" {
+		resumeURL, err := url.Parse(raw)
+		if err != nil || !resumeURL.IsAbs() {
+			return nil, errors.New("vice.default_backend.suspensions.resume_url must be an absolute URL")
+		}
+		s.resumeURL = resumeURL
+	}
+	return s, nil
+}
+
+// Refresh reloads the suspended analyses from the database.
+func (s *Suspensions) Refresh(ctx context.Context, db *sql.DB) (err error) {
+	defer observeQuery(QuerySuspendedAnalyses, time.Now(), &err)
+
+	rows, err := db.QueryContext(ctx, suspendedAnalysesQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	suspended := make(map[string]*Suspension)
+	for rows.Next() {
+		var (
+			id         string
+			suspension Suspension
+		)
+		if err = rows.Scan(&id, &suspension.Kind, &suspension.Reason); err != nil {
+			return err
+		}
+		suspended[id] = &suspension
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspended = suspended
+	return nil
+}
+
+// Poll refreshes the suspended analyses from the database on the interval
+// passed in until the context is canceled.
+func (s *Suspensions) Poll(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx, db); err != nil {
+			log.Errorf("error refreshing the suspended analyses: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Get returns the suspension of an analysis, or nil if it isn't suspended.
+// Analyses that have ended aren't reported as suspended.
+func (s *Suspensions) Get(analysis *Analysis) *Suspension {
+	if analysis == nil || analysis.Ended() {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.suspended[analysis.ID]
+}
+
+// ResumeURL returns the URL where the owner can resume an analysis, or an
+// empty string if resume_url isn't configured. The analysis ID is appended to
+// the configured path.
+func (s *Suspensions) ResumeURL(analysis *Analysis) string {
+	if s.resumeURL == nil {
+		return ""
+	}
+	return s.resumeURL.JoinPath(analysis.ID).String()
+}
+
+// SuspendedHandler renders the page for a paused or suspended analysis. The
+// resume link is only included when the visitor is the owner.
+func (a *App) SuspendedHandler(w http.ResponseWriter, r *http.Request, analysis *Analysis, suspension *Suspension, visitor string) {
+	data := &SuspendedPageData{
+		PageData: a.analysisPageData(r.Context(), analysis),
+		Name:     analysis.Name,
+		Kind:     suspension.Kind,
+		Reason:   suspension.Reason,
+	}
+	if visitor != "" && visitor == analysis.Username {
+		data.ResumeURL = a.suspensions.ResumeURL(analysis)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.renderPage(w, http.StatusServiceUnavailable, "suspended.html", data)
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/vice-default-backend/urls"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Trace sampling strategies, named as in the OTEL_TRACES_SAMPLER environment
+// variable. The parent-based strategies follow the caller's decision when the
+// request carries a traceparent header, and use the rest of the name for new
+// traces.
+const (
+	SamplerAlwaysOn           = "always_on"
+	SamplerAlwaysOff          = "always_off"
+	SamplerTraceIDRatio       = "traceidratio"
+	SamplerParentAlwaysOn     = "parentbased_always_on"
+	SamplerParentAlwaysOff    = "parentbased_always_off"
+	SamplerParentTraceIDRatio = "parentbased_traceidratio"
+)
+
+// parentBasedPrefix starts the names of the parent-based strategies.
+const parentBasedPrefix = "parentbased_"
+
+// knownSamplers lists the supported sampling strategies.
+var knownSamplers = map[string]bool{
+	SamplerAlwaysOn:           true,
+	SamplerAlwaysOff:          true,
+	SamplerTraceIDRatio:       true,
+	SamplerParentAlwaysOn:     true,
+	SamplerParentAlwaysOff:    true,
+	SamplerParentTraceIDRatio: true,
+}
+
+// OTLP span kinds and status codes.
+const (
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusError = 2
+)
+
+// Names of the W3C trace context headers, which are also used as query
+// parameters on the loading page URL.
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+var otlpSpans = NewCounterVec(
+	"otlp_spans_total",
+	"Spans handed to the OTLP trace exporter, by result.",
+	"result",
+)
+
+var tracesSampled = NewCounterVec(
+	"traces_total",
+	"Traces recorded by this service, by sampling result.",
+	"result",
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// traceParent is the trace context from a W3C traceparent header.
+type traceParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header, returning nil if it's
+// missing or invalid.
+func parseTraceparent(header string) *traceParent {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return nil
+	}
+	// Later versions may add fields, but must keep these ones.
+	version := parts[0]
+	if _, err := strconv.ParseUint(version, 16, 8); err != nil || len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return nil
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	var p traceParent
+	if _, err := hex.Decode(p.traceID[:], []byte(parts[1])); err != nil || p.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(p.spanID[:], []byte(parts[2])); err != nil || p.spanID == [8]byte{} {
+		return nil
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil
+	}
+	p.sampled = flags&1 == 1
+	return &p
+}
+
+// Sampler makes the head-based sampling decision for new traces.
+type Sampler struct {
+	strategy string
+	ratio    float64
+}
+
+// Sample returns true if the trace should be recorded. The trace ID ratio
+// strategy compares the random part of the trace ID against the ratio, as
+// the OpenTelemetry SDKs do, so that every service sampling at the same
+// ratio keeps the same traces.
+func (s Sampler) Sample(traceID [16]byte, parent *traceParent) bool {
+	strategy := s.strategy
+	if strings.HasPrefix(strategy, parentBasedPrefix) {
+		if parent != nil {
+			return parent.sampled
+		}
+		strategy = strings.TrimPrefix(strategy, parentBasedPrefix)
+	}
+	switch strategy {
+	case SamplerAlwaysOn:
+		return true
+	case SamplerAlwaysOff:
+		return false
+	default:
+		return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(s.ratio*(1<<63))
+	}
+}
+
+// localTrace holds the spans this service records for a request until the
+// request is done, so that failed requests can be exported even when the
+// sampler passed on them.
+type localTrace struct {
+	sampled bool
+	state   string
+	mu      sync.Mutex
+	spans   []otlpSpan
+	failed  bool
+}
+
+// Span is an operation in a trace. Its methods do nothing on a nil Span, so
+// callers don't need to check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	trace    *localTrace
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	root     bool
+	name     string
+	kind     int
+	start    time.Time
+	mu       sync.Mutex
+	attrs    map[string]interface{}
+	errMsg   string
+}
+
+type spanContextKey struct{}
+
+// SpanFromContext returns the span in the context, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span for an operation within the span in the context,
+// returning a context holding the new span. The span is nil if there's no
+// span in the context.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:   parent.tracer,
+		trace:    parent.trace,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    make(map[string]interface{}),
+	}
+	_, _ = rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// traceQuery starts a span for a named database query if the context is
+// being traced. The function it returns ends the span, and is meant to be
+// deferred with a pointer to the function's error result, as with
+// observeQuery.
+func traceQuery(ctx context.Context, name string) func(*error) {
+	_, span := StartSpan(ctx, name, spanKindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.operation.name", name)
+	return func(err *error) {
+		if *err != nil && *err != sql.ErrNoRows {
+			span.SetError((*err).Error())
+		}
+		span.End()
+	}
+}
+
+// Traceparent returns the W3C traceparent header value that makes the span
+// the parent of the receiver's spans.
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.trace.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// Inject adds the trace context headers to an outgoing request, so that the
+// service it calls continues the trace.
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set(traceparentHeader, s.Traceparent())
+	if s.trace.state != "" {
+		h.Set(tracestateHeader, s.trace.state)
+	}
+}
+
+// AddToURL adds the trace context to a URL's query parameters, for the
+// redirects to the loading page, which can't carry headers.
+func (s *Span) AddToURL(u *url.URL) {
+	if s == nil {
+		return
+	}
+	urls.SetQuery(u, traceparentHeader, s.Traceparent())
+	if s.trace.state != "" {
+		urls.SetQuery(u, tracestateHeader, s.trace.state)
+	}
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks the span, and the trace it belongs to, as failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = msg
+	s.mu.Unlock()
+
+	s.trace.mu.Lock()
+	defer s.trace.mu.Unlock()
+	s.trace.failed = true
+}
+
+// SetDecision adds a routing decision to the span. Failed decisions mark the
+// span as failed.
+func (s *Span) SetDecision(d *Decision) {
+	if s == nil {
+		return
+	}
+	s.SetAttribute("vice.decision", d.FinalDecision())
+	s.SetAttribute("vice.reason", d.Reason)
+	s.SetAttribute("vice.subdomain", d.Subdomain)
+	if d.AnalysisID != "" {
+		s.SetAttribute("vice.analysis_id", d.AnalysisID)
+	}
+	if d.Failed() {
+		s.SetError("routing failed: " + d.Reason)
+	}
+}
+
+// End finishes the span. Ending the span that started the trace in this
+// service exports the trace if it was sampled or failed.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, k := range keys {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpAnyValue(s.attrs[k])})
+	}
+	if s.errMsg != "" {
+		span.Status = otlpStatus{Code: spanStatusError, Message: s.errMsg}
+	}
+	s.mu.Unlock()
+
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, span)
+	s.trace.mu.Unlock()
+
+	if s.root {
+		s.tracer.finish(s.trace)
+	}
+}
+
+// Tracer records a trace span for each request and sends the sampled ones to
+// an OpenTelemetry collector. Which traces are kept is decided when the
+// request comes in, by the configured sampling strategy, except that traces
+// of failed routing decisions and server errors are always kept unless that's
+// turned off.
+type Tracer struct {
+	endpoint      string
+	headers       map[string]string
+	client        *http.Client
+	resource      []otlpAttribute
+	sampler       Sampler
+	sampleErrors  bool
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan otlpSpan
+	mu            sync.Mutex
+}
+
+// NewTracer returns a Tracer configured from the vice.default_backend.otel
+// section of the config, or nil if vice.default_backend.otel.traces.endpoint
+// isn't set. The sampler settings default to the OTEL_TRACES_SAMPLER and
+// OTEL_TRACES_SAMPLER_ARG environment variables.
+func NewTracer(cfg *viper.Viper) (*Tracer, error) {
+	sampler, ratio := envOr("OTEL_TRACES_SAMPLER", SamplerParentAlwaysOn), 1.0
+	if env := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); env != "" {
+		if r, err := strconv.ParseFloat(env, 64); err == nil {
+			ratio = r
+		}
+	}
+	cfg.SetDefault("vice.default_backend.otel.traces.sampler", sampler)
+	cfg.SetDefault("vice.default_backend.otel.traces.sampler_arg", ratio)
+	cfg.SetDefault("vice.default_backend.otel.traces.sample_errors", true)
+	cfg.SetDefault("vice.default_backend.otel.traces.batch_size", defaultOTLPBatchSize)
+	cfg.SetDefault("vice.default_backend.otel.traces.queue_size", defaultOTLPQueueSize)
+	cfg.SetDefault("vice.default_backend.otel.traces.flush_interval", defaultOTLPFlushInterval)
+
+	endpoint := cfg.GetString("vice.default_backend.otel.traces.endpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(endpoint); err != nil || !u.IsAbs() {
+		return nil, errors.New("vice.default_backend.otel.traces.endpoint must be an absolute URL")
+	}
+	s := Sampler{
+		strategy: cfg.GetString("vice.default_backend.otel.traces.sampler"),
+		ratio:    cfg.GetFloat64("vice.default_backend.otel.traces.sampler_arg"),
+	}
+	if !knownSamplers[s.strategy] {
+		return nil, errors.Errorf("unsupported trace sampler %q", s.strategy)
+	}
+	if s.ratio < 0 || s.ratio > 1 {
+		return nil, errors.New("vice.default_backend.otel.traces.sampler_arg must be between 0 and 1")
+	}
+	batchSize := cfg.GetInt("vice.default_backend.otel.traces.batch_size")
+	queueSize := cfg.GetInt("vice.default_backend.otel.traces.queue_size")
+	if batchSize < 1 || queueSize < batchSize {
+		return nil, errors.New("vice.default_backend.otel.traces.queue_size must be at least the batch size, which must be positive")
+	}
+
+	resource, err := otlpResource(cfg.GetStringMapString("vice.default_backend.otel.resource_attributes"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tracer{
+		endpoint:      endpoint,
+		headers:       cfg.GetStringMapString("vice.default_backend.otel.traces.headers"),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		resource:      resource,
+		sampler:       s,
+		sampleErrors:  cfg.GetBool("vice.default_backend.otel.traces.sample_errors"),
+		batchSize:     batchSize,
+		flushInterval: cfg.GetDuration("vice.default_backend.otel.traces.flush_interval"),
+		queue:         make(chan otlpSpan, queueSize),
+	}, nil
+}
+
+// startRequest starts the span for a request, continuing the caller's trace
+// if the request has a traceparent header. The tracestate header is passed on
+// unchanged to the services this one calls.
+func (t *Tracer) startRequest(r *http.Request) *Span {
+	span := &Span{
+		tracer: t,
+		root:   true,
+		kind:   spanKindServer,
+		start:  time.Now(),
+		attrs: map[string]interface{}{
+			"http.request.method": r.Method,
+			"url.path":            r.URL.Path,
+			"server.address":      r.Host,
+			"user_agent.original": r.UserAgent(),
+		},
+	}
+	if ip := clientIP(r); ip != nil {
+		span.attrs["client.address"] = ip.String()
+	}
+
+	parent := parseTraceparent(r.Header.Get(traceparentHeader))
+	var state string
+	if parent != nil {
+		span.traceID, span.parentID = parent.traceID, parent.spanID
+		state = strings.Join(r.Header.Values(tracestateHeader), ",")
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+	}
+	_, _ = rand.Read(span.spanID[:])
+	span.trace = &localTrace{sampled: t.sampler.Sample(span.traceID, parent), state: state}
+
+	span.name = r.Method
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			span.name += " " + tmpl
+			span.attrs["http.route"] = tmpl
+		}
+	}
+	return span
+}
+
+// Middleware records a span for each request.
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := t.startRequest(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span)))
+
+		span.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(rec.status))
+		}
+		span.End()
+	})
+}
+
+// finish queues the spans of a trace for export if the trace was sampled, or
+// if it failed and failed traces are always kept.
+func (t *Tracer) finish(trace *localTrace) {
+	trace.mu.Lock()
+	spans, sampled, failed := trace.spans, trace.sampled, trace.failed
+	trace.mu.Unlock()
+
+	switch {
+	case sampled:
+		tracesSampled.Inc("sampled")
+	case failed && t.sampleErrors:
+		tracesSampled.Inc("failed")
+	default:
+		tracesSampled.Inc("not_sampled")
+		return
+	}
+	for _, span := range spans {
+		select {
+		case t.queue <- span:
+		default:
+			otlpSpans.Inc("dropped")
+		}
+	}
+}
+
+// Run sends the queued spans whenever a batch fills up or the flush interval
+// passes, until the context is canceled.
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.flush()
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+		for len(t.queue) >= t.batchSize {
+			t.flush()
+		}
+	}
+}
+
+// flush sends up to a batch of the queued spans.
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var spans []otlpSpan
+	for len(spans) < t.batchSize && len(t.queue) > 0 {
+		spans = append(spans, <-t.queue)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	scope := otlpScopeSpans{Spans: spans}
+	scope.Scope.Name = otlpScopeName
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resourceSpans.Resource.Attributes = t.resource
+	err := postOTLP(t.client, t.endpoint, t.headers, &otlpTracesRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	if err != nil {
+		log.Errorf("error exporting %d spans: %s", len(spans), err)
+		otlpSpans.Add(float64(len(spans)), "failed")
+		return
+	}
+	otlpSpans.Add(float64(len(spans)), "exported")
+}
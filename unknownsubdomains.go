@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the unknown subdomain report settings.
+const (
+	defaultUnknownSubdomainsWindow = 24 * time.Hour
+	defaultUnknownSubdomainsTopN   = 20
+	unknownSubdomainsBuckets       = 24
+	unknownSubdomainsRefresh       = time.Minute
+)
+
+var unknownSubdomainRequests = NewGaugeVec(
+	"unknown_subdomain_requests",
+	"Requests for the most-requested subdomains without an analysis over the rolling window.",
+	"subdomain",
+)
+
+// unknownSubdomainCount is the count for a subdomain within a bucket.
+type unknownSubdomainCount struct {
+	count    int
+	lastSeen time.Time
+	lastHost string
+}
+
+// unknownSubdomainsBucket holds the counts for one slice of the window.
+type unknownSubdomainsBucket struct {
+	slot   int64
+	counts map[string]*unknownSubdomainCount
+}
+
+// UnknownSubdomain is a subdomain without an analysis that was requested
+// within the window.
+type UnknownSubdomain struct {
+	Subdomain string    `json:"subdomain"`
+	Count     int       `json:"count"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastHost  string    `json:"last_host"`
+}
+
+// UnknownSubdomainsResponse is the body returned by the unknown subdomains
+// endpoint.
+type UnknownSubdomainsResponse struct {
+	Window     string             `json:"window"`
+	Total      int                `json:"total"`
+	Subdomains []UnknownSubdomain `json:"subdomains"`
+}
+
+// UnknownSubdomains counts the requests for subdomains that don't belong to
+// an analysis over a rolling window, so that the most-requested ones can be
+// found. They usually come from broken links in notification emails or stale
+// bookmarks. The window is split into buckets that are dropped as they age
+// out, and each bucket counts at most maxSubdomainsPerBucket subdomains, so
+// that scans don't use unbounded memory.
+type UnknownSubdomains struct {
+	window  time.Duration
+	slot    time.Duration
+	topN    int
+	mu      sync.Mutex
+	buckets [unknownSubdomainsBuckets]*unknownSubdomainsBucket
+}
+
+// NewUnknownSubdomains returns an UnknownSubdomains configured from the
+// vice.default_backend.unknown_subdomains section of the config.
+func NewUnknownSubdomains(cfg *viper.Viper) (*UnknownSubdomains, error) {
+	cfg.SetDefault("vice.default_backend.unknown_subdomains.window", defaultUnknownSubdomainsWindow)
+	cfg.SetDefault("vice.default_backend.unknown_subdomains.top_n", defaultUnknownSubdomainsTopN)
+
+	window := cfg.GetDuration("vice.default_backend.unknown_subdomains.window")
+	if window < unknownSubdomainsBuckets*time.Minute {
+		return nil, errors.New("vice.default_backend.unknown_subdomains.window must be at least 24m")
+	}
+	topN := cfg.GetInt("vice.default_backend.unknown_subdomains.top_n")
+	if topN < 1 {
+		return nil, errors.New("vice.default_backend.unknown_subdomains.top_n must be positive")
+	}
+	return &UnknownSubdomains{
+		window: window,
+		slot:   window / unknownSubdomainsBuckets,
+		topN:   topN,
+	}, nil
+}
+
+// Record counts a routing decision if it was for a subdomain without an
+// analysis.
+func (u *UnknownSubdomains) Record(d Decision) {
+	if d.Reason != ReasonUnknownSubdomain || d.Subdomain == "" {
+		return
+	}
+	slot := d.Time.UnixNano() / int64(u.slot)
+	i := slot % unknownSubdomainsBuckets
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	b := u.buckets[i]
+	if b == nil || b.slot != slot {
+		b = &unknownSubdomainsBucket{slot: slot, counts: make(map[string]*unknownSubdomainCount)}
+		u.buckets[i] = b
+	}
+	c, ok := b.counts[d.Subdomain]
+	if !ok {
+		if len(b.counts) >= maxSubdomainsPerBucket {
+			return
+		}
+		c = &unknownSubdomainCount{}
+		b.counts[d.Subdomain] = c
+	}
+	c.count++
+	c.lastSeen = d.Time
+	c.lastHost = d.Host
+}
+
+// Top returns the limit most-requested unknown subdomains in the window
+// ending now, along with the number of requests for all of them.
+func (u *UnknownSubdomains) Top(limit int) (int, []UnknownSubdomain) {
+	now := time.Now().UnixNano() / int64(u.slot)
+	totals := make(map[string]*UnknownSubdomain)
+	total := 0
+
+	u.mu.Lock()
+	for _, b := range u.buckets {
+		if b == nil || b.slot <= now-unknownSubdomainsBuckets || b.slot > now {
+			continue
+		}
+		for subdomain, c := range b.counts {
+			t, ok := totals[subdomain]
+			if !ok {
+				t = &UnknownSubdomain{Subdomain: subdomain}
+				totals[subdomain] = t
+			}
+			t.Count += c.count
+			if c.lastSeen.After(t.LastSeen) {
+				t.LastSeen, t.LastHost = c.lastSeen, c.lastHost
+			}
+			total += c.count
+		}
+	}
+	u.mu.Unlock()
+
+	top := make([]UnknownSubdomain, 0, len(totals))
+	for _, t := range totals {
+		top = append(top, *t)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Subdomain < top[j].Subdomain
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return total, top
+}
+
+// Run updates the unknown_subdomain_requests metric with the top subdomains
+// every minute until the context is canceled. Subdomains that drop out of
+// the top are removed from the metric.
+func (u *UnknownSubdomains) Run(ctx context.Context) {
+	ticker := time.NewTicker(unknownSubdomainsRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, top := u.Top(u.topN)
+		unknownSubdomainRequests.Reset()
+		for _, t := range top {
+			unknownSubdomainRequests.Set(float64(t.Count), t.Subdomain)
+		}
+	}
+}
+
+// UnknownSubdomainsHandler returns the most-requested subdomains without an
+// analysis over the rolling window. The limit query parameter sets how many
+// are returned, defaulting to the configured top N.
+func (a *App) UnknownSubdomainsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := pageLimit(r.URL.Query(), a.unknownSubdomains.topN)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	total, top := a.unknownSubdomains.Top(limit)
+	writeJSON(w, http.StatusOK, &UnknownSubdomainsResponse{
+		Window:     a.unknownSubdomains.window.String(),
+		Total:      total,
+		Subdomains: top,
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Environment variables used to hand the listening sockets to a new process.
+// The listeners are passed as file descriptors starting at 3, in the order of
+// the addresses in upgradeListenersEnv.
+const (
+	upgradeListenersEnv = "VICE_DEFAULT_BACKEND_LISTENERS"
+	upgradeParentEnv    = "VICE_DEFAULT_BACKEND_PARENT_PID"
+)
+
+// defaultShutdownTimeout is how long in-flight requests have to finish when
+// the service shuts down.
+const defaultShutdownTimeout = 30 * time.Second
+
+// Upgrader replaces the running binary without dropping connections. On
+// SIGUSR2 it starts the binary again, handing it the listening sockets, so
+// that the new process accepts connections on the same addresses while the
+// old one is still serving. Once the new process has started, it sends the
+// old one SIGTERM, and the old one stops accepting connections and finishes
+// its in-flight requests before exiting. If the new process fails to start,
+// the old one keeps serving.
+//
+// This is for deployments outside of Kubernetes, where a process manager runs
+// the service directly. The process ID changes with each upgrade, so the
+// process manager should track it through vice.default_backend.server.pid_file.
+type Upgrader struct {
+	pidFile   string
+	inherited map[string]*os.File
+	mu        sync.Mutex
+	addrs     []string
+	files     []*os.File
+	upgrading bool
+}
+
+// NewUpgrader returns an Upgrader configured from the
+// vice.default_backend.server section of the config, picking up the
+// listeners passed on by the process being replaced, if there is one.
+func NewUpgrader(cfg *viper.Viper) *Upgrader {
+	u := &Upgrader{
+		pidFile:   cfg.GetString("vice.default_backend.server.pid_file"),
+		inherited: make(map[string]*os.File),
+	}
+	if env := os.Getenv(upgradeListenersEnv); env != "" {
+		for i, addr := range strings.Split(env, ",") {
+			u.inherited[addr] = os.NewFile(uintptr(3+i), addr)
+		}
+	}
+	return u
+}
+
+// Listen returns a TCP listener for the address, using the socket handed over
+// by the process being replaced if there is one. The listener is passed on in
+// turn at the next upgrade.
+func (u *Upgrader) Listen(lc net.ListenConfig, network, addr string) (net.Listener, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+	if f, ok := u.inherited[addr]; ok {
+		listener, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error using the inherited listener for %s", addr)
+		}
+		log.Infof("took over the listener for %s", addr)
+	} else if listener, err = lc.Listen(context.Background(), network, addr); err != nil {
+		return nil, err
+	}
+
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return listener, nil
+	}
+	f, err := tcp.File()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error duplicating the listener for %s", addr)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addrs = append(u.addrs, addr)
+	u.files = append(u.files, f)
+	return listener, nil
+}
+
+// Upgrade starts a new copy of the binary with the same arguments, handing
+// it the listeners. It returns once the process has started; the new process
+// tells this one to shut down when it's ready.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.upgrading {
+		return errors.New("an upgrade is already in progress")
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "error finding the executable")
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = u.files
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(u.addrs, ","),
+		upgradeParentEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+	if err = cmd.Start(); err != nil {
+		return errors.Wrap(err, "error starting the new process")
+	}
+	log.Infof("started process %d to take over", cmd.Process.Pid)
+
+	u.upgrading = true
+	go func() {
+		err := cmd.Wait()
+		log.Errorf("process %d exited before taking over: %v", cmd.Process.Pid, err)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.upgrading = false
+	}()
+	return nil
+}
+
+// Ready writes the PID file and, if this process is replacing another one,
+// tells the old process to shut down. It's called once startup has finished.
+func (u *Upgrader) Ready() {
+	if u.pidFile != "" {
+		if err := os.WriteFile(u.pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			log.Errorf("error writing the PID file: %s", err)
+		}
+	}
+
+	parent, err := strconv.Atoi(os.Getenv(upgradeParentEnv))
+	if err != nil || parent != os.Getppid() {
+		return
+	}
+	log.Infof("taking over from process %d", parent)
+	if err = syscall.Kill(parent, syscall.SIGTERM); err != nil {
+		log.Errorf("error telling process %d to shut down: %s", parent, err)
+	}
+}
+
+// ShutdownSettings control how the servers are shut down.
+type ShutdownSettings struct {
+	// DrainDelay is how long the servers keep accepting connections after
+	// the signal, while the readiness probe fails, so that load balancers
+	// and the Kubernetes endpoints controller stop sending new connections
+	// before the listeners close.
+	DrainDelay time.Duration
+
+	// Timeout is how long in-flight requests have to finish once the
+	// listeners are closed.
+	Timeout time.Duration
+
+	// Drain is called as soon as the signal arrives, to start failing the
+	// readiness probe.
+	Drain func()
+}
+
+// NewShutdownSettings returns the ShutdownSettings from the
+// vice.default_backend.server section of the config.
+func NewShutdownSettings(cfg *viper.Viper, drain func()) ShutdownSettings {
+	cfg.SetDefault("vice.default_backend.server.shutdown_timeout", defaultShutdownTimeout)
+	return ShutdownSettings{
+		DrainDelay: cfg.GetDuration("vice.default_backend.server.drain_delay"),
+		Timeout:    cfg.GetDuration("vice.default_backend.server.shutdown_timeout"),
+		Drain:      drain,
+	}
+}
+
+// HandleSignals upgrades the binary on SIGUSR2 and shuts the servers down
+// gracefully on SIGTERM or SIGINT: the readiness probe starts failing right
+// away, the listeners close after the drain delay, and in-flight requests
+// get up to the timeout to finish. The returned channel is closed once the
+// servers have shut down.
+func (u *Upgrader) HandleSignals(settings ShutdownSettings, servers ...*http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		defer close(done)
+		for sig := range signals {
+			if sig == syscall.SIGUSR2 {
+				log.Info("got SIGUSR2, upgrading")
+				if err := u.Upgrade(); err != nil {
+					log.Error(err)
+				}
+				continue
+			}
+
+			log.Infof("got %s, shutting down", sig)
+			signal.Stop(signals)
+			if settings.Drain != nil {
+				settings.Drain()
+			}
+			if settings.DrainDelay > 0 {
+				log.Infof("waiting %s for load balancers to stop sending connections", settings.DrainDelay)
+				time.Sleep(settings.DrainDelay)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+			var wg sync.WaitGroup
+			for _, server := range servers {
+				wg.Add(1)
+				go func(server *http.Server) {
+					defer wg.Done()
+					if err := server.Shutdown(ctx); err != nil {
+						log.Errorf("error shutting down the server on %s: %s", server.Addr, err)
+					}
+				}(server)
+			}
+			wg.Wait()
+			cancel()
+			return
+		}
+	}()
+	return done
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// upstreamRetryAfter is the number of seconds clients are told to wait before
+// retrying an app that's restarting.
+const upstreamRetryAfter = 15
+
+// upstreamPage describes how an upstream error reported by the ingress
+// controller is presented.
+type upstreamPage struct {
+	template string
+	reason   string
+	message  string
+}
+
+// upstreamPages are the pages for the upstream errors that get their own
+// page, by the status code in the X-Code header.
+var upstreamPages = map[int]upstreamPage{
+	http.StatusBadGateway: {
+		template: "crashed.html",
+		reason:   ReasonAppCrashed,
+		message:  "the app appears to have crashed",
+	},
+	http.StatusServiceUnavailable: {
+		template: "restarting.html",
+		reason:   ReasonAppRestarting,
+		message:  "the app is restarting, please try again shortly",
+	},
+	http.StatusGatewayTimeout: {
+		template: "slow.html",
+		reason:   ReasonAppSlow,
+		message:  "the app took too long to answer",
+	},
+}
+
+// UpstreamErrorPageData is passed to the templates for the upstream error
+// pages.
+type UpstreamErrorPageData struct {
+	*PageData
+	Host       string
+	RetryURL   string
+	RetryAfter int
+	SupportURL string
+}
+
+// upstreamError returns the upstream error status code that the ingress
+// controller passed in the X-Code header when it sent the request to the
+// default backend as its custom error backend, or 0 if there isn't one with
+// its own page.
+func upstreamError(r *http.Request) int {
+	code, err := strconv.Atoi(r.Header.Get("X-Code"))
+	if err != nil {
+		return 0
+	}
+	if _, ok := upstreamPages[code]; !ok {
+		return 0
+	}
+	return code
+}
+
+// UpstreamErrorHandler serves the page for an app that failed behind the
+// ingress, with the status code it failed with. Crashed apps (502),
+// restarting apps (503), and slow apps (504) each get a page of their own.
+// WebSocket clients and JavaScript get a JSON error instead.
+func (a *App) UpstreamErrorHandler(w http.ResponseWriter, r *http.Request, code int, decision *Decision) {
+	page := upstreamPages[code]
+	decision.Outcome = OutcomeUpstreamError
+	decision.Reason = page.reason
+
+	// The original URI is only used when it's a path on the same host, so
+	// that the header can't be used to send users elsewhere.
+	retryURL := r.Header.Get("X-Original-URI")
+	if !strings.HasPrefix(retryURL, "/") || strings.HasPrefix(retryURL, "//") {
+		retryURL = "/"
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(upstreamRetryAfter))
+	}
+	vary(w, "X-Format")
+	if wantsRetry(w, r) || strings.Contains(r.Header.Get("X-Format"), "json") {
+		writeError(w, page.message, code)
+		return
+	}
+	a.renderPage(w, code, page.template, &UpstreamErrorPageData{
+		PageData:   a.pageData(),
+		Host:       r.Host,
+		RetryURL:   retryURL,
+		RetryAfter: upstreamRetryAfter,
+		SupportURL: a.supportURL,
+	})
+}
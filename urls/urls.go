@@ -0,0 +1,95 @@
+// Package urls builds the URLs that the VICE default backend sends clients
+// to: app URLs, and loading page URLs with an app URL or other values
+// embedded in them.
+//
+// Embedded values are percent-encoded as URI components, so every character
+// other than the unreserved ones (letters, digits, '-', '.', '_', and '~') is
+// escaped. They come back out unchanged with decodeURIComponent in
+// JavaScript or url.PathUnescape and url.QueryUnescape in Go, however many
+// '%', '+', '/', '?', '&', or '#' characters they contain. The rest of the
+// base URL, including parameters that are already in its query, keeps the
+// encoding it had.
+package urls
+
+import (
+	"net/url"
+	"strings"
+)
+
+// EscapeComponent percent-encodes every byte of s other than the unreserved
+// characters.
+func EscapeComponent(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// isUnreserved returns true for the characters that never need escaping in a
+// URL.
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// App returns the URL of an app: the base URL with the subdomain labels in
+// front of its host, and the path and query of the requested URL, encoded as
+// they were requested.
+func App(base *url.URL, labels []string, requested *url.URL) *url.URL {
+	u := *base
+	u.Host = strings.Join(labels, ".") + "." + base.Host
+	u.Path = requested.Path
+	u.RawPath = requested.RawPath
+	u.RawQuery = requested.RawQuery
+	u.Fragment, u.RawFragment = "", ""
+	return &u
+}
+
+// WithPathSegment returns a copy of the base URL with the value added to the
+// end of its path as a single segment. Slashes in the value are escaped
+// rather than starting new segments, and the base path isn't cleaned, so
+// nothing in either one is lost.
+func WithPathSegment(base *url.URL, value string) *url.URL {
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + "/" + value
+	u.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + "/" + EscapeComponent(value)
+	return &u
+}
+
+// WithQuery returns a copy of the base URL with the query parameter set to the
+// value.
+func WithQuery(base *url.URL, key, value string) *url.URL {
+	u := *base
+	SetQuery(&u, key, value)
+	return &u
+}
+
+// SetQuery sets a query parameter of the URL, replacing any values it already
+// has. Unlike url.Values.Encode, it leaves the other parameters as they were
+// instead of decoding, sorting, and encoding them again, which would drop
+// parameters with semicolons and change the encoding of others.
+func SetQuery(u *url.URL, key, value string) {
+	var params []string
+	if u.RawQuery != "" {
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			k, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(k); err == nil && unescaped == key {
+				continue
+			}
+			params = append(params, param)
+		}
+	}
+	params = append(params, EscapeComponent(key)+"="+EscapeComponent(value))
+	u.RawQuery = strings.Join(params, "&")
+	u.ForceQuery = false
+}
@@ -0,0 +1,258 @@
+package urls
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("cannot parse %q: %s", s, err)
+	}
+	return u
+}
+
+func TestEscapeComponent(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"unreserved", "AZaz09-._~", "AZaz09-._~"},
+		{"space", "a b", "a%20b"},
+		{"percent", "100%", "100%25"},
+		{"escaped percent", "%2F", "%252F"},
+		{"plus", "a+b", "a%2Bb"},
+		{"semicolon", "a;b", "a%3Bb"},
+		{"nested query", "https://a.example.org/p?x=1&y=2", "https%3A%2F%2Fa.example.org%2Fp%3Fx%3D1%26y%3D2"},
+		{"fragment", "/p#top", "%2Fp%23top"},
+		{"multibyte", "é", "%C3%A9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EscapeComponent(tt.in)
+			if got != tt.want {
+				t.Errorf("EscapeComponent(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if back, err := url.PathUnescape(got); err != nil || back != tt.in {
+				t.Errorf("url.PathUnescape(%q) = %q, %v, want %q", got, back, err, tt.in)
+			}
+			if back, err := url.QueryUnescape(got); err != nil || back != tt.in {
+				t.Errorf("url.QueryUnescape(%q) = %q, %v, want %q", got, back, err, tt.in)
+			}
+		})
+	}
+}
+
+func TestWithPathSegment(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		value string
+		want  string
+	}{
+		{
+			name:  "no path",
+			base:  "https://de.example.org",
+			value: "v",
+			want:  "https://de.example.org/v",
+		},
+		{
+			name:  "trailing slash",
+			base:  "https://de.example.org/loading/",
+			value: "v",
+			want:  "https://de.example.org/loading/v",
+		},
+		{
+			name:  "app URL with a nested query and fragment",
+			base:  "https://de.example.org/loading",
+			value: "https://a1b2c3d4.cyverse.run/lab?token=a&next=%2Ftree#cell-1",
+			want:  "https://de.example.org/loading/https%3A%2F%2Fa1b2c3d4.cyverse.run%2Flab%3Ftoken%3Da%26next%3D%252Ftree%23cell-1",
+		},
+		{
+			name:  "percent, plus, and semicolon",
+			base:  "https://de.example.org/loading",
+			value: "100%+a;b",
+			want:  "https://de.example.org/loading/100%25%2Ba%3Bb",
+		},
+		{
+			name:  "escaped base path",
+			base:  "https://de.example.org/a%2Fb",
+			value: "c",
+			want:  "https://de.example.org/a%2Fb/c",
+		},
+		{
+			name:  "base query and fragment",
+			base:  "https://de.example.org/loading?theme=dark;x=1#top",
+			value: "v",
+			want:  "https://de.example.org/loading/v?theme=dark;x=1#top",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := mustParse(t, tt.base)
+			before := base.String()
+			got := WithPathSegment(base, tt.value)
+			if got.String() != tt.want {
+				t.Errorf("WithPathSegment(%q, %q) = %q, want %q", tt.base, tt.value, got.String(), tt.want)
+			}
+			if base.String() != before {
+				t.Errorf("WithPathSegment changed the base URL to %q", base.String())
+			}
+
+			escaped := got.EscapedPath()
+			segment, err := url.PathUnescape(escaped[strings.LastIndex(escaped, "/")+1:])
+			if err != nil || segment != tt.value {
+				t.Errorf("last path segment is %q, %v, want %q", segment, err, tt.value)
+			}
+		})
+	}
+}
+
+func TestSetQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		key   string
+		value string
+		want  string
+	}{
+		{
+			name:  "no query",
+			base:  "https://de.example.org/loading",
+			key:   "token",
+			value: "abc",
+			want:  "https://de.example.org/loading?token=abc",
+		},
+		{
+			name:  "empty query",
+			base:  "https://de.example.org/loading?",
+			key:   "token",
+			value: "abc",
+			want:  "https://de.example.org/loading?token=abc",
+		},
+		{
+			name:  "replaces every value",
+			base:  "https://de.example.org/loading?token=a&x=1&token=b",
+			key:   "token",
+			value: "c",
+			want:  "https://de.example.org/loading?x=1&token=c",
+		},
+		{
+			name:  "keeps semicolons and encoding of other parameters",
+			base:  "https://de.example.org/loading?b=2;c=3&d=a+b&e=%2F",
+			key:   "token",
+			value: "abc",
+			want:  "https://de.example.org/loading?b=2;c=3&d=a+b&e=%2F&token=abc",
+		},
+		{
+			name:  "matches escaped keys",
+			base:  "https://de.example.org/loading?a+b=1&a%20b=2&ab=3",
+			key:   "a b",
+			value: "v",
+			want:  "https://de.example.org/loading?ab=3&a%20b=v",
+		},
+		{
+			name:  "percent, plus, and semicolon in the value",
+			base:  "https://de.example.org/loading",
+			key:   "v",
+			value: "100%+a;b",
+			want:  "https://de.example.org/loading?v=100%25%2Ba%3Bb",
+		},
+		{
+			name:  "nested query and fragment in the value",
+			base:  "https://de.example.org/loading",
+			key:   "url",
+			value: "https://a1b2c3d4.cyverse.run/lab?x=1&y=2#cell-1",
+			want:  "https://de.example.org/loading?url=https%3A%2F%2Fa1b2c3d4.cyverse.run%2Flab%3Fx%3D1%26y%3D2%23cell-1",
+		},
+		{
+			name:  "keeps the fragment",
+			base:  "https://de.example.org/loading?x=1#top",
+			key:   "token",
+			value: "abc",
+			want:  "https://de.example.org/loading?x=1&token=abc#top",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := mustParse(t, tt.base)
+			SetQuery(u, tt.key, tt.value)
+			if u.String() != tt.want {
+				t.Errorf("SetQuery(%q, %q, %q) = %q, want %q", tt.base, tt.key, tt.value, u.String(), tt.want)
+			}
+			if got := mustParse(t, u.String()).Query()[tt.key]; len(got) != 1 || got[0] != tt.value {
+				t.Errorf("query values for %q are %q, want [%q]", tt.key, got, tt.value)
+			}
+		})
+	}
+}
+
+func TestWithQuery(t *testing.T) {
+	base := mustParse(t, "https://de.example.org/loading?x=1")
+	got := WithQuery(base, "token", "a+b")
+	if want := "https://de.example.org/loading?x=1&token=a%2Bb"; got.String() != want {
+		t.Errorf("WithQuery = %q, want %q", got.String(), want)
+	}
+	if want := "https://de.example.org/loading?x=1"; base.String() != want {
+		t.Errorf("WithQuery changed the base URL to %q", base.String())
+	}
+}
+
+func TestApp(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		labels    []string
+		requested string
+		want      string
+	}{
+		{
+			name:      "root",
+			base:      "https://cyverse.run",
+			labels:    []string{"a1b2c3d4"},
+			requested: "/",
+			want:      "https://a1b2c3d4.cyverse.run/",
+		},
+		{
+			name:      "several labels and a port",
+			base:      "https://cyverse.run:8443",
+			labels:    []string{"a1b2c3d4", "west"},
+			requested: "/lab",
+			want:      "https://a1b2c3d4.west.cyverse.run:8443/lab",
+		},
+		{
+			name:      "replaces the base path and query",
+			base:      "https://cyverse.run/ignored?x=1",
+			labels:    []string{"a1b2c3d4"},
+			requested: "/lab?y=2",
+			want:      "https://a1b2c3d4.cyverse.run/lab?y=2",
+		},
+		{
+			name:      "keeps the requested encoding",
+			base:      "https://cyverse.run",
+			labels:    []string{"a1b2c3d4"},
+			requested: "/files/a%2Fb/100%25?q=a+b;c=%25&next=%2Flab%3Fx%3D1",
+			want:      "https://a1b2c3d4.cyverse.run/files/a%2Fb/100%25?q=a+b;c=%25&next=%2Flab%3Fx%3D1",
+		},
+		{
+			name:      "drops fragments",
+			base:      "https://cyverse.run#base",
+			labels:    []string{"a1b2c3d4"},
+			requested: "/lab?x=1#cell-1",
+			want:      "https://a1b2c3d4.cyverse.run/lab?x=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := App(mustParse(t, tt.base), tt.labels, mustParse(t, tt.requested))
+			if got.String() != tt.want {
+				t.Errorf("App(%q, %q, %q) = %q, want %q", tt.base, tt.labels, tt.requested, got.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import "strings"
+
+// Coarse classes of clients, determined from the User-Agent header.
+const (
+	ClientBrowser     = "browser"
+	ClientBot         = "bot"
+	ClientScript      = "script"
+	ClientHealthCheck = "health_check"
+	ClientOther       = "other"
+)
+
+var requestsByClientClass = NewCounterVec(
+	"requests_by_client_class_total",
+	"Routed requests by the coarse class of the client's user agent.",
+	"class",
+)
+
+// Product names for each class, checked in the order health checks, bots,
+// then scripts. The user agent is split into products, such as "curl" in
+// "curl/8.4.0" or "googlebot" in "(compatible; Googlebot/2.1)", and a name
+// matches the products that start with it, so that it isn't found in the
+// middle of unrelated words. Everything is matched against the lowercased
+// header.
+var (
+	healthCheckAgents = []string{
+		"kube-probe", "elb-healthchecker", "googlehc", "blackbox", "uptimerobot",
+		"pingdom", "statuscake", "prometheus", "nagios", "check_http",
+	}
+	botAgents = []string{
+		"slurp", "facebookexternalhit", "zgrab", "masscan", "nmap", "nuclei",
+	}
+	scriptAgents = []string{
+		"curl", "wget", "python", "go-http-client", "java", "okhttp", "axios",
+		"node-fetch", "undici", "libwww", "httpie", "postman", "powershell",
+		"ruby", "php", "rust", "apache-httpclient",
+	}
+)
+
+// botSuffixes end the product names of bots that aren't listed by name, or a
+// hyphenated part of them, such as "bingbot", "slackbot-linkexpanding", or
+// "ia_archiver".
+var botSuffixes = []string{"bot", "crawler", "spider", "preview", "archiver", "scanner"}
+
+// userAgentProducts returns the lowercased product names in a user agent,
+// without their versions.
+func userAgentProducts(ua string) []string {
+	tokens := strings.FieldsFunc(ua, func(r rune) bool {
+		return r == ' ' || r == ';' || r == '(' || r == ')' || r == ',' || r == '+'
+	})
+	products := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		name, _, _ := strings.Cut(token, "/")
+		if name != "" {
+			products = append(products, name)
+		}
+	}
+	return products
+}
+
+// hasProduct returns true if any of the products starts with one of the names,
+// or if a part of one separated by hyphens or underscores ends with one of
+// the suffixes.
+func hasProduct(products, names, suffixes []string) bool {
+	for _, product := range products {
+		for _, name := range names {
+			if strings.HasPrefix(product, name) {
+				return true
+			}
+		}
+		if len(suffixes) == 0 {
+			continue
+		}
+		parts := strings.FieldsFunc(product, func(r rune) bool { return r == '-' || r == '_' })
+		for _, part := range parts {
+			for _, suffix := range suffixes {
+				if strings.HasSuffix(part, suffix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ClassifyUserAgent returns the coarse class of the client with the user
+// agent passed in.
+func ClassifyUserAgent(userAgent string) string {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	products := userAgentProducts(ua)
+	switch {
+	case ua == "":
+		return ClientScript
+	case hasProduct(products, healthCheckAgents, nil):
+		return ClientHealthCheck
+	case hasProduct(products, botAgents, botSuffixes):
+		return ClientBot
+	case hasProduct(products, scriptAgents, nil):
+		return ClientScript
+	case strings.HasPrefix(ua, "mozilla/") || strings.HasPrefix(ua, "opera/"):
+		return ClientBrowser
+	default:
+		return ClientOther
+	}
+}
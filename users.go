@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Sources of user profiles.
+const (
+	UserSourceDB      = "db"
+	UserSourceTerrain = "terrain"
+)
+
+// Defaults for the user profile settings.
+const (
+	defaultUserDomain   = "iplantcollaborative.org"
+	defaultUserCacheTTL = 5 * time.Minute
+)
+
+const userByUsernameQuery = `
+	SELECT id, username
+	  FROM users
+	 WHERE username = $1
+`
+
+// UserProfile describes an authenticated user. Username is the qualified
+// user name used in the DE database, such as ipcdev@iplantcollaborative.org.
+type UserProfile struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+}
+
+type userEntry struct {
+	profile *UserProfile
+	expires time.Time
+}
+
+// UserProfiles resolves the profiles of authenticated users from the DE
+// database's users table or from Terrain, so that requests can be attributed
+// to the user who made them in the logs and the audit log. Profiles are
+// cached by user name.
+type UserProfiles struct {
+	source     string
+	db         *sql.DB
+	terrainURL *url.URL
+	domain     string
+	client     *http.Client
+	ttl        time.Duration
+	mu         sync.Mutex
+	profiles   map[string]userEntry
+}
+
+// NewUserProfiles returns a UserProfiles configured from the
+// vice.default_backend.users section of the config, or nil if
+// vice.default_backend.users.source isn't set.
+func NewUserProfiles(cfg *viper.Viper, db *sql.DB) (*UserProfiles, error) {
+	cfg.SetDefault("vice.default_backend.users.domain", defaultUserDomain)
+	cfg.SetDefault("vice.default_backend.users.cache_ttl", defaultUserCacheTTL)
+
+	u := &UserProfiles{
+		source:   cfg.GetString("vice.default_backend.users.source"),
+		db:       db,
+		domain:   cfg.GetString("vice.default_backend.users.domain"),
+		client:   &http.Client{Timeout: 5 * time.Second},
+		ttl:      cfg.GetDuration("vice.default_backend.users.cache_ttl"),
+		profiles: make(map[string]userEntry),
+	}
+	switch u.source {
+	case "":
+		return nil, nil
+	case UserSourceDB:
+		if db == nil {
+			return nil, errors.New("vice.default_backend.users.source db needs the database")
+		}
+	case UserSourceTerrain:
+		terrainURL, err := url.Parse(cfg.GetString("vice.default_backend.users.terrain_url"))
+		if err != nil || !terrainURL.IsAbs() {
+			return nil, errors.New("vice.default_backend.users.terrain_url must be an absolute URL")
+		}
+		u.terrainURL = terrainURL
+	default:
+		return nil, fmt.Errorf("unsupported user profile source %q", u.source)
+	}
+	return u, nil
+}
+
+// qualifyUsername adds the user domain to a user name from the identity
+// provider if it doesn't have one, giving the user name used in the DE
+// database.
+func qualifyUsername(username, domain string) string {
+	if username == "" || strings.Contains(username, "@") {
+		return username
+	}
+	return username + "@" + domain
+}
+
+// Qualify adds the user domain to a user name from the identity provider if
+// it doesn't have one, giving the user name used in the DE database.
+func (u *UserProfiles) Qualify(username string) string {
+	return qualifyUsername(username, u.domain)
+}
+
+// Lookup returns the profile of a user. The access token is used to call
+// Terrain on the user's behalf.
+func (u *UserProfiles) Lookup(ctx context.Context, username, token string) (*UserProfile, error) {
+	username = u.Qualify(username)
+
+	u.mu.Lock()
+	entry, ok := u.profiles[username]
+	u.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.profile, nil
+	}
+
+	var (
+		profile *UserProfile
+		err     error
+	)
+	if u.source == UserSourceTerrain {
+		profile, err = u.fromTerrain(ctx, username, token)
+	} else {
+		profile, err = u.fromDB(ctx, username)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the profile of %s", username)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.profiles[username] = userEntry{profile: profile, expires: time.Now().Add(u.ttl)}
+	return profile, nil
+}
+
+func (u *UserProfiles) fromDB(ctx context.Context, username string) (profile *UserProfile, err error) {
+	defer observeQuery(QueryUserByUsername, time.Now(), &err)
+	defer traceQuery(ctx, QueryUserByUsername)(&err)
+	profile = &UserProfile{}
+	err = u.db.QueryRowContext(ctx, userByUsernameQuery, username).Scan(&profile.ID, &profile.Username)
+	if err == sql.ErrNoRows {
+		return &UserProfile{Username: username}, nil
+	}
+	return profile, err
+}
+
+// fromTerrain calls Terrain's user info endpoint, which returns the profiles
+// of the requested users keyed by the unqualified user name.
+func (u *UserProfiles) fromTerrain(ctx context.Context, username, token string) (*UserProfile, error) {
+	short, _, _ := strings.Cut(username, "@")
+	endpoint := u.terrainURL.JoinPath("secured", "user-info")
+	endpoint.RawQuery = url.Values{"username": {short}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("terrain returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result map[string]struct {
+		ID        string `json:"id"`
+		Email     string `json:"email"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	info := result[short]
+	return &UserProfile{
+		ID:        info.ID,
+		Username:  username,
+		Email:     info.Email,
+		FirstName: info.FirstName,
+		LastName:  info.LastName,
+	}, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+var vaultCredentialEvents = NewCounterVec(
+	"vault_credential_events_total",
+	"Vault database credential leases issued and renewed, by event and result.",
+	"event", "result",
+)
+
+// vaultRetryInterval is how long to wait before trying again after Vault
+// fails to issue or renew credentials.
+const vaultRetryInterval = 10 * time.Second
+
+// vaultSecret is the subset of a Vault secret response used here.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// dataString returns a string field of the secret's data.
+func (s *vaultSecret) dataString(name string) string {
+	value, _ := s.Data[name].(string)
+	return value
+}
+
+// vaultClient makes authenticated requests to the Vault HTTP API.
+type vaultClient struct {
+	address   *url.URL
+	client    *http.Client
+	token     string
+	tokenFile string
+	authMount string
+	authRole  string
+	jwtFile   string
+}
+
+// newVaultClient returns a vaultClient configured from the given section of
+// the config, or nil if the section's address isn't set.
+func newVaultClient(cfg *viper.Viper, section string) (*vaultClient, error) {
+	cfg.SetDefault(section+".kubernetes_auth_mount", "kubernetes")
+	cfg.SetDefault(section+".jwt_file", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+
+	addr := cfg.GetString(section + ".address")
+	if addr == "" {
+		return nil, nil
+	}
+	address, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s.address", section)
+	}
+
+	return &vaultClient{
+		address:   address,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		token:     cfg.GetString(section + ".token"),
+		tokenFile: cfg.GetString(section + ".token_file"),
+		authMount: cfg.GetString(section + ".kubernetes_auth_mount"),
+		authRole:  cfg.GetString(section + ".kubernetes_role"),
+		jwtFile:   cfg.GetString(section + ".jwt_file"),
+	}, nil
+}
+
+// do sends a request to the Vault API and decodes the response into out.
+func (c *vaultClient) do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address.JoinPath("v1", path).String(), reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault returned %s for %s: %s", resp.Status, path, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vaultToken returns the token used to talk to Vault, logging in with the
+// pod's service account if a Kubernetes auth role is configured.
+func (c *vaultClient) vaultToken(ctx context.Context) (string, error) {
+	if c.authRole != "" {
+		jwt, err := readSecretFile(c.jwtFile)
+		if err != nil {
+			return "", errors.Wrap(err, "error reading the service account token")
+		}
+		var secret vaultSecret
+		body := map[string]string{"role": c.authRole, "jwt": jwt}
+		if err = c.do(ctx, http.MethodPost, "auth/"+c.authMount+"/login", "", body, &secret); err != nil {
+			return "", errors.Wrap(err, "error logging in to vault")
+		}
+		if secret.Auth == nil || secret.Auth.ClientToken == "" {
+			return "", errors.New("vault login didn't return a token")
+		}
+		return secret.Auth.ClientToken, nil
+	}
+	if c.tokenFile != "" {
+		token, err := readSecretFile(c.tokenFile)
+		return token, errors.Wrap(err, "error reading the vault token file")
+	}
+	return c.token, nil
+}
+
+// call sends an authenticated request to the Vault API.
+func (c *vaultClient) call(ctx context.Context, method, path string, body, out interface{}) error {
+	token, err := c.vaultToken(ctx)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, path, token, body, out)
+}
+
+// VaultCredentials obtains short-lived Postgres credentials from Vault's
+// database secrets engine and renews their lease, replacing them with new
+// ones once the lease can't be renewed any further. The credentials are
+// handed to a DBConnector, so the pool always connects with the current ones.
+type VaultCredentials struct {
+	vault         *vaultClient
+	mount         string
+	role          string
+	baseURIs      []*url.URL
+	connector     *DBConnector
+	mu            sync.Mutex
+	leaseID       string
+	leaseDuration time.Duration
+	renewable     bool
+}
+
+// NewVaultCredentials returns a VaultCredentials configured from the
+// vice.db.vault section of the config, or nil if vice.db.vault.address isn't
+// set. The credentials replace the user name and password in each of the
+// connector's database URIs.
+func NewVaultCredentials(cfg *viper.Viper, connector *DBConnector) (*VaultCredentials, error) {
+	cfg.SetDefault("vice.db.vault.mount", "database")
+
+	vault, err := newVaultClient(cfg, "vice.db.vault")
+	if vault == nil || err != nil {
+		return nil, err
+	}
+	var baseURIs []*url.URL
+	for _, dsn := range connector.DSNs() {
+		baseURI, err := url.Parse(dsn)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse the database URI")
+		}
+		baseURIs = append(baseURIs, baseURI)
+	}
+
+	v := &VaultCredentials{
+		vault:     vault,
+		mount:     cfg.GetString("vice.db.vault.mount"),
+		role:      cfg.GetString("vice.db.vault.role"),
+		baseURIs:  baseURIs,
+		connector: connector,
+	}
+	if v.role == "" {
+		return nil, errors.New("vice.db.vault.role is required with vice.db.vault.address")
+	}
+	return v, nil
+}
+
+// Fetch obtains new credentials from Vault and uses them for new connections.
+func (v *VaultCredentials) Fetch(ctx context.Context) error {
+	var secret vaultSecret
+	if err := v.vault.call(ctx, http.MethodGet, v.mount+"/creds/"+v.role, nil, &secret); err != nil {
+		vaultCredentialEvents.Inc("issue", "failure")
+		return errors.Wrap(err, "error getting database credentials from vault")
+	}
+	vaultCredentialEvents.Inc("issue", "success")
+
+	username := secret.dataString("username")
+	var dsns []string
+	for _, baseURI := range v.baseURIs {
+		uri := *baseURI
+		uri.User = url.UserPassword(username, secret.dataString("password"))
+		dsns = append(dsns, uri.String())
+	}
+	v.connector.SetDSNs(dsns)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.leaseID = secret.LeaseID
+	v.leaseDuration = time.Duration(secret.LeaseDuration) * time.Second
+	v.renewable = secret.Renewable
+	log.Infof("got database credentials for %s from vault, valid for %s", username, v.leaseDuration)
+	return nil
+}
+
+// renew extends the lease on the current credentials. It returns false if the
+// lease couldn't be renewed or won't last as long as it did before, meaning
+// it's close to its maximum TTL.
+func (v *VaultCredentials) renew(ctx context.Context) bool {
+	v.mu.Lock()
+	leaseID, duration, renewable := v.leaseID, v.leaseDuration, v.renewable
+	v.mu.Unlock()
+	if !renewable {
+		return false
+	}
+
+	var secret vaultSecret
+	body := map[string]interface{}{"lease_id": leaseID, "increment": int(duration.Seconds())}
+	if err := v.vault.call(ctx, http.MethodPut, "sys/leases/renew", body, &secret); err != nil {
+		vaultCredentialEvents.Inc("renew", "failure")
+		log.Errorf("error renewing the database credentials: %s", err)
+		return false
+	}
+	vaultCredentialEvents.Inc("renew", "success")
+
+	renewed := time.Duration(secret.LeaseDuration) * time.Second
+	v.mu.Lock()
+	v.leaseDuration = renewed
+	v.renewable = secret.Renewable
+	v.mu.Unlock()
+	return renewed >= duration
+}
+
+// Maintain renews the lease on the credentials two thirds of the way through
+// it until the process exits. Once the lease can't be renewed, new
+// credentials are fetched, and the connections using the old ones are closed
+// as they're returned to the pool.
+func (v *VaultCredentials) Maintain(db *sql.DB) {
+	for {
+		v.mu.Lock()
+		wait := v.leaseDuration * 2 / 3
+		v.mu.Unlock()
+		if wait <= 0 {
+			wait = vaultRetryInterval
+		}
+		db.SetConnMaxLifetime(wait)
+		time.Sleep(wait)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		renewed := v.renew(ctx)
+		cancel()
+		if renewed {
+			continue
+		}
+		for {
+			ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+			err := v.Fetch(ctx)
+			cancel()
+			if err == nil {
+				break
+			}
+			log.Error(err)
+			time.Sleep(vaultRetryInterval)
+		}
+	}
+}
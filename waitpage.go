@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// VariantWait is the loading page variant that clients opt in to in order to
+// get the local wait page instead of an external loading page.
+const VariantWait = "wait"
+
+// Defaults for the wait page settings.
+const (
+	defaultWaitPageInitialDelay = 2 * time.Second
+	defaultWaitPageMaxDelay     = 30 * time.Second
+)
+
+// waitPageCookie counts how many times in a row the wait page has been served
+// to a client, so that the delay keeps growing across the meta refreshes of
+// clients without JavaScript.
+const (
+	waitPageCookie       = "vice_wait_attempts"
+	waitPageCookieMaxAge = 10 * time.Minute
+)
+
+// WaitPage is a locally served alternative to the external loading page for
+// clients and deployments that can't use it. The page stays on the app's URL
+// and keeps requesting it, backing off exponentially, until the app answers
+// instead of the default backend.
+type WaitPage struct {
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	always       bool
+}
+
+// WaitPageData is passed to the template for the wait page. Refresh is the
+// meta refresh delay in seconds. The other delays are in milliseconds.
+type WaitPageData struct {
+	*PageData
+	Name     string
+	Refresh  int
+	Delay    int64
+	MaxDelay int64
+}
+
+// NewWaitPage returns a WaitPage configured from the
+// vice.default_backend.wait_page section of the config, or nil if
+// vice.default_backend.wait_page.enabled isn't set.
+func NewWaitPage(cfg *viper.Viper) *WaitPage {
+	cfg.SetDefault("vice.default_backend.wait_page.initial_delay", defaultWaitPageInitialDelay)
+	cfg.SetDefault("vice.default_backend.wait_page.max_delay", defaultWaitPageMaxDelay)
+
+	if !cfg.GetBool("vice.default_backend.wait_page.enabled") {
+		return nil
+	}
+	return &WaitPage{
+		initialDelay: cfg.GetDuration("vice.default_backend.wait_page.initial_delay"),
+		maxDelay:     cfg.GetDuration("vice.default_backend.wait_page.max_delay"),
+		always:       cfg.GetBool("vice.default_backend.wait_page.default"),
+	}
+}
+
+// Wanted returns true if the request should get the wait page, either
+// because it's the default or because the client opted in to it with the
+// loading page variant header or cookie.
+func (p *WaitPage) Wanted(r *http.Request, lp *LoadingPages) bool {
+	return p.always || lp.optIn(r) == VariantWait
+}
+
+// delay returns how long to wait before the next attempt, doubling the
+// initial delay for every earlier attempt up to the maximum.
+func (p *WaitPage) delay(attempts int) time.Duration {
+	d := p.initialDelay
+	for i := 0; i < attempts && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d
+}
+
+// WaitPageHandler renders the wait page for an app that isn't ready yet.
+// It's served with a 503 so that it isn't mistaken for the app. The analysis
+// is nil if the subdomain wasn't looked up.
+func (a *App) WaitPageHandler(w http.ResponseWriter, r *http.Request, analysis *Analysis) {
+	attempts := 0
+	if c, err := r.Cookie(waitPageCookie); err == nil {
+		attempts, _ = strconv.Atoi(c.Value)
+	}
+	delay := a.waitPage.delay(attempts)
+	http.SetCookie(w, &http.Cookie{
+		Name:     waitPageCookie,
+		Value:    strconv.Itoa(attempts + 1),
+		Path:     "/",
+		MaxAge:   int(waitPageCookieMaxAge.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	refresh := int(delay.Round(time.Second).Seconds())
+	if refresh < 1 {
+		refresh = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(refresh))
+	w.Header().Set("Cache-Control", "no-store")
+	var name string
+	if analysis != nil {
+		name = analysis.Name
+	}
+	a.renderPage(w, http.StatusServiceUnavailable, "wait.html", &WaitPageData{
+		PageData: a.analysisPageData(r.Context(), analysis),
+		Name:     name,
+		Refresh:  refresh,
+		Delay:    delay.Milliseconds(),
+		MaxDelay: a.waitPage.maxDelay.Milliseconds(),
+	})
+}